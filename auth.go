@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Callers identify their tenant with "Authorization: Bearer <api key>". Keys
+// are read from the JSON file named by API_KEYS_FILE, mapping each key to a
+// tenant ID. Without that file the service stays open and every caller acts
+// as defaultTenant.
+const defaultTenant = "default"
+
+type apiKeyEntry struct {
+	hash   [sha256.Size]byte
+	tenant string
+}
+
+var apiKeys []apiKeyEntry
+
+func loadAPIKeys(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid API keys file: %w", err)
+	}
+	apiKeys = apiKeys[:0]
+	for key, tenant := range keys {
+		if key == "" || tenant == "" {
+			return fmt.Errorf("invalid API keys file: empty key or tenant")
+		}
+		apiKeys = append(apiKeys, apiKeyEntry{hash: sha256.Sum256([]byte(key)), tenant: tenant})
+	}
+	return nil
+}
+
+// tenantMiddleware resolves the calling tenant. Unknown or missing keys leave
+// the tenant empty; handlers that need one use requireTenant.
+func tenantMiddleware(c *gin.Context) {
+	if len(apiKeys) == 0 {
+		setTenant(c, defaultTenant)
+		c.Next()
+		return
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if ok {
+		hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		for _, entry := range apiKeys {
+			if subtle.ConstantTimeCompare(hash[:], entry.hash[:]) == 1 {
+				setTenant(c, entry.tenant)
+				break
+			}
+		}
+	}
+	c.Next()
+}
+
+// setTenant records the caller's tenant on the gin context and on the
+// request context, where work queued on the caller's behalf finds it
+func setTenant(c *gin.Context, tenant string) {
+	c.Set("tenant", tenant)
+	c.Request = c.Request.WithContext(withTenant(c.Request.Context(), tenant))
+}
+
+type tenantContextKey struct{}
+
+// tenantFromContext returns the tenant recorded by setTenant or withTenant
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// withTenant tags background work with the tenant it is done for
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// tenantOf returns the caller's tenant, or "" for anonymous callers
+func tenantOf(c *gin.Context) string {
+	return c.GetString("tenant")
+}
+
+// requireTenant writes a 401 and returns false for anonymous callers
+func requireTenant(c *gin.Context) (string, bool) {
+	tenant := tenantOf(c)
+	if tenant == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid API key is required"})
+		return "", false
+	}
+	return tenant, true
+}
+
+// adminTenants may use the /api/admin routes. They are read from the
+// comma-separated ADMIN_TENANTS; without API keys the default tenant is an
+// admin.
+var adminTenants = map[string]bool{}
+
+func loadAdminTenants(list string) {
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			adminTenants[t] = true
+		}
+	}
+}
+
+// isAdminTenant reports whether tenant may use the admin routes
+func isAdminTenant(tenant string) bool {
+	return adminTenants[tenant] || (len(apiKeys) == 0 && tenant == defaultTenant)
+}
+
+// requireAdmin writes a 401 or 403 and returns false unless the caller is an
+// admin tenant
+func requireAdmin(c *gin.Context) bool {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return false
+	}
+	if !isAdminTenant(tenant) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+		return false
+	}
+	return true
+}
+
+// requireOwner writes a 401 or 403 and returns false unless the caller is the
+// tenant that uploaded a record (owner) or an admin tenant. Records uploaded
+// before tenants were recorded can only be changed by admins.
+func requireOwner(c *gin.Context, owner *string, action string) bool {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return false
+	}
+	if isAdminTenant(tenant) || (owner != nil && *owner == tenant) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Only the tenant that uploaded this record can " + action})
+	return false
+}
+
+// recordOwner returns the tenant that uploaded the latest copy of cid, which
+// is nil for records uploaded before tenants were recorded
+func recordOwner(ctx context.Context, cid string) (*string, error) {
+	var owner *string
+	err := db.QueryRow(ctx,
+		"SELECT tenant FROM file_cids WHERE cid = $1 ORDER BY id DESC LIMIT 1",
+		cid).Scan(&owner)
+	return owner, err
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	batchUploadConcurrency int
+	batchMaxFiles          int
+)
+
+// recordMetadata is the metadata for one uploaded file, as sent in a batch
+// manifest or tus Upload-Metadata. Only the fields of the target data type
+// are used; names match the single-file forms.
+type recordMetadata struct {
+	Filename string `json:"filename"`
+
+	// paper
+	Title    string   `json:"title"`
+	Journal  string   `json:"journal"`
+	Year     *int     `json:"year"`
+	Keywords []string `json:"keywords"`
+
+	// genome
+	Organism        string `json:"organism"`
+	AssemblyVersion string `json:"assemblyVersion"`
+	Notes           string `json:"notes"`
+
+	// spectrum
+	Compound  string          `json:"compound"`
+	Technique string          `json:"technique"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+func (e *recordMetadata) validate(dataType string) error {
+	switch dataType {
+	case "paper":
+		if strings.TrimSpace(e.Title) == "" {
+			return errors.New("title is required")
+		}
+	case "genome":
+		if strings.TrimSpace(e.Organism) == "" {
+			return errors.New("organism is required")
+		}
+	case "spectrum":
+		if strings.TrimSpace(e.Compound) == "" {
+			return errors.New("compound is required")
+		}
+		if len(e.Metadata) > 0 && !json.Valid(e.Metadata) {
+			return errors.New("metadata is not valid JSON")
+		}
+	}
+	return nil
+}
+
+// batchFileResult is the per-file outcome returned by the batch endpoint
+type batchFileResult struct {
+	filcdn.BatchFileResult
+
+	env    *envelope // server-side encryption of the uploaded file, if any
+	status int       // HTTP status the file alone would have failed with
+}
+
+// fail records why a file was not added
+func (r *batchFileResult) fail(status string, err error) {
+	r.Status, r.Error, r.status = status, err.Error(), uploadFailureStatus(err)
+}
+
+// uploadFailureStatus is the status a single-file upload failing with err
+// responds with (see uploadFailed); saving a record that exists is a
+// conflict, other database errors are internal
+func uploadFailureStatus(err error) int {
+	var me *malwareError
+	var pe *pdpError
+	switch {
+	case errors.As(err, &me):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errScannerUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errRecordExists):
+		return http.StatusConflict
+	case errors.As(err, &pe):
+		return pe.status()
+	}
+	return http.StatusInternalServerError
+}
+
+// batchStatus is the status of a batch none of whose files were added: the
+// status shared by every failure, 422 when they are all client errors of
+// different kinds, and otherwise the first server error
+func batchStatus(results []*batchFileResult) int {
+	status, same, clientOnly := results[0].status, true, true
+	firstServer := 0
+	for _, res := range results {
+		same = same && res.status == status
+		if res.status >= 500 {
+			clientOnly = false
+			if firstServer == 0 {
+				firstServer = res.status
+			}
+		}
+	}
+	switch {
+	case same:
+		return status
+	case clientOnly:
+		return http.StatusUnprocessableEntity
+	}
+	return firstServer
+}
+
+// uploadBatchHandler uploads many files of one data type in a single request.
+// Files are sent as repeated "files" parts; "manifest" is a JSON array with
+// one entry per file, matched by filename. Files are uploaded concurrently and
+// all resulting roots are added to the proof set with one add-roots call.
+// POST /api/upload/paper/batch
+//
+//	serviceUrl, serviceName, proofSetID, encryption (none or server)
+//	manifest=[{"filename": "a.pdf", "title": "...", "keywords": ["x"]}, ...]
+//	files=@a.pdf files=@b.pdf
+func uploadBatchHandler(c *gin.Context) {
+	dataType := c.Param("type")
+	if _, ok := editableFields[dataType]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid data type. Valid types: paper, genome, spectrum",
+		})
+		return
+	}
+
+	if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
+		fmt.Printf("[DEBUG] Failed to parse multipart form: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse form"})
+		return
+	}
+
+	serviceUrl := c.PostForm("serviceUrl")
+	serviceName := c.PostForm("serviceName")
+	proofSetID := c.PostForm("proofSetID")
+
+	// Each file gets its own data key when server-side encryption is requested
+	encryptFor, ok := uploadEncryptionTenant(c, c.PostForm("encryption"))
+	if !ok {
+		return
+	}
+
+	headers := c.Request.MultipartForm.File["files"]
+	if len(headers) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one file is required in the files field"})
+		return
+	}
+	if len(headers) > batchMaxFiles {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("too many files: %d (max %d)", len(headers), batchMaxFiles),
+		})
+		return
+	}
+
+	var manifest []recordMetadata
+	if err := json.Unmarshal([]byte(c.PostForm("manifest")), &manifest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "manifest must be a JSON array of per-file metadata"})
+		return
+	}
+	entries := make(map[string]*recordMetadata, len(manifest))
+	for i := range manifest {
+		entry := &manifest[i]
+		if _, dup := entries[entry.Filename]; dup {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duplicate manifest entry for %q", entry.Filename)})
+			return
+		}
+		if err := entry.validate(dataType); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("manifest entry %q: %v", entry.Filename, err)})
+			return
+		}
+		entries[entry.Filename] = entry
+	}
+
+	seen := make(map[string]bool, len(headers))
+	sizes := make(map[string]int64, len(headers))
+	var totalSize int64
+	for _, header := range headers {
+		sizes[header.Filename] = header.Size
+		totalSize += header.Size
+		if seen[header.Filename] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duplicate file %q", header.Filename)})
+			return
+		}
+		seen[header.Filename] = true
+		if entries[header.Filename] == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("no manifest entry for file %q", header.Filename)})
+			return
+		}
+	}
+
+	// Every file must be in an allowed format before any is uploaded, and no
+	// two may have the same content: they would get the same root CID
+	sameAs := make(map[[sha256.Size]byte]string, len(headers))
+	for _, header := range headers {
+		file, err := header.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot read file %q: %v", header.Filename, err)})
+			return
+		}
+		ok := requireFormat(c, dataType, file, header.Filename)
+		h := sha256.New()
+		if ok {
+			_, err = io.Copy(h, file)
+		}
+		file.Close()
+		if !ok {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot read file %q: %v", header.Filename, err)})
+			return
+		}
+		sum := [sha256.Size]byte(h.Sum(nil))
+		if other, dup := sameAs[sum]; dup {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("files %q and %q have the same content", other, header.Filename)})
+			return
+		}
+		sameAs[sum] = header.Filename
+	}
+
+	// Without a proofSetID the whole batch goes to one proof set from the
+	// tenant's pool
+	proofSetID, lease, ok := leaseProofSetFor(c, serviceUrl, serviceName, proofSetID, len(headers), totalSize)
+	if !ok {
+		return
+	}
+	defer lease.done()
+
+	fmt.Printf("[BATCH %s] %d files → proofSet %s (concurrency %d)\n",
+		strings.ToUpper(dataType), len(headers), proofSetID, batchUploadConcurrency)
+
+	// Record an intent per file before touching the provider
+	intents := make(map[string]int64, len(headers))
+	for _, header := range headers {
+		id, err := createIntent(tenantOf(c), dataType, "batch", "", entries[header.Filename],
+			proofSetID, serviceUrl, serviceName, encryptFor != "")
+		if err != nil {
+			fmt.Printf("[DB ERROR] %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload intent"})
+			return
+		}
+		intents[header.Filename] = id
+	}
+
+	// Step 1: upload all files with a bounded worker pool
+	results := uploadBatchFiles(c.Request.Context(), headers, dataType, serviceUrl, serviceName, encryptFor)
+	for _, res := range results {
+		if res.Status == "uploaded" {
+			markIntent(intents[res.Filename], "uploaded", res.RootCID, nil)
+			emitEvent(tenantOf(c), eventUploadCompleted, gin.H{"type": dataType, "filename": res.Filename, "rootCID": res.RootCID})
+		} else {
+			markIntent(intents[res.Filename], "failed", "", errors.New(res.Error))
+		}
+	}
+
+	// Step 2: add every uploaded root in one add-roots call
+	var rootCIDs []string
+	for _, res := range results {
+		if res.Status == "uploaded" {
+			rootCIDs = append(rootCIDs, res.RootCID)
+		}
+	}
+	if len(rootCIDs) > 0 {
+		err := addRootsToProofSet(c.Request.Context(), serviceUrl, serviceName, proofSetID, rootCIDs, nil)
+		if err != nil {
+			fmt.Printf("[DEBUG] Batch add roots failed: %v\n", err)
+		}
+		for _, res := range results {
+			if res.Status != "uploaded" {
+				continue
+			}
+			if err != nil {
+				res.fail("add_roots_failed", err)
+				markAddRootsFailed(intents[res.Filename], err)
+				emitEvent(tenantOf(c), eventRootFailed, gin.H{"type": dataType, "proofSetID": proofSetID, "rootCID": res.RootCID, "error": err.Error()})
+			} else {
+				lease.assign(res.RootCID, sizes[res.Filename])
+				markIntent(intents[res.Filename], "root_added", "", nil)
+				emitEvent(tenantOf(c), eventRootAdded, gin.H{"type": dataType, "proofSetID": proofSetID, "rootCID": res.RootCID})
+			}
+		}
+	}
+
+	// Step 3: save metadata; each file gets its own transaction
+	added := 0
+	for _, res := range results {
+		if res.Status != "uploaded" {
+			continue
+		}
+		// Without the wrapped key the stored ciphertext is unreadable
+		if res.env != nil {
+			if err := saveEnvelope(context.Background(), res.RootCID, res.env); err != nil {
+				fmt.Printf("[DB ERROR] %v\n", err)
+				res.fail("db_failed", err)
+				continue
+			}
+		}
+		if err := saveUploadedRecord(intents[res.Filename], dataType, entries[res.Filename], res.RootCID, proofSetID, serviceUrl, serviceName); err != nil {
+			fmt.Printf("[DB ERROR] Failed to save %s %s: %v\n", dataType, res.Filename, err)
+			res.fail("db_failed", err)
+			continue
+		}
+		res.Status = "added"
+		added++
+		go replicateRecord(res.RootCID, dataType, serviceUrl)
+	}
+
+	status := http.StatusOK
+	switch {
+	case added == 0:
+		status = batchStatus(results)
+		annotateError(c, codeBatchFailed, "no files were added", nil)
+	case added < len(results):
+		status = http.StatusMultiStatus
+	}
+
+	fmt.Printf("[BATCH %s] %d/%d files added\n", strings.ToUpper(dataType), added, len(results))
+	out := filcdn.BatchResult{ProofSetID: proofSetID, Total: len(results), Added: added, Failed: len(results) - added}
+	for _, res := range results {
+		out.Results = append(out.Results, res.BatchFileResult)
+	}
+	c.JSON(status, out)
+}
+
+// uploadBatchFiles runs upload-file for every part using at most
+// batchUploadConcurrency concurrent pdptool processes, encrypting each file
+// for encryptFor unless it is "". Results keep the order of headers.
+func uploadBatchFiles(ctx context.Context, headers []*multipart.FileHeader, dataType, serviceUrl, serviceName, encryptFor string) []*batchFileResult {
+	results := make([]*batchFileResult, len(headers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < batchUploadConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = uploadBatchFile(ctx, headers[i], dataType, serviceUrl, serviceName, encryptFor)
+			}
+		}()
+	}
+	for i := range headers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func uploadBatchFile(ctx context.Context, header *multipart.FileHeader, dataType, serviceUrl, serviceName, encryptFor string) *batchFileResult {
+	res := &batchFileResult{BatchFileResult: filcdn.BatchFileResult{Filename: header.Filename}}
+
+	file, err := header.Open()
+	if err != nil {
+		res.fail("upload_failed", err)
+		return res
+	}
+	defer file.Close()
+
+	// No failover: every root of the batch goes in the same add-roots call
+	target := &uploadTarget{serviceURL: serviceUrl, serviceName: serviceName}
+	facts := newFactsRecorder()
+	src, env, err := encryptUpload(encryptFor, io.TeeReader(file, facts))
+	if err != nil {
+		res.fail("upload_failed", err)
+		return res
+	}
+	rootCID, err := uploadFileToStorage(ctx, src, file, header, target, dataType, nil)
+	if err != nil {
+		fmt.Printf("[DEBUG] Batch upload of %s failed: %v\n", header.Filename, err)
+		res.fail("upload_failed", err)
+		var me *malwareError
+		if errors.As(err, &me) {
+			res.Status = "quarantined"
+		}
+		return res
+	}
+
+	recordFileFacts(rootCID, facts.facts(header.Filename))
+	res.RootCID, res.Status, res.env = rootCID, "uploaded", env
+	return res
+}
+
+// errRecordExists is returned when saving a record whose root CID already has
+// live metadata
+var errRecordExists = errors.New("a record with this content already exists")
+
+// revivedColumns resets the bookkeeping columns of a metadata row that is
+// uploaded again after being soft-deleted
+const revivedColumns = "created_at = NOW(), updated_at = NULL, deleted_at = NULL"
+
+// saveUploadedRecord inserts the typed metadata row and the file_cids row for
+// one file whose root has been added to the proof set, and completes its
+// upload intent (when intentID is not 0) in the same transaction, along with
+// the primary replica. dataType "file" saves only the file_cids row.
+func saveUploadedRecord(intentID int64, dataType string, entry *recordMetadata, rootCID, proofSetID, serviceUrl, serviceName string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// A row soft-deleted through DELETE /api/data or a deletion keeps its
+	// CID, so uploading the same content again revives it
+	var tag pgconn.CommandTag
+	switch dataType {
+	case "paper":
+		var keywords []string
+		for _, k := range entry.Keywords {
+			if k = strings.TrimSpace(k); k != "" {
+				keywords = append(keywords, k)
+			}
+		}
+		tag, err = tx.Exec(ctx,
+			`INSERT INTO paper (cid, title, journal, year, keywords) VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (cid) DO UPDATE
+			    SET title = EXCLUDED.title, journal = EXCLUDED.journal, year = EXCLUDED.year,
+			        keywords = EXCLUDED.keywords, `+revivedColumns+`
+			  WHERE paper.deleted_at IS NOT NULL`,
+			rootCID, entry.Title, entry.Journal, entry.Year, keywords)
+	case "genome":
+		tag, err = tx.Exec(ctx,
+			`INSERT INTO genome (cid, organism, assembly_version, notes) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (cid) DO UPDATE
+			    SET organism = EXCLUDED.organism, assembly_version = EXCLUDED.assembly_version,
+			        notes = EXCLUDED.notes, `+revivedColumns+`
+			  WHERE genome.deleted_at IS NOT NULL`,
+			rootCID, entry.Organism, entry.AssemblyVersion, entry.Notes)
+	case "spectrum":
+		tag, err = tx.Exec(ctx,
+			`INSERT INTO spectrum (cid, compound, technique_nmr_ir_ms, metadata_json) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (cid) DO UPDATE
+			    SET compound = EXCLUDED.compound, technique_nmr_ir_ms = EXCLUDED.technique_nmr_ir_ms,
+			        metadata_json = EXCLUDED.metadata_json, `+revivedColumns+`
+			  WHERE spectrum.deleted_at IS NOT NULL`,
+			rootCID, entry.Compound, entry.Technique, nullableJSON(entry.Metadata))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save %s metadata: %w", dataType, err)
+	}
+	if slices.Contains(metadataTables, dataType) && tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to save %s metadata for %s: %w", dataType, rootCID, errRecordExists)
+	}
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO file_cids (filename, cid, proof_set_id, service_url, service_name, tenant)
+		 VALUES ($1, $2, $3, $4, $5, (SELECT NULLIF(tenant, '') FROM upload_intents WHERE id = $6))`,
+		entry.Filename, rootCID, proofSetID, serviceUrl, serviceName, intentID); err != nil {
+		return fmt.Errorf("failed to save file_cids: %w", err)
+	}
+
+	if serviceUrl != "" {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO replicas (cid, root_cid, service_url, service_name, proof_set_id, is_primary, status)
+			 VALUES ($1, $1, $2, $3, $4, TRUE, 'stored')
+			 ON CONFLICT (cid, service_url) DO UPDATE SET status = 'stored', is_primary = TRUE, updated_at = NOW()`,
+			rootCID, serviceUrl, serviceName, proofSetID); err != nil {
+			return fmt.Errorf("failed to save primary replica: %w", err)
+		}
+	}
+
+	if intentID != 0 {
+		if _, err := tx.Exec(ctx,
+			"UPDATE upload_intents SET state = 'completed', root_cid = $2, updated_at = NOW() WHERE id = $1",
+			intentID, rootCID); err != nil {
+			return fmt.Errorf("failed to complete upload intent: %w", err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"filcdn-service/filcdn"
+)
+
+// recordColumns are the table columns shown for each data type
+var recordColumns = map[string][]string{
+	"paper":     {"cid", "title", "journal", "year", "keywords", "created_at"},
+	"genome":    {"cid", "organism", "assembly_version", "notes", "created_at"},
+	"spectrum":  {"cid", "compound", "technique", "metadata", "created_at"},
+	"file_cids": {"id", "filename", "cid", "proof_set_id", "uploaded_at", "verification_status"},
+}
+
+func dataType(args []string, allowFileCids bool) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, errors.New("missing data type (paper, genome or spectrum)")
+	}
+	t := args[0]
+	if _, ok := recordColumns[t]; !ok || (t == "file_cids" && !allowFileCids) {
+		return "", nil, fmt.Errorf("unknown data type %q", t)
+	}
+	return t, args[1:], nil
+}
+
+// runUpload uploads files, walking directories recursively. Per-file
+// failures are reported and the rest of the files are still uploaded.
+func runUpload(ctx context.Context, cl *filcdn.Client, cfg *config, g globals, args []string) error {
+	t, args, err := dataType(args, false)
+	if err != nil {
+		return err
+	}
+
+	var target filcdn.Target
+	var opts filcdn.UploadOptions
+	var paper filcdn.PaperUpload
+	var genome filcdn.GenomeUpload
+	var spectrum filcdn.SpectrumUpload
+	var keywords, metadata string
+
+	fs := flag.NewFlagSet("upload "+t, flag.ContinueOnError)
+	fs.StringVar(&target.ServiceURL, "service-url", cfg.ServiceURL, "storage provider URL")
+	fs.StringVar(&target.ServiceName, "service-name", cfg.ServiceName, "storage provider service name")
+	fs.StringVar(&target.ProofSetID, "proof-set", cfg.ProofSetID, "proof set ID")
+	fs.StringVar(&opts.Encryption, "encryption", "", `"server" to encrypt with the tenant key`)
+	fs.BoolVar(&opts.SkipFormatCheck, "skip-format-check", false, "accept a file in any format (admins only)")
+	switch t {
+	case "paper":
+		fs.StringVar(&paper.Title, "title", "", "title (defaults to the file name)")
+		fs.StringVar(&paper.Journal, "journal", "", "journal")
+		fs.IntVar(&paper.Year, "year", 0, "publication year")
+		fs.StringVar(&keywords, "keywords", "", "comma-separated keywords")
+	case "genome":
+		fs.StringVar(&genome.Organism, "organism", "", "organism (required)")
+		fs.StringVar(&genome.AssemblyVersion, "assembly-version", "", "assembly version")
+		fs.StringVar(&genome.Notes, "notes", "", "notes")
+	case "spectrum":
+		fs.StringVar(&spectrum.Compound, "compound", "", "compound (required)")
+		fs.StringVar(&spectrum.Technique, "technique", "", "technique (NMR, IR, MS, ...)")
+		fs.StringVar(&metadata, "metadata", "", "JSON metadata")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no files given")
+	}
+	if target.ProofSetID == "" && target.ServiceURL == "" {
+		return errors.New("--proof-set or --service-url is required (or set them in the config file)")
+	}
+	if keywords != "" {
+		paper.Keywords = strings.Split(keywords, ",")
+	}
+	if metadata != "" {
+		if !json.Valid([]byte(metadata)) {
+			return errors.New("--metadata must be valid JSON")
+		}
+		spectrum.Metadata = json.RawMessage(metadata)
+	}
+
+	files, err := collectFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		File    string `json:"file"`
+		RootCID string `json:"rootCID,omitempty"`
+		Error   string `json:"error,omitempty"`
+	}
+	var results []result
+	failed := 0
+	for _, path := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "uploading %s\n", path)
+		r := result{File: path}
+		rootCID, err := uploadOne(ctx, cl, t, target, opts, paper, genome, spectrum, path)
+		if err != nil {
+			r.Error = err.Error()
+			failed++
+		} else {
+			r.RootCID = rootCID
+		}
+		results = append(results, r)
+	}
+
+	if g.output == "json" {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		rows := make([][]string, len(results))
+		for i, r := range results {
+			rows[i] = []string{r.File, r.RootCID, r.Error}
+		}
+		if err := printTable([]string{"FILE", "ROOT CID", "ERROR"}, rows); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, len(results))
+	}
+	return ctx.Err()
+}
+
+func uploadOne(ctx context.Context, cl *filcdn.Client, t string, target filcdn.Target, opts filcdn.UploadOptions,
+	paper filcdn.PaperUpload, genome filcdn.GenomeUpload, spectrum filcdn.SpectrumUpload, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	file := filcdn.File{Name: filepath.Base(path), Content: f}
+
+	var res *filcdn.UploadResult
+	switch t {
+	case "paper":
+		if paper.Title == "" {
+			paper.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		res, err = cl.UploadPaper(ctx, target, paper, file, opts)
+	case "genome":
+		res, err = cl.UploadGenome(ctx, target, genome, file, opts)
+	case "spectrum":
+		res, err = cl.UploadSpectrum(ctx, target, spectrum, file, opts)
+	}
+	if err != nil {
+		return "", err
+	}
+	return res.RootCID, nil
+}
+
+// collectFiles expands directories into the regular files below them,
+// skipping hidden files and directories
+func collectFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != arg && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files found")
+	}
+	return files, nil
+}
+
+func runQuery(ctx context.Context, cl *filcdn.Client, g globals, args []string) error {
+	t, args, err := dataType(args, true)
+	if err != nil {
+		return err
+	}
+
+	var list filcdn.ListOptions
+	var paper filcdn.PaperQuery
+	var genome filcdn.GenomeQuery
+	var spectrum filcdn.SpectrumQuery
+	var files filcdn.FileCIDQuery
+
+	fs := flag.NewFlagSet("query "+t, flag.ContinueOnError)
+	fs.IntVar(&list.Limit, "limit", 20, "maximum number of records")
+	fs.IntVar(&list.Offset, "offset", 0, "records to skip")
+	fs.StringVar(&list.Sort, "sort", "", "sort column")
+	fs.StringVar(&list.Order, "order", "", "ASC or DESC")
+	fs.StringVar(&list.Search, "search", "", "free-text search")
+	switch t {
+	case "paper":
+		fs.IntVar(&paper.Year, "year", 0, "filter by year")
+		fs.StringVar(&paper.Journal, "journal", "", "filter by journal")
+		fs.StringVar(&paper.Keyword, "keyword", "", "filter by keyword")
+	case "genome":
+		fs.StringVar(&genome.Organism, "organism", "", "filter by organism")
+		fs.StringVar(&genome.Assembly, "assembly", "", "filter by assembly version")
+	case "spectrum":
+		fs.StringVar(&spectrum.Compound, "compound", "", "filter by compound")
+		fs.StringVar(&spectrum.Technique, "technique", "", "filter by technique")
+	case "file_cids":
+		fs.StringVar(&files.Verification, "verification", "", "filter by verification status (verified, missing, not_proving, unretrievable, error or unverified)")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	list.Order = strings.ToUpper(list.Order)
+
+	var page any
+	var pagination filcdn.Pagination
+	switch t {
+	case "paper":
+		paper.ListOptions = list
+		p, err := cl.QueryPapers(ctx, paper)
+		if err != nil {
+			return err
+		}
+		page, pagination = p, p.Pagination
+	case "genome":
+		genome.ListOptions = list
+		p, err := cl.QueryGenomes(ctx, genome)
+		if err != nil {
+			return err
+		}
+		page, pagination = p, p.Pagination
+	case "spectrum":
+		spectrum.ListOptions = list
+		p, err := cl.QuerySpectra(ctx, spectrum)
+		if err != nil {
+			return err
+		}
+		page, pagination = p, p.Pagination
+	case "file_cids":
+		files.ListOptions = list
+		p, err := cl.QueryFileCIDs(ctx, files)
+		if err != nil {
+			return err
+		}
+		page, pagination = p, p.Pagination
+	}
+
+	if g.output == "json" {
+		return printJSON(page)
+	}
+	var records struct {
+		Data []map[string]any `json:"data"`
+	}
+	if err := roundTrip(page, &records); err != nil {
+		return err
+	}
+	if err := printRecords(recordColumns[t], records.Data); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d-%d of %d\n", pagination.Offset+min(1, pagination.Count),
+		pagination.Offset+pagination.Count, pagination.Total)
+	return nil
+}
+
+func runGet(ctx context.Context, cl *filcdn.Client, g globals, args []string) error {
+	t, args, err := dataType(args, true)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("usage: filcdn get <type> <cid>")
+	}
+
+	var record any
+	switch t {
+	case "paper":
+		record, err = cl.GetPaper(ctx, args[0])
+	case "genome":
+		record, err = cl.GetGenome(ctx, args[0])
+	case "spectrum":
+		record, err = cl.GetSpectrum(ctx, args[0])
+	case "file_cids":
+		record, err = cl.GetFileCID(ctx, args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		return printJSON(record)
+	}
+
+	var fields map[string]any
+	if err := roundTrip(record, &fields); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(fields))
+	for _, k := range sortedKeys(fields) {
+		rows = append(rows, []string{k, formatValue(fields[k])})
+	}
+	return printTable([]string{"FIELD", "VALUE"}, rows)
+}
+
+func runProofSets(ctx context.Context, cl *filcdn.Client, g globals, args []string) error {
+	if len(args) == 1 && args[0] == "pool" {
+		return runProofSetPool(ctx, cl, g)
+	}
+	if len(args) != 1 || args[0] != "list" {
+		return errors.New("usage: filcdn proofsets list|pool")
+	}
+
+	sets, err := cl.ListProofSets(ctx)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		return printJSON(sets)
+	}
+	rows := make([][]string, len(sets))
+	for i, s := range sets {
+		rows[i] = []string{s.ProofSetID, s.ServiceURL, s.ServiceName, strconv.Itoa(s.Roots), s.LastUpload.Format("2006-01-02 15:04:05")}
+	}
+	return printTable([]string{"PROOF SET", "SERVICE URL", "SERVICE NAME", "ROOTS", "LAST UPLOAD"}, rows)
+}
+
+func runProofSetPool(ctx context.Context, cl *filcdn.Client, g globals) error {
+	pool, err := cl.ProofSetPool(ctx, "")
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		return printJSON(pool)
+	}
+	rows := make([][]string, len(pool))
+	for i, p := range pool {
+		var proofSetID string
+		if p.ProofSetID != nil {
+			proofSetID = *p.ProofSetID
+		}
+		rows[i] = []string{proofSetID, p.Status, p.ServiceURL, strconv.Itoa(p.Roots), strconv.FormatInt(p.Bytes, 10),
+			p.UpdatedAt.Format("2006-01-02 15:04:05")}
+	}
+	return printTable([]string{"PROOF SET", "STATUS", "SERVICE URL", "ROOTS", "BYTES", "UPDATED"}, rows)
+}
+
+// roundTrip converts a typed value to its generic JSON form for table output
+func roundTrip(in, out any) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// formatValue renders a JSON value for a table cell
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = formatValue(e)
+		}
+		return strings.Join(parts, ",")
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// config is the CLI configuration file:
+//
+//	{
+//	  "url": "http://localhost:8080",
+//	  "apiKey": "...",
+//	  "serviceUrl": "https://provider.example",
+//	  "serviceName": "pdp-service",
+//	  "proofSetID": "123"
+//	}
+//
+// FILCDN_URL and FILCDN_API_KEY override the file, so credentials can be
+// kept out of it in CI.
+type config struct {
+	URL         string `json:"url"`
+	APIKey      string `json:"apiKey,omitempty"`
+	ServiceURL  string `json:"serviceUrl,omitempty"`
+	ServiceName string `json:"serviceName,omitempty"`
+	ProofSetID  string `json:"proofSetID,omitempty"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "filcdn.json"
+	}
+	return filepath.Join(dir, "filcdn", "config.json")
+}
+
+// loadConfig reads the config file; a missing file is not an error
+func loadConfig(path string) (*config, error) {
+	cfg := &config{URL: "http://localhost:8080"}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("reading config: %w", err)
+	default:
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+		// The file holds an API key; warn when others can read it
+		if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o077 != 0 {
+			fmt.Fprintf(os.Stderr, "filcdn: warning: %s is readable by other users (chmod 600 it)\n", path)
+		}
+	}
+
+	if v := os.Getenv("FILCDN_URL"); v != "" {
+		cfg.URL = v
+	}
+	if v := os.Getenv("FILCDN_API_KEY"); v != "" {
+		cfg.APIKey = v
+	}
+	return cfg, nil
+}
+
+// printConfig shows the effective configuration with the API key masked
+func printConfig(cfg *config, g globals) error {
+	shown := *cfg
+	if len(shown.APIKey) > 4 {
+		shown.APIKey = "****" + shown.APIKey[len(shown.APIKey)-4:]
+	} else if shown.APIKey != "" {
+		shown.APIKey = "****"
+	}
+	if g.output == "json" {
+		return printJSON(shown)
+	}
+	return printTable([]string{"KEY", "VALUE"}, [][]string{
+		{"config", g.configPath},
+		{"url", shown.URL},
+		{"apiKey", shown.APIKey},
+		{"serviceUrl", shown.ServiceURL},
+		{"serviceName", shown.ServiceName},
+		{"proofSetID", shown.ProofSetID},
+	})
+}
@@ -0,0 +1,105 @@
+// Command filcdn is a command-line client for the filcdn service.
+//
+//	filcdn upload paper --title "..." --keywords a,b paper.pdf
+//	filcdn upload genome --organism human -r ./assemblies
+//	filcdn query genome --organism human
+//	filcdn get spectrum <cid>
+//	filcdn proofsets list
+//	filcdn proofsets pool
+//
+// The server address, API key and default proof set are read from
+// $XDG_CONFIG_HOME/filcdn/config.json (see config.go).
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"filcdn-service/filcdn"
+)
+
+const usage = `Usage: filcdn [global flags] <command> [flags] [args]
+
+Commands:
+  upload paper|genome|spectrum [flags] <file|dir>...   upload files with metadata
+  query paper|genome|spectrum|file_cids [flags]         list records
+  get paper|genome|spectrum|file_cids <cid>             show one record
+  proofsets list                                        list proof sets in use
+  proofsets pool                                        list your automatically managed proof sets
+  config                                                show the effective configuration
+
+Global flags:
+  --config path      config file (default %s)
+  --url url          service URL (overrides config)
+  --output format    json or table (default table)
+
+Run "filcdn <command> -h" for command flags.
+`
+
+// globals holds the flags shared by every command
+type globals struct {
+	configPath string
+	url        string
+	output     string
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "filcdn:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	var g globals
+	fs := flag.NewFlagSet("filcdn", flag.ContinueOnError)
+	fs.StringVar(&g.configPath, "config", defaultConfigPath(), "config file")
+	fs.StringVar(&g.url, "url", "", "service URL")
+	fs.StringVar(&g.output, "output", "table", "output format: json or table")
+	fs.Usage = func() { fmt.Fprintf(fs.Output(), usage, defaultConfigPath()) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if g.output != "json" && g.output != "table" {
+		return fmt.Errorf("unknown output format %q", g.output)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	cfg, err := loadConfig(g.configPath)
+	if err != nil {
+		return err
+	}
+	if g.url != "" {
+		cfg.URL = g.url
+	}
+	cl := filcdn.NewClient(cfg.URL, filcdn.WithAPIKey(cfg.APIKey))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "upload":
+		return runUpload(ctx, cl, cfg, g, rest)
+	case "query":
+		return runQuery(ctx, cl, g, rest)
+	case "get":
+		return runGet(ctx, cl, g, rest)
+	case "proofsets":
+		return runProofSets(ctx, cl, g, rest)
+	case "config":
+		return printConfig(cfg, g)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
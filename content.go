@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// getContentHandler streams a stored file back from the provider it was
+// uploaded to. Server-side encrypted records are decrypted on the fly for
+// callers of the owning tenant; tenants holding an active key grant get the
+// ciphertext, to decrypt with their unwrapped data key. Everything else is
+// passed through unchanged.
+// GET /api/content/:cid
+func getContentHandler(c *gin.Context) {
+	cid := c.Param("cid")
+	ctx := context.Background()
+
+	var filename string
+	var serviceUrl *string
+	err := db.QueryRow(ctx,
+		`SELECT filename, service_url FROM file_cids
+		  WHERE cid = $1 AND deleted_at IS NULL
+		  ORDER BY id DESC LIMIT 1`,
+		cid).Scan(&filename, &serviceUrl)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if serviceUrl == nil || *serviceUrl == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Record has no known provider to retrieve it from"})
+		return
+	}
+
+	env, err := loadEnvelope(ctx, cid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if env != nil && tenantOf(c) != env.Tenant {
+		var granted bool
+		if err := db.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM record_key_grants
+			                 WHERE cid = $1 AND recipient_tenant = $2 AND revoked_at IS NULL)`,
+			cid, tenantOf(c)).Scan(&granted); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !granted {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to read this record"})
+			return
+		}
+		env = nil // the recipient decrypts
+	} else if env != nil {
+		if err := env.unwrap(); err != nil {
+			fmt.Printf("[CONTENT ERROR] %s: %v\n", cid, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot unwrap data key"})
+			return
+		}
+	}
+
+	resp, err := fetchPiece(c.Request.Context(), *serviceUrl, cid)
+	if err != nil {
+		fmt.Printf("[CONTENT ERROR] %s: %v\n", cid, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if env == nil {
+		c.DataFromReader(http.StatusOK, resp.ContentLength, "application/octet-stream", resp.Body, nil)
+		return
+	}
+
+	c.Header("Content-Length", strconv.FormatInt(env.PlaintextSize, 10))
+	c.Header("Content-Type", "application/octet-stream")
+	c.Status(http.StatusOK)
+	if _, err := env.decryptTo(c.Writer, resp.Body); err != nil {
+		// Headers are already sent; the short body tells the client it failed
+		fmt.Printf("[CONTENT ERROR] %s: decrypt failed: %v\n", cid, err)
+	}
+}
+
+// fetchPiece requests a piece from the provider's retrieval endpoint
+func fetchPiece(ctx context.Context, serviceUrl, rootCID string) (*http.Response, error) {
+	url := strings.TrimRight(serviceUrl, "/") + "/piece/" + pieceCIDForRoot(rootCID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("retrieval failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("retrieval failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// pieceCIDForRoot returns the CID of the uploaded piece. Root CIDs printed by
+// upload-file have the form rootCID:subrootCID[+subrootCID...]; the piece is
+// the first subroot.
+func pieceCIDForRoot(rootCID string) string {
+	root, subroots, ok := strings.Cut(strings.TrimSpace(rootCID), ":")
+	if !ok {
+		return root
+	}
+	piece, _, _ := strings.Cut(subroots, "+")
+	return piece
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Deletion lifecycle:
+//
+//	scheduled --undo window--> removing --roots gone on-chain--> deleted --grace period--> purged
+//	    \--undo--> cancelled
+//
+// While scheduled nothing irreversible has happened and the request can be
+// undone. Removal covers the root in the deletion's proof set and the root of
+// every replica on other providers (replicas moves them to removing, then
+// removed). Once all of them are confirmed gone, file_cids and the typed
+// metadata rows are soft-deleted (hidden from all queries) and then purged
+// after the grace period. A deletion whose roots are not all gone
+// deletionRemovalTimeout after remove-roots was submitted is marked failed.
+var (
+	deletionUndoWindow     time.Duration
+	deletionGracePeriod    time.Duration
+	deletionPollInterval   time.Duration
+	deletionRemovalTimeout time.Duration
+)
+
+const maxDeletionAttempts = 5
+
+// metadataTables lists the typed tables a root CID may have metadata in
+var metadataTables = []string{"paper", "genome", "spectrum"}
+
+const deletionColumns = `id, cid, proof_set_id, service_url, service_name, root_id, status, attempts,
+	last_error, requested_at, undo_until, removal_submitted_at, confirmed_at, purge_after, purged_at`
+
+func scanDeletion(row pgx.Row) (*filcdn.Deletion, error) {
+	var d filcdn.Deletion
+	err := row.Scan(&d.ID, &d.CID, &d.ProofSetID, &d.ServiceURL, &d.ServiceName, &d.RootID,
+		&d.Status, &d.Attempts, &d.LastError, &d.RequestedAt, &d.UndoUntil,
+		&d.RemovalSubmittedAt, &d.ConfirmedAt, &d.PurgeAfter, &d.PurgedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// createDeletionHandler schedules removal of a root and its records.
+// The proof set and service default to the ones recorded at upload time.
+// POST /api/deletions {"cid": "baga..."}
+func createDeletionHandler(c *gin.Context) {
+	var req struct {
+		CID         string `json:"cid" binding:"required"`
+		ProofSetID  string `json:"proofSetID"`
+		ServiceURL  string `json:"serviceUrl"`
+		ServiceName string `json:"serviceName"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := context.Background()
+	var owner, proofSetID, serviceUrl, serviceName *string
+	err := db.QueryRow(ctx,
+		`SELECT tenant, proof_set_id, service_url, service_name
+		   FROM file_cids
+		  WHERE cid = $1 AND deleted_at IS NULL
+		  ORDER BY id DESC LIMIT 1`,
+		req.CID).Scan(&owner, &proofSetID, &serviceUrl, &serviceName)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireOwner(c, owner, "delete it") {
+		return
+	}
+
+	// Rows uploaded before proof sets were tracked need the caller to say where the root lives
+	pick := func(override string, recorded *string) string {
+		if override != "" {
+			return override
+		}
+		if recorded != nil {
+			return *recorded
+		}
+		return ""
+	}
+	req.ProofSetID = pick(req.ProofSetID, proofSetID)
+	req.ServiceURL = pick(req.ServiceURL, serviceUrl)
+	req.ServiceName = pick(req.ServiceName, serviceName)
+	if req.ProofSetID == "" || req.ServiceURL == "" || req.ServiceName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "proofSetID, serviceUrl and serviceName are required for records uploaded without them",
+		})
+		return
+	}
+
+	d, err := scanDeletion(db.QueryRow(ctx,
+		`INSERT INTO deletions (cid, proof_set_id, service_url, service_name, undo_until)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING `+deletionColumns,
+		req.CID, req.ProofSetID, req.ServiceURL, req.ServiceName, time.Now().Add(deletionUndoWindow)))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "A deletion is already in progress for this CID"})
+			return
+		}
+		fmt.Printf("[DELETION ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[DELETION] #%d scheduled for %s in proofSet %s (undo until %s)\n",
+		d.ID, d.CID, d.ProofSetID, d.UndoUntil.Format(time.RFC3339))
+	c.JSON(http.StatusAccepted, gin.H{"data": d})
+}
+
+// listDeletionsHandler lists deletion requests, newest first
+// GET /api/deletions?status=scheduled
+func listDeletionsHandler(c *gin.Context) {
+	status := c.Query("status")
+	limit := parseIntParam(c, "limit", 50)
+	offset := parseIntParam(c, "offset", 0)
+
+	rows, err := db.Query(context.Background(),
+		`SELECT `+deletionColumns+`
+		   FROM deletions
+		  WHERE ($1 = '' OR status = $1)
+		  ORDER BY requested_at DESC, id DESC
+		  LIMIT $2 OFFSET $3`,
+		status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var result []*filcdn.Deletion
+	for rows.Next() {
+		d, err := scanDeletion(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result = append(result, d)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+// getDeletionHandler returns a single deletion request
+// GET /api/deletions/:id
+func getDeletionHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deletion id"})
+		return
+	}
+
+	d, err := scanDeletion(db.QueryRow(context.Background(),
+		`SELECT `+deletionColumns+` FROM deletions WHERE id = $1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Deletion not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": d})
+}
+
+// undoDeletionHandler cancels a deletion that is still inside its undo window
+// POST /api/deletions/:id/undo
+func undoDeletionHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deletion id"})
+		return
+	}
+
+	ctx := context.Background()
+	d, err := scanDeletion(db.QueryRow(ctx, `SELECT `+deletionColumns+` FROM deletions WHERE id = $1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Deletion not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	owner, err := recordOwner(ctx, d.CID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireOwner(c, owner, "undo its deletion") {
+		return
+	}
+
+	cancelled, err := scanDeletion(db.QueryRow(ctx,
+		`UPDATE deletions SET status = 'cancelled'
+		  WHERE id = $1 AND status = 'scheduled' AND undo_until > NOW()
+		  RETURNING `+deletionColumns,
+		id))
+	if err == nil {
+		fmt.Printf("[DELETION] #%d cancelled\n", id)
+		c.JSON(http.StatusOK, gin.H{"data": cancelled})
+		return
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Moved on since it was loaded, report where it is now
+	if current, err := scanDeletion(db.QueryRow(ctx, `SELECT `+deletionColumns+` FROM deletions WHERE id = $1`, id)); err == nil {
+		d = current
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error": fmt.Sprintf("Deletion can no longer be undone (status %s)", d.Status),
+		"data":  d,
+	})
+}
+
+// runDeletionWorker advances deletions through their lifecycle until the process exits
+func runDeletionWorker() {
+	fmt.Printf("[DELETION] Worker started (undo window %s, grace period %s, poll every %s)\n",
+		deletionUndoWindow, deletionGracePeriod, deletionPollInterval)
+	ticker := time.NewTicker(deletionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		processDeletions(context.Background())
+		<-ticker.C
+	}
+}
+
+func processDeletions(ctx context.Context) {
+	for _, step := range []struct {
+		status string
+		where  string
+		run    func(context.Context, *filcdn.Deletion) error
+	}{
+		{"scheduled", "undo_until <= NOW()", submitRootRemoval},
+		{"removing", "TRUE", confirmRootRemoval},
+		{"deleted", "purge_after <= NOW()", purgeDeletedRecords},
+	} {
+		due, err := loadDeletions(ctx, step.status, step.where)
+		if err != nil {
+			fmt.Printf("[DELETION ERROR] Loading %s deletions: %v\n", step.status, err)
+			continue
+		}
+		for _, d := range due {
+			if err := step.run(ctx, d); err != nil {
+				fmt.Printf("[DELETION ERROR] #%d (%s): %v\n", d.ID, d.Status, err)
+				recordDeletionFailure(ctx, d, err)
+			}
+		}
+	}
+}
+
+func loadDeletions(ctx context.Context, status, where string) ([]*filcdn.Deletion, error) {
+	rows, err := db.Query(ctx,
+		`SELECT `+deletionColumns+` FROM deletions WHERE status = $1 AND `+where+` ORDER BY id`,
+		status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*filcdn.Deletion
+	for rows.Next() {
+		d, err := scanDeletion(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+// submitRootRemoval looks up the root's ID in the proof set and asks the
+// provider to remove it, then does the same for the replicas. A root that is
+// already absent is left for confirmation. The deletion is marked removing
+// before remove-roots is sent, so it is never submitted twice; it goes back to
+// scheduled only when the provider certainly did not apply the removal.
+func submitRootRemoval(ctx context.Context, d *filcdn.Deletion) error {
+	info, err := getProofSet(ctx, d.ServiceURL, d.ServiceName, d.ProofSetID)
+	if err != nil {
+		return err
+	}
+
+	root, ok, err := info.findRoot(d.CID)
+	if err != nil {
+		return err
+	}
+	var rootID *string
+	if ok {
+		rootID = &root.RootID
+	}
+	tag, err := db.Exec(ctx,
+		`UPDATE deletions
+		    SET status = 'removing', root_id = $2, removal_submitted_at = NOW()
+		  WHERE id = $1 AND status = 'scheduled'`,
+		d.ID, rootID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil // cancelled or picked up meanwhile
+	}
+
+	if ok {
+		out, err := removeRootFromProofSet(ctx, d.ServiceURL, d.ServiceName, d.ProofSetID, root.RootID)
+		if err != nil {
+			if pdpOutcomeUnknown(err) {
+				// Left removing: confirmation sees whether it landed
+				now := time.Now()
+				d.Status, d.RemovalSubmittedAt = "removing", &now
+			} else if _, rerr := db.Exec(ctx,
+				`UPDATE deletions
+				    SET status = 'scheduled', root_id = NULL, removal_submitted_at = NULL
+				  WHERE id = $1 AND status = 'removing'`,
+				d.ID); rerr != nil {
+				fmt.Printf("[DELETION ERROR] #%d cannot reschedule: %v\n", d.ID, rerr)
+			}
+			return err
+		}
+		fmt.Printf("[DELETION] #%d remove-roots submitted for root %s: %s\n", d.ID, root.RootID, out)
+	} else {
+		fmt.Printf("[DELETION] #%d root %s not in proofSet %s\n", d.ID, d.CID, d.ProofSetID)
+	}
+
+	if _, err := db.Exec(ctx,
+		"UPDATE deletions SET attempts = 0, last_error = NULL WHERE id = $1",
+		d.ID); err != nil {
+		fmt.Printf("[DELETION ERROR] #%d cannot reset attempts: %v\n", d.ID, err)
+	}
+
+	// Replicas that fail here are retried while confirming
+	if _, err := removeReplicaRoots(ctx, d); err != nil {
+		fmt.Printf("[DELETION ERROR] #%d replicas: %v\n", d.ID, err)
+	}
+	return nil
+}
+
+// confirmRootRemoval checks whether the root and every replica root have
+// left their proof sets on-chain
+func confirmRootRemoval(ctx context.Context, d *filcdn.Deletion) error {
+	info, err := getProofSet(ctx, d.ServiceURL, d.ServiceName, d.ProofSetID)
+	if err != nil {
+		return err
+	}
+	_, present, err := info.findRoot(d.CID)
+	if err != nil {
+		return err
+	}
+	gone := false
+	if !present {
+		if gone, err = removeReplicaRoots(ctx, d); err != nil {
+			return err
+		}
+	}
+	if !gone {
+		// Removal not yet applied, check again next round
+		if removalOverdue(d) {
+			return fmt.Errorf("roots of %s still stored %s after remove-roots was submitted", d.CID, deletionRemovalTimeout)
+		}
+		return nil
+	}
+
+	fmt.Printf("[DELETION] #%d root removal confirmed for %s\n", d.ID, d.CID)
+	return markRecordsDeleted(ctx, d)
+}
+
+// removeReplicaRoots submits remove-roots for every replica of d.CID outside
+// the deletion's own proof set whose root is still in its proof set, and
+// marks the ones whose root is gone removed. It reports whether all of them
+// are removed. A replica is marked removing before its remove-roots is sent,
+// so submitted replicas are not submitted again.
+func removeReplicaRoots(ctx context.Context, d *filcdn.Deletion) (bool, error) {
+	rows, err := db.Query(ctx,
+		`SELECT `+replicaColumns+` FROM replicas
+		  WHERE cid = $1 AND service_url <> $2 AND status <> 'removed'
+		  ORDER BY id`,
+		d.CID, d.ServiceURL)
+	if err != nil {
+		return false, err
+	}
+	var pending []*filcdn.Replica
+	for rows.Next() {
+		r, err := scanReplica(rows)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+
+	gone := true
+	for _, r := range pending {
+		info, err := getProofSet(ctx, r.ServiceURL, r.ServiceName, r.ProofSetID)
+		if err != nil {
+			return false, fmt.Errorf("replica on %s: %w", r.ServiceURL, err)
+		}
+		root, ok, err := info.findRoot(r.RootCID)
+		switch {
+		case err != nil:
+		case !ok:
+			fmt.Printf("[DELETION] #%d replica on %s removed\n", d.ID, r.ServiceURL)
+			err = setReplicaStatus(ctx, d.CID, r.ServiceURL, "removed")
+		case r.Status != "removing":
+			// Marked removing first so remove-roots is never sent twice
+			if err = setReplicaStatus(ctx, d.CID, r.ServiceURL, "removing"); err != nil {
+				break
+			}
+			var out string
+			if out, err = removeRootFromProofSet(ctx, r.ServiceURL, r.ServiceName, r.ProofSetID, root.RootID); err == nil {
+				fmt.Printf("[DELETION] #%d remove-roots submitted for replica root %s on %s: %s\n", d.ID, root.RootID, r.ServiceURL, out)
+			} else if !pdpOutcomeUnknown(err) {
+				if rerr := setReplicaStatus(ctx, d.CID, r.ServiceURL, r.Status); rerr != nil {
+					fmt.Printf("[DELETION ERROR] #%d cannot reset replica on %s: %v\n", d.ID, r.ServiceURL, rerr)
+				}
+			}
+			gone = false
+		default:
+			gone = false // removal not yet applied
+		}
+		if err != nil {
+			return false, fmt.Errorf("replica on %s: %w", r.ServiceURL, err)
+		}
+	}
+	return gone, nil
+}
+
+func setReplicaStatus(ctx context.Context, cid, serviceURL, status string) error {
+	_, err := db.Exec(ctx,
+		"UPDATE replicas SET status = $3, updated_at = NOW() WHERE cid = $1 AND service_url = $2",
+		cid, serviceURL, status)
+	return err
+}
+
+// markRecordsDeleted soft-deletes file_cids and metadata rows for the CID and
+// starts the grace period before they are purged
+func markRecordsDeleted(ctx context.Context, d *filcdn.Deletion) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range append([]string{"file_cids"}, metadataTables...) {
+		if _, err := tx.Exec(ctx,
+			fmt.Sprintf("UPDATE %s SET deleted_at = NOW() WHERE cid = $1 AND deleted_at IS NULL", table),
+			d.CID); err != nil {
+			return fmt.Errorf("failed to mark %s deleted: %w", table, err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE deletions
+		    SET status = 'deleted', confirmed_at = NOW(), purge_after = $2, attempts = 0, last_error = NULL
+		  WHERE id = $1`,
+		d.ID, time.Now().Add(deletionGracePeriod)); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// purgeDeletedRecords permanently removes soft-deleted rows once the grace period is over
+func purgeDeletedRecords(ctx context.Context, d *filcdn.Deletion) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range append([]string{"file_cids"}, metadataTables...) {
+		if _, err := tx.Exec(ctx,
+			fmt.Sprintf("DELETE FROM %s WHERE cid = $1 AND deleted_at IS NOT NULL", table),
+			d.CID); err != nil {
+			return fmt.Errorf("failed to purge %s: %w", table, err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM replicas WHERE cid = $1", d.CID); err != nil {
+		return fmt.Errorf("failed to purge replicas: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx,
+		"UPDATE deletions SET status = 'purged', purged_at = NOW() WHERE id = $1", d.ID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("[DELETION] #%d purged records for %s\n", d.ID, d.CID)
+	return nil
+}
+
+// removalOverdue reports whether a removing deletion is past its deadline
+func removalOverdue(d *filcdn.Deletion) bool {
+	return d.RemovalSubmittedAt != nil && time.Since(*d.RemovalSubmittedAt) > deletionRemovalTimeout
+}
+
+// recordDeletionFailure stores the error; a deletion that keeps failing before
+// its removal was submitted, or whose removal is overdue, is given up on.
+func recordDeletionFailure(ctx context.Context, d *filcdn.Deletion, cause error) {
+	status := d.Status
+	switch {
+	case d.Status == "scheduled" && d.Attempts+1 >= maxDeletionAttempts,
+		d.Status == "removing" && removalOverdue(d):
+		status = "failed"
+		fmt.Printf("[DELETION ERROR] #%d failed for %s: %v\n", d.ID, d.CID, cause)
+	}
+	if _, err := db.Exec(ctx,
+		"UPDATE deletions SET attempts = attempts + 1, last_error = $2, status = $3 WHERE id = $1",
+		d.ID, cause.Error(), status); err != nil {
+		fmt.Printf("[DELETION ERROR] #%d cannot record failure: %v\n", d.ID, err)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// editableField describes a metadata field that may be changed after upload.
+// The JSON name matches the multipart form field used by the upload handlers.
+type editableField struct {
+	column   string
+	kind     string // "string", "year", "stringArray" or "json"
+	required bool   // must not be cleared or set to an empty value
+}
+
+var editableFields = map[string]map[string]editableField{
+	"paper": {
+		"title":    {column: "title", kind: "string", required: true},
+		"journal":  {column: "journal", kind: "string"},
+		"year":     {column: "year", kind: "year"},
+		"keywords": {column: "keywords", kind: "stringArray"},
+	},
+	"genome": {
+		"organism":        {column: "organism", kind: "string", required: true},
+		"assemblyVersion": {column: "assembly_version", kind: "string"},
+		"notes":           {column: "notes", kind: "string"},
+	},
+	"spectrum": {
+		"compound":  {column: "compound", kind: "string", required: true},
+		"technique": {column: "technique_nmr_ir_ms", kind: "string"},
+		"metadata":  {column: "metadata_json", kind: "json"},
+	},
+}
+
+// replaceableFields maps the sub-resources accepted by PUT to their field name.
+var replaceableFields = map[string]map[string]string{
+	"paper":    {"keywords": "keywords"},
+	"spectrum": {"metadata": "metadata"},
+}
+
+// patchDataHandler updates individual metadata fields of a record.
+// Arrays (keywords) and JSON documents (metadata) are replaced as a whole.
+// PATCH /api/data/paper/QmX123...   {"title": "Fixed title", "keywords": ["a", "b"]}
+// PATCH /api/data/genome/QmY456...  {"organism": "Homo sapiens"}
+func patchDataHandler(c *gin.Context) {
+	dataType := c.Param("type")
+	cid := c.Param("cid")
+
+	fields, ok := editableFields[dataType]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid data type. Editable types: paper, genome, spectrum",
+		})
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body must be a JSON object"})
+		return
+	}
+	if len(body) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	fmt.Printf("[PATCH] Type: %s, CID: %s, Fields: %d\n", dataType, cid, len(body))
+
+	values := make(map[string]interface{}, len(body))
+	for name, raw := range body {
+		field, ok := fields[name]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Unknown or read-only field %q for type %s", name, dataType),
+			})
+			return
+		}
+		value, err := parseEditableValue(field, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid value for %s: %v", name, err)})
+			return
+		}
+		values[name] = value
+	}
+
+	updateRecord(c, dataType, cid, values, "update")
+}
+
+// replaceDataFieldHandler replaces a list or JSON document on a record.
+// PUT /api/data/paper/QmX123.../keywords    ["chemistry", "nmr"]
+// PUT /api/data/spectrum/QmZ789.../metadata {"solvent": "CDCl3"}
+func replaceDataFieldHandler(c *gin.Context) {
+	dataType := c.Param("type")
+	cid := c.Param("cid")
+	subresource := c.Param("field")
+
+	name, ok := replaceableFields[dataType][subresource]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("%s cannot be replaced on type %s", subresource, dataType),
+		})
+		return
+	}
+
+	raw, err := c.GetRawData()
+	if err != nil || len(raw) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body is required"})
+		return
+	}
+
+	fmt.Printf("[PUT] Type: %s, CID: %s, Field: %s\n", dataType, cid, name)
+
+	value, err := parseEditableValue(editableFields[dataType][name], raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid value for %s: %v", name, err)})
+		return
+	}
+
+	updateRecord(c, dataType, cid, map[string]interface{}{name: value}, "replace")
+}
+
+// deleteDataHandler soft-deletes the metadata row of a record, hiding it from
+// listings and edits; uploading the same file again revives it. The stored
+// file and its file_cids entry are left untouched; removing those goes
+// through POST /api/deletions.
+// DELETE /api/data/genome/QmY456...
+func deleteDataHandler(c *gin.Context) {
+	dataType := c.Param("type")
+	cid := c.Param("cid")
+
+	if _, ok := editableFields[dataType]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid data type. Deletable types: paper, genome, spectrum",
+		})
+		return
+	}
+
+	if !requireRecordEditor(c, cid) {
+		return
+	}
+
+	fmt.Printf("[DELETE] Type: %s, CID: %s\n", dataType, cid)
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var previous []byte
+	err = tx.QueryRow(ctx,
+		fmt.Sprintf(`UPDATE %s r SET deleted_at = NOW(), updated_at = NOW()
+		              WHERE cid = $1 AND deleted_at IS NULL RETURNING to_jsonb(r)`, dataType),
+		cid).Scan(&previous)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+			return
+		}
+		fmt.Printf("[DELETE ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := recordEdit(ctx, tx, dataType, cid, "delete", previous, nil); err != nil {
+		fmt.Printf("[DELETE ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": cid, "type": dataType})
+}
+
+// getDataHistoryHandler lists the edit history of a record, newest first
+// GET /api/data/paper/QmX123.../history
+func getDataHistoryHandler(c *gin.Context) {
+	dataType := c.Param("type")
+	cid := c.Param("cid")
+
+	rows, err := db.Query(context.Background(),
+		`SELECT id, action, previous, changes, edited_at
+		   FROM record_edits
+		  WHERE record_type = $1 AND cid = $2
+		  ORDER BY edited_at DESC, id DESC`,
+		dataType, cid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var history []filcdn.HistoryEntry
+	for rows.Next() {
+		var h filcdn.HistoryEntry
+		var previous, changes []byte
+		if err := rows.Scan(&h.ID, &h.Action, &previous, &changes, &h.EditedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.Previous, h.Changes = orNull(previous), orNull(changes)
+		history = append(history, h)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": history})
+}
+
+// updateRecord applies values to a record and writes an edit history entry in
+// the same transaction, then responds with the updated record.
+func updateRecord(c *gin.Context, dataType, cid string, values map[string]interface{}, action string) {
+	if !requireRecordEditor(c, cid) {
+		return
+	}
+	fields := editableFields[dataType]
+
+	var setClauses []string
+	var args []interface{}
+	argIndex := 1
+	for name, value := range values {
+		setClauses = append(setClauses, fmt.Sprintf("%s = $%d", fields[name].column, argIndex))
+		args = append(args, value)
+		argIndex++
+	}
+	setClauses = append(setClauses, "updated_at = NOW()")
+	args = append(args, cid)
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var previous []byte
+	err = tx.QueryRow(ctx,
+		fmt.Sprintf("SELECT to_jsonb(r) FROM %s r WHERE cid = $1 AND deleted_at IS NULL FOR UPDATE", dataType),
+		cid).Scan(&previous)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+			return
+		}
+		fmt.Printf("[UPDATE ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE cid = $%d",
+		dataType, strings.Join(setClauses, ", "), argIndex)
+	if _, err := tx.Exec(ctx, query, args...); err != nil {
+		fmt.Printf("[UPDATE ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	changed := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		if s, ok := value.(string); ok && fields[name].kind == "json" {
+			changed[name] = json.RawMessage(s)
+		} else {
+			changed[name] = value
+		}
+	}
+	changes, _ := json.Marshal(changed)
+	if err := recordEdit(ctx, tx, dataType, cid, action, previous, changes); err != nil {
+		fmt.Printf("[UPDATE ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var result interface{}
+	switch dataType {
+	case "paper":
+		result, err = getPaperByCID(cid)
+	case "genome":
+		result, err = getGenomeByCID(cid)
+	case "spectrum":
+		result, err = getSpectrumByCID(cid)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[UPDATE] %s %s updated (%s)\n", dataType, cid, action)
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+// requireRecordEditor writes an error and returns false unless the caller
+// uploaded the record or is an admin
+func requireRecordEditor(c *gin.Context, cid string) bool {
+	owner, err := recordOwner(context.Background(), cid)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return requireOwner(c, owner, "edit it")
+}
+
+// recordEdit appends an entry to the per-record edit history
+func recordEdit(ctx context.Context, tx pgx.Tx, dataType, cid, action string, previous, changes []byte) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO record_edits (record_type, cid, action, previous, changes)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		dataType, cid, action, nullableJSON(previous), nullableJSON(changes))
+	if err != nil {
+		return fmt.Errorf("failed to record edit history: %w", err)
+	}
+	return nil
+}
+
+// parseEditableValue validates a raw JSON value against the field definition
+// and converts it to a value suitable as a query argument.
+func parseEditableValue(field editableField, raw json.RawMessage) (interface{}, error) {
+	if string(raw) == "null" {
+		if field.required {
+			return nil, errors.New("field is required and cannot be null")
+		}
+		return nil, nil
+	}
+
+	switch field.kind {
+	case "string":
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, errors.New("expected a string")
+		}
+		s = strings.TrimSpace(s)
+		if field.required && s == "" {
+			return nil, errors.New("field is required and cannot be empty")
+		}
+		return s, nil
+
+	case "year":
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, errors.New("expected an integer")
+		}
+		if n < 1000 || n > time.Now().Year()+1 {
+			return nil, fmt.Errorf("year %d is out of range", n)
+		}
+		return n, nil
+
+	case "stringArray":
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, errors.New("expected an array of strings")
+		}
+		cleaned := make([]string, 0, len(list))
+		for _, item := range list {
+			if item = strings.TrimSpace(item); item != "" {
+				cleaned = append(cleaned, item)
+			}
+		}
+		return cleaned, nil
+
+	case "json":
+		if !json.Valid(raw) {
+			return nil, errors.New("expected a JSON document")
+		}
+		return string(raw), nil
+	}
+
+	return nil, fmt.Errorf("unsupported field kind %q", field.kind)
+}
+
+func nullableJSON(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
+
+func orNull(b []byte) []byte {
+	if len(b) == 0 {
+		return []byte("null")
+	}
+	return b
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Server-side envelope encryption. Each upload gets a random 256-bit data key
+// and is encrypted as a sequence of AES-GCM sealed chunks; the data key is
+// wrapped with the tenant's master key from the keystore file and stored in
+// record_encryption next to the root CID. Only ciphertext leaves the service.
+//
+// Chunk nonces are prefix(7) || counter(4, big endian) || last(1), so chunks
+// cannot be reordered, dropped or truncated without failing authentication.
+//
+// KEYSTORE_PATH points to a JSON file of tenant master keys:
+//
+//	{"lab-a": {"active": "k2", "keys": {"k1": "<base64 32 bytes>", "k2": "<base64 32 bytes>"}}}
+//
+// Old keys stay in the file so records wrapped with them can still be read.
+
+const (
+	serverEncryptionAlgorithm = "AES-256-GCM-STREAM"
+	encryptionChunkSize       = 64 << 10
+	noncePrefixSize           = 7
+)
+
+type tenantKeys struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+var keystore map[string]tenantKeys
+
+func loadKeystore(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var ks map[string]tenantKeys
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return fmt.Errorf("invalid keystore: %w", err)
+	}
+	for tenant, tk := range ks {
+		if _, ok := tk.Keys[tk.Active]; !ok {
+			return fmt.Errorf("invalid keystore: tenant %s has no key %q", tenant, tk.Active)
+		}
+		for id := range tk.Keys {
+			if _, err := masterKey(ks, tenant, id); err != nil {
+				return fmt.Errorf("invalid keystore: %w", err)
+			}
+		}
+	}
+	keystore = ks
+	return nil
+}
+
+func masterKey(ks map[string]tenantKeys, tenant, keyID string) ([]byte, error) {
+	encoded, ok := ks[tenant].Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no master key %q for tenant %s", keyID, tenant)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("master key %q for tenant %s must be 32 base64-encoded bytes", keyID, tenant)
+	}
+	return key, nil
+}
+
+// envelope is the stored encryption metadata of one record
+type envelope struct {
+	Algorithm     string
+	Tenant        string
+	MasterKeyID   string
+	WrappedKey    []byte // nonce || AES-GCM(master key, data key)
+	NoncePrefix   []byte
+	ChunkSize     int
+	PlaintextSize int64
+
+	dataKey []byte // unwrapped; never stored
+}
+
+// newEnvelope creates a data key for tenant and wraps it with the active master key
+func newEnvelope(tenant string) (*envelope, error) {
+	tk, ok := keystore[tenant]
+	if !ok {
+		return nil, fmt.Errorf("tenant %s has no master key in the keystore", tenant)
+	}
+	master, err := masterKey(keystore, tenant, tk.Active)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &envelope{
+		Algorithm:   serverEncryptionAlgorithm,
+		Tenant:      tenant,
+		MasterKeyID: tk.Active,
+		ChunkSize:   encryptionChunkSize,
+		dataKey:     make([]byte, 32),
+		NoncePrefix: make([]byte, noncePrefixSize),
+	}
+	if _, err := rand.Read(env.dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(env.NoncePrefix); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	env.WrappedKey = aead.Seal(nonce, nonce, env.dataKey, []byte(tenant))
+	return env, nil
+}
+
+// unwrap recovers the data key using the tenant master key it was wrapped with
+func (env *envelope) unwrap() error {
+	master, err := masterKey(keystore, env.Tenant, env.MasterKeyID)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return err
+	}
+	if len(env.WrappedKey) < aead.NonceSize() {
+		return errors.New("wrapped key is truncated")
+	}
+	nonce, sealed := env.WrappedKey[:aead.NonceSize()], env.WrappedKey[aead.NonceSize():]
+	env.dataKey, err = aead.Open(nil, nonce, sealed, []byte(env.Tenant))
+	if err != nil {
+		return errors.New("cannot unwrap data key")
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader yields the chunked ciphertext of src
+type encryptReader struct {
+	env     *envelope
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	chunk   []byte
+	out     []byte
+	counter uint32
+	done    bool
+}
+
+func (env *envelope) encryptReader(src io.Reader) (io.Reader, error) {
+	aead, err := newGCM(env.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		env:   env,
+		aead:  aead,
+		src:   bufio.NewReaderSize(src, env.ChunkSize),
+		chunk: make([]byte, env.ChunkSize),
+	}, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// The chunk is last when the source has nothing after it
+		last := err != nil
+		if !last {
+			if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+				last = true
+			} else if peekErr != nil {
+				return 0, peekErr
+			}
+		}
+		r.env.PlaintextSize += int64(n)
+		r.out = r.aead.Seal(r.out[:0], chunkNonce(r.env.NoncePrefix, r.counter, last), r.chunk[:n], nil)
+		r.counter++
+		r.done = last
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decryptTo streams the plaintext of the chunked ciphertext in src to dst
+func (env *envelope) decryptTo(dst io.Writer, src io.Reader) (int64, error) {
+	aead, err := newGCM(env.dataKey)
+	if err != nil {
+		return 0, err
+	}
+	in := bufio.NewReaderSize(src, env.ChunkSize+aead.Overhead())
+	sealed := make([]byte, env.ChunkSize+aead.Overhead())
+	var plain []byte
+	var written int64
+
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(in, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return written, err
+		}
+		if n == 0 {
+			return written, errors.New("ciphertext is truncated")
+		}
+		last := err != nil
+		if !last {
+			if _, peekErr := in.Peek(1); peekErr == io.EOF {
+				last = true
+			}
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(env.NoncePrefix, counter, last), sealed[:n], nil)
+		if err != nil {
+			return written, fmt.Errorf("chunk %d failed authentication", counter)
+		}
+		m, err := dst.Write(plain)
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		if last {
+			return written, nil
+		}
+	}
+}
+
+// prepareUploadEncryption returns the reader to upload. With the form field
+// encryption=server it is the ciphertext of file under a fresh envelope;
+// otherwise file itself and a nil envelope. On failure it writes the error
+// response and returns ok=false.
+func prepareUploadEncryption(c *gin.Context, file io.Reader) (io.Reader, *envelope, bool) {
+	tenant, ok := uploadEncryptionTenant(c, c.PostForm("encryption"))
+	if !ok {
+		return nil, nil, false
+	}
+	reader, env, err := encryptUpload(tenant, file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+	return reader, env, true
+}
+
+// uploadEncryptionTenant checks an encryption option (none or server) and
+// returns the tenant to encrypt for, "" when the upload is stored as sent.
+// Uploads that encrypt each file later (batch, tus) call it up front so a
+// tenant without a master key is refused before anything is stored. On
+// failure it writes the error response and returns ok=false.
+func uploadEncryptionTenant(c *gin.Context, mode string) (string, bool) {
+	switch mode {
+	case "", "none":
+		return "", true
+	case "server":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "encryption must be none or server"})
+		return "", false
+	}
+
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return "", false
+	}
+	if _, ok := keystore[tenant]; !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "server-side encryption is not configured for this tenant"})
+		return "", false
+	}
+	return tenant, true
+}
+
+// encryptUpload returns the ciphertext of file under a fresh envelope for
+// tenant, or file itself and a nil envelope when tenant is ""
+func encryptUpload(tenant string, file io.Reader) (io.Reader, *envelope, error) {
+	if tenant == "" {
+		return file, nil, nil
+	}
+	env, err := newEnvelope(tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := env.encryptReader(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("[ENCRYPT] Server-side encryption for tenant %s (master key %s)\n", tenant, env.MasterKeyID)
+	return reader, env, nil
+}
+
+// saveEnvelope stores the wrapped key and parameters for a record
+func saveEnvelope(ctx context.Context, rootCID string, env *envelope) error {
+	_, err := db.Exec(ctx,
+		`INSERT INTO record_encryption
+		   (cid, mode, algorithm, tenant, master_key_id, wrapped_key, nonce_prefix, chunk_size, plaintext_size)
+		 VALUES ($1, 'server', $2, $3, $4, $5, $6, $7, $8)
+		 ON CONFLICT (cid) DO NOTHING`,
+		rootCID, env.Algorithm, env.Tenant, env.MasterKeyID, env.WrappedKey, env.NoncePrefix,
+		env.ChunkSize, env.PlaintextSize)
+	if err != nil {
+		return fmt.Errorf("failed to save encryption metadata: %w", err)
+	}
+	return nil
+}
+
+// loadEnvelope returns the server-side envelope of a record, or nil when the
+// record is not server-side encrypted
+func loadEnvelope(ctx context.Context, rootCID string) (*envelope, error) {
+	env := &envelope{}
+	var mode string
+	err := db.QueryRow(ctx,
+		`SELECT mode, algorithm, tenant, master_key_id, wrapped_key, nonce_prefix, chunk_size, plaintext_size
+		   FROM record_encryption WHERE cid = $1`,
+		rootCID).Scan(&mode, &env.Algorithm, &env.Tenant, &env.MasterKeyID, &env.WrappedKey,
+		&env.NoncePrefix, &env.ChunkSize, &env.PlaintextSize)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if mode != "server" {
+		return nil, nil
+	}
+	return env, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Routes under /api/v2 are the /api routes with uniform responses: successes
+// are always {"data": ...} (plus pagination and sort on lists) and errors are
+// always {"error": {code, message, details, requestId}}. Handlers write the
+// typed filcdn responses for both versions; v2Middleware only wraps bodies
+// that lack "data" and converts error bodies, so both share one
+// implementation.
+
+// Machine-readable error codes. Handlers set the specific ones with
+// annotateError; the rest are derived from the status code.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codePreconditionFailed   = "precondition_failed"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeLocked               = "locked"
+	codeRateLimited          = "rate_limited"
+	codeInternal             = "internal_error"
+	codeUpstream             = "upstream_error"
+	codeUnavailable          = "unavailable"
+	codeTimeout              = "timeout"
+	codePDPToolFailed        = "pdptool_failed"
+	codeBatchFailed          = "batch_failed"
+	codeMalwareDetected      = "malware_detected"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            codeInvalidRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusConflict:              codeConflict,
+	http.StatusPreconditionFailed:    codePreconditionFailed,
+	http.StatusRequestEntityTooLarge: codePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  codeUnsupportedMediaType,
+	http.StatusLocked:                codeLocked,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusInternalServerError:   codeInternal,
+	http.StatusBadGateway:            codeUpstream,
+	http.StatusServiceUnavailable:    codeUnavailable,
+	http.StatusGatewayTimeout:        codeTimeout,
+}
+
+func errorCodeFor(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// requestIDMiddleware tags every request with an ID, taken from X-Request-ID
+// when the caller sends a valid one, and echoes it in the response
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader("X-Request-ID")
+	if !uploadIDPattern.MatchString(id) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	c.Set("requestID", id)
+	c.Header("X-Request-ID", id)
+	c.Next()
+}
+
+// requestIDOf returns the request's ID
+func requestIDOf(c *gin.Context) string {
+	return c.GetString("requestID")
+}
+
+// errorAnnotation overrides what v2 reports for an error response
+type errorAnnotation struct {
+	code    string
+	message string
+	output  string
+}
+
+// annotateError gives the error response the handler is about to write a
+// specific code and message under /api/v2. output, usually pdptool's, is
+// reported in details instead of as the message.
+func annotateError(c *gin.Context, code, message string, output []byte) {
+	c.Set("errorAnnotation", errorAnnotation{code: code, message: message, output: strings.TrimSpace(string(output))})
+}
+
+// pdptoolFailed annotates a failed pdptool command
+func pdptoolFailed(c *gin.Context, command string, output []byte) {
+	annotateError(c, codePDPToolFailed, command+" failed", output)
+}
+
+// v2Writer buffers JSON and error responses so v2Middleware can reshape
+// them. Other content types (file downloads, event streams) pass straight
+// through. Like gin's own writer, the status is only recorded until the
+// first write, when the Content-Type is known.
+type v2Writer struct {
+	gin.ResponseWriter
+	status    int
+	decided   bool
+	buffering bool
+	buf       bytes.Buffer
+}
+
+func (w *v2Writer) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	ct := w.Header().Get("Content-Type")
+	w.buffering = w.status >= 400 || strings.HasPrefix(ct, "application/json")
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *v2Writer) WriteHeader(status int) {
+	if status > 0 && !w.decided {
+		w.status = status
+	}
+}
+
+func (w *v2Writer) WriteHeaderNow() {
+	w.decide()
+}
+
+func (w *v2Writer) Write(b []byte) (int, error) {
+	w.decide()
+	if w.buffering {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *v2Writer) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *v2Writer) Status() int {
+	return w.status
+}
+
+func (w *v2Writer) Size() int {
+	if w.buffering {
+		return w.buf.Len()
+	}
+	return w.ResponseWriter.Size()
+}
+
+func (w *v2Writer) Written() bool {
+	return w.decided
+}
+
+// v2Middleware reshapes /api/v2 responses into the uniform envelopes
+func v2Middleware(c *gin.Context) {
+	orig := c.Writer
+	w := &v2Writer{ResponseWriter: orig, status: http.StatusOK}
+	c.Writer = w
+	defer func() {
+		if p := recover(); p != nil {
+			c.Writer = orig
+			fmt.Printf("[PANIC] %s %s: %v\n%s", c.Request.Method, c.Request.URL.Path, p, debug.Stack())
+			c.Abort()
+			if !w.decided || w.buffering {
+				writeErrorEnvelope(c, http.StatusInternalServerError, codeInternal, "internal server error", nil)
+			}
+		}
+	}()
+
+	c.Next()
+
+	// Handlers that only set a status (c.Status, AbortWithStatus) never wrote
+	w.decide()
+	c.Writer = orig
+	if !w.buffering {
+		return
+	}
+	if w.status >= 400 {
+		writeV2Error(c, w.status, w.buf.Bytes())
+		return
+	}
+
+	// The body is embedded as is, never decoded into Go values, so numbers
+	// keep their precision
+	out := w.buf.Bytes()
+	if !json.Valid(out) {
+		orig.WriteHeader(w.status)
+		orig.Write(out)
+		return
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(out, &obj) != nil || !hasKey(obj, "data") {
+		out, _ = json.Marshal(gin.H{"data": json.RawMessage(out)})
+	}
+	orig.Header().Set("Content-Type", "application/json; charset=utf-8")
+	orig.WriteHeader(w.status)
+	orig.Write(out)
+}
+
+// writeV2Error converts an /api error body ({"error": message, ...}) into
+// the v2 envelope. Other keys become details, with a nested "details"
+// object flattened into them.
+func writeV2Error(c *gin.Context, status int, raw []byte) {
+	code := errorCodeFor(status)
+	message := http.StatusText(status)
+	details := map[string]interface{}{}
+	var reported string
+
+	var body map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber() // keep large IDs exact in details
+	if dec.Decode(&body) == nil {
+		for k, v := range body {
+			switch {
+			case k == "error":
+				if s, ok := v.(string); ok && s != "" {
+					message, reported = s, s
+				}
+			case k == "details":
+				if m, ok := v.(map[string]interface{}); ok {
+					for dk, dv := range m {
+						details[dk] = dv
+					}
+				} else {
+					details[k] = v
+				}
+			default:
+				details[k] = v
+			}
+		}
+	} else if s := strings.TrimSpace(string(raw)); s != "" {
+		message, reported = s, s
+	}
+
+	if v, ok := c.Get("errorAnnotation"); ok {
+		a := v.(errorAnnotation)
+		if a.output != "" {
+			details["output"] = a.output
+		} else if reported != "" && reported != a.message {
+			details["output"] = reported
+		}
+		code, message = a.code, a.message
+	}
+	writeErrorEnvelope(c, status, code, message, details)
+}
+
+func writeErrorEnvelope(c *gin.Context, status int, code, message string, details map[string]interface{}) {
+	if len(details) == 0 {
+		details = nil
+	}
+	body, _ := json.Marshal(filcdn.ErrorResponse{Error: filcdn.ErrorDetail{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: requestIDOf(c),
+	}})
+	c.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	c.Writer.WriteHeader(status)
+	c.Writer.Write(body)
+}
+
+// noRouteHandler answers unknown /api/v2 paths with the error envelope;
+// other paths get gin's default 404
+func noRouteHandler(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/api/v2/") {
+		writeErrorEnvelope(c, http.StatusNotFound, codeNotFound, "no such endpoint", nil)
+	}
+}
+
+func hasKey[V any](m map[string]V, key string) bool {
+	_, ok := m[key]
+	return ok
+}
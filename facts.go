@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Every upload records facts about the bytes the client sent: the size, the
+// SHA-256, the MIME type sniffed from the content (the Content-Type header
+// is not trusted) and the original filename. With server-side encryption
+// they describe the plaintext. They are kept in file_facts by root CID and
+// returned with the records.
+
+// sniffLen is how much of the start of a file MIME detection looks at
+const sniffLen = 3072
+
+// factsRecorder collects file facts from the bytes written to it. Uploads
+// tee the client's bytes into one on their way to the temp file.
+type factsRecorder struct {
+	size int64
+	sum  hash.Hash
+	head []byte
+}
+
+func newFactsRecorder() *factsRecorder {
+	return &factsRecorder{sum: sha256.New()}
+}
+
+func (r *factsRecorder) Write(p []byte) (int, error) {
+	r.size += int64(len(p))
+	r.sum.Write(p)
+	if n := sniffLen - len(r.head); n > 0 {
+		r.head = append(r.head, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// facts returns the facts of everything written so far
+func (r *factsRecorder) facts(originalName string) *filcdn.FileFacts {
+	return &filcdn.FileFacts{
+		OriginalName: originalName,
+		Size:         r.size,
+		MIMEType:     mimetype.Detect(r.head).String(),
+		SHA256:       hex.EncodeToString(r.sum.Sum(nil)),
+	}
+}
+
+// recordFileFacts stores the facts of a root once upload-file has stored
+// it. A failure is logged; the upload itself has succeeded.
+func recordFileFacts(rootCID string, facts *filcdn.FileFacts) {
+	if _, err := db.Exec(context.Background(),
+		`INSERT INTO file_facts (cid, original_name, size_bytes, mime_type, sha256)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (cid) DO UPDATE SET original_name = EXCLUDED.original_name, size_bytes = EXCLUDED.size_bytes,
+		        mime_type = EXCLUDED.mime_type, sha256 = EXCLUDED.sha256, recorded_at = NOW()`,
+		rootCID, facts.OriginalName, facts.Size, facts.MIMEType, facts.SHA256); err != nil {
+		fmt.Printf("[FACTS ERROR] Saving facts of %s: %v\n", rootCID, err)
+	}
+}
+
+// factsColumns selects the facts of a record from file_facts joined as ff;
+// scan them with a factsScan
+const factsColumns = "ff.original_name, ff.size_bytes, ff.mime_type, ff.sha256"
+
+type factsScan struct {
+	name, mimeType, sha *string
+	size                *int64
+}
+
+func (s *factsScan) dest() []any {
+	return []any{&s.name, &s.size, &s.mimeType, &s.sha}
+}
+
+// facts returns the scanned facts, or nil when the record has none
+func (s *factsScan) facts() *filcdn.FileFacts {
+	if s.sha == nil {
+		return nil
+	}
+	return &filcdn.FileFacts{
+		OriginalName: *s.name,
+		Size:         *s.size,
+		MIMEType:     *s.mimeType,
+		SHA256:       *s.sha,
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every provider has a circuit breaker fed by upload-file. It opens after
+// circuitFailureThreshold transient failures in a row, and while open
+// uploads to the provider fail at once. After circuitCooldown it lets one
+// upload through (half-open): success closes it again, failure reopens it.
+//
+// When an upload fails transiently, or the circuit is open, single-file
+// uploads move on to the next healthy registered provider and its proof set,
+// trying at most uploadFailoverAttempts providers in all. Batches stay on
+// the provider they were sent to since all their roots go in one add-roots
+// call.
+var (
+	circuitFailureThreshold int
+	circuitCooldown         time.Duration
+	uploadFailoverAttempts  int
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// errProviderUnavailable matches failures worth retrying elsewhere: transient
+// pdpErrors and open circuits
+var errProviderUnavailable = errors.New("storage provider unavailable")
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool // a half-open trial upload is running
+}
+
+var breakers sync.Map // service URL -> *circuitBreaker
+
+func breakerFor(serviceUrl string) *circuitBreaker {
+	b, _ := breakers.LoadOrStore(serviceUrl, &circuitBreaker{state: circuitClosed})
+	return b.(*circuitBreaker)
+}
+
+// allow reports whether an upload may go to the provider, taking the trial
+// slot when the circuit is half-open
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < circuitCooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		fallthrough
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// available is allow without taking the trial slot
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		return time.Since(b.openedAt) >= circuitCooldown
+	case circuitHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// record counts the outcome of an allowed upload. Only transient failures
+// count against the provider; any other answer shows it is up.
+func (b *circuitBreaker) record(serviceUrl string, transientFailure bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !transientFailure {
+		if b.state != circuitClosed {
+			fmt.Printf("[CIRCUIT] %s closed\n", serviceUrl)
+		}
+		b.state, b.failures = circuitClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= circuitFailureThreshold {
+		if b.state != circuitOpen {
+			fmt.Printf("[CIRCUIT] %s open after %d failures, retrying in %s\n", serviceUrl, b.failures, circuitCooldown)
+		}
+		b.state, b.openedAt = circuitOpen, time.Now()
+	}
+}
+
+// abandon gives back the trial slot of an upload that was canceled
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// circuitState returns the breaker state of a provider for display
+func circuitState(serviceUrl string) string {
+	b := breakerFor(serviceUrl)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen && time.Since(b.openedAt) >= circuitCooldown {
+		return circuitHalfOpen
+	}
+	return b.state
+}
+
+// uploadTarget is where an upload is stored. uploadWithFailover moves it to
+// another provider when failover is allowed and the provider fails.
+type uploadTarget struct {
+	serviceURL  string
+	serviceName string
+	proofSetID  string
+	lease       *proofSetLease // pool room held in proofSetID, if any
+	failover    bool
+	movedFrom   string // provider the upload was sent to before failing over
+}
+
+// uploadWithFailover runs upload-file against t, then against the next
+// healthy registered providers while failures are transient
+func uploadWithFailover(ctx context.Context, t *uploadTarget, path string) (string, error) {
+	rootCID, err := runUploadFile(ctx, t.serviceURL, t.serviceName, path)
+	if err == nil || !t.failover || uploadFailoverAttempts <= 1 || !errors.Is(err, errProviderUnavailable) {
+		return rootCID, err
+	}
+
+	providers, perr := activeProviders(ctx)
+	if perr != nil {
+		fmt.Printf("[FAILOVER ERROR] Loading providers: %v\n", perr)
+		return "", err
+	}
+	tried := map[string]bool{t.serviceURL: true}
+	attempts := 1
+	for _, p := range providers {
+		if attempts >= uploadFailoverAttempts {
+			break
+		}
+		if tried[p.ServiceURL] || !breakerFor(p.ServiceURL).available() || !proofSetHealthy(ctx, p.ProofSetID, p.ServiceURL) {
+			continue
+		}
+		tried[p.ServiceURL] = true
+		attempts++
+		fmt.Printf("[FAILOVER] %s failed (%v), trying %s\n", t.serviceURL, err, p.ServiceURL)
+
+		rootCID, err = runUploadFile(ctx, p.ServiceURL, p.ServiceName, path)
+		if err == nil {
+			t.lease.done()
+			t.movedFrom = t.serviceURL
+			t.serviceURL, t.serviceName, t.proofSetID, t.lease = p.ServiceURL, p.ServiceName, p.ProofSetID, nil
+			fmt.Printf("[FAILOVER] Stored on %s (proofSet %s) instead of %s\n", t.serviceURL, t.proofSetID, t.movedFrom)
+			return rootCID, nil
+		}
+		if !errors.Is(err, errProviderUnavailable) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("upload failed on %d provider(s), last error: %w", attempts, err)
+}
+
+// proofSetHealthy reports whether the latest health sample of a proof set,
+// if any, shows it being proven
+func proofSetHealthy(ctx context.Context, proofSetID, serviceUrl string) bool {
+	var status string
+	err := db.QueryRow(ctx,
+		`SELECT status FROM proof_set_health
+		  WHERE proof_set_id = $1 AND service_url = $2
+		  ORDER BY checked_at DESC LIMIT 1`,
+		proofSetID, serviceUrl).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		fmt.Printf("[FAILOVER ERROR] Loading health of proofSet %s: %v\n", proofSetID, err)
+		return false
+	}
+	return status != healthMissedDeadline && status != healthNotProving
+}
+
+// retargetIntent points an upload intent at the provider the upload
+// failed over to
+func retargetIntent(id int64, t *uploadTarget) {
+	if id == 0 || t.movedFrom == "" {
+		return
+	}
+	if _, err := db.Exec(context.Background(),
+		`UPDATE upload_intents SET proof_set_id = $2, service_url = $3, service_name = $4, updated_at = NOW()
+		  WHERE id = $1`,
+		id, t.proofSetID, t.serviceURL, t.serviceName); err != nil {
+		fmt.Printf("[INTENT ERROR] Retargeting intent %d: %v\n", id, err)
+	}
+}
@@ -0,0 +1,131 @@
+package filcdn
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ListUploadIntents lists upload intents in state (default needs_attention;
+// "all" for every state), most recently updated first. Admins only.
+func (c *Client) ListUploadIntents(ctx context.Context, state string, limit, offset int) ([]UploadIntent, error) {
+	q := url.Values{}
+	setIf(q, "state", state)
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	var env dataEnvelope[[]UploadIntent]
+	if err := c.get(ctx, "/api/admin/intents", q, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// GetUploadIntent returns one upload intent
+func (c *Client) GetUploadIntent(ctx context.Context, id int64) (*UploadIntent, error) {
+	var env dataEnvelope[UploadIntent]
+	if err := c.get(ctx, pathJoin("api", "admin", "intents", strconv.FormatInt(id, 10)), nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// RetryUploadIntent saves the stored metadata of an intent whose root is in
+// the proof set
+func (c *Client) RetryUploadIntent(ctx context.Context, id int64) (*UploadIntent, error) {
+	var env dataEnvelope[UploadIntent]
+	if err := c.sendJSON(ctx, http.MethodPost, pathJoin("api", "admin", "intents", strconv.FormatInt(id, 10), "retry"), nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// ResolveUploadIntent closes an intent that was handled by hand, recording
+// note
+func (c *Client) ResolveUploadIntent(ctx context.Context, id int64, note string) (*UploadIntent, error) {
+	var env dataEnvelope[UploadIntent]
+	path := pathJoin("api", "admin", "intents", strconv.FormatInt(id, 10), "resolve")
+	if err := c.sendJSON(ctx, http.MethodPost, path, map[string]string{"note": note}, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// ListProviders lists registered providers. Admins only.
+func (c *Client) ListProviders(ctx context.Context) ([]Provider, error) {
+	var env dataEnvelope[[]Provider]
+	if err := c.get(ctx, "/api/admin/providers", nil, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// RegisterProvider registers a provider replicas can be placed on, or
+// updates the one with the same service URL
+func (c *Client) RegisterProvider(ctx context.Context, req ProviderRequest) (*Provider, error) {
+	var env dataEnvelope[Provider]
+	if err := c.sendJSON(ctx, http.MethodPost, "/api/admin/providers", req, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// DeactivateProvider stops placing replicas on a provider
+func (c *Client) DeactivateProvider(ctx context.Context, id int64) (*Provider, error) {
+	var env dataEnvelope[Provider]
+	if err := c.sendJSON(ctx, http.MethodDelete, pathJoin("api", "admin", "providers", strconv.FormatInt(id, 10)), nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// ReplicationPolicies lists the per-type replication policies
+func (c *Client) ReplicationPolicies(ctx context.Context) ([]ReplicationPolicy, error) {
+	var env dataEnvelope[[]ReplicationPolicy]
+	if err := c.get(ctx, "/api/admin/replication-policies", nil, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// SetReplicationPolicy sets how many copies are kept of every record of
+// dataType (paper, genome, spectrum or file)
+func (c *Client) SetReplicationPolicy(ctx context.Context, dataType string, copies int) (*ReplicationPolicy, error) {
+	var env dataEnvelope[ReplicationPolicy]
+	in := map[string]int{"copies": copies}
+	if err := c.sendJSON(ctx, http.MethodPut, pathJoin("api", "admin", "replication-policies", dataType), in, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// PDPQueue reports the pdptool concurrency limits and queue. Admins only.
+func (c *Client) PDPQueue(ctx context.Context) (*PDPQueueStats, error) {
+	var env dataEnvelope[PDPQueueStats]
+	if err := c.get(ctx, "/api/admin/pdp-queue", nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// ListScans lists malware scan audit records, newest first. verdict is
+// clean, infected, error or "" for all. Admins only.
+func (c *Client) ListScans(ctx context.Context, verdict string, limit, offset int) ([]ScanRecord, error) {
+	q := url.Values{}
+	setIf(q, "verdict", verdict)
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	var env dataEnvelope[[]ScanRecord]
+	if err := c.get(ctx, "/api/admin/scans", q, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
@@ -0,0 +1,296 @@
+// Package filcdn is a Go client for the filcdn service REST API.
+//
+//	c := filcdn.NewClient("http://localhost:8080", filcdn.WithAPIKey(key))
+//	page, err := c.QueryGenomes(ctx, filcdn.GenomeQuery{Organism: "human"})
+//
+// Every method takes a context. Requests without a body, or with a body
+// that can be replayed, are retried on network errors, 429 and 5xx
+// responses; uploads stream their content and are never retried.
+package filcdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the service. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	maxRetries int
+	retryWait  time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithAPIKey authenticates requests as the key's tenant
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient replaces http.DefaultClient
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times a failed request is retried and the base
+// wait before the first retry, which doubles on every further attempt
+func WithRetries(max int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = max
+		c.retryWait = wait
+	}
+}
+
+// NewClient returns a client for the service at baseURL
+func NewClient(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		retryWait:  500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// APIError is a non-2xx response from the service. Code and Details are
+// only set by /api/v2 routes.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    map[string]any
+	RequestID  string
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("filcdn: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the service
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+type idempotencyKeyContext struct{}
+
+// WithIdempotencyKey returns a context whose mutating requests carry key as
+// their Idempotency-Key. The service replays the first response to a
+// repeated key, so such requests are also retried on network errors and
+// 5xx. Use a new key for each logical operation.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContext{}).(string)
+	return key
+}
+
+// request is one API call. body is either nil, a []byte (replayable) or an
+// io.Reader (streamed once).
+type request struct {
+	method  string
+	path    string
+	query   url.Values
+	header  http.Header
+	body    any
+	out     any
+	raw     bool // return the open response instead of decoding it
+	retries bool
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, out any) error {
+	_, err := c.do(ctx, request{method: http.MethodGet, path: path, query: query, out: out, retries: true})
+	return err
+}
+
+// sendJSON sends in as a JSON body and decodes the response into out
+func (c *Client) sendJSON(ctx context.Context, method, path string, in, out any) error {
+	var body any
+	header := http.Header{}
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = b
+		header.Set("Content-Type", "application/json")
+	}
+	// Creating requests are only retried with an idempotency key: without
+	// one a lost response would create twice
+	retries := method != http.MethodPost || idempotencyKey(ctx) != ""
+	_, err := c.do(ctx, request{method: method, path: path, header: header, body: body, out: out, retries: retries})
+	return err
+}
+
+func (c *Client) do(ctx context.Context, r request) (*http.Response, error) {
+	u := c.baseURL + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+
+	attempts := 1
+	if r.retries {
+		if _, streamed := r.body.(io.Reader); !streamed {
+			attempts += c.maxRetries
+		}
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if err := sleep(ctx, c.backoff(attempt-1, lastErr)); err != nil {
+				return nil, err
+			}
+		}
+
+		var body io.Reader
+		switch b := r.body.(type) {
+		case []byte:
+			body = bytes.NewReader(b)
+		case io.Reader:
+			body = b
+		}
+		req, err := http.NewRequestWithContext(ctx, r.method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range r.header {
+			req.Header[k] = v
+		}
+		if c.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+		if key := idempotencyKey(ctx); key != "" && r.method != http.MethodGet && r.method != http.MethodHead {
+			req.Header.Set("Idempotency-Key", key)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			lastErr = readAPIError(resp)
+			if retryable(resp.StatusCode) {
+				continue
+			}
+			return nil, lastErr
+		}
+
+		if r.raw {
+			return resp, nil
+		}
+		defer resp.Body.Close()
+		if r.out == nil {
+			io.Copy(io.Discard, resp.Body)
+			return resp, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(r.out); err != nil {
+			return nil, fmt.Errorf("filcdn: decoding %s %s: %w", r.method, r.path, err)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func readAPIError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+		Body:       body,
+	}
+	// /api routes send {"error": "message"}, /api/v2 routes an ErrorResponse
+	var e struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && len(e.Error) > 0 {
+		var msg string
+		var detail ErrorDetail
+		if json.Unmarshal(e.Error, &msg) == nil && msg != "" {
+			apiErr.Message = msg
+		} else if json.Unmarshal(e.Error, &detail) == nil && detail.Message != "" {
+			apiErr.Code, apiErr.Message, apiErr.Details = detail.Code, detail.Message, detail.Details
+			if detail.RequestID != "" {
+				apiErr.RequestID = detail.RequestID
+			}
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			return &retryAfterError{APIError: apiErr, wait: time.Duration(secs) * time.Second}
+		}
+	}
+	return apiErr
+}
+
+// retryAfterError carries the server's Retry-After hint
+type retryAfterError struct {
+	*APIError
+	wait time.Duration
+}
+
+func (e *retryAfterError) Unwrap() error { return e.APIError }
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff is the wait before retry n: the server's Retry-After when given,
+// otherwise exponential with up to 50% jitter
+func (c *Client) backoff(n int, lastErr error) time.Duration {
+	var ra *retryAfterError
+	if errors.As(lastErr, &ra) {
+		return ra.wait
+	}
+	d := c.retryWait << (n - 1)
+	return d/2 + rand.N(d/2+1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// dataEnvelope is the {"data": ...} wrapper most routes respond with
+type dataEnvelope[T any] struct {
+	Data T `json:"data"`
+}
+
+func pathJoin(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = url.PathEscape(p)
+	}
+	return "/" + strings.Join(escaped, "/")
+}
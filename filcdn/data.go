@@ -0,0 +1,215 @@
+package filcdn
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ListOptions are the paging and ordering options shared by every query
+type ListOptions struct {
+	Limit  int    // default 20
+	Offset int    //
+	Sort   string // column, e.g. created_at
+	Order  string // ASC or DESC
+	Search string // free-text search
+}
+
+func (o ListOptions) values() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Offset > 0 {
+		q.Set("offset", strconv.Itoa(o.Offset))
+	}
+	setIf(q, "sort", o.Sort)
+	setIf(q, "order", o.Order)
+	setIf(q, "search", o.Search)
+	return q
+}
+
+func setIf(q url.Values, key, value string) {
+	if value != "" {
+		q.Set(key, value)
+	}
+}
+
+// PaperQuery filters papers
+type PaperQuery struct {
+	ListOptions
+	Year    int
+	Journal string
+	Keyword string
+}
+
+// GenomeQuery filters genomes
+type GenomeQuery struct {
+	ListOptions
+	Organism string
+	Assembly string
+}
+
+// SpectrumQuery filters spectra
+type SpectrumQuery struct {
+	ListOptions
+	Compound  string
+	Technique string
+}
+
+// FileCIDQuery filters file mappings
+type FileCIDQuery struct {
+	ListOptions
+	Verification string // verification status, or "unverified"
+}
+
+// QueryPapers lists papers
+func (c *Client) QueryPapers(ctx context.Context, q PaperQuery) (*Page[Paper], error) {
+	v := q.values()
+	if q.Year != 0 {
+		v.Set("year", strconv.Itoa(q.Year))
+	}
+	setIf(v, "journal", q.Journal)
+	setIf(v, "keyword", q.Keyword)
+	var page Page[Paper]
+	if err := c.get(ctx, "/api/data/paper", v, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// QueryGenomes lists genomes
+func (c *Client) QueryGenomes(ctx context.Context, q GenomeQuery) (*Page[Genome], error) {
+	v := q.values()
+	setIf(v, "organism", q.Organism)
+	setIf(v, "assembly", q.Assembly)
+	var page Page[Genome]
+	if err := c.get(ctx, "/api/data/genome", v, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// QuerySpectra lists spectra
+func (c *Client) QuerySpectra(ctx context.Context, q SpectrumQuery) (*Page[Spectrum], error) {
+	v := q.values()
+	setIf(v, "compound", q.Compound)
+	setIf(v, "technique", q.Technique)
+	var page Page[Spectrum]
+	if err := c.get(ctx, "/api/data/spectrum", v, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// QueryFileCIDs lists filename to CID mappings
+func (c *Client) QueryFileCIDs(ctx context.Context, q FileCIDQuery) (*Page[FileCID], error) {
+	v := q.values()
+	setIf(v, "verification", q.Verification)
+	var page Page[FileCID]
+	if err := c.get(ctx, "/api/data/file_cids", v, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func getRecord[T any](ctx context.Context, c *Client, dataType, cid string) (*T, error) {
+	var env dataEnvelope[T]
+	if err := c.get(ctx, pathJoin("api", "data", dataType, cid), nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// GetPaper returns one paper
+func (c *Client) GetPaper(ctx context.Context, cid string) (*Paper, error) {
+	return getRecord[Paper](ctx, c, "paper", cid)
+}
+
+// GetGenome returns one genome
+func (c *Client) GetGenome(ctx context.Context, cid string) (*Genome, error) {
+	return getRecord[Genome](ctx, c, "genome", cid)
+}
+
+// GetSpectrum returns one spectrum
+func (c *Client) GetSpectrum(ctx context.Context, cid string) (*Spectrum, error) {
+	return getRecord[Spectrum](ctx, c, "spectrum", cid)
+}
+
+// GetFileCID returns the file mapping of a CID
+func (c *Client) GetFileCID(ctx context.Context, cid string) (*FileCID, error) {
+	return getRecord[FileCID](ctx, c, "file_cids", cid)
+}
+
+// History lists the edit history of a record, newest first
+func (c *Client) History(ctx context.Context, dataType, cid string) ([]HistoryEntry, error) {
+	var env dataEnvelope[[]HistoryEntry]
+	if err := c.get(ctx, pathJoin("api", "data", dataType, cid, "history"), nil, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// UpdateRecord sets metadata fields of a record, using the upload form
+// names (title, keywords, organism, assemblyVersion, ...). out receives the
+// updated record and should be a *Paper, *Genome or *Spectrum.
+func (c *Client) UpdateRecord(ctx context.Context, dataType, cid string, fields map[string]any, out any) error {
+	env := dataEnvelope[any]{Data: out}
+	return c.sendJSON(ctx, http.MethodPatch, pathJoin("api", "data", dataType, cid), fields, &env)
+}
+
+// ReplaceField replaces a whole collection field (paper keywords, spectrum
+// metadata). out receives the updated record.
+func (c *Client) ReplaceField(ctx context.Context, dataType, cid, field string, value any, out any) error {
+	env := dataEnvelope[any]{Data: out}
+	return c.sendJSON(ctx, http.MethodPut, pathJoin("api", "data", dataType, cid, field), value, &env)
+}
+
+// DeleteRecord deletes a record's metadata. The stored data is not removed;
+// see ScheduleDeletion for that.
+func (c *Client) DeleteRecord(ctx context.Context, dataType, cid string) error {
+	return c.sendJSON(ctx, http.MethodDelete, pathJoin("api", "data", dataType, cid), nil, nil)
+}
+
+// Content streams a stored file, decrypted when the service holds its key.
+// The caller must close the returned body.
+func (c *Client) Content(ctx context.Context, cid string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: pathJoin("api", "content", cid), raw: true, retries: true})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ListCIDs lists stored filename to CID rows, optionally for one filename
+func (c *Client) ListCIDs(ctx context.Context, filename string) ([]CIDEntry, error) {
+	q := url.Values{}
+	setIf(q, "filename", filename)
+	var entries []CIDEntry
+	if err := c.get(ctx, "/api/cids", q, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Replicas returns the desired and actual copies of a record
+func (c *Client) Replicas(ctx context.Context, dataType, cid string) (*RecordReplicas, error) {
+	var env dataEnvelope[RecordReplicas]
+	if err := c.get(ctx, pathJoin("api", "data", dataType, cid, "replicas"), nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// SetRecordReplication overrides the number of copies kept of one record;
+// missing copies are added in the background
+func (c *Client) SetRecordReplication(ctx context.Context, dataType, cid string, copies int) (*RecordReplicas, error) {
+	var env dataEnvelope[RecordReplicas]
+	in := map[string]int{"copies": copies}
+	if err := c.sendJSON(ctx, http.MethodPut, pathJoin("api", "data", dataType, cid, "replication"), in, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
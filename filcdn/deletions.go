@@ -0,0 +1,54 @@
+package filcdn
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ScheduleDeletion schedules removal of a root and its records. It can be
+// undone until the returned deletion's UndoUntil.
+func (c *Client) ScheduleDeletion(ctx context.Context, req DeletionRequest) (*Deletion, error) {
+	var env dataEnvelope[Deletion]
+	if err := c.sendJSON(ctx, http.MethodPost, "/api/deletions", req, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// ListDeletions lists deletion requests, newest first, optionally only those
+// in status
+func (c *Client) ListDeletions(ctx context.Context, status string, limit, offset int) ([]Deletion, error) {
+	q := url.Values{}
+	setIf(q, "status", status)
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	var env dataEnvelope[[]Deletion]
+	if err := c.get(ctx, "/api/deletions", q, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// GetDeletion returns one deletion request
+func (c *Client) GetDeletion(ctx context.Context, id int) (*Deletion, error) {
+	var env dataEnvelope[Deletion]
+	if err := c.get(ctx, pathJoin("api", "deletions", strconv.Itoa(id)), nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// UndoDeletion cancels a deletion inside its undo window
+func (c *Client) UndoDeletion(ctx context.Context, id int) (*Deletion, error) {
+	var env dataEnvelope[Deletion]
+	if err := c.sendJSON(ctx, http.MethodPost, pathJoin("api", "deletions", strconv.Itoa(id), "undo"), nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
@@ -0,0 +1,99 @@
+package filcdn
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Ping checks that the service can reach a storage provider and returns
+// pdptool's output
+func (c *Client) Ping(ctx context.Context, serviceURL, serviceName string) (string, error) {
+	var res struct {
+		Message string `json:"message"`
+	}
+	in := map[string]string{"serviceUrl": serviceURL, "serviceName": serviceName}
+	if err := c.sendJSON(ctx, http.MethodPost, "/api/ping", in, &res); err != nil {
+		return "", err
+	}
+	return res.Message, nil
+}
+
+// ListProofSets lists the proof sets the service has added roots to
+func (c *Client) ListProofSets(ctx context.Context) ([]ProofSet, error) {
+	var env dataEnvelope[[]ProofSet]
+	if err := c.get(ctx, "/api/proof-sets", nil, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// ProofSetPool lists the caller's pool proof sets, newest first, optionally
+// only those on one provider
+func (c *Client) ProofSetPool(ctx context.Context, serviceURL string) ([]PoolProofSet, error) {
+	q := url.Values{}
+	setIf(q, "serviceUrl", serviceURL)
+	var env dataEnvelope[[]PoolProofSet]
+	if err := c.get(ctx, "/api/proof-sets/pool", q, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// CreateProofSet starts creating a proof set and returns pdptool's output,
+// which includes the transaction hash to poll with ProofSetStatus
+func (c *Client) CreateProofSet(ctx context.Context, serviceURL, serviceName, recordKeeper string) (string, error) {
+	var res struct {
+		Output string `json:"output"`
+	}
+	in := map[string]string{"serviceUrl": serviceURL, "serviceName": serviceName, "recordkeeper": recordKeeper}
+	if err := c.sendJSON(ctx, http.MethodPost, "/api/proof-sets", in, &res); err != nil {
+		return "", err
+	}
+	return res.Output, nil
+}
+
+// ProofSetStatus returns the creation status of a proof set as printed by
+// pdptool
+func (c *Client) ProofSetStatus(ctx context.Context, txHash, serviceURL, serviceName string) (string, error) {
+	var res struct {
+		Status string `json:"status"`
+	}
+	q := url.Values{"serviceUrl": {serviceURL}, "serviceName": {serviceName}}
+	if err := c.get(ctx, pathJoin("api", "proof-sets", txHash, "status"), q, &res); err != nil {
+		return "", err
+	}
+	return res.Status, nil
+}
+
+// AddRoot adds an uploaded root to a proof set and returns pdptool's output
+func (c *Client) AddRoot(ctx context.Context, serviceURL, serviceName, proofSetID, rootCID string) (string, error) {
+	var res struct {
+		Message string `json:"message"`
+	}
+	in := map[string]string{"serviceUrl": serviceURL, "serviceName": serviceName, "root": rootCID}
+	path := pathJoin("api", "proof-sets", proofSetID, "roots")
+	if err := c.sendJSON(ctx, http.MethodPost, path, in, &res); err != nil {
+		return "", err
+	}
+	return res.Message, nil
+}
+
+// ProofSetHealth returns the latest health sample of a provider's proof set
+// and its samples since since (zero for all that are kept), newest first
+func (c *Client) ProofSetHealth(ctx context.Context, serviceURL, proofSetID string, since time.Time, limit int) (*ProofSetHealth, error) {
+	q := url.Values{"serviceUrl": {serviceURL}}
+	if !since.IsZero() {
+		q.Set("since", since.UTC().Format(time.RFC3339))
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var env dataEnvelope[ProofSetHealth]
+	if err := c.get(ctx, pathJoin("api", "proof-sets", proofSetID, "health"), q, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
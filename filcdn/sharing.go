@@ -0,0 +1,72 @@
+package filcdn
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// RegisterPublicKey registers a user's base64 X25519 public key for the
+// caller's tenant
+func (c *Client) RegisterPublicKey(ctx context.Context, user, publicKey string) (*PublicKey, error) {
+	var res PublicKey
+	in := map[string]string{"publicKey": publicKey}
+	if err := c.sendJSON(ctx, http.MethodPut, pathJoin("api", "users", user, "public-key"), in, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetPublicKey returns a user's public key. An empty tenant means the
+// caller's own.
+func (c *Client) GetPublicKey(ctx context.Context, tenant, user string) (*PublicKey, error) {
+	q := url.Values{}
+	setIf(q, "tenant", tenant)
+	var res PublicKey
+	if err := c.get(ctx, pathJoin("api", "users", user, "public-key"), q, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RegisterEncryption records that a record was encrypted client-side with
+// algorithm, optionally with key grants for initial recipients
+func (c *Client) RegisterEncryption(ctx context.Context, cid, algorithm string, recipients []Recipient) error {
+	in := map[string]any{"algorithm": algorithm, "recipients": recipients}
+	return c.sendJSON(ctx, http.MethodPost, pathJoin("api", "records", cid, "encryption"), in, nil)
+}
+
+// ShareRecord grants a recipient access to a record's data key. For
+// server-side encrypted records leave WrappedKey empty and the service wraps
+// the key for the recipient's registered public key.
+func (c *Client) ShareRecord(ctx context.Context, cid string, r Recipient) error {
+	return c.sendJSON(ctx, http.MethodPost, pathJoin("api", "records", cid, "recipients"), r, nil)
+}
+
+// ListRecipients lists everyone a record has been shared with
+func (c *Client) ListRecipients(ctx context.Context, cid string) ([]KeyGrant, error) {
+	var env dataEnvelope[[]KeyGrant]
+	if err := c.get(ctx, pathJoin("api", "records", cid, "recipients"), nil, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// RevokeRecipient revokes a recipient's grant. An empty tenant means the
+// caller's own.
+func (c *Client) RevokeRecipient(ctx context.Context, cid, tenant, user string) error {
+	path := pathJoin("api", "records", cid, "recipients", user)
+	if tenant != "" {
+		path += "?" + url.Values{"tenant": {tenant}}.Encode()
+	}
+	return c.sendJSON(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// WrappedKey returns the caller's wrapped copy of a record's data key
+func (c *Client) WrappedKey(ctx context.Context, cid, user string) (*WrappedKey, error) {
+	var res WrappedKey
+	if err := c.get(ctx, pathJoin("api", "records", cid, "keys", user), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
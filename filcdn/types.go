@@ -0,0 +1,500 @@
+package filcdn
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Paper is a paper record. JSON field names match the service responses.
+type Paper struct {
+	CID       string     `json:"cid"`
+	Title     string     `json:"title"`
+	Journal   *string    `json:"journal"`
+	Year      *int       `json:"year"`
+	Keywords  []string   `json:"keywords"`
+	Facts     *FileFacts `json:"facts"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// Genome is a genome record
+type Genome struct {
+	CID             string     `json:"cid"`
+	Organism        string     `json:"organism"`
+	AssemblyVersion *string    `json:"assembly_version"`
+	Notes           *string    `json:"notes"`
+	Facts           *FileFacts `json:"facts"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       *time.Time `json:"updated_at"`
+}
+
+// Spectrum is a spectrum record. Metadata is the free-form JSON supplied at
+// upload, or null.
+type Spectrum struct {
+	CID       string          `json:"cid"`
+	Compound  string          `json:"compound"`
+	Technique *string         `json:"technique"`
+	Metadata  json.RawMessage `json:"metadata"`
+	Facts     *FileFacts      `json:"facts"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt *time.Time      `json:"updated_at"`
+}
+
+// FileFacts describes the bytes received for a record: the filename the
+// client sent, the size, the MIME type detected from the content and the
+// SHA-256. With server-side encryption they describe the plaintext. Records
+// uploaded before facts were kept have none (null).
+type FileFacts struct {
+	OriginalName string `json:"original_name"`
+	Size         int64  `json:"size_bytes"`
+	MIMEType     string `json:"mime_type"`
+	SHA256       string `json:"sha256"`
+}
+
+// FileCID maps an uploaded filename to its root CID
+type FileCID struct {
+	ID         int        `json:"id"`
+	Filename   string     `json:"filename"`
+	CID        string     `json:"cid"`
+	ProofSetID *string    `json:"proof_set_id"`
+	UploadedAt time.Time  `json:"uploaded_at"`
+	Facts      *FileFacts `json:"facts"`
+
+	// Set by the background verifier. VerificationStatus is verified,
+	// missing, not_proving, unretrievable or error; nil until first checked.
+	LastVerifiedAt     *time.Time `json:"last_verified_at"`
+	VerificationStatus *string    `json:"verification_status"`
+	VerificationError  *string    `json:"verification_error"`
+}
+
+// Pagination describes one page of a query result
+type Pagination struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	Count  int `json:"count"`
+}
+
+// Sort is the ordering a query result was returned in
+type Sort struct {
+	By    string `json:"by"`
+	Order string `json:"order"`
+}
+
+// Page is one page of records returned by a query
+type Page[T any] struct {
+	Data       []T        `json:"data"`
+	Pagination Pagination `json:"pagination"`
+	Sort       Sort       `json:"sort"`
+}
+
+// HistoryEntry is one edit of a record's metadata. Previous is the full
+// record before the edit; Changes holds the fields the edit set.
+type HistoryEntry struct {
+	ID       int             `json:"id"`
+	Action   string          `json:"action"` // update, replace or delete
+	Previous json.RawMessage `json:"previous"`
+	Changes  json.RawMessage `json:"changes"`
+	EditedAt time.Time       `json:"edited_at"`
+}
+
+// CIDEntry is a row of the legacy GET /api/cids listing
+type CIDEntry struct {
+	Filename   string    `json:"filename"`
+	CID        string    `json:"cid"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// ProofSet is a proof set the service has added roots to
+type ProofSet struct {
+	ProofSetID  string    `json:"proofSetID"`
+	ServiceURL  string    `json:"serviceUrl"`
+	ServiceName string    `json:"serviceName"`
+	Roots       int       `json:"roots"`
+	LastUpload  time.Time `json:"lastUpload"`
+}
+
+// ProofSetHealth is the proving state of a proof set over time
+type ProofSetHealth struct {
+	ProofSetID string                 `json:"proofSetID"`
+	Latest     *ProofSetHealthSample  `json:"latest"`
+	Samples    []ProofSetHealthSample `json:"samples"` // newest first
+}
+
+// ProofSetHealthSample is one check of a proof set. Epochs and faults are nil
+// when the provider did not report them.
+type ProofSetHealthSample struct {
+	CheckedAt          time.Time `json:"checkedAt"`
+	Status             string    `json:"status"` // healthy, faulted, missed_deadline, not_proving or error
+	CurrentEpoch       int64     `json:"currentEpoch"`
+	NextChallengeEpoch *int64    `json:"nextChallengeEpoch"`
+	LastProvenEpoch    *int64    `json:"lastProvenEpoch"`
+	FaultedRoots       *int      `json:"faultedRoots"`
+	Roots              int       `json:"roots"`
+	Error              *string   `json:"error"`
+}
+
+// PoolProofSet is a proof set in a tenant's pool for a provider. Uploads
+// without a proofSetID are placed in an active one; ProofSetID and TxHash
+// are nil until creation gets that far.
+type PoolProofSet struct {
+	ID          int64     `json:"id"`
+	Tenant      string    `json:"tenant"`
+	ServiceURL  string    `json:"serviceUrl"`
+	ServiceName string    `json:"serviceName"`
+	ProofSetID  *string   `json:"proofSetID"`
+	TxHash      *string   `json:"txHash"`
+	Status      string    `json:"status"` // creating, active, full or failed
+	Roots       int       `json:"roots"`
+	Bytes       int64     `json:"bytes"`
+	LastError   *string   `json:"lastError"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// UploadResult is the response to a single typed upload. Only the fields of
+// the uploaded type are set.
+type UploadResult struct {
+	ProofSetID string `json:"proofSetID"`
+	ServiceURL string `json:"serviceUrl"` // differs from the request's after failover
+	RootCID    string `json:"rootCID"`
+	Encrypted  bool   `json:"encrypted"`
+
+	Title    string   `json:"title,omitempty"`
+	Journal  string   `json:"journal,omitempty"`
+	Year     *int     `json:"year,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+
+	Organism        string `json:"organism,omitempty"`
+	AssemblyVersion string `json:"assemblyVersion,omitempty"`
+	Notes           string `json:"notes,omitempty"`
+
+	Compound  string          `json:"compound,omitempty"`
+	Technique string          `json:"technique,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+}
+
+// RootUploadResult is the response of the legacy upload-and-add-root route
+type RootUploadResult struct {
+	ProofSetID  string `json:"proofSetID"`
+	ServiceURL  string `json:"serviceUrl"` // differs from the request's after failover
+	RootCID     string `json:"rootCID"`
+	AddRoots    string `json:"addRoots"`
+	IsEncrypted bool   `json:"isEncrypted"`
+}
+
+// OrchestrateResult is the response of the combined /api/pdp flow
+type OrchestrateResult struct {
+	TxHash     string     `json:"txHash"`
+	ProofSetID string     `json:"proofSetID"`
+	RootCID    string     `json:"rootCID"`
+	AddRoots   string     `json:"addRoots"`
+	Facts      *FileFacts `json:"facts"`
+}
+
+// BatchManifestEntry is the metadata of one file in a batch upload, matched
+// to the file by Filename
+type BatchManifestEntry struct {
+	Filename string `json:"filename"`
+
+	Title    string   `json:"title,omitempty"`
+	Journal  string   `json:"journal,omitempty"`
+	Year     *int     `json:"year,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+
+	Organism        string `json:"organism,omitempty"`
+	AssemblyVersion string `json:"assemblyVersion,omitempty"`
+	Notes           string `json:"notes,omitempty"`
+
+	Compound  string          `json:"compound,omitempty"`
+	Technique string          `json:"technique,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+}
+
+// BatchFileResult is the outcome of one file of a batch upload
+type BatchFileResult struct {
+	Filename string `json:"filename"`
+	RootCID  string `json:"rootCID,omitempty"`
+	Status   string `json:"status"` // added, upload_failed, quarantined, add_roots_failed, db_failed
+	Error    string `json:"error,omitempty"`
+}
+
+// BatchResult is the response of a batch upload
+type BatchResult struct {
+	ProofSetID string            `json:"proofSetID"`
+	Total      int               `json:"total"`
+	Added      int               `json:"added"`
+	Failed     int               `json:"failed"`
+	Results    []BatchFileResult `json:"results"`
+}
+
+// ResumableUpload is the state of a tus upload
+type ResumableUpload struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Filename string            `json:"filename"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata"`
+	Status   string            `json:"status"` // uploading, processing, completed, failed
+	RootCID  *string           `json:"rootCID"`
+	Error    *string           `json:"error"`
+}
+
+// ProgressEvent is one stage of an upload's progress stream
+type ProgressEvent struct {
+	Stage       string    `json:"stage"`
+	Bytes       int64     `json:"bytes,omitempty"`
+	Total       int64     `json:"total,omitempty"`
+	Attempt     int       `json:"attempt,omitempty"`
+	MaxAttempts int       `json:"maxAttempts,omitempty"`
+	RootCID     string    `json:"rootCID,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// Terminal reports whether the event ends the stream
+func (e ProgressEvent) Terminal() bool {
+	return e.Stage == "completed" || e.Stage == "failed"
+}
+
+// Deletion is a root removal request and its lifecycle state
+type Deletion struct {
+	ID                 int        `json:"id"`
+	CID                string     `json:"cid"`
+	ProofSetID         string     `json:"proofSetID"`
+	ServiceURL         string     `json:"serviceUrl"`
+	ServiceName        string     `json:"serviceName"`
+	RootID             *string    `json:"rootId"`
+	Status             string     `json:"status"` // scheduled, cancelled, removing, deleted, purged, failed
+	Attempts           int        `json:"attempts"`
+	LastError          *string    `json:"lastError"`
+	RequestedAt        time.Time  `json:"requestedAt"`
+	UndoUntil          time.Time  `json:"undoUntil"`
+	RemovalSubmittedAt *time.Time `json:"removalSubmittedAt"`
+	ConfirmedAt        *time.Time `json:"confirmedAt"`
+	PurgeAfter         *time.Time `json:"purgeAfter"`
+	PurgedAt           *time.Time `json:"purgedAt"`
+}
+
+// DeletionRequest schedules removal of a root. The proof set and service
+// default to the ones recorded at upload time.
+type DeletionRequest struct {
+	CID         string `json:"cid"`
+	ProofSetID  string `json:"proofSetID,omitempty"`
+	ServiceURL  string `json:"serviceUrl,omitempty"`
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+// UploadIntent tracks one upload from before the file reaches the provider
+// until its metadata is saved. Intents that could not be completed
+// automatically are listed for admins with state needs_attention.
+type UploadIntent struct {
+	ID          int64           `json:"id"`
+	Tenant      string          `json:"tenant"`
+	DataType    string          `json:"dataType"` // paper, genome, spectrum or file
+	Source      string          `json:"source"`   // upload, batch, tus, legacy or reconciler
+	SourceRef   *string         `json:"sourceRef"`
+	Filename    string          `json:"filename"`
+	ProofSetID  *string         `json:"proofSetID"`
+	ServiceURL  *string         `json:"serviceUrl"`
+	ServiceName *string         `json:"serviceName"`
+	Metadata    json.RawMessage `json:"metadata"`
+	RootCID     *string         `json:"rootCID"`
+	Encrypted   bool            `json:"encrypted"`
+	State       string          `json:"state"` // pending, uploaded, root_added, completed, failed, needs_attention, resolved
+	Attempts    int             `json:"attempts"`
+	LastError   *string         `json:"lastError"`
+	Resolution  *string         `json:"resolution"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// Provider is a registered storage provider that replicas can be placed on
+type Provider struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	ServiceURL  string    `json:"serviceUrl"`
+	ServiceName string    `json:"serviceName"`
+	ProofSetID  string    `json:"proofSetID"` // proof set replica roots are added to
+	Active      bool      `json:"active"`
+	Circuit     string    `json:"circuit"` // upload circuit breaker: closed, open or half_open
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// PDPQueueStats describes the pdptool concurrency limits and the commands
+// running and waiting under them. Limits holds the per-command limits,
+// "default" for commands not listed and "perProvider". Waits are measured
+// from queueing to starting, over every command admitted since Since.
+type PDPQueueStats struct {
+	Queued            int            `json:"queued"`
+	QueueCapacity     int            `json:"queueCapacity"`
+	QueuedByTenant    map[string]int `json:"queuedByTenant"`
+	QueuedByCommand   map[string]int `json:"queuedByCommand"`
+	Running           map[string]int `json:"running"` // by command
+	RunningByProvider map[string]int `json:"runningByProvider"`
+	Limits            map[string]int `json:"limits"`
+	Admitted          int64          `json:"admitted"`
+	Rejected          int64          `json:"rejected"` // turned away with 429 because the queue was full
+	AvgWaitMs         int64          `json:"avgWaitMs"`
+	MaxWaitMs         int64          `json:"maxWaitMs"`
+	Since             time.Time      `json:"since"`
+}
+
+// ScanRecord is the audit record of a malware scan of an upload. Verdict is
+// clean, infected or error; Action is what happened to the upload: stored,
+// quarantined, rejected (the scanner failed and the policy is fail-closed)
+// or allowed (it failed and the policy is fail-open).
+type ScanRecord struct {
+	ID             int64     `json:"id"`
+	Tenant         string    `json:"tenant"`
+	DataType       string    `json:"dataType"`
+	Filename       string    `json:"filename"`
+	Size           int64     `json:"size"`
+	SHA256         string    `json:"sha256,omitempty"`
+	Scanner        string    `json:"scanner"`
+	Verdict        string    `json:"verdict"`
+	Signature      string    `json:"signature,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Action         string    `json:"action"`
+	QuarantinePath string    `json:"quarantinePath,omitempty"`
+	ScannedAt      time.Time `json:"scannedAt"`
+}
+
+// ProviderRequest registers a provider
+type ProviderRequest struct {
+	Name        string `json:"name"`
+	ServiceURL  string `json:"serviceUrl"`
+	ServiceName string `json:"serviceName"`
+	ProofSetID  string `json:"proofSetID"`
+}
+
+// ReplicationPolicy is the number of copies kept of every record of a data
+// type (paper, genome, spectrum or file)
+type ReplicationPolicy struct {
+	DataType string `json:"dataType"`
+	Copies   int    `json:"copies"`
+}
+
+// RecordReplicas is the desired and actual copies of one record
+type RecordReplicas struct {
+	CID      string    `json:"cid"`
+	Copies   int       `json:"copies"` // desired
+	Source   string    `json:"source"` // record or type: where Copies comes from
+	Stored   int       `json:"stored"`
+	Replicas []Replica `json:"replicas"`
+}
+
+// Replica is one copy of a record on one provider
+type Replica struct {
+	ServiceURL  string    `json:"serviceUrl"`
+	ServiceName string    `json:"serviceName"`
+	ProofSetID  string    `json:"proofSetID"`
+	RootCID     string    `json:"rootCID"`
+	Primary     bool      `json:"primary"`
+	Status      string    `json:"status"` // uploaded, stored or failed; removing or removed once deleted
+	Attempts    int       `json:"attempts"`
+	LastError   *string   `json:"lastError"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// PublicKey is a user's registered X25519 public key
+type PublicKey struct {
+	Tenant         string `json:"tenant"`
+	User           string `json:"user"`
+	PublicKey      string `json:"publicKey,omitempty"` // base64
+	KeyFingerprint string `json:"keyFingerprint"`
+}
+
+// Recipient is a wrapped data key for one recipient of a client-side
+// encrypted record
+type Recipient struct {
+	Tenant        string `json:"tenant,omitempty"`
+	User          string `json:"user"`
+	WrapAlgorithm string `json:"wrapAlgorithm,omitempty"`
+	WrappedKey    string `json:"wrappedKey,omitempty"` // base64
+}
+
+// KeyGrant is a recipient's access to a record's data key
+type KeyGrant struct {
+	RecipientTenant string     `json:"recipientTenant"`
+	RecipientUser   string     `json:"recipientUser"`
+	Algorithm       string     `json:"algorithm"`
+	KeyFingerprint  string     `json:"keyFingerprint"`
+	WrappedKey      string     `json:"wrappedKey,omitempty"`
+	GrantedAt       time.Time  `json:"grantedAt"`
+	RevokedAt       *time.Time `json:"revokedAt"`
+}
+
+// WrappedKey is the caller's wrapped copy of a record's data key. For
+// server-side encrypted records (AES-256-GCM-STREAM) it carries the envelope
+// parameters: the content is ChunkSize-byte plaintext chunks, each sealed
+// with the nonce NoncePrefix (7) || chunk counter (4, big endian) || 1 for
+// the last chunk, else 0.
+type WrappedKey struct {
+	Data                KeyGrant `json:"data"`
+	EncryptionAlgorithm string   `json:"encryptionAlgorithm"`
+	NoncePrefix         string   `json:"noncePrefix,omitempty"` // base64
+	ChunkSize           int      `json:"chunkSize,omitempty"`
+	PlaintextSize       int64    `json:"plaintextSize,omitempty"`
+}
+
+// Webhook is a webhook subscription. Secret is only returned on creation.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one delivery of an event to a subscription
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	EventID        int64      `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"` // pending, delivered, failed, cancelled
+	Attempts       int        `json:"attempts"`
+	LastStatusCode *int       `json:"last_status_code"`
+	LastError      *string    `json:"last_error"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// WebhookDeliveryDetail is a delivery with its payload and every attempt
+type WebhookDeliveryDetail struct {
+	ID        int64                    `json:"id"`
+	Status    string                   `json:"status"`
+	EventID   int64                    `json:"event_id"`
+	EventType string                   `json:"event_type"`
+	EventData json.RawMessage          `json:"event_data"`
+	Attempts  []WebhookDeliveryAttempt `json:"attempts"`
+}
+
+// WebhookDeliveryAttempt is one HTTP attempt of a delivery
+type WebhookDeliveryAttempt struct {
+	Attempt      int       `json:"attempt"`
+	StatusCode   *int      `json:"status_code"`
+	Error        *string   `json:"error"`
+	ResponseBody *string   `json:"response_body"` // status line only, e.g. "404 Not Found"
+	DurationMs   int       `json:"duration_ms"`
+	AttemptedAt  time.Time `json:"attempted_at"`
+}
+
+// ErrorResponse is the body of every /api/v2 error
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes a failed /api/v2 request. Code is machine-readable
+// (e.g. "not_found", "pdptool_failed"); RequestID matches the X-Request-ID
+// response header and the server logs.
+type ErrorDetail struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"requestId"`
+}
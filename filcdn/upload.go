@@ -0,0 +1,406 @@
+package filcdn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Target is the storage provider and proof set an upload goes to. Without
+// a ProofSetID the service picks one from the caller's pool for ServiceURL.
+type Target struct {
+	ServiceURL  string
+	ServiceName string
+	ProofSetID  string
+}
+
+// File is content to upload. Content is streamed and read once.
+type File struct {
+	Name    string
+	Content io.Reader
+}
+
+// UploadOptions are optional settings shared by uploads
+type UploadOptions struct {
+	// Encryption "server" encrypts with the tenant's key before storing
+	Encryption string
+	// UploadID lets the upload be followed with Progress
+	UploadID string
+	// SkipFormatCheck stores typed uploads in any format (admins only)
+	SkipFormatCheck bool
+}
+
+// PaperUpload is the metadata of an uploaded paper
+type PaperUpload struct {
+	Title    string
+	Journal  string
+	Year     int
+	Keywords []string
+}
+
+// GenomeUpload is the metadata of an uploaded genome
+type GenomeUpload struct {
+	Organism        string
+	AssemblyVersion string
+	Notes           string
+}
+
+// SpectrumUpload is the metadata of an uploaded spectrum
+type SpectrumUpload struct {
+	Compound  string
+	Technique string
+	Metadata  json.RawMessage
+}
+
+// UploadPaper uploads a paper and adds it to the target proof set
+func (c *Client) UploadPaper(ctx context.Context, t Target, meta PaperUpload, f File, opts UploadOptions) (*UploadResult, error) {
+	fields := t.fields(opts)
+	fields["title"] = meta.Title
+	fields["journal"] = meta.Journal
+	if meta.Year != 0 {
+		fields["year"] = strconv.Itoa(meta.Year)
+	}
+	fields["keywords"] = strings.Join(meta.Keywords, ",")
+	return c.uploadTyped(ctx, "/api/upload/paper", fields, f, opts)
+}
+
+// UploadGenome uploads a genome and adds it to the target proof set
+func (c *Client) UploadGenome(ctx context.Context, t Target, meta GenomeUpload, f File, opts UploadOptions) (*UploadResult, error) {
+	fields := t.fields(opts)
+	fields["organism"] = meta.Organism
+	fields["assemblyVersion"] = meta.AssemblyVersion
+	fields["notes"] = meta.Notes
+	return c.uploadTyped(ctx, "/api/upload/genome", fields, f, opts)
+}
+
+// UploadSpectrum uploads a spectrum and adds it to the target proof set
+func (c *Client) UploadSpectrum(ctx context.Context, t Target, meta SpectrumUpload, f File, opts UploadOptions) (*UploadResult, error) {
+	fields := t.fields(opts)
+	fields["compound"] = meta.Compound
+	fields["technique"] = meta.Technique
+	fields["metadata"] = string(meta.Metadata)
+	return c.uploadTyped(ctx, "/api/upload/spectrum", fields, f, opts)
+}
+
+func (c *Client) uploadTyped(ctx context.Context, path string, fields map[string]string, f File, opts UploadOptions) (*UploadResult, error) {
+	var res UploadResult
+	if err := c.postMultipart(ctx, path, fields, "file", []File{f}, opts.UploadID, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UploadBatch uploads several files of one type with a single add-roots
+// call. Each manifest entry is matched to a file by name. Partial failures
+// are reported per file in the result, not as an error.
+func (c *Client) UploadBatch(ctx context.Context, dataType string, t Target, manifest []BatchManifestEntry, files []File, opts UploadOptions) (*BatchResult, error) {
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	fields := t.fields(opts)
+	fields["manifest"] = string(m)
+
+	var res BatchResult
+	err = c.postMultipart(ctx, pathJoin("api", "upload", dataType, "batch"), fields, "files", files, opts.UploadID, &res)
+	// 207 and a failed batch both carry per-file results
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && len(apiErr.Body) > 0 && json.Unmarshal(apiErr.Body, &res) == nil && res.Results != nil {
+		return &res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UploadAndAddRoot uploads an untyped file and adds it to the proof set
+// (legacy /api/proofset/upload-and-add-root)
+func (c *Client) UploadAndAddRoot(ctx context.Context, t Target, f File, opts UploadOptions) (*RootUploadResult, error) {
+	var res RootUploadResult
+	if err := c.postMultipart(ctx, "/api/proofset/upload-and-add-root", t.fields(opts), "file", []File{f}, opts.UploadID, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UploadFile uploads a file without adding it to a proof set and returns
+// pdptool's output (legacy /api/upload)
+func (c *Client) UploadFile(ctx context.Context, serviceURL, serviceName string, f File) (string, error) {
+	var res struct {
+		Output string `json:"output"`
+	}
+	fields := map[string]string{"serviceUrl": serviceURL, "serviceName": serviceName}
+	if err := c.postMultipart(ctx, "/api/upload", fields, "file", []File{f}, "", &res); err != nil {
+		return "", err
+	}
+	return res.Output, nil
+}
+
+// Orchestrate creates a proof set, waits for it, uploads the file and adds
+// it as a root in one call (/api/pdp)
+func (c *Client) Orchestrate(ctx context.Context, serviceURL, serviceName, recordKeeper string, f File) (*OrchestrateResult, error) {
+	fields := map[string]string{"serviceUrl": serviceURL, "serviceName": serviceName, "recordkeeper": recordKeeper}
+	var res OrchestrateResult
+	if err := c.postMultipart(ctx, "/api/pdp", fields, "file", []File{f}, "", &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (t Target) fields(opts UploadOptions) map[string]string {
+	fields := map[string]string{
+		"serviceUrl":  t.ServiceURL,
+		"serviceName": t.ServiceName,
+		"proofSetID":  t.ProofSetID,
+		"encryption":  opts.Encryption,
+	}
+	if opts.SkipFormatCheck {
+		fields["skipFormatCheck"] = "true"
+	}
+	return fields
+}
+
+// postMultipart streams fields and files as multipart/form-data, each file
+// in a part named part
+func (c *Client) postMultipart(ctx context.Context, path string, fields map[string]string, part string, files []File, uploadID string, out any) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMultipart(mw, fields, part, files))
+	}()
+	defer pr.Close()
+
+	header := http.Header{}
+	header.Set("Content-Type", mw.FormDataContentType())
+	if uploadID != "" {
+		header.Set("X-Upload-ID", uploadID)
+	}
+	_, err := c.do(ctx, request{method: http.MethodPost, path: path, header: header, body: io.Reader(pr), out: out})
+	return err
+}
+
+func writeMultipart(mw *multipart.Writer, fields map[string]string, part string, files []File) error {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if fields[k] == "" {
+			continue
+		}
+		if err := mw.WriteField(k, fields[k]); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		w, err := mw.CreateFormFile(part, f.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, f.Content); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// ResumableUploadOptions describes a new tus upload
+type ResumableUploadOptions struct {
+	Type     string // paper, genome or spectrum
+	Filename string
+	Target   Target
+	// Metadata holds the record fields, e.g. title or organism
+	Metadata map[string]string
+	// ChunkSize is the size of each PATCH; default 8 MiB
+	ChunkSize int64
+}
+
+// CreateResumableUpload starts a tus upload of length bytes and returns its ID
+func (c *Client) CreateResumableUpload(ctx context.Context, length int64, opts ResumableUploadOptions) (string, error) {
+	meta := map[string]string{
+		"type":        opts.Type,
+		"filename":    opts.Filename,
+		"serviceUrl":  opts.Target.ServiceURL,
+		"serviceName": opts.Target.ServiceName,
+		"proofSetID":  opts.Target.ProofSetID,
+	}
+	for k, v := range opts.Metadata {
+		meta[k] = v
+	}
+	var pairs []string
+	for k, v := range meta {
+		if v != "" {
+			pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+		}
+	}
+	sort.Strings(pairs)
+
+	header := tusHeader()
+	header.Set("Upload-Length", strconv.FormatInt(length, 10))
+	header.Set("Upload-Metadata", strings.Join(pairs, ","))
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: "/api/tus/", header: header})
+	if err != nil {
+		return "", err
+	}
+	loc := resp.Header.Get("Location")
+	id := loc[strings.LastIndex(loc, "/")+1:]
+	if id == "" {
+		return "", errors.New("filcdn: tus create returned no Location")
+	}
+	return id, nil
+}
+
+// ResumableUploadOffset returns how many bytes of a tus upload the server has
+func (c *Client) ResumableUploadOffset(ctx context.Context, id string) (int64, error) {
+	resp, err := c.do(ctx, request{method: http.MethodHead, path: pathJoin("api", "tus", id), header: tusHeader(), retries: true})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// ResumeUpload sends the rest of a tus upload from r, starting at the offset
+// the server reports. r must support seeking so an interrupted upload can
+// pick up where the server left off; after an error, call it again.
+func (c *Client) ResumeUpload(ctx context.Context, id string, r io.ReadSeeker, chunkSize int64) error {
+	if chunkSize <= 0 {
+		chunkSize = 8 << 20
+	}
+	offset, err := c.ResumableUploadOffset(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n == 0 {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+
+		header := tusHeader()
+		header.Set("Content-Type", "application/offset+octet-stream")
+		header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		resp, perr := c.do(ctx, request{method: http.MethodPatch, path: pathJoin("api", "tus", id), header: header, body: buf[:n]})
+		if perr != nil {
+			return perr
+		}
+		if offset, perr = strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64); perr != nil {
+			return fmt.Errorf("filcdn: bad Upload-Offset in response: %w", perr)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// UploadResumable uploads r with the tus protocol, creating the upload and
+// sending it in chunks. The returned ID can be passed to ResumeUpload if the
+// call fails part way, and to ResumableUploadStatus to follow processing.
+func (c *Client) UploadResumable(ctx context.Context, r io.ReadSeeker, length int64, opts ResumableUploadOptions) (string, error) {
+	id, err := c.CreateResumableUpload(ctx, length, opts)
+	if err != nil {
+		return "", err
+	}
+	return id, c.ResumeUpload(ctx, id, r, opts.ChunkSize)
+}
+
+// ResumableUploadStatus returns the state of a tus upload, including the
+// root CID once it has been stored
+func (c *Client) ResumableUploadStatus(ctx context.Context, id string) (*ResumableUpload, error) {
+	var env dataEnvelope[ResumableUpload]
+	_, err := c.do(ctx, request{method: http.MethodGet, path: pathJoin("api", "tus", id), header: tusHeader(), out: &env, retries: true})
+	if err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// CancelResumableUpload terminates a tus upload that has not been stored
+func (c *Client) CancelResumableUpload(ctx context.Context, id string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: pathJoin("api", "tus", id), header: tusHeader(), retries: true})
+	return err
+}
+
+// TusOptions returns the server's tus capabilities (Tus-Version,
+// Tus-Extension, Tus-Max-Size headers)
+func (c *Client) TusOptions(ctx context.Context) (http.Header, error) {
+	resp, err := c.do(ctx, request{method: http.MethodOptions, path: "/api/tus/", retries: true})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Header, nil
+}
+
+func tusHeader() http.Header {
+	h := http.Header{}
+	h.Set("Tus-Resumable", "1.0.0")
+	return h
+}
+
+// Progress follows the progress stream of an upload started with
+// UploadOptions.UploadID. It may be called before the upload starts. The
+// channel is closed after the terminal event or when ctx is cancelled.
+func (c *Client) Progress(ctx context.Context, uploadID string) (<-chan ProgressEvent, error) {
+	header := http.Header{}
+	header.Set("Accept", "text/event-stream")
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: pathJoin("api", "uploads", uploadID, "events"), header: header, raw: true, retries: true})
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan ProgressEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		var data bytes.Buffer
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			if v, ok := strings.CutPrefix(line, "data:"); ok {
+				data.WriteString(strings.TrimPrefix(v, " "))
+				continue
+			}
+			if line != "" || data.Len() == 0 {
+				continue
+			}
+			var e ProgressEvent
+			err := json.Unmarshal(data.Bytes(), &e)
+			data.Reset()
+			if err != nil || e.Stage == "" { // heartbeats
+				continue
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+			if e.Terminal() {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
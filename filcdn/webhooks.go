@@ -0,0 +1,108 @@
+package filcdn
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CreateWebhook subscribes url to events (all events when empty). The
+// returned Secret signs deliveries; when secret is empty one is generated.
+func (c *Client) CreateWebhook(ctx context.Context, url string, events []string, secret string) (*Webhook, error) {
+	in := map[string]any{"url": url, "events": events, "secret": secret}
+	var res Webhook
+	if err := c.sendJSON(ctx, http.MethodPost, "/api/webhooks", in, &res); err != nil {
+		return nil, err
+	}
+	res.Active = true
+	return &res, nil
+}
+
+// ListWebhooks lists the caller's subscriptions
+func (c *Client) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	var env dataEnvelope[[]Webhook]
+	if err := c.get(ctx, "/api/webhooks", nil, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// DeleteWebhook deactivates a subscription and cancels its pending deliveries
+func (c *Client) DeleteWebhook(ctx context.Context, id int) error {
+	return c.sendJSON(ctx, http.MethodDelete, pathJoin("api", "webhooks", strconv.Itoa(id)), nil, nil)
+}
+
+// ListDeliveries lists a subscription's deliveries, newest first,
+// optionally only those in status
+func (c *Client) ListDeliveries(ctx context.Context, webhookID int, status string, limit, offset int) ([]WebhookDelivery, error) {
+	q := url.Values{}
+	setIf(q, "status", status)
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	var env dataEnvelope[[]WebhookDelivery]
+	if err := c.get(ctx, pathJoin("api", "webhooks", strconv.Itoa(webhookID), "deliveries"), q, &env); err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
+
+// GetDelivery returns a delivery with its payload and attempts
+func (c *Client) GetDelivery(ctx context.Context, webhookID int, deliveryID int64) (*WebhookDeliveryDetail, error) {
+	var env dataEnvelope[WebhookDeliveryDetail]
+	path := pathJoin("api", "webhooks", strconv.Itoa(webhookID), "deliveries", strconv.FormatInt(deliveryID, 10))
+	if err := c.get(ctx, path, nil, &env); err != nil {
+		return nil, err
+	}
+	return &env.Data, nil
+}
+
+// ReplayDelivery queues a new delivery of the same event and returns its ID
+func (c *Client) ReplayDelivery(ctx context.Context, webhookID int, deliveryID int64) (int64, error) {
+	var res struct {
+		ID int64 `json:"id"`
+	}
+	path := pathJoin("api", "webhooks", strconv.Itoa(webhookID), "deliveries", strconv.FormatInt(deliveryID, 10), "replay")
+	if err := c.sendJSON(ctx, http.MethodPost, path, nil, &res); err != nil {
+		return 0, err
+	}
+	return res.ID, nil
+}
+
+// VerifyWebhookSignature checks an X-Filcdn-Signature header
+// ("t=<unix>,v1=<hex hmac>") against the raw request body, rejecting
+// signatures older than tolerance
+func VerifyWebhookSignature(secret, header string, body []byte, tolerance time.Duration) bool {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		if v, ok := strings.CutPrefix(part, "t="); ok {
+			ts = v
+		} else if v, ok := strings.CutPrefix(part, "v1="); ok {
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return false
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
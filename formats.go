@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+)
+
+// Typed uploads must be in one of the formats allowed for their data type.
+// The format is sniffed from the first sniffLen bytes of the content, looking
+// inside gzip where the format allows it; the filename and Content-Type are
+// not trusted. ALLOWED_FORMATS_<TYPE> replaces the list of a type with
+// comma-separated format names, or "any" to accept every file, and admins
+// can skip the check of one upload with the form field skipFormatCheck=true.
+// Uploads in other formats are rejected with 415 and the accepted formats.
+
+// contentFormat is a file format typed uploads may be in
+type contentFormat struct {
+	name   string // as used in ALLOWED_FORMATS_<TYPE>
+	label  string // as reported to clients
+	gzipOK bool   // may also be gzipped
+	match  func(head []byte, mime *mimetype.MIME) bool
+}
+
+var contentFormats = []contentFormat{
+	{name: "pdf", label: "PDF", match: func(head []byte, mime *mimetype.MIME) bool {
+		return mime.Is("application/pdf")
+	}},
+	{name: "epub", label: "EPUB", match: func(head []byte, mime *mimetype.MIME) bool {
+		return mime.Is("application/epub+zip")
+	}},
+	// A tar or zip archive whose visible entry names include a .tex file
+	{name: "latex", label: "LaTeX archive (tar, tar.gz or zip)", gzipOK: true, match: func(head []byte, mime *mimetype.MIME) bool {
+		return (mime.Is("application/x-tar") || mime.Is("application/zip")) && bytes.Contains(head, []byte(".tex"))
+	}},
+	{name: "fasta", label: "FASTA (optionally gzipped)", gzipOK: true, match: func(head []byte, mime *mimetype.MIME) bool {
+		text := textStart(head)
+		return strings.HasPrefix(text, ">") || strings.HasPrefix(text, ";")
+	}},
+	{name: "fastq", label: "FASTQ (optionally gzipped)", gzipOK: true, match: func(head []byte, mime *mimetype.MIME) bool {
+		lines := strings.SplitN(textStart(head), "\n", 4)
+		return len(lines) >= 3 && strings.HasPrefix(lines[0], "@") && strings.HasPrefix(lines[2], "+")
+	}},
+	{name: "genbank", label: "GenBank (optionally gzipped)", gzipOK: true, match: func(head []byte, mime *mimetype.MIME) bool {
+		return strings.HasPrefix(textStart(head), "LOCUS")
+	}},
+	{name: "gff", label: "GFF (optionally gzipped)", gzipOK: true, match: func(head []byte, mime *mimetype.MIME) bool {
+		return strings.HasPrefix(textStart(head), "##gff-version")
+	}},
+	{name: "jcamp-dx", label: "JCAMP-DX", match: func(head []byte, mime *mimetype.MIME) bool {
+		text := textStart(head)
+		return strings.HasPrefix(text, "##") && strings.Contains(strings.ToUpper(text), "##JCAMP-DX=")
+	}},
+	// Markup from the first byte: gzip keeps short inputs uncompressed, so
+	// the tags alone would also match a gzipped document
+	{name: "mzml", label: "mzML", match: func(head []byte, mime *mimetype.MIME) bool {
+		text := textStart(head)
+		return strings.HasPrefix(text, "<") &&
+			(strings.Contains(text, "<mzML") || strings.Contains(text, "<indexedmzML"))
+	}},
+	{name: "csv", label: "CSV", match: func(head []byte, mime *mimetype.MIME) bool {
+		return mime.Is("text/csv")
+	}},
+}
+
+// allowedFormats are the formats accepted per data type; a type without an
+// entry accepts any file
+var allowedFormats = map[string][]contentFormat{}
+
+// defaultFormats are the format names allowed per data type unless
+// ALLOWED_FORMATS_<TYPE> says otherwise
+var defaultFormats = map[string]string{
+	"paper":    "pdf,epub,latex",
+	"genome":   "fasta,fastq,genbank,gff",
+	"spectrum": "jcamp-dx,mzml,csv",
+}
+
+// parseFormats reads a comma-separated list of format names; "any" (nil)
+// accepts every file. Unknown names are skipped, so a list of only unknown
+// names accepts nothing.
+func parseFormats(list string) []contentFormat {
+	if strings.TrimSpace(list) == "any" {
+		return nil
+	}
+	formats := []contentFormat{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for _, f := range contentFormats {
+			if f.name == name {
+				formats, found = append(formats, f), true
+				break
+			}
+		}
+		if !found && name != "" {
+			fmt.Printf("[INIT] Ignoring unknown content format %q\n", name)
+		}
+	}
+	return formats
+}
+
+// textStart returns the start of head as text, without a byte order mark
+// or leading blank lines
+func textStart(head []byte) string {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	return strings.ReplaceAll(strings.TrimLeft(string(head), " \t\r\n"), "\r\n", "\n")
+}
+
+// gunzipHead returns the start of the decompressed content of a gzipped
+// head, as far as the head holds it
+func gunzipHead(head []byte) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(head))
+	if err != nil {
+		return nil
+	}
+	out := make([]byte, sniffLen)
+	n, _ := io.ReadFull(zr, out)
+	return out[:n]
+}
+
+// checkFormat reports whether the content starting with head is in a format
+// allowed for dataType, along with the MIME type detected
+func checkFormat(dataType string, head []byte) (bool, string) {
+	mime := mimetype.Detect(head)
+	formats := allowedFormats[dataType]
+	if formats == nil {
+		return true, mime.String()
+	}
+
+	var inner []byte
+	var innerMIME *mimetype.MIME
+	if mime.Is("application/gzip") {
+		inner = gunzipHead(head)
+		innerMIME = mimetype.Detect(inner)
+	}
+	for _, f := range formats {
+		if f.match(head, mime) {
+			return true, mime.String()
+		}
+		if f.gzipOK && inner != nil && f.match(inner, innerMIME) {
+			return true, mime.String()
+		}
+	}
+	return false, mime.String()
+}
+
+// acceptedFormats lists the formats allowed for dataType for clients
+func acceptedFormats(dataType string) []string {
+	var labels []string
+	for _, f := range allowedFormats[dataType] {
+		labels = append(labels, f.label)
+	}
+	return labels
+}
+
+// formatRejected responds 415 for a file not in an allowed format
+func formatRejected(c *gin.Context, dataType, filename, detected string) {
+	c.JSON(http.StatusUnsupportedMediaType, gin.H{
+		"error":    fmt.Sprintf("%s (%s) is not in an accepted %s format", filename, detected, dataType),
+		"detected": detected,
+		"accepted": acceptedFormats(dataType),
+	})
+}
+
+// requireFormat sniffs an uploaded file and, when its format is not allowed
+// for dataType, responds 415 and returns false
+func requireFormat(c *gin.Context, dataType string, file io.ReaderAt, filename string) bool {
+	if c.PostForm("skipFormatCheck") == "true" {
+		if !requireAdmin(c) {
+			return false
+		}
+		fmt.Printf("[FORMAT] Check of %s %s skipped by admin\n", dataType, filename)
+		return true
+	}
+	head := make([]byte, sniffLen)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot read file: " + err.Error()})
+		return false
+	}
+	if ok, detected := checkFormat(dataType, head[:n]); !ok {
+		fmt.Printf("[FORMAT] Rejected %s %s: %s\n", dataType, filename, detected)
+		formatRejected(c, dataType, filename, detected)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// The health monitor samples the proving state of every proof set we have
+// added roots to and keeps the samples as a time series in
+// proof_set_health. A proof set whose next challenge epoch is more than
+// proofChallengeWindow epochs in the past has missed a proving deadline;
+// the first sample that sees it raises proofset.deadline_missed for every
+// tenant with data in the proof set. Epochs are counted from
+// FILECOIN_GENESIS_TIMESTAMP, which must match the providers' network; the
+// monitor stays off without it rather than judge deadlines on the wrong chain.
+// Proof set IDs are only unique per provider, so samples are keyed by both.
+var (
+	healthInterval       time.Duration
+	healthRetention      time.Duration
+	proofChallengeWindow int64
+	filecoinGenesis      time.Time
+)
+
+const (
+	filecoinEpochDuration = 30 * time.Second
+
+	healthHealthy        = "healthy"
+	healthFaulted        = "faulted"
+	healthMissedDeadline = "missed_deadline"
+	healthNotProving     = "not_proving"
+	healthError          = "error"
+)
+
+const healthColumns = `checked_at, status, current_epoch, next_challenge_epoch, last_proven_epoch,
+	faulted_roots, roots, error`
+
+func scanHealthSample(row pgx.Row) (*filcdn.ProofSetHealthSample, error) {
+	var h filcdn.ProofSetHealthSample
+	err := row.Scan(&h.CheckedAt, &h.Status, &h.CurrentEpoch, &h.NextChallengeEpoch, &h.LastProvenEpoch,
+		&h.FaultedRoots, &h.Roots, &h.Error)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// currentEpoch derives the chain epoch from the wall clock
+func currentEpoch() int64 {
+	return int64(time.Since(filecoinGenesis) / filecoinEpochDuration)
+}
+
+// parseEpoch returns nil for values get-proof-set did not print
+func parseEpoch(s string) *int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+// runHealthMonitor samples every known proof set each healthInterval
+func runHealthMonitor() {
+	if filecoinGenesis.IsZero() {
+		fmt.Printf("[HEALTH] FILECOIN_GENESIS_TIMESTAMP not set, monitor disabled\n")
+		return
+	}
+	fmt.Printf("[HEALTH] Monitor started (every %s, challenge window %d epochs, keep %s)\n",
+		healthInterval, proofChallengeWindow, healthRetention)
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	for {
+		checkProofSets(context.Background())
+		<-ticker.C
+	}
+}
+
+func checkProofSets(ctx context.Context) {
+	rows, err := db.Query(ctx,
+		`SELECT DISTINCT proof_set_id, COALESCE(service_url, ''), COALESCE(service_name, '')
+		   FROM file_cids
+		  WHERE proof_set_id IS NOT NULL AND deleted_at IS NULL`)
+	if err != nil {
+		fmt.Printf("[HEALTH ERROR] Loading proof sets: %v\n", err)
+		return
+	}
+	var sets [][3]string
+	for rows.Next() {
+		var s [3]string
+		if err := rows.Scan(&s[0], &s[1], &s[2]); err != nil {
+			fmt.Printf("[HEALTH ERROR] %v\n", err)
+			continue
+		}
+		sets = append(sets, s)
+	}
+	rows.Close()
+
+	for _, s := range sets {
+		if err := checkProofSet(ctx, s[0], s[1], s[2]); err != nil {
+			fmt.Printf("[HEALTH ERROR] proofSet %s: %v\n", s[0], err)
+		}
+	}
+
+	if _, err := db.Exec(ctx,
+		`DELETE FROM proof_set_health WHERE checked_at < NOW() - $1::float8 * INTERVAL '1 second'`,
+		healthRetention.Seconds()); err != nil {
+		fmt.Printf("[HEALTH ERROR] Pruning samples: %v\n", err)
+	}
+}
+
+// checkProofSet stores one health sample and raises the missed-deadline event
+func checkProofSet(ctx context.Context, proofSetID, serviceUrl, serviceName string) error {
+	h := filcdn.ProofSetHealthSample{CheckedAt: time.Now(), CurrentEpoch: currentEpoch()}
+
+	info, err := getProofSet(ctx, serviceUrl, serviceName, proofSetID)
+	if err != nil {
+		msg := err.Error()
+		h.Status, h.Error = healthError, &msg
+	} else {
+		h.Roots = len(info.Roots)
+		h.NextChallengeEpoch = parseEpoch(info.NextChallengeEpoch)
+		h.LastProvenEpoch = parseEpoch(info.LastProvenEpoch)
+		if n, err := strconv.Atoi(strings.TrimSpace(info.Faults)); err == nil {
+			h.FaultedRoots = &n
+		}
+		switch {
+		case h.NextChallengeEpoch == nil || *h.NextChallengeEpoch == 0:
+			h.Status = healthNotProving
+		case h.CurrentEpoch > *h.NextChallengeEpoch+proofChallengeWindow:
+			h.Status = healthMissedDeadline
+		case h.FaultedRoots != nil && *h.FaultedRoots > 0:
+			h.Status = healthFaulted
+		default:
+			h.Status = healthHealthy
+		}
+	}
+
+	// Only the first sample of a missed deadline raises the event
+	var alreadyMissed bool
+	if h.Status == healthMissedDeadline {
+		if err := db.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM proof_set_health
+			                 WHERE proof_set_id = $1 AND service_url = $2
+			                   AND status = 'missed_deadline' AND next_challenge_epoch = $3)`,
+			proofSetID, serviceUrl, *h.NextChallengeEpoch).Scan(&alreadyMissed); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(ctx,
+		`INSERT INTO proof_set_health
+		   (proof_set_id, service_url, service_name, checked_at, status, current_epoch,
+		    next_challenge_epoch, last_proven_epoch, faulted_roots, roots, error)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		proofSetID, serviceUrl, serviceName, h.CheckedAt, h.Status, h.CurrentEpoch,
+		h.NextChallengeEpoch, h.LastProvenEpoch, h.FaultedRoots, h.Roots, h.Error); err != nil {
+		return err
+	}
+
+	if h.Status == healthMissedDeadline && !alreadyMissed {
+		fmt.Printf("[HEALTH] proofSet %s missed its deadline: next challenge epoch %d, now %d\n",
+			proofSetID, *h.NextChallengeEpoch, h.CurrentEpoch)
+		data := gin.H{
+			"proofSetID":         proofSetID,
+			"serviceUrl":         serviceUrl,
+			"nextChallengeEpoch": *h.NextChallengeEpoch,
+			"currentEpoch":       h.CurrentEpoch,
+			"lastProvenEpoch":    h.LastProvenEpoch,
+		}
+		for _, tenant := range proofSetTenants(ctx, proofSetID, serviceUrl) {
+			emitEvent(tenant, eventProofSetDeadlineMissed, data)
+		}
+	}
+	return nil
+}
+
+// proofSetTenants returns the tenants that uploaded into a provider's proof set
+func proofSetTenants(ctx context.Context, proofSetID, serviceUrl string) []string {
+	rows, err := db.Query(ctx,
+		`SELECT DISTINCT tenant FROM upload_intents
+		  WHERE proof_set_id = $1 AND service_url = $2 AND state = 'completed' AND tenant <> ''`,
+		proofSetID, serviceUrl)
+	if err != nil {
+		fmt.Printf("[HEALTH ERROR] Loading tenants of proofSet %s: %v\n", proofSetID, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var tenants []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err == nil {
+			tenants = append(tenants, t)
+		}
+	}
+	return tenants
+}
+
+// getProofSetHealthHandler returns the latest health sample of a proof set
+// and its recent history, newest first. Only admins and tenants with data in
+// the proof set may read it.
+// GET /api/proof-sets/:id/health?serviceUrl=https://sp.example&since=2024-01-01T00:00:00Z&limit=100
+func getProofSetHealthHandler(c *gin.Context) {
+	proofSetID := c.Param("id")
+	serviceUrl := c.Query("serviceUrl")
+	if serviceUrl == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "serviceUrl is required"})
+		return
+	}
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return
+	}
+	if !isAdminTenant(tenant) && !slices.Contains(proofSetTenants(c.Request.Context(), proofSetID, serviceUrl), tenant) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to read this proof set"})
+		return
+	}
+	limit := parseIntParam(c, "limit", 100)
+	since := time.Now().Add(-healthRetention)
+	if s := c.Query("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC 3339 timestamp"})
+			return
+		}
+		since = t
+	}
+
+	rows, err := db.Query(context.Background(),
+		`SELECT `+healthColumns+` FROM proof_set_health
+		  WHERE proof_set_id = $1 AND service_url = $2 AND checked_at >= $3
+		  ORDER BY checked_at DESC
+		  LIMIT $4`,
+		proofSetID, serviceUrl, since, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	health := filcdn.ProofSetHealth{ProofSetID: proofSetID, Samples: []filcdn.ProofSetHealthSample{}}
+	for rows.Next() {
+		h, err := scanHealthSample(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		health.Samples = append(health.Samples, *h)
+	}
+	if len(health.Samples) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No health samples for this proof set"})
+		return
+	}
+	health.Latest = &health.Samples[0]
+	c.JSON(http.StatusOK, gin.H{"data": health})
+}
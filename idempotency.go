@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Mutating routes accept an Idempotency-Key header. The first request with a
+// key runs and its response is stored; retries with the same key and the
+// same request replay that response, and a retry that arrives while the
+// first is still running waits for it. Keys are scoped to the tenant and
+// expire after idempotencyTTL.
+//
+// 429 responses, and 5xx responses from requests that failed before any
+// pdptool command changed state at a provider, are not stored, so such a
+// request can be retried with the same key. Once upload-file or add-roots has
+// run the outcome is stored whatever it is: a retry could add the root again.
+
+var (
+	idempotencyTTL         time.Duration
+	idempotencyWait        time.Duration
+	idempotencyLockTimeout time.Duration
+)
+
+const (
+	idempotencyPollInterval = 250 * time.Millisecond
+	idempotencyMaxResponse  = 1 << 20
+
+	codeIdempotencyKeyReused     = "idempotency_key_reused"
+	codeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+)
+
+var idempotencyKeyPattern = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// pdpSideEffects are the pdptool commands that change state at a provider
+var pdpSideEffects = map[string]bool{
+	"upload-file": true, "add-roots": true, "remove-roots": true, "create-proof-set": true,
+}
+
+type providerCallsKey struct{}
+
+// withProviderCalls returns a context in which noteProviderCall records that
+// a command in pdpSideEffects was started
+func withProviderCalls(ctx context.Context) (context.Context, *atomic.Bool) {
+	called := &atomic.Bool{}
+	return context.WithValue(ctx, providerCallsKey{}, called), called
+}
+
+// noteProviderCall marks ctx's request as having reached a provider, when
+// command changes state there
+func noteProviderCall(ctx context.Context, command string) {
+	if called, ok := ctx.Value(providerCallsKey{}).(*atomic.Bool); ok && pdpSideEffects[command] {
+		called.Store(true)
+	}
+}
+
+// idempotencyStore keeps the keys and stored responses
+type idempotencyStore interface {
+	// claim records a new in-progress request, or returns false when
+	// another request holds the key
+	claim(tenant, key, fingerprint string) (bool, error)
+	load(tenant, key string) (*storedResponse, error)
+	complete(tenant, key string, status int, headers http.Header, body []byte) error
+	// release forgets a request that should be retried
+	release(tenant, key string)
+}
+
+var idempotencyKeys idempotencyStore = pgIdempotencyStore{}
+
+// storedResponse is a completed request's response as kept in
+// idempotency_keys
+type storedResponse struct {
+	fingerprint string
+	status      string
+	code        *int
+	headers     http.Header
+	body        []byte
+}
+
+// idempotencyMiddleware makes a route safe to retry with an Idempotency-Key.
+// It goes after progressMiddleware so upload progress still counts the body.
+func idempotencyMiddleware(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	if !idempotencyKeyPattern.MatchString(key) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be 1-255 printable ASCII characters"})
+		return
+	}
+	fingerprint, err := requestFingerprint(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request: " + err.Error()})
+		return
+	}
+	tenant := tenantOf(c)
+
+	deadline := time.Now().Add(idempotencyWait)
+	for {
+		claimed, err := idempotencyKeys.claim(tenant, key, fingerprint)
+		if err != nil {
+			fmt.Printf("[IDEMPOTENCY ERROR] Claiming %q: %v\n", key, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			return
+		}
+		if claimed {
+			break
+		}
+
+		stored, err := idempotencyKeys.load(tenant, key)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue // released by a failed first request; claim it
+		}
+		if err != nil {
+			fmt.Printf("[IDEMPOTENCY ERROR] Loading %q: %v\n", key, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			return
+		}
+		if stored.fingerprint != fingerprint {
+			annotateError(c, codeIdempotencyKeyReused, "Idempotency-Key was already used for a different request", nil)
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			return
+		}
+		if stored.status == "completed" {
+			fmt.Printf("[IDEMPOTENCY] Replaying %s %s for key %q\n", c.Request.Method, c.Request.URL.Path, key)
+			replayResponse(c, stored)
+			return
+		}
+
+		// The first request is still running
+		if time.Now().After(deadline) {
+			c.Header("Retry-After", "5")
+			annotateError(c, codeIdempotencyKeyInProgress, "A request with this Idempotency-Key is still in progress", nil)
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			return
+		}
+		select {
+		case <-c.Request.Context().Done():
+			c.Abort()
+			return
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+
+	ctx, calledProvider := withProviderCalls(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+
+	status := w.Status()
+	if status == http.StatusTooManyRequests || (!calledProvider.Load() && (status >= 500 || w.overflow)) {
+		idempotencyKeys.release(tenant, key)
+		return
+	}
+	body := w.body.Bytes()
+	if w.overflow {
+		// Too large to replay, but the request must not run again
+		fmt.Printf("[IDEMPOTENCY] Response for %q too large to store, keeping status only\n", key)
+		body = nil
+	}
+	if err := idempotencyKeys.complete(tenant, key, status, storableHeaders(w.Header()), body); err != nil {
+		fmt.Printf("[IDEMPOTENCY ERROR] Storing response for %q: %v\n", key, err)
+	}
+}
+
+// requestFingerprint hashes what makes two requests the same request: method,
+// path (ignoring the /api/v2 prefix), query and body. Multipart bodies are
+// hashed by field and file content because the boundary changes on every
+// retry.
+func requestFingerprint(r *http.Request) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", r.Method, strings.Replace(r.URL.Path, "/api/v2/", "/api/", 1), r.URL.RawQuery)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		// Handlers call ParseMultipartForm again, which is then a no-op
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return "", err
+		}
+		for _, name := range slices.Sorted(maps.Keys(r.MultipartForm.Value)) {
+			fmt.Fprintf(h, "%q=%q\n", name, r.MultipartForm.Value[name])
+		}
+		for _, name := range slices.Sorted(maps.Keys(r.MultipartForm.File)) {
+			for _, fh := range r.MultipartForm.File[name] {
+				fmt.Fprintf(h, "%q:%q:", name, fh.Filename)
+				f, err := fh.Open()
+				if err != nil {
+					return "", err
+				}
+				_, err = io.Copy(h, f)
+				f.Close()
+				if err != nil {
+					return "", err
+				}
+				h.Write([]byte("\n"))
+			}
+		}
+	} else if r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pgIdempotencyStore keeps keys in idempotency_keys
+type pgIdempotencyStore struct{}
+
+// claim takes over keys that expired or whose request was abandoned (e.g.
+// by a restart)
+func (pgIdempotencyStore) claim(tenant, key, fingerprint string) (bool, error) {
+	var claimed bool
+	err := db.QueryRow(context.Background(),
+		`INSERT INTO idempotency_keys (tenant, key, fingerprint)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (tenant, key) DO UPDATE
+		    SET fingerprint = EXCLUDED.fingerprint, status = 'processing', response_status = NULL,
+		        response_headers = NULL, response_body = NULL, created_at = NOW(), locked_at = NOW(),
+		        completed_at = NULL
+		  WHERE idempotency_keys.created_at < NOW() - $4::float8 * INTERVAL '1 second'
+		     OR (idempotency_keys.status = 'processing'
+		         AND idempotency_keys.locked_at < NOW() - $5::float8 * INTERVAL '1 second')
+		 RETURNING TRUE`,
+		tenant, key, fingerprint, idempotencyTTL.Seconds(), idempotencyLockTimeout.Seconds()).Scan(&claimed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return claimed, err
+}
+
+func (pgIdempotencyStore) load(tenant, key string) (*storedResponse, error) {
+	var s storedResponse
+	var headers []byte
+	err := db.QueryRow(context.Background(),
+		`SELECT fingerprint, status, response_status, response_headers, response_body
+		   FROM idempotency_keys WHERE tenant = $1 AND key = $2`,
+		tenant, key).Scan(&s.fingerprint, &s.status, &s.code, &headers, &s.body)
+	if err != nil {
+		return nil, err
+	}
+	if headers != nil {
+		if err := json.Unmarshal(headers, &s.headers); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+func (pgIdempotencyStore) complete(tenant, key string, status int, headers http.Header, body []byte) error {
+	h, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(context.Background(),
+		`UPDATE idempotency_keys
+		    SET status = 'completed', response_status = $3, response_headers = $4, response_body = $5,
+		        completed_at = NOW()
+		  WHERE tenant = $1 AND key = $2`,
+		tenant, key, status, h, body)
+	return err
+}
+
+func (pgIdempotencyStore) release(tenant, key string) {
+	if _, err := db.Exec(context.Background(),
+		`DELETE FROM idempotency_keys WHERE tenant = $1 AND key = $2 AND status = 'processing'`,
+		tenant, key); err != nil {
+		fmt.Printf("[IDEMPOTENCY ERROR] Releasing %q: %v\n", key, err)
+	}
+}
+
+func replayResponse(c *gin.Context, s *storedResponse) {
+	for k, vs := range s.headers {
+		for _, v := range vs {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+	c.Header("Idempotent-Replayed", "true")
+	status := http.StatusOK
+	if s.code != nil {
+		status = *s.code
+	}
+	c.Status(status)
+	c.Writer.Write(s.body)
+	c.Abort()
+}
+
+// storableHeaders keeps the response headers set by the handler, dropping
+// per-request ones
+func storableHeaders(h http.Header) http.Header {
+	out := http.Header{}
+	for k, v := range h {
+		if k == "X-Request-Id" || k == "Vary" || strings.HasPrefix(k, "Access-Control-") {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// recordingWriter keeps a copy of the response body up to
+// idempotencyMaxResponse
+type recordingWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.body.Len()+len(b) > idempotencyMaxResponse {
+		w.overflow = true
+	} else {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// runIdempotencySweeper deletes expired keys
+func runIdempotencySweeper() {
+	fmt.Printf("[IDEMPOTENCY] Sweeper started (keys kept %s)\n", idempotencyTTL)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		tag, err := db.Exec(context.Background(),
+			`DELETE FROM idempotency_keys
+			  WHERE created_at < NOW() - $1::float8 * INTERVAL '1 second'
+			    AND (status = 'completed' OR locked_at < NOW() - $2::float8 * INTERVAL '1 second')`,
+			idempotencyTTL.Seconds(), idempotencyLockTimeout.Seconds())
+		if err != nil {
+			fmt.Printf("[IDEMPOTENCY ERROR] Sweeping: %v\n", err)
+		} else if tag.RowsAffected() > 0 {
+			fmt.Printf("[IDEMPOTENCY] Deleted %d expired keys\n", tag.RowsAffected())
+		}
+		<-ticker.C
+	}
+}
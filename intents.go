@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Upload intents make the upload flow recoverable. An intent row is written
+// before the provider is touched and moves through
+//
+//	pending --upload-file--> uploaded --add-roots--> root_added --metadata saved--> completed
+//	    \------------ failed (nothing in the proof set) ----------/
+//
+// The last step saves the metadata, the file_cids row and the intent state in
+// one transaction (saveUploadedRecord). The reconciler picks up intents a
+// crashed or failed request left behind: root_added intents have a proven
+// root without metadata and are completed from the stored metadata; intents
+// whose outcome is unknown, and metadata rows without a root, are flagged
+// needs_attention for an admin to retry or resolve.
+var (
+	reconcileInterval   time.Duration
+	reconcileStaleAfter time.Duration
+)
+
+const maxReconcileAttempts = 5
+
+type uploadIntent struct {
+	ID          int64           `json:"id"`
+	Tenant      string          `json:"tenant"`
+	DataType    string          `json:"dataType"` // paper, genome, spectrum or file
+	Source      string          `json:"source"`   // upload, batch, tus, legacy or reconciler
+	SourceRef   *string         `json:"sourceRef"`
+	Filename    string          `json:"filename"`
+	ProofSetID  *string         `json:"proofSetID"`
+	ServiceURL  *string         `json:"serviceUrl"`
+	ServiceName *string         `json:"serviceName"`
+	Metadata    json.RawMessage `json:"metadata"`
+	RootCID     *string         `json:"rootCID"`
+	Encrypted   bool            `json:"encrypted"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	LastError   *string         `json:"lastError"`
+	Resolution  *string         `json:"resolution"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+const intentColumns = `id, tenant, data_type, source, source_ref, filename, proof_set_id, service_url,
+	service_name, metadata, root_cid, encrypted, state, attempts, last_error, resolution, created_at, updated_at`
+
+func scanIntent(row pgx.Row) (*uploadIntent, error) {
+	var in uploadIntent
+	err := row.Scan(&in.ID, &in.Tenant, &in.DataType, &in.Source, &in.SourceRef, &in.Filename,
+		&in.ProofSetID, &in.ServiceURL, &in.ServiceName, &in.Metadata, &in.RootCID, &in.Encrypted,
+		&in.State, &in.Attempts, &in.LastError, &in.Resolution, &in.CreatedAt, &in.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+// createIntent records an upload before the provider is touched. sourceRef
+// identifies the originating object (the tus upload ID) and may be empty.
+func createIntent(tenant, dataType, source, sourceRef string, entry *recordMetadata,
+	proofSetID, serviceUrl, serviceName string, encrypted bool) (int64, error) {
+	metadata, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = db.QueryRow(context.Background(),
+		`INSERT INTO upload_intents
+		   (tenant, data_type, source, source_ref, filename, proof_set_id, service_url, service_name,
+		    metadata, encrypted)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10)
+		 RETURNING id`,
+		tenant, dataType, source, sourceRef, entry.Filename, proofSetID, serviceUrl, serviceName,
+		metadata, encrypted).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record upload intent: %w", err)
+	}
+	return id, nil
+}
+
+// markIntent moves an intent to state, recording the root CID and error
+// when given. Failures are logged: the reconciler treats an intent stuck in
+// an earlier state conservatively.
+func markIntent(id int64, state, rootCID string, cause error) {
+	if id == 0 {
+		return
+	}
+	var lastError *string
+	if cause != nil {
+		msg := cause.Error()
+		lastError = &msg
+	}
+	if _, err := db.Exec(context.Background(),
+		`UPDATE upload_intents
+		    SET state = $2, root_cid = COALESCE(NULLIF($3, ''), root_cid),
+		        last_error = COALESCE($4, last_error), updated_at = NOW()
+		  WHERE id = $1`,
+		id, state, rootCID, lastError); err != nil {
+		fmt.Printf("[INTENT ERROR] Marking intent %d %s: %v\n", id, state, err)
+	}
+}
+
+// markAddRootsFailed records a failed add-roots on an intent. Only failures
+// the provider reports before submitting anything mark it failed; after a
+// timeout, cancellation or dropped connection the roots may still land, so
+// the intent stays uploaded for the reconciler to flag.
+func markAddRootsFailed(id int64, cause error) {
+	state := "failed"
+	if pdpOutcomeUnknown(cause) {
+		state = "uploaded"
+	}
+	markIntent(id, state, "", cause)
+}
+
+// findIntent returns the latest intent for a source object, or nil
+func findIntent(source, sourceRef string) (*uploadIntent, error) {
+	in, err := scanIntent(db.QueryRow(context.Background(),
+		`SELECT `+intentColumns+` FROM upload_intents
+		  WHERE source = $1 AND source_ref = $2
+		  ORDER BY id DESC LIMIT 1`,
+		source, sourceRef))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return in, err
+}
+
+// completeIntent saves the metadata of an intent whose root is in the proof
+// set
+func completeIntent(ctx context.Context, in *uploadIntent) error {
+	if in.RootCID == nil || in.ProofSetID == nil {
+		return errors.New("intent has no root CID or proof set")
+	}
+	if in.Encrypted {
+		var exists bool
+		if err := db.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM record_encryption WHERE cid = $1)", *in.RootCID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("encrypted upload has no saved encryption envelope; the content cannot be decrypted")
+		}
+	}
+	var entry recordMetadata
+	if err := json.Unmarshal(in.Metadata, &entry); err != nil {
+		return fmt.Errorf("invalid intent metadata: %w", err)
+	}
+	return saveUploadedRecord(in.ID, in.DataType, &entry, *in.RootCID, *in.ProofSetID,
+		stringOrEmpty(in.ServiceURL), stringOrEmpty(in.ServiceName))
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// runReconciler periodically repairs or flags intents left behind
+func runReconciler() {
+	fmt.Printf("[RECONCILE] Worker started (every %s, stale after %s)\n", reconcileInterval, reconcileStaleAfter)
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		reconcile(context.Background())
+		<-ticker.C
+	}
+}
+
+func reconcile(ctx context.Context) {
+	stale := reconcileStaleAfter.Seconds()
+
+	// Proven roots without metadata: finish the job
+	rows, err := db.Query(ctx,
+		`SELECT `+intentColumns+` FROM upload_intents
+		  WHERE state = 'root_added' AND updated_at < NOW() - $1::float8 * INTERVAL '1 second'
+		  ORDER BY id`, stale)
+	if err != nil {
+		fmt.Printf("[RECONCILE ERROR] Loading intents: %v\n", err)
+		return
+	}
+	var due []*uploadIntent
+	for rows.Next() {
+		in, err := scanIntent(rows)
+		if err != nil {
+			fmt.Printf("[RECONCILE ERROR] %v\n", err)
+			continue
+		}
+		due = append(due, in)
+	}
+	rows.Close()
+
+	for _, in := range due {
+		err := completeIntent(ctx, in)
+		if err == nil {
+			fmt.Printf("[RECONCILE] Completed intent %d (%s %s)\n", in.ID, in.DataType, *in.RootCID)
+			continue
+		}
+		fmt.Printf("[RECONCILE ERROR] Intent %d: %v\n", in.ID, err)
+		state := "root_added"
+		if in.Attempts+1 >= maxReconcileAttempts {
+			state = "needs_attention"
+		}
+		db.Exec(ctx,
+			`UPDATE upload_intents SET state = $2, attempts = attempts + 1, last_error = $3, updated_at = NOW()
+			  WHERE id = $1`,
+			in.ID, state, err.Error())
+	}
+
+	// Root uploaded but add-roots never reported back: adding it again could
+	// put the root in the proof set twice, so leave it to an admin
+	if tag, err := db.Exec(ctx,
+		`UPDATE upload_intents
+		    SET state = 'needs_attention', updated_at = NOW(),
+		        last_error = 'add-roots outcome unknown: check whether the root is in the proof set'
+		  WHERE state = 'uploaded' AND updated_at < NOW() - $1::float8 * INTERVAL '1 second'`,
+		stale); err != nil {
+		fmt.Printf("[RECONCILE ERROR] Flagging uploaded intents: %v\n", err)
+	} else if tag.RowsAffected() > 0 {
+		fmt.Printf("[RECONCILE] %d intents need attention (add-roots outcome unknown)\n", tag.RowsAffected())
+	}
+
+	// Nothing reached the proof set
+	if _, err := db.Exec(ctx,
+		`UPDATE upload_intents
+		    SET state = 'failed', updated_at = NOW(),
+		        last_error = COALESCE(last_error, 'abandoned before the upload finished')
+		  WHERE state = 'pending' AND updated_at < NOW() - $1::float8 * INTERVAL '1 second'`,
+		stale); err != nil {
+		fmt.Printf("[RECONCILE ERROR] Failing abandoned intents: %v\n", err)
+	}
+
+	// Metadata without a root. The tenant and filename come from the last
+	// file_cids row of the CID, even a deleted one, else from its last intent.
+	if tag, err := db.Exec(ctx,
+		`INSERT INTO upload_intents (tenant, data_type, source, filename, metadata, root_cid, state, last_error)
+		 SELECT COALESCE(f.tenant, i.tenant, ''), r.type, 'reconciler', COALESCE(f.filename, i.filename, ''),
+		        '{}', r.cid, 'needs_attention', 'metadata has no file_cids root'
+		   FROM (SELECT 'paper' AS type, cid FROM paper WHERE deleted_at IS NULL
+		         UNION ALL SELECT 'genome', cid FROM genome WHERE deleted_at IS NULL
+		         UNION ALL SELECT 'spectrum', cid FROM spectrum WHERE deleted_at IS NULL) r
+		   LEFT JOIN LATERAL (SELECT tenant, filename FROM file_cids
+		                       WHERE cid = r.cid ORDER BY id DESC LIMIT 1) f ON TRUE
+		   LEFT JOIN LATERAL (SELECT NULLIF(tenant, '') AS tenant, NULLIF(filename, '') AS filename
+		                        FROM upload_intents
+		                       WHERE root_cid = r.cid AND source <> 'reconciler' ORDER BY id DESC LIMIT 1) i ON TRUE
+		  WHERE NOT EXISTS (SELECT 1 FROM file_cids f WHERE f.cid = r.cid AND f.deleted_at IS NULL)
+		    AND NOT EXISTS (SELECT 1 FROM upload_intents i
+		                     WHERE i.root_cid = r.cid AND i.data_type = r.type
+		                       AND i.state IN ('needs_attention', 'resolved'))`); err != nil {
+		fmt.Printf("[RECONCILE ERROR] Checking metadata without roots: %v\n", err)
+	} else if tag.RowsAffected() > 0 {
+		fmt.Printf("[RECONCILE] %d metadata rows have no root\n", tag.RowsAffected())
+	}
+}
+
+// listIntentsHandler lists upload intents, by default those needing attention
+// GET /api/admin/intents?state=needs_attention
+func listIntentsHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	state := c.DefaultQuery("state", "needs_attention")
+	limit := parseIntParam(c, "limit", 50)
+	offset := parseIntParam(c, "offset", 0)
+
+	rows, err := db.Query(context.Background(),
+		`SELECT `+intentColumns+` FROM upload_intents
+		  WHERE ($1 = 'all' OR state = $1)
+		  ORDER BY updated_at DESC, id DESC
+		  LIMIT $2 OFFSET $3`,
+		state, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	result := []*uploadIntent{}
+	for rows.Next() {
+		in, err := scanIntent(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result = append(result, in)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+func loadIntentParam(c *gin.Context) (*uploadIntent, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid intent ID"})
+		return nil, false
+	}
+	in, err := scanIntent(db.QueryRow(context.Background(),
+		`SELECT `+intentColumns+` FROM upload_intents WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Intent not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return in, true
+}
+
+// getIntentHandler returns one upload intent
+// GET /api/admin/intents/:id
+func getIntentHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	if in, ok := loadIntentParam(c); ok {
+		c.JSON(http.StatusOK, gin.H{"data": in})
+	}
+}
+
+// retryIntentHandler saves the metadata of a flagged intent now. The admin
+// asserts the root is in the proof set.
+// POST /api/admin/intents/:id/retry
+func retryIntentHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	in, ok := loadIntentParam(c)
+	if !ok {
+		return
+	}
+	if in.State != "needs_attention" && in.State != "root_added" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Intent is %s; only needs_attention and root_added intents can be retried", in.State)})
+		return
+	}
+	if in.Source == "reconciler" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Intent was raised by the reconciler and has no upload to complete; resolve it instead"})
+		return
+	}
+	if err := completeIntent(context.Background(), in); err != nil {
+		db.Exec(context.Background(),
+			"UPDATE upload_intents SET attempts = attempts + 1, last_error = $2, updated_at = NOW() WHERE id = $1",
+			in.ID, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	fmt.Printf("[RECONCILE] Intent %d completed by admin retry\n", in.ID)
+	if in, ok := loadIntentParam(c); ok {
+		c.JSON(http.StatusOK, gin.H{"data": in})
+	}
+}
+
+// resolveIntentHandler closes a flagged intent that was handled by hand
+// POST /api/admin/intents/:id/resolve {"note": "root removed manually"}
+func resolveIntentHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	var req struct {
+		Note string `json:"note"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	in, ok := loadIntentParam(c)
+	if !ok {
+		return
+	}
+	if in.State == "completed" || in.State == "resolved" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Intent is already %s", in.State)})
+		return
+	}
+	if _, err := db.Exec(context.Background(),
+		`UPDATE upload_intents
+		    SET state = 'resolved', resolution = NULLIF($2, ''), updated_at = NOW()
+		  WHERE id = $1`,
+		in.ID, req.Note); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if in, ok := loadIntentParam(c); ok {
+		c.JSON(http.StatusOK, gin.H{"data": in})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -14,14 +15,16 @@ import (
 	"strings"
 	"time"
 
+	"filcdn-service/filcdn"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var (
 	pdpToolPath string
-	db          *pgx.Conn
+	db          *pgxpool.Pool
 )
 
 // ------------------------------------------------------------
@@ -35,13 +38,186 @@ func init() {
 	}
 	fmt.Printf("[INIT] pdptool: %s\n", pdpToolPath)
 
-	// -------- Postgres connection --------
+	// -------- API keys and encryption keystore --------
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		if err := loadAPIKeys(path); err != nil {
+			panic(fmt.Errorf("cannot load API keys: %w", err))
+		}
+		fmt.Printf("[INIT] %d API keys loaded\n", len(apiKeys))
+	}
+	loadAdminTenants(os.Getenv("ADMIN_TENANTS"))
+	if path := os.Getenv("KEYSTORE_PATH"); path != "" {
+		if err := loadKeystore(path); err != nil {
+			panic(fmt.Errorf("cannot load keystore: %w", err))
+		}
+		fmt.Printf("[INIT] Keystore loaded for %d tenants\n", len(keystore))
+	}
+
+	// -------- Deletion workflow --------
+	deletionUndoWindow = envDuration("DELETION_UNDO_WINDOW", 24*time.Hour)
+	deletionGracePeriod = envDuration("DELETION_GRACE_PERIOD", 30*24*time.Hour)
+	deletionPollInterval = envDuration("DELETION_POLL_INTERVAL", time.Minute)
+	deletionRemovalTimeout = envDuration("DELETION_REMOVAL_TIMEOUT", 24*time.Hour)
+
+	// -------- Batch uploads --------
+	batchUploadConcurrency = envInt("BATCH_UPLOAD_CONCURRENCY", 4)
+	batchMaxFiles = envInt("BATCH_MAX_FILES", 500)
+
+	// -------- Webhooks --------
+	webhookPollInterval = envDuration("WEBHOOK_POLL_INTERVAL", 5*time.Second)
+	webhookMaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", 10)
+	webhookTimeout = envDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	webhookAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE_ADDRESSES") == "true" // default: public receivers only
+
+	// -------- Idempotency keys --------
+	idempotencyTTL = envDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	idempotencyWait = envDuration("IDEMPOTENCY_WAIT", 2*time.Minute)
+	idempotencyLockTimeout = envDuration("IDEMPOTENCY_LOCK_TIMEOUT", time.Hour)
+
+	// -------- Upload intents --------
+	reconcileInterval = envDuration("RECONCILE_INTERVAL", 5*time.Minute)
+	reconcileStaleAfter = envDuration("RECONCILE_STALE_AFTER", 30*time.Minute)
+
+	// -------- Root verification --------
+	verifyInterval = envDuration("VERIFY_INTERVAL", time.Hour)
+	verifyBatchSize = envInt("VERIFY_BATCH_SIZE", 100)
+	verifyMaxAge = envDuration("VERIFY_MAX_AGE", 24*time.Hour)
+	verifySampleBytes = int64(envInt("VERIFY_SAMPLE_BYTES", 0)) // 0 skips the retrieval check
+
+	// -------- Proof set health --------
+	healthInterval = envDuration("HEALTH_INTERVAL", 10*time.Minute)
+	healthRetention = envDuration("HEALTH_RETENTION", 30*24*time.Hour)
+	proofChallengeWindow = int64(envInt("PROOF_CHALLENGE_WINDOW", 60)) // epochs
+	// Genesis of the providers' network, e.g. 1598306400 (mainnet) or
+	// 1667326380 (calibration); the monitor is off without it
+	if genesis := envInt("FILECOIN_GENESIS_TIMESTAMP", 0); genesis > 0 {
+		filecoinGenesis = time.Unix(int64(genesis), 0)
+	}
+
+	// -------- Replication --------
+	replicationInterval = envDuration("REPLICATION_INTERVAL", 10*time.Minute)
+	replicationRepairBatch = envInt("REPLICATION_REPAIR_BATCH", 20)
+
+	// -------- PDP timeouts --------
+	// PDP_TIMEOUT_<COMMAND> overrides the limit of one command, e.g.
+	// PDP_TIMEOUT_UPLOAD_FILE=1h
+	pdpDefaultTimeout = envDuration("PDP_TIMEOUT", 2*time.Minute)
+	for command, limit := range map[string]time.Duration{
+		"upload-file":                 30 * time.Minute,
+		"add-roots":                   5 * time.Minute,
+		"remove-roots":                5 * time.Minute,
+		"create-proof-set":            5 * time.Minute,
+		"get-proof-set":               time.Minute,
+		"get-proof-set-create-status": time.Minute,
+		"ping":                        30 * time.Second,
+	} {
+		pdpTimeouts[command] = envDuration("PDP_TIMEOUT_"+strings.ToUpper(strings.ReplaceAll(command, "-", "_")), limit)
+	}
+	proofSetCreateDeadline = envDuration("PROOF_SET_CREATE_DEADLINE", 10*time.Minute)
+	proofSetPollInterval = envDuration("PROOF_SET_POLL_INTERVAL", 3*time.Second)
+	addRootsDeadline = envDuration("ADD_ROOTS_DEADLINE", 15*time.Minute)
+
+	// -------- PDP retries --------
+	retryOn := os.Getenv("PDP_RETRY_ON")
+	if retryOn == "" {
+		retryOn = "transient,not_synced"
+	}
+	pdpRetry = pdpRetryPolicy{
+		maxAttempts: envInt("PDP_RETRY_ATTEMPTS", 5),
+		baseDelay:   envDuration("PDP_RETRY_BASE_DELAY", 2*time.Second),
+		maxDelay:    envDuration("PDP_RETRY_MAX_DELAY", 30*time.Second),
+		deadline:    envDuration("PDP_RETRY_DEADLINE", 2*time.Minute),
+		retryOn:     parseRetryKinds(retryOn),
+	}
+
+	// -------- PDP concurrency --------
+	// PDP_CONCURRENCY_<COMMAND> overrides the limit of one command, e.g.
+	// PDP_CONCURRENCY_UPLOAD_FILE=2
+	pdpConcurrency = envInt("PDP_CONCURRENCY", 8)
+	for command, limit := range map[string]int{
+		"upload-file":                 4,
+		"add-roots":                   4,
+		"remove-roots":                pdpConcurrency,
+		"create-proof-set":            2,
+		"get-proof-set":               pdpConcurrency,
+		"get-proof-set-create-status": pdpConcurrency,
+		"ping":                        pdpConcurrency,
+	} {
+		pdpCommandLimits[command] = envInt("PDP_CONCURRENCY_"+strings.ToUpper(strings.ReplaceAll(command, "-", "_")), limit)
+	}
+	pdpProviderConcurrency = envInt("PDP_PROVIDER_CONCURRENCY", 8)
+	pdpQueueMax = envInt("PDP_QUEUE_MAX", 100)
+
+	// -------- Content formats --------
+	for dataType, names := range defaultFormats {
+		if list := os.Getenv("ALLOWED_FORMATS_" + strings.ToUpper(dataType)); list != "" {
+			names = list
+		}
+		allowedFormats[dataType] = parseFormats(names)
+	}
+
+	// -------- Malware scanning --------
+	// MALWARE_SCANNER=clamd enables scanning; CLAMD_ADDRESS is unix:/path,
+	// a socket path or host:port
+	clamdAddress := os.Getenv("CLAMD_ADDRESS")
+	if clamdAddress == "" {
+		clamdAddress = "/var/run/clamav/clamd.ctl"
+	}
+	scanner, err := newScanner(os.Getenv("MALWARE_SCANNER"), clamdAddress)
+	if err != nil {
+		panic(err)
+	}
+	uploadScanner = scanner
+	scanTimeout = envDuration("SCAN_TIMEOUT", 2*time.Minute)
+	scanFailOpen = os.Getenv("SCAN_FAIL_POLICY") == "open" // default closed: no upload is stored unscanned
+	quarantineDir = os.Getenv("QUARANTINE_DIR")
+	if quarantineDir == "" {
+		quarantineDir = filepath.Join(os.TempDir(), "filcdn-quarantine")
+	}
+	if uploadScanner != nil {
+		if err := os.MkdirAll(quarantineDir, 0o700); err != nil {
+			panic(fmt.Errorf("cannot create quarantine dir: %w", err))
+		}
+		fmt.Printf("[INIT] Malware scanning with %s, fail-open %v, quarantine: %s\n", uploadScanner.name(), scanFailOpen, quarantineDir)
+	}
+
+	// -------- Provider failover --------
+	circuitFailureThreshold = envInt("CIRCUIT_FAILURE_THRESHOLD", 5)
+	circuitCooldown = envDuration("CIRCUIT_COOLDOWN", time.Minute)
+	uploadFailoverAttempts = envInt("UPLOAD_FAILOVER_ATTEMPTS", 3) // providers tried per upload; 1 disables failover
+
+	// -------- Proof set pools --------
+	poolMaxRoots = envInt("POOL_MAX_ROOTS", 1000)
+	poolMaxBytes = int64(envInt("POOL_MAX_BYTES", 0)) // 0 is no size limit
+	poolRolloverAt = envFraction("POOL_ROLLOVER_AT", 0.8)
+	poolCreateWait = envDuration("POOL_CREATE_WAIT", 2*time.Minute)
+	poolCreateTimeout = envDuration("POOL_CREATE_TIMEOUT", time.Hour)
+	poolPollInterval = envDuration("POOL_POLL_INTERVAL", 15*time.Second)
+	poolRecordKeeper = os.Getenv("PDP_RECORDKEEPER") // unset disables automatic proof set creation
+
+	// -------- Resumable (tus) uploads --------
+	tusStagingDir = os.Getenv("TUS_STAGING_DIR")
+	if tusStagingDir == "" {
+		tusStagingDir = filepath.Join(os.TempDir(), "filcdn-tus")
+	}
+	if err := os.MkdirAll(tusStagingDir, 0o700); err != nil {
+		panic(fmt.Errorf("cannot create tus staging dir: %w", err))
+	}
+	tusMaxSize = int64(envInt("TUS_MAX_SIZE", 50<<30))
+	tusRetryDelay = envDuration("TUS_RETRY_DELAY", time.Minute)
+	tusMaxAttempts = envInt("TUS_MAX_ATTEMPTS", 10)
+	fmt.Printf("[INIT] tus staging: %s\n", tusStagingDir)
+}
+
+// initDB connects to Postgres and creates the tables. It runs from main
+// rather than init so the router can be built without a database.
+func initDB() {
 	dsn := os.Getenv("POSTGRES_DSN")
 	if dsn == "" {
 		dsn = "postgres://filcdn:filcdnpassword@db:5432/filcdn_db"
 	}
 	var err error
-	db, err = pgx.Connect(context.Background(), dsn)
+	db, err = pgxpool.New(context.Background(), dsn)
 	if err != nil {
 		panic(fmt.Errorf("cannot connect to Postgres: %w", err))
 	}
@@ -84,6 +260,317 @@ func init() {
 			notes TEXT,
 			created_at TIMESTAMPTZ DEFAULT NOW()
 		);`,
+
+		// Last metadata edit per record
+		`ALTER TABLE paper ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;`,
+		`ALTER TABLE spectrum ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;`,
+		`ALTER TABLE genome ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;`,
+
+		// Edit history table
+		`CREATE TABLE IF NOT EXISTS record_edits (
+			id SERIAL PRIMARY KEY,
+			record_type TEXT NOT NULL,
+			cid TEXT NOT NULL,
+			action TEXT NOT NULL, -- update, replace or delete
+			previous JSONB, -- full row before the edit
+			changes JSONB, -- fields set by the edit
+			edited_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS record_edits_record_idx ON record_edits (record_type, cid);`,
+
+		// Where each root lives, and soft deletion
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS proof_set_id TEXT;`,
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS service_url TEXT;`,
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS service_name TEXT;`,
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+		`ALTER TABLE paper ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+		`ALTER TABLE spectrum ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+		`ALTER TABLE genome ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+
+		// Root verification results
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS last_verified_at TIMESTAMPTZ;`,
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS verification_status TEXT;`,
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS verification_error TEXT;`,
+
+		// Deletion workflow table
+		`CREATE TABLE IF NOT EXISTS deletions (
+			id SERIAL PRIMARY KEY,
+			cid TEXT NOT NULL,
+			proof_set_id TEXT NOT NULL,
+			service_url TEXT NOT NULL,
+			service_name TEXT NOT NULL,
+			root_id TEXT,
+			status TEXT NOT NULL DEFAULT 'scheduled', -- scheduled, cancelled, removing, deleted, purged, failed
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			requested_at TIMESTAMPTZ DEFAULT NOW(),
+			undo_until TIMESTAMPTZ NOT NULL, -- removal is submitted once this passes
+			removal_submitted_at TIMESTAMPTZ,
+			confirmed_at TIMESTAMPTZ,
+			purge_after TIMESTAMPTZ, -- soft-deleted rows are purged once this passes
+			purged_at TIMESTAMPTZ
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS deletions_active_cid_idx ON deletions (cid)
+			WHERE status IN ('scheduled', 'removing', 'deleted');`,
+
+		// Resumable upload table
+		`CREATE TABLE IF NOT EXISTS tus_uploads (
+			id TEXT PRIMARY KEY,
+			data_type TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			length BIGINT NOT NULL,
+			metadata JSONB NOT NULL, -- decoded Upload-Metadata
+			status TEXT NOT NULL DEFAULT 'uploading', -- uploading, processing, completed, failed
+			root_cid TEXT,
+			error TEXT,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			updated_at TIMESTAMPTZ DEFAULT NOW(),
+			completed_at TIMESTAMPTZ
+		);`,
+		`ALTER TABLE tus_uploads ADD COLUMN IF NOT EXISTS tenant TEXT;`,
+		`ALTER TABLE tus_uploads ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;`,
+
+		// Per-record encryption metadata
+		`CREATE TABLE IF NOT EXISTS record_encryption (
+			cid TEXT PRIMARY KEY,
+			mode TEXT NOT NULL, -- server or client
+			algorithm TEXT NOT NULL,
+			tenant TEXT NOT NULL,
+			master_key_id TEXT,
+			wrapped_key BYTEA,
+			nonce_prefix BYTEA,
+			chunk_size INTEGER,
+			plaintext_size BIGINT,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+
+		// Key sharing tables
+		`CREATE TABLE IF NOT EXISTS user_public_keys (
+			tenant TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			public_key BYTEA NOT NULL, -- X25519
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			updated_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (tenant, user_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS record_key_grants (
+			id SERIAL PRIMARY KEY,
+			cid TEXT NOT NULL,
+			recipient_tenant TEXT NOT NULL,
+			recipient_user TEXT NOT NULL,
+			algorithm TEXT NOT NULL, -- how the data key was wrapped
+			key_fingerprint TEXT NOT NULL, -- recipient public key at grant time
+			wrapped_key BYTEA NOT NULL,
+			granted_by TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			revoked_at TIMESTAMPTZ,
+			UNIQUE (cid, recipient_tenant, recipient_user)
+		);`,
+
+		// Webhook tables
+		`CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+			id SERIAL PRIMARY KEY,
+			tenant TEXT NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL, -- HMAC key for X-Filcdn-Signature
+			events TEXT[] NOT NULL DEFAULT '{}', -- empty means all events
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_events (
+			id BIGSERIAL PRIMARY KEY,
+			tenant TEXT NOT NULL,
+			type TEXT NOT NULL,
+			data JSONB NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id BIGSERIAL PRIMARY KEY,
+			subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (id),
+			event_id BIGINT NOT NULL REFERENCES webhook_events (id),
+			replay_of BIGINT,
+			status TEXT NOT NULL DEFAULT 'pending', -- pending, delivered, failed, cancelled
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_status_code INTEGER,
+			last_error TEXT,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			delivered_at TIMESTAMPTZ
+		);`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at)
+			WHERE status = 'pending';`,
+		`CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+			id BIGSERIAL PRIMARY KEY,
+			delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries (id),
+			attempt INTEGER NOT NULL,
+			status_code INTEGER,
+			error TEXT,
+			response_body TEXT, -- status line; the body is not kept
+			duration_ms INTEGER NOT NULL,
+			attempted_at TIMESTAMPTZ DEFAULT NOW()
+		);`,
+
+		// Idempotency-Key replay store
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			tenant TEXT NOT NULL,
+			key TEXT NOT NULL,
+			fingerprint TEXT NOT NULL, -- SHA-256 of method, path, query and body
+			status TEXT NOT NULL DEFAULT 'processing', -- processing, completed
+			response_status INTEGER,
+			response_headers JSONB,
+			response_body BYTEA,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			locked_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			completed_at TIMESTAMPTZ,
+			PRIMARY KEY (tenant, key)
+		);`,
+
+		// Upload intents: recorded before a file reaches the provider and
+		// completed in the same transaction as its metadata
+		`CREATE TABLE IF NOT EXISTS upload_intents (
+			id BIGSERIAL PRIMARY KEY,
+			tenant TEXT NOT NULL DEFAULT '',
+			data_type TEXT NOT NULL, -- paper, genome, spectrum, file
+			source TEXT NOT NULL, -- upload, batch, tus, legacy, reconciler
+			source_ref TEXT,
+			filename TEXT NOT NULL DEFAULT '',
+			proof_set_id TEXT,
+			service_url TEXT,
+			service_name TEXT,
+			metadata JSONB NOT NULL DEFAULT '{}',
+			root_cid TEXT,
+			encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+			state TEXT NOT NULL DEFAULT 'pending', -- pending, uploaded, root_added, completed, failed, needs_attention, resolved
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			resolution TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS upload_intents_open_idx ON upload_intents (state, updated_at)
+			WHERE state IN ('pending', 'uploaded', 'root_added', 'needs_attention');`,
+		`CREATE INDEX IF NOT EXISTS upload_intents_source_idx ON upload_intents (source, source_ref);`,
+		// The tenant that uploaded each record; NULL when anonymous or unknown
+		`ALTER TABLE file_cids ADD COLUMN IF NOT EXISTS tenant TEXT;`,
+		`UPDATE file_cids f SET tenant = NULLIF(i.tenant, '')
+		   FROM upload_intents i
+		  WHERE f.tenant IS NULL AND i.state = 'completed' AND i.root_cid = f.cid;`,
+
+		// Proof set health time series
+		`CREATE TABLE IF NOT EXISTS proof_set_health (
+			id BIGSERIAL PRIMARY KEY,
+			proof_set_id TEXT NOT NULL,
+			service_url TEXT NOT NULL,
+			service_name TEXT NOT NULL,
+			checked_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			status TEXT NOT NULL, -- healthy, faulted, missed_deadline, not_proving, error
+			current_epoch BIGINT NOT NULL,
+			next_challenge_epoch BIGINT,
+			last_proven_epoch BIGINT,
+			faulted_roots INTEGER,
+			roots INTEGER NOT NULL DEFAULT 0,
+			error TEXT
+		);`,
+		`CREATE INDEX IF NOT EXISTS proof_set_health_idx ON proof_set_health (proof_set_id, checked_at DESC);`,
+
+		// Registered providers and replication
+		`CREATE TABLE IF NOT EXISTS providers (
+			id BIGSERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			service_url TEXT NOT NULL UNIQUE,
+			service_name TEXT NOT NULL DEFAULT '',
+			proof_set_id TEXT NOT NULL, -- where replica roots are added
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS replication_policies (
+			data_type TEXT PRIMARY KEY, -- paper, genome, spectrum, file
+			copies INTEGER NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS record_replication (
+			cid TEXT PRIMARY KEY,
+			copies INTEGER NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS replicas (
+			id BIGSERIAL PRIMARY KEY,
+			cid TEXT NOT NULL,
+			root_cid TEXT NOT NULL,
+			service_url TEXT NOT NULL,
+			service_name TEXT NOT NULL DEFAULT '',
+			proof_set_id TEXT NOT NULL,
+			is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+			status TEXT NOT NULL, -- uploaded, stored, failed; removing, removed once deleted
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (cid, service_url)
+		);`,
+		// Records stored before replication have their primary copy only
+		`INSERT INTO replicas (cid, root_cid, service_url, service_name, proof_set_id, is_primary, status)
+		 SELECT DISTINCT ON (cid, service_url) cid, cid, service_url, COALESCE(service_name, ''), proof_set_id, TRUE, 'stored'
+		   FROM file_cids
+		  WHERE deleted_at IS NULL AND service_url <> '' AND proof_set_id IS NOT NULL
+		  ORDER BY cid, service_url, id
+		 ON CONFLICT (cid, service_url) DO NOTHING;`,
+		`CREATE TABLE IF NOT EXISTS proof_set_pool (
+			id BIGSERIAL PRIMARY KEY,
+			tenant TEXT NOT NULL,
+			service_url TEXT NOT NULL,
+			service_name TEXT NOT NULL DEFAULT '',
+			proof_set_id TEXT,
+			tx_hash TEXT,
+			status TEXT NOT NULL, -- creating, active, full, failed
+			roots INTEGER NOT NULL DEFAULT 0,
+			bytes BIGINT NOT NULL DEFAULT 0,
+			last_error TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		// At most one proof set is being created per pool
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_proof_set_pool_creating
+			ON proof_set_pool (tenant, service_url, service_name) WHERE status = 'creating';`,
+		`CREATE INDEX IF NOT EXISTS idx_proof_set_pool_active
+			ON proof_set_pool (tenant, service_url, service_name, id) WHERE status = 'active';`,
+		`CREATE TABLE IF NOT EXISTS proof_set_assignments (
+			id BIGSERIAL PRIMARY KEY,
+			cid TEXT NOT NULL,
+			pool_id BIGINT NOT NULL REFERENCES proof_set_pool(id),
+			tenant TEXT NOT NULL,
+			proof_set_id TEXT NOT NULL,
+			bytes BIGINT NOT NULL DEFAULT 0,
+			assigned_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_proof_set_assignments_cid ON proof_set_assignments (cid);`,
+
+		// Malware scans of uploads
+		`CREATE TABLE IF NOT EXISTS scan_audit (
+			id BIGSERIAL PRIMARY KEY,
+			tenant TEXT NOT NULL,
+			data_type TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			sha256 TEXT,
+			scanner TEXT NOT NULL,
+			verdict TEXT NOT NULL, -- clean, infected, error
+			signature TEXT,
+			error TEXT,
+			action TEXT NOT NULL, -- stored, quarantined, rejected, allowed
+			quarantine_path TEXT,
+			scanned_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+
+		// Facts about the bytes received for each root
+		`CREATE TABLE IF NOT EXISTS file_facts (
+			cid TEXT PRIMARY KEY,
+			original_name TEXT NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			mime_type TEXT NOT NULL,
+			sha256 TEXT NOT NULL,
+			recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
 	}
 
 	// Execute each CREATE TABLE statement
@@ -97,55 +584,192 @@ func init() {
 	fmt.Println("[DB] All tables created successfully")
 }
 
-// newPDPCommand returns a command configured to run pdptool with debug output
-func newPDPCommand(args ...string) *exec.Cmd {
+// newPDPCommand returns a command configured to run pdptool.
+// The process is killed when ctx is done.
+func newPDPCommand(ctx context.Context, args ...string) *exec.Cmd {
 	dir := filepath.Dir(pdpToolPath)
-	cmd := exec.Command(pdpToolPath, args...)
+	cmd := exec.CommandContext(ctx, pdpToolPath, args...)
 	cmd.Dir = dir
+	cmd.WaitDelay = 5 * time.Second // don't wait forever on output pipes after a kill
 	fmt.Printf("[CMD] Dir: %s, Executable: %s, Args: %v\n", dir, pdpToolPath, args)
-	// List files in dir for debugging
-	files, err := os.ReadDir(dir)
+	return cmd
+}
+
+// pdpTimeouts are the time limits of pdptool commands; commands not listed
+// get pdpDefaultTimeout. Waiting for a new proof set is bounded by
+// proofSetCreateDeadline, polling every proofSetPollInterval. add-roots
+// outlives the request that started it by up to addRootsDeadline, queueing
+// and retries included.
+var (
+	pdpTimeouts            = map[string]time.Duration{}
+	pdpDefaultTimeout      time.Duration
+	proofSetCreateDeadline time.Duration
+	proofSetPollInterval   time.Duration
+	addRootsDeadline       time.Duration
+)
+
+// runPDP runs a pdptool command under ctx and the command's time limit and
+// returns its combined output. The command first waits for a slot in
+// pdpSlots, which the time limit does not cover. A run cut short by ctx or
+// the limit is a pdpError of kind timeout or canceled.
+func runPDP(ctx context.Context, args ...string) ([]byte, error) {
+	release, err := pdpSlots.acquire(ctx, args[0], argValue(args, "--service-url"))
 	if err != nil {
-		fmt.Printf("[DEBUG] Error reading dir %s: %v\n", dir, err)
-	} else {
-		fmt.Printf("[DEBUG] Files in %s: ", dir)
-		for _, f := range files {
-			fmt.Printf("%s ", f.Name())
+		return nil, err
+	}
+	defer release()
+	noteProviderCall(ctx, args[0])
+
+	timeout, ok := pdpTimeouts[args[0]]
+	if !ok {
+		timeout = pdpDefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	out, err := newPDPCommand(ctx, args...).CombinedOutput()
+	if err != nil && ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return out, &pdpError{Op: args[0], Kind: pdpTimeout, Output: fmt.Sprintf("killed after %s: %s", timeout, strings.TrimSpace(string(out)))}
 		}
-		fmt.Println()
+		return out, &pdpError{Op: args[0], Kind: pdpCanceled, Output: "request canceled: " + strings.TrimSpace(string(out))}
 	}
-	return cmd
+	return out, err
 }
 
 func main() {
-	r := gin.New()
-	r.Use(gin.Logger(), gin.Recovery())
+	initDB()
+	r := setupRouter()
+
+	go runDeletionWorker()
+	go runWebhookWorker()
+	go runIdempotencySweeper()
+	go runReconciler()
+	go runVerifier()
+	go runHealthMonitor()
+	go runReplicationRepair()
+	go runProofSetPool()
+	resumeTusProcessing()
 
-	r.Use(cors.Default())
+	fmt.Println("[START] Server listening on :8080")
+	r.Run(":8080")
+}
 
+// setupRouter registers every route. The OpenAPI test walks the routes
+// registered here, so new routes must also be described in openapi.go.
+func setupRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Logger(), gin.Recovery(), requestIDMiddleware)
+
+	// Default CORS plus the headers browser tus and progress clients send and read
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	corsConfig.AddAllowHeaders("Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "X-Upload-ID", "X-Request-ID", "Idempotency-Key")
+	corsConfig.AddExposeHeaders("Location", "Tus-Resumable", "Tus-Version", "Tus-Extension",
+		"Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Metadata", "X-Request-ID", "Idempotent-Replayed")
+	r.Use(cors.New(corsConfig))
+	r.Use(tenantMiddleware)
+
+	// The same routes twice: /api keeps its original response shapes,
+	// /api/v2 wraps them in the uniform envelopes (see envelope.go)
+	registerAPIRoutes(r.Group("/api"))
+	registerAPIRoutes(r.Group("/api/v2", v2Middleware))
+	r.NoRoute(noRouteHandler)
+
+	// API description
+	r.GET("/openapi.json", openAPIHandler)
+	r.GET("/docs", docsHandler)
+
+	return r
+}
+
+// registerAPIRoutes registers the API on a /api or /api/v2 group
+// Mutating routes take an Idempotency-Key (see idempotency.go); tus PATCH
+// is already safe to retry thanks to Upload-Offset.
+func registerAPIRoutes(api *gin.RouterGroup) {
 	// Combined orchestrator endpoint
-	r.POST("/api/pdp", orchestrateHandler)
+	api.POST("/pdp", idempotencyMiddleware, orchestrateHandler)
 
 	// Specialized upload endpoints
-	r.POST("/api/upload/paper", uploadAndAddPaperHandler)
-	r.POST("/api/upload/genome", uploadAndAddGenomeHandler)
-	r.POST("/api/upload/spectrum", uploadAndAddSpectrumHandler)
+	api.POST("/upload/paper", progressMiddleware, idempotencyMiddleware, uploadAndAddPaperHandler)
+	api.POST("/upload/genome", progressMiddleware, idempotencyMiddleware, uploadAndAddGenomeHandler)
+	api.POST("/upload/spectrum", progressMiddleware, idempotencyMiddleware, uploadAndAddSpectrumHandler)
+	api.POST("/upload/:type/batch", progressMiddleware, idempotencyMiddleware, uploadBatchHandler)
+
+	// Upload progress (Server-Sent Events), keyed by the X-Upload-ID request header
+	api.GET("/uploads/:id/events", uploadEventsHandler)
+
+	// Resumable uploads (tus protocol)
+	tus := api.Group("/tus", tusMiddleware)
+	tus.OPTIONS("/", tusOptionsHandler)
+	tus.POST("/", idempotencyMiddleware, tusCreateHandler)
+	tus.HEAD("/:id", tusHeadHandler)
+	tus.PATCH("/:id", tusPatchHandler)
+	tus.GET("/:id", tusStatusHandler)
+	tus.DELETE("/:id", idempotencyMiddleware, tusDeleteHandler)
 
 	// Generic query endpoint - flexible data retrieval
-	r.GET("/api/data/:type", queryDataHandler)
-	r.GET("/api/data/:type/:cid", getDataByIDHandler)
+	api.GET("/data/:type", queryDataHandler)
+	api.GET("/data/:type/:cid", getDataByIDHandler)
+	api.GET("/data/:type/:cid/history", getDataHistoryHandler)
+	api.GET("/content/:cid", getContentHandler)
+
+	// Sharing encrypted records
+	api.PUT("/users/:user/public-key", idempotencyMiddleware, registerPublicKeyHandler)
+	api.GET("/users/:user/public-key", getPublicKeyHandler)
+	api.POST("/records/:cid/encryption", idempotencyMiddleware, registerEncryptionHandler)
+	api.POST("/records/:cid/recipients", idempotencyMiddleware, shareRecordHandler)
+	api.GET("/records/:cid/recipients", listRecipientsHandler)
+	api.DELETE("/records/:cid/recipients/:user", idempotencyMiddleware, revokeRecipientHandler)
+	api.GET("/records/:cid/keys/:user", getWrappedKeyHandler)
+
+	// Webhook subscriptions and delivery logs
+	api.POST("/webhooks", idempotencyMiddleware, createWebhookHandler)
+	api.GET("/webhooks", listWebhooksHandler)
+	api.DELETE("/webhooks/:id", idempotencyMiddleware, deleteWebhookHandler)
+	api.GET("/webhooks/:id/deliveries", listDeliveriesHandler)
+	api.GET("/webhooks/:id/deliveries/:deliveryId", getDeliveryHandler)
+	api.POST("/webhooks/:id/deliveries/:deliveryId/replay", idempotencyMiddleware, replayDeliveryHandler)
+
+	// Metadata editing
+	api.PATCH("/data/:type/:cid", idempotencyMiddleware, patchDataHandler)
+	api.PUT("/data/:type/:cid/:field", idempotencyMiddleware, replaceDataFieldHandler)
+	api.DELETE("/data/:type/:cid", idempotencyMiddleware, deleteDataHandler)
+
+	// Root removal and data deletion lifecycle
+	api.POST("/deletions", idempotencyMiddleware, createDeletionHandler)
+	api.GET("/deletions", listDeletionsHandler)
+	api.GET("/deletions/:id", getDeletionHandler)
+	api.POST("/deletions/:id/undo", idempotencyMiddleware, undoDeletionHandler)
+
+	// Upload intents left behind by failed or interrupted uploads (admins only)
+	api.GET("/admin/intents", listIntentsHandler)
+	api.GET("/admin/intents/:id", getIntentHandler)
+	api.POST("/admin/intents/:id/retry", idempotencyMiddleware, retryIntentHandler)
+	api.POST("/admin/intents/:id/resolve", idempotencyMiddleware, resolveIntentHandler)
+	api.GET("/admin/pdp-queue", pdpQueueHandler)
+	api.GET("/admin/scans", listScansHandler)
+
+	// Storage providers and replication
+	api.GET("/admin/providers", listProvidersHandler)
+	api.POST("/admin/providers", idempotencyMiddleware, registerProviderHandler)
+	api.DELETE("/admin/providers/:id", idempotencyMiddleware, deactivateProviderHandler)
+	api.GET("/admin/replication-policies", replicationPoliciesHandler)
+	api.PUT("/admin/replication-policies/:type", idempotencyMiddleware, setReplicationPolicyHandler)
+	api.GET("/data/:type/:cid/replicas", getReplicasHandler)
+	api.PUT("/data/:type/:cid/replication", idempotencyMiddleware, setRecordReplicationHandler)
 
 	// Legacy endpoints
-	r.POST("/api/ping", pingHandler)
-	r.POST("/api/proof-sets", createProofSetHandler)
-	r.GET("/api/proof-sets/:txHash/status", getProofSetStatusHandler)
-	r.POST("/api/upload", uploadFileHandler)
-	r.POST("/api/proof-sets/:proofSetId/roots", addRootsHandler)
-	r.POST("/api/proofset/upload-and-add-root", uploadAndAddRootHandler)
-	r.GET("/api/cids", listCIDsHandler)
-
-	fmt.Println("[START] Server listening on :8080")
-	r.Run(":8080")
+	api.POST("/ping", idempotencyMiddleware, pingHandler)
+	api.POST("/proof-sets", idempotencyMiddleware, createProofSetHandler)
+	api.GET("/proof-sets", listProofSetsHandler)
+	api.GET("/proof-sets/pool", listProofSetPoolHandler)
+	api.GET("/proof-sets/:id/status", getProofSetStatusHandler) // id is the creation tx hash
+	api.GET("/proof-sets/:id/health", getProofSetHealthHandler)
+	api.POST("/upload", idempotencyMiddleware, uploadFileHandler)
+	api.POST("/proof-sets/:proofSetId/roots", idempotencyMiddleware, addRootsHandler)
+	api.POST("/proofset/upload-and-add-root", progressMiddleware, idempotencyMiddleware, uploadAndAddRootHandler)
+	api.GET("/cids", listCIDsHandler)
 }
 
 // queryDataHandler provides flexible querying for all data types
@@ -170,6 +794,13 @@ func queryDataHandler(c *gin.Context) {
 		return
 	}
 
+	if status := c.Query("verification"); dataType == "file_cids" && status != "" && status != "unverified" && !verificationStatuses[status] {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid verification status. Valid statuses: verified, missing, not_proving, unretrievable, error, unverified",
+		})
+		return
+	}
+
 	// Parse query parameters
 	limit := parseIntParam(c, "limit", 20)  // default 20
 	offset := parseIntParam(c, "offset", 0) // default 0
@@ -207,16 +838,13 @@ func queryDataHandler(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"data": results,
-		"pagination": gin.H{
-			"total":  totalCount,
-			"limit":  limit,
-			"offset": offset,
-			"count":  getResultCount(results),
-		},
-		"sort": gin.H{
-			"by":    sortBy,
-			"order": sortOrder,
+		"pagination": filcdn.Pagination{
+			Total:  totalCount,
+			Limit:  limit,
+			Offset: offset,
+			Count:  getResultCount(results),
 		},
+		"sort": filcdn.Sort{By: sortBy, Order: sortOrder},
 	})
 }
 
@@ -271,7 +899,7 @@ func getDataByIDHandler(c *gin.Context) {
 // Query functions for each data type
 func queryPapers(c *gin.Context, limit, offset int, sortBy, sortOrder string) (interface{}, int, error) {
 	// Build WHERE clause based on query parameters
-	var whereClauses []string
+	whereClauses := []string{"deleted_at IS NULL"}
 	var args []interface{}
 	argIndex := 1
 
@@ -306,14 +934,12 @@ func queryPapers(c *gin.Context, limit, offset int, sortBy, sortOrder string) (i
 	}
 
 	// Build query
-	whereClause := ""
-	if len(whereClauses) > 0 {
-		whereClause = "WHERE " + strings.Join(whereClauses, " AND ")
-	}
+	whereClause := "WHERE " + strings.Join(whereClauses, " AND ")
 
 	// Validate sortBy for papers
 	validSortFields := map[string]bool{
 		"created_at": true,
+		"updated_at": true,
 		"title":      true,
 		"journal":    true,
 		"year":       true,
@@ -333,8 +959,8 @@ func queryPapers(c *gin.Context, limit, offset int, sortBy, sortOrder string) (i
 
 	// Get results
 	query := fmt.Sprintf(`
-		SELECT cid, title, journal, year, keywords, created_at 
-		FROM paper %s 
+		SELECT cid, title, journal, year, keywords, created_at, updated_at, `+factsColumns+`
+		FROM paper LEFT JOIN file_facts ff USING (cid) %s 
 		ORDER BY %s %s 
 		LIMIT $%d OFFSET $%d`,
 		whereClause, sortBy, sortOrder, argIndex, argIndex+1)
@@ -347,35 +973,23 @@ func queryPapers(c *gin.Context, limit, offset int, sortBy, sortOrder string) (i
 	}
 	defer rows.Close()
 
-	var papers []map[string]interface{}
+	var papers []filcdn.Paper
 	for rows.Next() {
-		var cid, title string
-		var journal *string
-		var year *int
-		var keywords []string
-		var createdAt time.Time
-
-		err := rows.Scan(&cid, &title, &journal, &year, &keywords, &createdAt)
+		var p filcdn.Paper
+		var fs factsScan
+		err := rows.Scan(append([]any{&p.CID, &p.Title, &p.Journal, &p.Year, &p.Keywords, &p.CreatedAt, &p.UpdatedAt}, fs.dest()...)...)
 		if err != nil {
 			return nil, 0, err
 		}
-
-		paper := map[string]interface{}{
-			"cid":        cid,
-			"title":      title,
-			"journal":    journal,
-			"year":       year,
-			"keywords":   keywords,
-			"created_at": createdAt,
-		}
-		papers = append(papers, paper)
+		p.Facts = fs.facts()
+		papers = append(papers, p)
 	}
 
 	return papers, totalCount, nil
 }
 
 func queryGenomes(c *gin.Context, limit, offset int, sortBy, sortOrder string) (interface{}, int, error) {
-	var whereClauses []string
+	whereClauses := []string{"deleted_at IS NULL"}
 	var args []interface{}
 	argIndex := 1
 
@@ -400,14 +1014,12 @@ func queryGenomes(c *gin.Context, limit, offset int, sortBy, sortOrder string) (
 		argIndex++
 	}
 
-	whereClause := ""
-	if len(whereClauses) > 0 {
-		whereClause = "WHERE " + strings.Join(whereClauses, " AND ")
-	}
+	whereClause := "WHERE " + strings.Join(whereClauses, " AND ")
 
 	// Validate sortBy for genomes
 	validSortFields := map[string]bool{
 		"created_at":       true,
+		"updated_at":       true,
 		"organism":         true,
 		"assembly_version": true,
 		"cid":              true,
@@ -426,8 +1038,8 @@ func queryGenomes(c *gin.Context, limit, offset int, sortBy, sortOrder string) (
 
 	// Get results
 	query := fmt.Sprintf(`
-		SELECT cid, organism, assembly_version, notes, created_at 
-		FROM genome %s 
+		SELECT cid, organism, assembly_version, notes, created_at, updated_at, `+factsColumns+`
+		FROM genome LEFT JOIN file_facts ff USING (cid) %s 
 		ORDER BY %s %s 
 		LIMIT $%d OFFSET $%d`,
 		whereClause, sortBy, sortOrder, argIndex, argIndex+1)
@@ -440,32 +1052,23 @@ func queryGenomes(c *gin.Context, limit, offset int, sortBy, sortOrder string) (
 	}
 	defer rows.Close()
 
-	var genomes []map[string]interface{}
+	var genomes []filcdn.Genome
 	for rows.Next() {
-		var cid, organism string
-		var assemblyVersion, notes *string
-		var createdAt time.Time
-
-		err := rows.Scan(&cid, &organism, &assemblyVersion, &notes, &createdAt)
+		var g filcdn.Genome
+		var fs factsScan
+		err := rows.Scan(append([]any{&g.CID, &g.Organism, &g.AssemblyVersion, &g.Notes, &g.CreatedAt, &g.UpdatedAt}, fs.dest()...)...)
 		if err != nil {
 			return nil, 0, err
 		}
-
-		genome := map[string]interface{}{
-			"cid":              cid,
-			"organism":         organism,
-			"assembly_version": assemblyVersion,
-			"notes":            notes,
-			"created_at":       createdAt,
-		}
-		genomes = append(genomes, genome)
+		g.Facts = fs.facts()
+		genomes = append(genomes, g)
 	}
 
 	return genomes, totalCount, nil
 }
 
 func querySpectrums(c *gin.Context, limit, offset int, sortBy, sortOrder string) (interface{}, int, error) {
-	var whereClauses []string
+	whereClauses := []string{"deleted_at IS NULL"}
 	var args []interface{}
 	argIndex := 1
 
@@ -490,14 +1093,12 @@ func querySpectrums(c *gin.Context, limit, offset int, sortBy, sortOrder string)
 		argIndex++
 	}
 
-	whereClause := ""
-	if len(whereClauses) > 0 {
-		whereClause = "WHERE " + strings.Join(whereClauses, " AND ")
-	}
+	whereClause := "WHERE " + strings.Join(whereClauses, " AND ")
 
 	// Validate sortBy for spectrums
 	validSortFields := map[string]bool{
 		"created_at":          true,
+		"updated_at":          true,
 		"compound":            true,
 		"technique_nmr_ir_ms": true,
 		"cid":                 true,
@@ -516,8 +1117,8 @@ func querySpectrums(c *gin.Context, limit, offset int, sortBy, sortOrder string)
 
 	// Get results
 	query := fmt.Sprintf(`
-		SELECT cid, compound, technique_nmr_ir_ms, metadata_json, created_at 
-		FROM spectrum %s 
+		SELECT cid, compound, technique_nmr_ir_ms, metadata_json, created_at, updated_at, `+factsColumns+`
+		FROM spectrum LEFT JOIN file_facts ff USING (cid) %s 
 		ORDER BY %s %s 
 		LIMIT $%d OFFSET $%d`,
 		whereClause, sortBy, sortOrder, argIndex, argIndex+1)
@@ -530,39 +1131,25 @@ func querySpectrums(c *gin.Context, limit, offset int, sortBy, sortOrder string)
 	}
 	defer rows.Close()
 
-	var spectrums []map[string]interface{}
+	var spectrums []filcdn.Spectrum
 	for rows.Next() {
-		var cid, compound string
-		var technique *string
+		var s filcdn.Spectrum
 		var metadataJson *string
-		var createdAt time.Time
-
-		err := rows.Scan(&cid, &compound, &technique, &metadataJson, &createdAt)
+		var fs factsScan
+		err := rows.Scan(append([]any{&s.CID, &s.Compound, &s.Technique, &metadataJson, &s.CreatedAt, &s.UpdatedAt}, fs.dest()...)...)
 		if err != nil {
 			return nil, 0, err
 		}
-
-		// Parse JSON metadata
-		var metadata interface{}
-		if metadataJson != nil && *metadataJson != "" {
-			json.Unmarshal([]byte(*metadataJson), &metadata)
-		}
-
-		spectrum := map[string]interface{}{
-			"cid":        cid,
-			"compound":   compound,
-			"technique":  technique,
-			"metadata":   metadata,
-			"created_at": createdAt,
-		}
-		spectrums = append(spectrums, spectrum)
+		s.Metadata = spectrumMetadata(metadataJson)
+		s.Facts = fs.facts()
+		spectrums = append(spectrums, s)
 	}
 
 	return spectrums, totalCount, nil
 }
 
 func queryFileCids(c *gin.Context, limit, offset int, sortBy, sortOrder string) (interface{}, int, error) {
-	var whereClauses []string
+	whereClauses := []string{"deleted_at IS NULL"}
 	var args []interface{}
 	argIndex := 1
 
@@ -573,17 +1160,24 @@ func queryFileCids(c *gin.Context, limit, offset int, sortBy, sortOrder string)
 		argIndex++
 	}
 
-	whereClause := ""
-	if len(whereClauses) > 0 {
-		whereClause = "WHERE " + strings.Join(whereClauses, " AND ")
+	// Filter by verification status; "unverified" matches roots not yet checked
+	if status := c.Query("verification"); status == "unverified" {
+		whereClauses = append(whereClauses, "verification_status IS NULL")
+	} else if status != "" {
+		whereClauses = append(whereClauses, fmt.Sprintf("verification_status = $%d", argIndex))
+		args = append(args, status)
+		argIndex++
 	}
 
+	whereClause := "WHERE " + strings.Join(whereClauses, " AND ")
+
 	// Validate sortBy for file_cids
 	validSortFields := map[string]bool{
-		"uploaded_at": true,
-		"filename":    true,
-		"cid":         true,
-		"id":          true,
+		"uploaded_at":      true,
+		"filename":         true,
+		"cid":              true,
+		"id":               true,
+		"last_verified_at": true,
 	}
 	if !validSortFields[sortBy] {
 		sortBy = "uploaded_at"
@@ -599,8 +1193,8 @@ func queryFileCids(c *gin.Context, limit, offset int, sortBy, sortOrder string)
 
 	// Get results
 	query := fmt.Sprintf(`
-		SELECT id, filename, cid, uploaded_at 
-		FROM file_cids %s 
+		SELECT `+fileCidColumns+`, `+factsColumns+`
+		FROM file_cids LEFT JOIN file_facts ff USING (cid) %s 
 		ORDER BY %s %s 
 		LIMIT $%d OFFSET $%d`,
 		whereClause, sortBy, sortOrder, argIndex, argIndex+1)
@@ -613,125 +1207,94 @@ func queryFileCids(c *gin.Context, limit, offset int, sortBy, sortOrder string)
 	}
 	defer rows.Close()
 
-	var files []map[string]interface{}
+	var files []filcdn.FileCID
 	for rows.Next() {
-		var id int
-		var filename, cid string
-		var uploadedAt time.Time
-
-		err := rows.Scan(&id, &filename, &cid, &uploadedAt)
+		var f filcdn.FileCID
+		var fs factsScan
+		err := rows.Scan(append([]any{&f.ID, &f.Filename, &f.CID, &f.ProofSetID, &f.UploadedAt,
+			&f.LastVerifiedAt, &f.VerificationStatus, &f.VerificationError}, fs.dest()...)...)
 		if err != nil {
 			return nil, 0, err
 		}
-
-		file := map[string]interface{}{
-			"id":          id,
-			"filename":    filename,
-			"cid":         cid,
-			"uploaded_at": uploadedAt,
-		}
-		files = append(files, file)
+		f.Facts = fs.facts()
+		files = append(files, f)
 	}
 
 	return files, totalCount, nil
 }
 
 // Individual record retrieval functions
-func getPaperByCID(cid string) (interface{}, error) {
-	var title string
-	var journal *string
-	var year *int
-	var keywords []string
-	var createdAt time.Time
-
+func getPaperByCID(cid string) (*filcdn.Paper, error) {
+	var p filcdn.Paper
+	var fs factsScan
 	err := db.QueryRow(context.Background(),
-		"SELECT cid, title, journal, year, keywords, created_at FROM paper WHERE cid = $1",
-		cid).Scan(&cid, &title, &journal, &year, &keywords, &createdAt)
+		"SELECT cid, title, journal, year, keywords, created_at, updated_at, "+factsColumns+
+			" FROM paper LEFT JOIN file_facts ff USING (cid) WHERE cid = $1 AND deleted_at IS NULL",
+		cid).Scan(append([]any{&p.CID, &p.Title, &p.Journal, &p.Year, &p.Keywords, &p.CreatedAt, &p.UpdatedAt}, fs.dest()...)...)
 
 	if err != nil {
 		return nil, err
 	}
-
-	return map[string]interface{}{
-		"cid":        cid,
-		"title":      title,
-		"journal":    journal,
-		"year":       year,
-		"keywords":   keywords,
-		"created_at": createdAt,
-	}, nil
+	p.Facts = fs.facts()
+	return &p, nil
 }
 
-func getGenomeByCID(cid string) (interface{}, error) {
-	var organism string
-	var assemblyVersion, notes *string
-	var createdAt time.Time
-
+func getGenomeByCID(cid string) (*filcdn.Genome, error) {
+	var g filcdn.Genome
+	var fs factsScan
 	err := db.QueryRow(context.Background(),
-		"SELECT cid, organism, assembly_version, notes, created_at FROM genome WHERE cid = $1",
-		cid).Scan(&cid, &organism, &assemblyVersion, &notes, &createdAt)
+		"SELECT cid, organism, assembly_version, notes, created_at, updated_at, "+factsColumns+
+			" FROM genome LEFT JOIN file_facts ff USING (cid) WHERE cid = $1 AND deleted_at IS NULL",
+		cid).Scan(append([]any{&g.CID, &g.Organism, &g.AssemblyVersion, &g.Notes, &g.CreatedAt, &g.UpdatedAt}, fs.dest()...)...)
 
 	if err != nil {
 		return nil, err
 	}
-
-	return map[string]interface{}{
-		"cid":              cid,
-		"organism":         organism,
-		"assembly_version": assemblyVersion,
-		"notes":            notes,
-		"created_at":       createdAt,
-	}, nil
+	g.Facts = fs.facts()
+	return &g, nil
 }
 
-func getSpectrumByCID(cid string) (interface{}, error) {
-	var compound string
-	var technique *string
+func getSpectrumByCID(cid string) (*filcdn.Spectrum, error) {
+	var s filcdn.Spectrum
 	var metadataJson *string
-	var createdAt time.Time
-
+	var fs factsScan
 	err := db.QueryRow(context.Background(),
-		"SELECT cid, compound, technique_nmr_ir_ms, metadata_json, created_at FROM spectrum WHERE cid = $1",
-		cid).Scan(&cid, &compound, &technique, &metadataJson, &createdAt)
+		"SELECT cid, compound, technique_nmr_ir_ms, metadata_json, created_at, updated_at, "+factsColumns+
+			" FROM spectrum LEFT JOIN file_facts ff USING (cid) WHERE cid = $1 AND deleted_at IS NULL",
+		cid).Scan(append([]any{&s.CID, &s.Compound, &s.Technique, &metadataJson, &s.CreatedAt, &s.UpdatedAt}, fs.dest()...)...)
 
 	if err != nil {
 		return nil, err
 	}
+	s.Metadata = spectrumMetadata(metadataJson)
+	s.Facts = fs.facts()
+	return &s, nil
+}
 
-	// Parse JSON metadata
-	var metadata interface{}
-	if metadataJson != nil && *metadataJson != "" {
-		json.Unmarshal([]byte(*metadataJson), &metadata)
+// spectrumMetadata returns the stored metadata JSON, or nil for null
+func spectrumMetadata(metadataJson *string) json.RawMessage {
+	if metadataJson == nil || *metadataJson == "" {
+		return nil
 	}
-
-	return map[string]interface{}{
-		"cid":        cid,
-		"compound":   compound,
-		"technique":  technique,
-		"metadata":   metadata,
-		"created_at": createdAt,
-	}, nil
+	return json.RawMessage(*metadataJson)
 }
 
-func getFileCidByCID(cid string) (interface{}, error) {
-	var id int
-	var filename string
-	var uploadedAt time.Time
+const fileCidColumns = "id, filename, cid, proof_set_id, uploaded_at, last_verified_at, verification_status, verification_error"
 
+func getFileCidByCID(cid string) (*filcdn.FileCID, error) {
+	var f filcdn.FileCID
+	var fs factsScan
 	err := db.QueryRow(context.Background(),
-		"SELECT id, filename, cid, uploaded_at FROM file_cids WHERE cid = $1",
-		cid).Scan(&id, &filename, &cid, &uploadedAt)
+		"SELECT "+fileCidColumns+", "+factsColumns+
+			" FROM file_cids LEFT JOIN file_facts ff USING (cid) WHERE cid = $1 AND deleted_at IS NULL",
+		cid).Scan(append([]any{&f.ID, &f.Filename, &f.CID, &f.ProofSetID, &f.UploadedAt,
+		&f.LastVerifiedAt, &f.VerificationStatus, &f.VerificationError}, fs.dest()...)...)
 
 	if err != nil {
 		return nil, err
 	}
-
-	return map[string]interface{}{
-		"id":          id,
-		"filename":    filename,
-		"cid":         cid,
-		"uploaded_at": uploadedAt,
-	}, nil
+	f.Facts = fs.facts()
+	return &f, nil
 }
 
 // Helper functions
@@ -744,9 +1307,48 @@ func parseIntParam(c *gin.Context, param string, defaultValue int) int {
 	return defaultValue
 }
 
+// envInt reads a positive integer from the environment
+func envInt(name string, defaultValue int) int {
+	if str := os.Getenv(name); str != "" {
+		if val, err := strconv.Atoi(str); err == nil && val > 0 {
+			return val
+		}
+		fmt.Printf("[INIT] Ignoring invalid %s=%q\n", name, str)
+	}
+	return defaultValue
+}
+
+// envDuration reads a Go duration (e.g. "24h") from the environment
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	if str := os.Getenv(name); str != "" {
+		if val, err := time.ParseDuration(str); err == nil && val > 0 {
+			return val
+		}
+		fmt.Printf("[INIT] Ignoring invalid %s=%q\n", name, str)
+	}
+	return defaultValue
+}
+
+// envFraction reads a number in (0, 1] from the environment
+func envFraction(name string, defaultValue float64) float64 {
+	if str := os.Getenv(name); str != "" {
+		if val, err := strconv.ParseFloat(str, 64); err == nil && val > 0 && val <= 1 {
+			return val
+		}
+		fmt.Printf("[INIT] Ignoring invalid %s=%q\n", name, str)
+	}
+	return defaultValue
+}
+
 func getResultCount(results interface{}) int {
 	switch r := results.(type) {
-	case []map[string]interface{}:
+	case []filcdn.Paper:
+		return len(r)
+	case []filcdn.Genome:
+		return len(r)
+	case []filcdn.Spectrum:
+		return len(r)
+	case []filcdn.FileCID:
 		return len(r)
 	default:
 		return 0
@@ -781,12 +1383,6 @@ func uploadAndAddRootHandler(c *gin.Context) {
 	fmt.Printf("[DEBUG] Form params - serviceUrl: %s, serviceName: %s, proofSetID: %s\n",
 		serviceUrl, serviceName, proofSetID)
 
-	if proofSetID == "" {
-		fmt.Printf("[DEBUG] Missing proofSetID, returning 400\n")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "proofSetID is required"})
-		return
-	}
-
 	file, header, err := c.Request.FormFile("file")
 	if err != nil {
 		fmt.Printf("[DEBUG] Failed to get form file: %v\n", err)
@@ -795,6 +1391,13 @@ func uploadAndAddRootHandler(c *gin.Context) {
 	}
 	defer file.Close()
 
+	// Without a proofSetID the file goes to a proof set from the tenant's pool
+	proofSetID, lease, ok := leaseProofSetFor(c, serviceUrl, serviceName, proofSetID, 1, header.Size)
+	if !ok {
+		return
+	}
+	defer lease.done()
+
 	fmt.Printf("[DEBUG] File details - Name: %s, Size: %d bytes, Header: %+v\n",
 		header.Filename, header.Size, header.Header)
 	fmt.Printf("[DEBUG] Content-Type from header: %s\n", header.Header.Get("Content-Type"))
@@ -804,11 +1407,29 @@ func uploadAndAddRootHandler(c *gin.Context) {
 	isEncrypted := strings.HasSuffix(strings.ToLower(header.Filename), ".enc")
 	fmt.Printf("[DEBUG] File is encrypted: %v\n", isEncrypted)
 
+	// Encrypt on the way in when server-side encryption is requested; the
+	// facts describe the plaintext
+	facts := newFactsRecorder()
+	src, env, ok := prepareUploadEncryption(c, io.TeeReader(file, facts))
+	if !ok {
+		return
+	}
+
+	// Record the intent before touching the provider
+	entry := &recordMetadata{Filename: header.Filename}
+	intentID, err := createIntent(tenantOf(c), "file", "legacy", "", entry, proofSetID, serviceUrl, serviceName, env != nil)
+	if err != nil {
+		fmt.Printf("[DB ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload intent"})
+		return
+	}
+
 	// write to temp
 	fmt.Printf("[DEBUG] Creating temporary file\n")
 	tmpFile, err := os.CreateTemp("", "pdp-upload-*")
 	if err != nil {
 		fmt.Printf("[DEBUG] Failed to create temp file: %v\n", err)
+		markIntent(intentID, "failed", "", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -816,14 +1437,18 @@ func uploadAndAddRootHandler(c *gin.Context) {
 	fmt.Printf("[DEBUG] Temp file created: %s\n", tmpPath)
 	defer os.Remove(tmpPath)
 
-	bytesWritten, err := io.Copy(tmpFile, file)
+	progress := progressOf(c)
+	dst, flush := progress.trackWrites(tmpFile, stageTempWrite, header.Size)
+	bytesWritten, err := io.Copy(dst, src)
 	if err != nil {
 		fmt.Printf("[DEBUG] Failed to copy file to temp: %v\n", err)
+		markIntent(intentID, "failed", "", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy file"})
 		return
 	} else {
 		fmt.Printf("[DEBUG] Copied %d bytes to temp file\n", bytesWritten)
 	}
+	flush()
 	tmpFile.Close()
 
 	// Verify temp file size
@@ -831,23 +1456,31 @@ func uploadAndAddRootHandler(c *gin.Context) {
 		fmt.Printf("[DEBUG] Temp file size on disk: %d bytes\n", stat.Size())
 	}
 
+	// Nothing infected may reach the provider
+	if err := scanUpload(c.Request.Context(), scanRequest{dataType: "file", filename: header.Filename, content: file, size: header.Size}); err != nil {
+		markIntent(intentID, "failed", "", err)
+		c.JSON(uploadFailed(c, err), gin.H{"error": err.Error()})
+		return
+	}
+
 	// upload-file
 	fmt.Printf("[DEBUG] Executing upload-file command\n")
-	cmd := newPDPCommand("upload-file", "--service-url", serviceUrl, "--service-name", serviceName, tmpPath)
-	fmt.Printf("[DEBUG] Command: %s\n", cmd.String())
-
-	upOut, err := cmd.CombinedOutput()
+	progress.stage(stageUploadStarted)
+	target := &uploadTarget{serviceURL: serviceUrl, serviceName: serviceName, proofSetID: proofSetID, lease: lease, failover: true}
+	rootCID, err := uploadWithFailover(c.Request.Context(), target, tmpPath)
 	if err != nil {
-		fmt.Printf("[DEBUG] upload-file command failed: %v\n", err)
-		fmt.Printf("[DEBUG] upload-file output: %s\n", string(upOut))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": string(upOut)})
+		fmt.Printf("[DEBUG] upload-file failed: %v\n", err)
+		markIntent(intentID, "failed", "", err)
+		c.JSON(pdpFailed(c, "upload-file", err), gin.H{"error": err.Error()})
 		return
 	}
-
-	fmt.Printf("[DEBUG] upload-file output: %s\n", string(upOut))
-	lines := strings.Split(strings.TrimSpace(string(upOut)), "\n")
-	rootCID := strings.TrimSpace(lines[len(lines)-1]) // full line
+	retargetIntent(intentID, target)
+	serviceUrl, serviceName, proofSetID = target.serviceURL, target.serviceName, target.proofSetID
 	fmt.Printf("[UPLOAD+ADD] rootCID=%s\n", rootCID)
+	progress.emit(progressEvent{Stage: stageUploadFinished, RootCID: rootCID})
+	markIntent(intentID, "uploaded", rootCID, nil)
+	recordFileFacts(rootCID, facts.facts(header.Filename))
+	emitEvent(tenantOf(c), eventUploadCompleted, gin.H{"filename": header.Filename, "rootCID": rootCID})
 
 	// For encrypted files, add a delay to allow service synchronization
 	if isEncrypted {
@@ -855,59 +1488,16 @@ func uploadAndAddRootHandler(c *gin.Context) {
 		time.Sleep(3 * time.Second)
 	}
 
-	// add-roots with retry logic
+	// add-roots under the PDP retry policy
 	fmt.Printf("[DEBUG] Executing add-roots command\n")
-	var arOut []byte
-	var addRootsSuccess bool
-	maxRetries := 3
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		fmt.Printf("[DEBUG] add-roots attempt %d/%d\n", attempt, maxRetries)
-
-		arCmd := newPDPCommand(
-			"add-roots", "--service-url", serviceUrl, "--service-name", serviceName,
-			"--proof-set-id", proofSetID, "--root", rootCID,
-		)
-		fmt.Printf("[DEBUG] Command: %s\n", arCmd.String())
-
-		arOut, err = arCmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("[DEBUG] add-roots attempt %d failed: %v\n", attempt, err)
-			fmt.Printf("[DEBUG] add-roots output: %s\n", string(arOut))
-
-			// Check if it's the "not found" error and we have more retries
-			if strings.Contains(string(arOut), "not found or does not belong to service") && attempt < maxRetries {
-				fmt.Printf("[DEBUG] Retrying after delay (attempt %d/%d)...\n", attempt, maxRetries)
-				time.Sleep(time.Duration(attempt*2) * time.Second) // Exponential backoff
-				continue
-			}
-
-			// If it's the last attempt or a different error, return the error
-			if attempt == maxRetries {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"error": string(arOut),
-					"details": map[string]interface{}{
-						"rootCID":     rootCID,
-						"attempts":    attempt,
-						"isEncrypted": isEncrypted,
-					},
-				})
-				return
-			}
-		} else {
-			fmt.Printf("[DEBUG] add-roots succeeded on attempt %d\n", attempt)
-			addRootsSuccess = true
-			break
-		}
-	}
-
-	if !addRootsSuccess {
-		fmt.Printf("[DEBUG] add-roots failed after all retries\n")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": string(arOut),
+	arOut, err := runAddRoots(c.Request.Context(), serviceUrl, serviceName, proofSetID, []string{rootCID}, progress)
+	if err != nil {
+		markAddRootsFailed(intentID, err)
+		emitEvent(tenantOf(c), eventRootFailed, gin.H{"proofSetID": proofSetID, "rootCID": rootCID, "error": err.Error()})
+		c.JSON(pdpFailed(c, "add-roots", err), gin.H{
+			"error": err.Error(),
 			"details": map[string]interface{}{
 				"rootCID":     rootCID,
-				"maxRetries":  maxRetries,
 				"isEncrypted": isEncrypted,
 			},
 		})
@@ -915,22 +1505,36 @@ func uploadAndAddRootHandler(c *gin.Context) {
 	}
 
 	fmt.Printf("[DEBUG] add-roots output: %s\n", string(arOut))
+	target.lease.assign(rootCID, header.Size)
+	markIntent(intentID, "root_added", "", nil)
+	emitEvent(tenantOf(c), eventRootAdded, gin.H{"proofSetID": proofSetID, "rootCID": rootCID})
+
+	// Without the wrapped key the stored ciphertext is unreadable
+	if env != nil {
+		if err := saveEnvelope(context.Background(), rootCID, env); err != nil {
+			fmt.Printf("[DB ERROR] %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save encryption metadata"})
+			return
+		}
+	}
 
 	// save mapping to DB
 	fmt.Printf("[DEBUG] Saving file mapping to database\n")
-	if _, err := db.Exec(context.Background(),
-		"INSERT INTO file_cids (filename,cid) VALUES ($1,$2)", header.Filename, rootCID); err != nil {
+	if err := saveUploadedRecord(intentID, "file", entry, rootCID, proofSetID, serviceUrl, serviceName); err != nil {
 		fmt.Printf("[DB ERROR] %v\n", err)
-	} else {
-		fmt.Printf("[DEBUG] Successfully saved to database: %s -> %s\n", header.Filename, rootCID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file mapping"})
+		return
 	}
+	fmt.Printf("[DEBUG] Successfully saved to database: %s -> %s\n", header.Filename, rootCID)
+	progress.stage(stageDBSaved)
 
 	fmt.Printf("[DEBUG] Request completed successfully\n")
-	c.JSON(http.StatusOK, gin.H{
-		"proofSetID":  proofSetID,
-		"rootCID":     rootCID,
-		"addRoots":    strings.TrimSpace(string(arOut)),
-		"isEncrypted": isEncrypted,
+	c.JSON(http.StatusOK, filcdn.RootUploadResult{
+		ProofSetID:  proofSetID,
+		ServiceURL:  serviceUrl,
+		RootCID:     rootCID,
+		AddRoots:    strings.TrimSpace(string(arOut)),
+		IsEncrypted: isEncrypted || env != nil,
 	})
 }
 
@@ -963,9 +1567,9 @@ func uploadAndAddPaperHandler(c *gin.Context) {
 	fmt.Printf("[DEBUG] Paper metadata - title: %s, journal: %s, year: %s, keywords: %s\n",
 		title, journal, yearStr, keywordsStr)
 
-	if proofSetID == "" || title == "" {
+	if title == "" {
 		fmt.Printf("[DEBUG] Missing required fields, returning 400\n")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "proofSetID and title are required"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
 		return
 	}
 
@@ -998,45 +1602,91 @@ func uploadAndAddPaperHandler(c *gin.Context) {
 	fmt.Printf("[DEBUG] File details - Name: %s, Size: %d bytes\n", header.Filename, header.Size)
 	fmt.Printf("[UPLOAD+ADD PAPER] %s → proofSet %s\n", header.Filename, proofSetID)
 
+	if !requireFormat(c, "paper", file, header.Filename) {
+		return
+	}
+
+	// Without a proofSetID the file goes to a proof set from the tenant's pool
+	proofSetID, lease, ok := leaseProofSetFor(c, serviceUrl, serviceName, proofSetID, 1, header.Size)
+	if !ok {
+		return
+	}
+	defer lease.done()
+
+	// Encrypt on the way in when server-side encryption is requested; the
+	// facts describe the plaintext
+	facts := newFactsRecorder()
+	src, env, ok := prepareUploadEncryption(c, io.TeeReader(file, facts))
+	if !ok {
+		return
+	}
+
+	// Record the intent before touching the provider
+	entry := &recordMetadata{Filename: header.Filename, Title: title, Journal: journal, Year: year, Keywords: keywords}
+	intentID, err := createIntent(tenantOf(c), "paper", "upload", "", entry, proofSetID, serviceUrl, serviceName, env != nil)
+	if err != nil {
+		fmt.Printf("[DB ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload intent"})
+		return
+	}
+
 	// Upload to storage (reuse existing logic)
-	rootCID, err := uploadFileToStorage(file, header, serviceUrl, serviceName)
+	target := &uploadTarget{serviceURL: serviceUrl, serviceName: serviceName, proofSetID: proofSetID, lease: lease, failover: true}
+	rootCID, err := uploadFileToStorage(c.Request.Context(), src, file, header, target, "paper", progressOf(c))
 	if err != nil {
+		markIntent(intentID, "failed", "", err)
 		fmt.Printf("[DEBUG] Upload failed: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(uploadFailed(c, err), gin.H{"error": err.Error()})
 		return
 	}
+	retargetIntent(intentID, target)
+	serviceUrl, serviceName, proofSetID = target.serviceURL, target.serviceName, target.proofSetID
+	markIntent(intentID, "uploaded", rootCID, nil)
+	recordFileFacts(rootCID, facts.facts(header.Filename))
+	emitEvent(tenantOf(c), eventUploadCompleted, gin.H{"type": "paper", "filename": header.Filename, "rootCID": rootCID})
 
 	// Add to proof set (reuse existing logic)
-	if err := addRootToProofSet(serviceUrl, serviceName, proofSetID, rootCID); err != nil {
+	if err := addRootToProofSet(c.Request.Context(), serviceUrl, serviceName, proofSetID, rootCID, progressOf(c)); err != nil {
+		markAddRootsFailed(intentID, err)
 		fmt.Printf("[DEBUG] Add roots failed: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		emitEvent(tenantOf(c), eventRootFailed, gin.H{"type": "paper", "proofSetID": proofSetID, "rootCID": rootCID, "error": err.Error()})
+		c.JSON(pdpFailed(c, "add-roots", err), gin.H{"error": err.Error()})
 		return
 	}
+	target.lease.assign(rootCID, header.Size)
+	markIntent(intentID, "root_added", "", nil)
+	emitEvent(tenantOf(c), eventRootAdded, gin.H{"type": "paper", "proofSetID": proofSetID, "rootCID": rootCID})
 
-	// Save to database
+	// Without the wrapped key the stored ciphertext is unreadable
+	if env != nil {
+		if err := saveEnvelope(context.Background(), rootCID, env); err != nil {
+			fmt.Printf("[DB ERROR] %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save encryption metadata"})
+			return
+		}
+	}
+
+	// Save the metadata, file_cids row and intent together; if this fails
+	// the reconciler completes the intent from its stored metadata
 	fmt.Printf("[DEBUG] Saving paper to database\n")
-	if _, err := db.Exec(context.Background(),
-		"INSERT INTO paper (cid, title, journal, year, keywords) VALUES ($1, $2, $3, $4, $5)",
-		rootCID, title, journal, year, keywords); err != nil {
+	if err := saveUploadedRecord(intentID, "paper", entry, rootCID, proofSetID, serviceUrl, serviceName); err != nil {
 		fmt.Printf("[DB ERROR] Failed to save paper: %v\n", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save paper metadata"})
 		return
 	}
+	go replicateRecord(rootCID, "paper", serviceUrl)
 
-	// Also save to file_cids for compatibility
-	if _, err := db.Exec(context.Background(),
-		"INSERT INTO file_cids (filename, cid) VALUES ($1, $2)", header.Filename, rootCID); err != nil {
-		fmt.Printf("[DB ERROR] Failed to save file_cids: %v\n", err)
-	}
-
+	progressOf(c).stage(stageDBSaved)
 	fmt.Printf("[DEBUG] Paper saved successfully: %s -> %s\n", title, rootCID)
-	c.JSON(http.StatusOK, gin.H{
-		"proofSetID": proofSetID,
-		"rootCID":    rootCID,
-		"title":      title,
-		"journal":    journal,
-		"year":       year,
-		"keywords":   keywords,
+	c.JSON(http.StatusOK, filcdn.UploadResult{
+		ProofSetID: proofSetID,
+		ServiceURL: serviceUrl,
+		RootCID:    rootCID,
+		Encrypted:  env != nil,
+		Title:      title,
+		Journal:    journal,
+		Year:       year,
+		Keywords:   keywords,
 	})
 }
 
@@ -1064,9 +1714,9 @@ func uploadAndAddGenomeHandler(c *gin.Context) {
 	fmt.Printf("[DEBUG] Genome metadata - organism: %s, assemblyVersion: %s, notes: %s\n",
 		organism, assemblyVersion, notes)
 
-	if proofSetID == "" || organism == "" {
+	if organism == "" {
 		fmt.Printf("[DEBUG] Missing required fields, returning 400\n")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "proofSetID and organism are required"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organism is required"})
 		return
 	}
 
@@ -1081,44 +1731,90 @@ func uploadAndAddGenomeHandler(c *gin.Context) {
 
 	fmt.Printf("[UPLOAD+ADD GENOME] %s → proofSet %s\n", header.Filename, proofSetID)
 
+	if !requireFormat(c, "genome", file, header.Filename) {
+		return
+	}
+
+	// Without a proofSetID the file goes to a proof set from the tenant's pool
+	proofSetID, lease, ok := leaseProofSetFor(c, serviceUrl, serviceName, proofSetID, 1, header.Size)
+	if !ok {
+		return
+	}
+	defer lease.done()
+
+	// Encrypt on the way in when server-side encryption is requested; the
+	// facts describe the plaintext
+	facts := newFactsRecorder()
+	src, env, ok := prepareUploadEncryption(c, io.TeeReader(file, facts))
+	if !ok {
+		return
+	}
+
+	// Record the intent before touching the provider
+	entry := &recordMetadata{Filename: header.Filename, Organism: organism, AssemblyVersion: assemblyVersion, Notes: notes}
+	intentID, err := createIntent(tenantOf(c), "genome", "upload", "", entry, proofSetID, serviceUrl, serviceName, env != nil)
+	if err != nil {
+		fmt.Printf("[DB ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload intent"})
+		return
+	}
+
 	// Upload to storage
-	rootCID, err := uploadFileToStorage(file, header, serviceUrl, serviceName)
+	target := &uploadTarget{serviceURL: serviceUrl, serviceName: serviceName, proofSetID: proofSetID, lease: lease, failover: true}
+	rootCID, err := uploadFileToStorage(c.Request.Context(), src, file, header, target, "genome", progressOf(c))
 	if err != nil {
+		markIntent(intentID, "failed", "", err)
 		fmt.Printf("[DEBUG] Upload failed: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(uploadFailed(c, err), gin.H{"error": err.Error()})
 		return
 	}
+	retargetIntent(intentID, target)
+	serviceUrl, serviceName, proofSetID = target.serviceURL, target.serviceName, target.proofSetID
+	markIntent(intentID, "uploaded", rootCID, nil)
+	recordFileFacts(rootCID, facts.facts(header.Filename))
+	emitEvent(tenantOf(c), eventUploadCompleted, gin.H{"type": "genome", "filename": header.Filename, "rootCID": rootCID})
 
 	// Add to proof set
-	if err := addRootToProofSet(serviceUrl, serviceName, proofSetID, rootCID); err != nil {
+	if err := addRootToProofSet(c.Request.Context(), serviceUrl, serviceName, proofSetID, rootCID, progressOf(c)); err != nil {
+		markAddRootsFailed(intentID, err)
 		fmt.Printf("[DEBUG] Add roots failed: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		emitEvent(tenantOf(c), eventRootFailed, gin.H{"type": "genome", "proofSetID": proofSetID, "rootCID": rootCID, "error": err.Error()})
+		c.JSON(pdpFailed(c, "add-roots", err), gin.H{"error": err.Error()})
 		return
 	}
+	target.lease.assign(rootCID, header.Size)
+	markIntent(intentID, "root_added", "", nil)
+	emitEvent(tenantOf(c), eventRootAdded, gin.H{"type": "genome", "proofSetID": proofSetID, "rootCID": rootCID})
+
+	// Without the wrapped key the stored ciphertext is unreadable
+	if env != nil {
+		if err := saveEnvelope(context.Background(), rootCID, env); err != nil {
+			fmt.Printf("[DB ERROR] %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save encryption metadata"})
+			return
+		}
+	}
 
-	// Save to database
+	// Save the metadata, file_cids row and intent together; if this fails
+	// the reconciler completes the intent from its stored metadata
 	fmt.Printf("[DEBUG] Saving genome to database\n")
-	if _, err := db.Exec(context.Background(),
-		"INSERT INTO genome (cid, organism, assembly_version, notes) VALUES ($1, $2, $3, $4)",
-		rootCID, organism, assemblyVersion, notes); err != nil {
+	if err := saveUploadedRecord(intentID, "genome", entry, rootCID, proofSetID, serviceUrl, serviceName); err != nil {
 		fmt.Printf("[DB ERROR] Failed to save genome: %v\n", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save genome metadata"})
 		return
 	}
+	go replicateRecord(rootCID, "genome", serviceUrl)
 
-	// Also save to file_cids for compatibility
-	if _, err := db.Exec(context.Background(),
-		"INSERT INTO file_cids (filename, cid) VALUES ($1, $2)", header.Filename, rootCID); err != nil {
-		fmt.Printf("[DB ERROR] Failed to save file_cids: %v\n", err)
-	}
-
+	progressOf(c).stage(stageDBSaved)
 	fmt.Printf("[DEBUG] Genome saved successfully: %s -> %s\n", organism, rootCID)
-	c.JSON(http.StatusOK, gin.H{
-		"proofSetID":      proofSetID,
-		"rootCID":         rootCID,
-		"organism":        organism,
-		"assemblyVersion": assemblyVersion,
-		"notes":           notes,
+	c.JSON(http.StatusOK, filcdn.UploadResult{
+		ProofSetID:      proofSetID,
+		ServiceURL:      serviceUrl,
+		RootCID:         rootCID,
+		Encrypted:       env != nil,
+		Organism:        organism,
+		AssemblyVersion: assemblyVersion,
+		Notes:           notes,
 	})
 }
 
@@ -1146,9 +1842,9 @@ func uploadAndAddSpectrumHandler(c *gin.Context) {
 	fmt.Printf("[DEBUG] Spectrum metadata - compound: %s, technique: %s, metadata: %s\n",
 		compound, technique, metadataJson)
 
-	if proofSetID == "" || compound == "" {
+	if compound == "" {
 		fmt.Printf("[DEBUG] Missing required fields, returning 400\n")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "proofSetID and compound are required"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "compound is required"})
 		return
 	}
 
@@ -1173,49 +1869,103 @@ func uploadAndAddSpectrumHandler(c *gin.Context) {
 
 	fmt.Printf("[UPLOAD+ADD SPECTRUM] %s → proofSet %s\n", header.Filename, proofSetID)
 
+	if !requireFormat(c, "spectrum", file, header.Filename) {
+		return
+	}
+
+	// Without a proofSetID the file goes to a proof set from the tenant's pool
+	proofSetID, lease, ok := leaseProofSetFor(c, serviceUrl, serviceName, proofSetID, 1, header.Size)
+	if !ok {
+		return
+	}
+	defer lease.done()
+
+	// Encrypt on the way in when server-side encryption is requested; the
+	// facts describe the plaintext
+	facts := newFactsRecorder()
+	src, env, ok := prepareUploadEncryption(c, io.TeeReader(file, facts))
+	if !ok {
+		return
+	}
+
+	// Record the intent before touching the provider
+	entry := &recordMetadata{Filename: header.Filename, Compound: compound, Technique: technique}
+	if metadataJson != "" {
+		entry.Metadata = json.RawMessage(metadataJson)
+	}
+	intentID, err := createIntent(tenantOf(c), "spectrum", "upload", "", entry, proofSetID, serviceUrl, serviceName, env != nil)
+	if err != nil {
+		fmt.Printf("[DB ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload intent"})
+		return
+	}
+
 	// Upload to storage
-	rootCID, err := uploadFileToStorage(file, header, serviceUrl, serviceName)
+	target := &uploadTarget{serviceURL: serviceUrl, serviceName: serviceName, proofSetID: proofSetID, lease: lease, failover: true}
+	rootCID, err := uploadFileToStorage(c.Request.Context(), src, file, header, target, "spectrum", progressOf(c))
 	if err != nil {
+		markIntent(intentID, "failed", "", err)
 		fmt.Printf("[DEBUG] Upload failed: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(uploadFailed(c, err), gin.H{"error": err.Error()})
 		return
 	}
+	retargetIntent(intentID, target)
+	serviceUrl, serviceName, proofSetID = target.serviceURL, target.serviceName, target.proofSetID
+	markIntent(intentID, "uploaded", rootCID, nil)
+	recordFileFacts(rootCID, facts.facts(header.Filename))
+	emitEvent(tenantOf(c), eventUploadCompleted, gin.H{"type": "spectrum", "filename": header.Filename, "rootCID": rootCID})
 
 	// Add to proof set
-	if err := addRootToProofSet(serviceUrl, serviceName, proofSetID, rootCID); err != nil {
+	if err := addRootToProofSet(c.Request.Context(), serviceUrl, serviceName, proofSetID, rootCID, progressOf(c)); err != nil {
+		markAddRootsFailed(intentID, err)
 		fmt.Printf("[DEBUG] Add roots failed: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		emitEvent(tenantOf(c), eventRootFailed, gin.H{"type": "spectrum", "proofSetID": proofSetID, "rootCID": rootCID, "error": err.Error()})
+		c.JSON(pdpFailed(c, "add-roots", err), gin.H{"error": err.Error()})
 		return
 	}
+	target.lease.assign(rootCID, header.Size)
+	markIntent(intentID, "root_added", "", nil)
+	emitEvent(tenantOf(c), eventRootAdded, gin.H{"type": "spectrum", "proofSetID": proofSetID, "rootCID": rootCID})
 
-	// Save to database
+	// Without the wrapped key the stored ciphertext is unreadable
+	if env != nil {
+		if err := saveEnvelope(context.Background(), rootCID, env); err != nil {
+			fmt.Printf("[DB ERROR] %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save encryption metadata"})
+			return
+		}
+	}
+
+	// Save the metadata, file_cids row and intent together; if this fails
+	// the reconciler completes the intent from its stored metadata
 	fmt.Printf("[DEBUG] Saving spectrum to database\n")
-	if _, err := db.Exec(context.Background(),
-		"INSERT INTO spectrum (cid, compound, technique_nmr_ir_ms, metadata_json) VALUES ($1, $2, $3, $4)",
-		rootCID, compound, technique, metadataJson); err != nil {
+	if err := saveUploadedRecord(intentID, "spectrum", entry, rootCID, proofSetID, serviceUrl, serviceName); err != nil {
 		fmt.Printf("[DB ERROR] Failed to save spectrum: %v\n", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save spectrum metadata"})
 		return
 	}
+	go replicateRecord(rootCID, "spectrum", serviceUrl)
 
-	// Also save to file_cids for compatibility
-	if _, err := db.Exec(context.Background(),
-		"INSERT INTO file_cids (filename, cid) VALUES ($1, $2)", header.Filename, rootCID); err != nil {
-		fmt.Printf("[DB ERROR] Failed to save file_cids: %v\n", err)
-	}
-
+	progressOf(c).stage(stageDBSaved)
 	fmt.Printf("[DEBUG] Spectrum saved successfully: %s -> %s\n", compound, rootCID)
-	c.JSON(http.StatusOK, gin.H{
-		"proofSetID": proofSetID,
-		"rootCID":    rootCID,
-		"compound":   compound,
-		"technique":  technique,
-		"metadata":   metadataJsonb,
-	})
+	res := filcdn.UploadResult{
+		ProofSetID: proofSetID,
+		ServiceURL: serviceUrl,
+		RootCID:    rootCID,
+		Encrypted:  env != nil,
+		Compound:   compound,
+		Technique:  technique,
+	}
+	if metadataJsonb != nil {
+		res.Metadata = json.RawMessage(metadataJson)
+	}
+	c.JSON(http.StatusOK, res)
 }
 
 // Helper function to upload file to storage (extracted from common logic)
-func uploadFileToStorage(file multipart.File, header *multipart.FileHeader, serviceUrl, serviceName string) (string, error) {
+// file is what is stored and sent the bytes the client sent, which are
+// scanned; they differ with server-side encryption. progress may be nil.
+func uploadFileToStorage(ctx context.Context, file io.Reader, sent io.ReaderAt, header *multipart.FileHeader, target *uploadTarget, dataType string, progress *uploadProgress) (string, error) {
 	// Detect if this is an encrypted file
 	isEncrypted := strings.HasSuffix(strings.ToLower(header.Filename), ".enc")
 	fmt.Printf("[DEBUG] File is encrypted: %v\n", isEncrypted)
@@ -1229,22 +1979,26 @@ func uploadFileToStorage(file multipart.File, header *multipart.FileHeader, serv
 	defer os.Remove(tmpPath)
 
 	// Copy file content
-	_, err = io.Copy(tmpFile, file)
+	dst, flush := progress.trackWrites(tmpFile, stageTempWrite, header.Size)
+	_, err = io.Copy(dst, file)
 	if err != nil {
 		return "", fmt.Errorf("failed to copy file: %w", err)
 	}
+	flush()
 	tmpFile.Close()
 
+	// Nothing infected may reach the provider
+	if err := scanUpload(ctx, scanRequest{dataType: dataType, filename: header.Filename, content: sent, size: header.Size}); err != nil {
+		return "", err
+	}
+
 	// Execute upload-file command
-	cmd := newPDPCommand("upload-file", "--service-url", serviceUrl, "--service-name", serviceName, tmpPath)
-	upOut, err := cmd.CombinedOutput()
+	progress.stage(stageUploadStarted)
+	rootCID, err := uploadWithFailover(ctx, target, tmpPath)
 	if err != nil {
-		return "", fmt.Errorf("upload-file failed: %s", string(upOut))
+		return "", err
 	}
-
-	// Extract root CID from output
-	lines := strings.Split(strings.TrimSpace(string(upOut)), "\n")
-	rootCID := strings.TrimSpace(lines[len(lines)-1])
+	progress.emit(progressEvent{Stage: stageUploadFinished, RootCID: rootCID})
 
 	// For encrypted files, add delay
 	if isEncrypted {
@@ -1255,38 +2009,171 @@ func uploadFileToStorage(file multipart.File, header *multipart.FileHeader, serv
 	return rootCID, nil
 }
 
+// runUploadFile runs upload-file for a file on disk and returns the root CID
+// it prints. Failures are pdpErrors; transient ones count against the
+// provider's circuit breaker.
+func runUploadFile(ctx context.Context, serviceUrl, serviceName, path string) (string, error) {
+	breaker := breakerFor(serviceUrl)
+	if !breaker.allow() {
+		return "", &pdpError{Op: "upload-file", Kind: pdpTransient, Output: "circuit open for " + serviceUrl}
+	}
+	upOut, err := runPDP(ctx, "upload-file", "--service-url", serviceUrl, "--service-name", serviceName, path)
+	if err != nil {
+		pe := classifyPDPError("upload-file", upOut, err)
+		if pe.Kind == pdpCanceled || pe.Kind == pdpBusy {
+			breaker.abandon()
+		} else {
+			breaker.record(serviceUrl, pe.Kind == pdpTransient || pe.Kind == pdpTimeout)
+		}
+		return "", pe
+	}
+	breaker.record(serviceUrl, false)
+
+	// Extract root CID from output
+	lines := strings.Split(strings.TrimSpace(string(upOut)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1]), nil
+}
+
 // Helper function to add root to proof set (extracted from common logic)
-func addRootToProofSet(serviceUrl, serviceName, proofSetID, rootCID string) error {
-	maxRetries := 3
+func addRootToProofSet(ctx context.Context, serviceUrl, serviceName, proofSetID, rootCID string, progress *uploadProgress) error {
+	return addRootsToProofSet(ctx, serviceUrl, serviceName, proofSetID, []string{rootCID}, progress)
+}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		fmt.Printf("[DEBUG] add-roots attempt %d/%d\n", attempt, maxRetries)
+// Helper function to add several roots to a proof set in one add-roots call
+// progress may be nil.
+func addRootsToProofSet(ctx context.Context, serviceUrl, serviceName, proofSetID string, rootCIDs []string, progress *uploadProgress) error {
+	_, err := runAddRoots(ctx, serviceUrl, serviceName, proofSetID, rootCIDs, progress)
+	return err
+}
 
-		arCmd := newPDPCommand(
-			"add-roots", "--service-url", serviceUrl, "--service-name", serviceName,
-			"--proof-set-id", proofSetID, "--root", rootCID,
-		)
+// runAddRoots adds roots to a proof set under the PDP retry policy and
+// returns pdptool's output. Only not_synced failures are retried: the
+// provider rejects those before submitting anything, while after a timeout
+// or dropped connection the roots may already be on their way in, and a
+// retry would add them twice.
+//
+// Once the file is uploaded add-roots no longer follows ctx's cancellation:
+// killing pdptool because the client went away would leave the roots in an
+// unknown state. It is bounded by addRootsDeadline instead.
+func runAddRoots(ctx context.Context, serviceUrl, serviceName, proofSetID string, rootCIDs []string, progress *uploadProgress) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), addRootsDeadline)
+	defer cancel()
+
+	args := []string{"add-roots", "--service-url", serviceUrl, "--service-name", serviceName,
+		"--proof-set-id", proofSetID}
+	for _, rootCID := range rootCIDs {
+		args = append(args, "--root", rootCID)
+	}
+
+	var tries int
+	out, err := pdpRetry.only(pdpNotSynced).run(ctx, "add-roots",
+		func(attempt, maxAttempts int) {
+			tries = attempt
+			fmt.Printf("[DEBUG] add-roots attempt %d/%d (%d roots)\n", attempt, maxAttempts, len(rootCIDs))
+			progress.emit(progressEvent{Stage: stageAddRootsAttempt, Attempt: attempt, MaxAttempts: maxAttempts})
+		},
+		func() ([]byte, error) {
+			return runPDP(ctx, args...)
+		})
+	if err != nil {
+		fmt.Printf("[DEBUG] add-roots failed after %d attempts: %v\n", tries, err)
+		return out, err
+	}
+	fmt.Printf("[DEBUG] add-roots succeeded on attempt %d\n", tries)
+	progress.emit(progressEvent{Stage: stageAddRootsDone, Attempt: tries})
+	return out, nil
+}
 
-		arOut, err := arCmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("[DEBUG] add-roots attempt %d failed: %v\n", attempt, err)
-			fmt.Printf("[DEBUG] add-roots output: %s\n", string(arOut))
-
-			// Check if it's the "not found" error and we have more retries
-			if strings.Contains(string(arOut), "not found or does not belong to service") && attempt < maxRetries {
-				fmt.Printf("[DEBUG] Retrying after delay (attempt %d/%d)...\n", attempt, maxRetries)
-				time.Sleep(time.Duration(attempt*2) * time.Second)
-				continue
-			}
+// proofSetRoot is a root as listed by get-proof-set
+type proofSetRoot struct {
+	RootID  string `json:"rootId"`
+	RootCID string `json:"rootCid"`
+}
 
-			return fmt.Errorf("add-roots failed: %s", string(arOut))
+// proofSetInfo is the parsed output of get-proof-set
+type proofSetInfo struct {
+	ID                 string         `json:"id"`
+	NextChallengeEpoch string         `json:"nextChallengeEpoch"`
+	LastProvenEpoch    string         `json:"lastProvenEpoch"` // empty when not printed
+	Faults             string         `json:"faults"`          // empty when not printed
+	Roots              []proofSetRoot `json:"roots"`
+}
+
+// findRoot returns the root whose CID matches rootCID. Stored root CIDs may
+// carry the subroot suffix printed by upload-file, so only the part before
+// the first ':' is compared. An empty or partly parsed root list is an
+// error: it cannot tell an absent root from output this parser missed.
+func (p *proofSetInfo) findRoot(rootCID string) (proofSetRoot, bool, error) {
+	if len(p.Roots) == 0 {
+		return proofSetRoot{}, false, fmt.Errorf("get-proof-set listed no roots for proof set %s", p.ID)
+	}
+	want := strings.TrimSpace(strings.SplitN(rootCID, ":", 2)[0])
+	for _, root := range p.Roots {
+		if root.RootCID == "" {
+			return proofSetRoot{}, false, fmt.Errorf("get-proof-set printed root %s of proof set %s without a CID", root.RootID, p.ID)
+		}
+		if root.RootCID == want {
+			return root, true, nil
 		}
+	}
+	return proofSetRoot{}, false, nil
+}
 
-		fmt.Printf("[DEBUG] add-roots succeeded on attempt %d\n", attempt)
-		return nil
+// Helper function to fetch the details of a proof set
+func getProofSet(ctx context.Context, serviceUrl, serviceName, proofSetID string) (*proofSetInfo, error) {
+	out, err := runPDP(ctx,
+		"get-proof-set", "--service-url", serviceUrl, "--service-name", serviceName, proofSetID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get-proof-set failed: %s", string(out))
 	}
+	info := parseProofSetOutput(string(out))
+	if info.ID != strings.TrimSpace(proofSetID) {
+		return nil, fmt.Errorf("get-proof-set printed no details of proof set %s: %s", proofSetID, strings.TrimSpace(string(out)))
+	}
+	return info, nil
+}
 
-	return fmt.Errorf("add-roots failed after %d attempts", maxRetries)
+// parseProofSetOutput reads the "Key: value" lines printed by get-proof-set
+func parseProofSetOutput(out string) *proofSetInfo {
+	info := &proofSetInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "- "))
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "proof set id":
+			info.ID = value
+		case "next challenge epoch":
+			info.NextChallengeEpoch = value
+		case "last proven epoch":
+			info.LastProvenEpoch = value
+		case "faults", "faulted roots":
+			info.Faults = value
+		case "root id":
+			info.Roots = append(info.Roots, proofSetRoot{RootID: value})
+		case "root cid":
+			if n := len(info.Roots); n > 0 {
+				info.Roots[n-1].RootCID = value
+			}
+		}
+	}
+	return info
+}
+
+// Helper function to schedule removal of a root from a proof set
+func removeRootFromProofSet(ctx context.Context, serviceUrl, serviceName, proofSetID, rootID string) (string, error) {
+	out, err := runPDP(ctx,
+		"remove-roots", "--service-url", serviceUrl, "--service-name", serviceName,
+		"--proof-set-id", proofSetID, "--root-id", rootID,
+	)
+	if err != nil {
+		return "", fmt.Errorf("remove-roots failed: %s", string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
 }
 
 // -------------------------------------------------------------------
@@ -1302,7 +2189,7 @@ func listCIDsHandler(c *gin.Context) {
 		context.Background(),
 		`SELECT filename, cid, uploaded_at
            FROM file_cids
-          WHERE ($1 = '' OR filename = $1)
+          WHERE ($1 = '' OR filename = $1) AND deleted_at IS NULL
           ORDER BY uploaded_at DESC`,
 		filename,
 	)
@@ -1312,14 +2199,9 @@ func listCIDsHandler(c *gin.Context) {
 	}
 	defer rows.Close()
 
-	type entry struct {
-		Filename   string    `json:"filename"`
-		CID        string    `json:"cid"`
-		UploadedAt time.Time `json:"uploaded_at"`
-	}
-	var result []entry
+	var result []filcdn.CIDEntry
 	for rows.Next() {
-		var e entry
+		var e filcdn.CIDEntry
 		if err := rows.Scan(&e.Filename, &e.CID, &e.UploadedAt); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -1342,74 +2224,73 @@ func orchestrateHandler(c *gin.Context) {
 	}
 	defer file.Close()
 	fmt.Printf("[FLOW] Received file %s (size: %d)\n", header.Filename, header.Size)
+	ctx := c.Request.Context()
 
 	// Step 1: create-proof-set
-	out, err := newPDPCommand(
+	out, err := runPDP(ctx,
 		"create-proof-set",
 		"--service-url", serviceUrl,
 		"--service-name", serviceName,
 		"--recordkeeper", recordKeeper,
-	).CombinedOutput()
+	)
 	fmt.Printf("[STEP1] create-proof-set output:\n%s\n", string(out))
 	if err != nil {
 		fmt.Printf("[ERROR] create-proof-set failed: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "create-proof-set failed"})
-		return
-	}
-	// Parse txHash
-	lines := strings.Split(string(out), "\n")
-	var txHash string
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "Location:") {
-			idx := strings.Index(line, "/pdp/proof-sets/created/")
-			if idx >= 0 {
-				txHash = line[idx+len("/pdp/proof-sets/created/"):]
-				txHash = strings.TrimSpace(txHash)
-				break
-			}
-		}
+		c.JSON(pdpFailed(c, "create-proof-set", classifyPDPError("create-proof-set", out, err)), gin.H{"error": "create-proof-set failed"})
+		return
 	}
+	txHash := parseCreateTxHash(string(out))
 
 	if txHash == "" {
 		fmt.Println("[ERROR] txHash not found in output")
+		annotateError(c, codePDPToolFailed, "txHash parse failed", out)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "txHash parse failed"})
 		return
 	}
 	fmt.Printf("[FLOW] Parsed txHash: %s\n", txHash)
 
-	// Step 2: poll until ProofSet Created
+	// Step 2: poll until ProofSet Created, for at most proofSetCreateDeadline
 	var proofSetID string
+	var sout string
+	deadline := time.Now().Add(proofSetCreateDeadline)
 	count := 0
 	for {
 		count++
 		fmt.Printf("[STEP2] Poll #%d for txHash %s\n", count, txHash)
-		statusOut, _ := newPDPCommand(
+		statusOut, _ := runPDP(ctx,
 			"get-proof-set-create-status",
 			"--service-url", serviceUrl,
 			"--service-name", serviceName,
 			"--tx-hash", txHash,
-		).CombinedOutput()
-		sout := string(statusOut)
+		)
+		sout = string(statusOut)
 		fmt.Printf("[STEP2] status output:\n%s\n", sout)
-		if strings.Contains(strings.ToLower(sout), "proofset created: true") {
+		if id, created := parseCreatedProofSetID(sout); created {
 			fmt.Println("[FLOW] ProofSet Created!")
-			// extract ProofSet ID robustly (case insensitive)
-			idx := strings.Index(strings.ToLower(sout), "proofset id: ")
-			if idx >= 0 {
-				idStart := idx + len("proofset id: ")
-				rest := sout[idStart:]
-				idEnd := strings.Index(rest, "\n")
-				if idEnd < 0 {
-					proofSetID = strings.TrimSpace(rest)
-				} else {
-					proofSetID = strings.TrimSpace(rest[:idEnd])
-				}
-				fmt.Printf("[FLOW] Parsed proofSetID: %s\n", proofSetID)
-			}
+			proofSetID = id
+			fmt.Printf("[FLOW] Parsed proofSetID: %s\n", proofSetID)
+			emitEvent(tenantOf(c), eventProofSetCreated, gin.H{"txHash": txHash, "proofSetID": proofSetID})
 			break
 		}
-		time.Sleep(3 * time.Second)
+		if ctx.Err() != nil {
+			fmt.Printf("[FLOW] Client went away while waiting for txHash %s\n", txHash)
+			return
+		}
+		if time.Now().Add(proofSetPollInterval).After(deadline) {
+			fmt.Printf("[ERROR] proof set for txHash %s not created within %s\n", txHash, proofSetCreateDeadline)
+			annotateError(c, codeTimeout, "proof set creation did not finish in time", statusOut)
+			c.JSON(http.StatusGatewayTimeout, gin.H{
+				"error":      fmt.Sprintf("proof set not created within %s; poll GET /api/proof-sets/%s/status", proofSetCreateDeadline, txHash),
+				"txHash":     txHash,
+				"lastStatus": strings.TrimSpace(sout),
+				"polls":      count,
+			})
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(proofSetPollInterval):
+		}
 	}
 
 	// Step 3: save file to temp and upload
@@ -1423,46 +2304,53 @@ func orchestrateHandler(c *gin.Context) {
 	defer os.Remove(tmpPath)
 	defer tmpFile.Close()
 	fmt.Printf("[FLOW] Writing upload file to %s\n", tmpPath)
-	io.Copy(tmpFile, file)
+	facts := newFactsRecorder()
+	io.Copy(tmpFile, io.TeeReader(file, facts))
+	if err := scanUpload(ctx, scanRequest{dataType: "file", filename: header.Filename, content: file, size: header.Size}); err != nil {
+		c.JSON(uploadFailed(c, err), gin.H{"error": err.Error()})
+		return
+	}
 
-	uOut, err := newPDPCommand(
+	uOut, err := runPDP(ctx,
 		"upload-file",
 		"--service-url", serviceUrl,
 		"--service-name", serviceName,
 		tmpPath,
-	).CombinedOutput()
+	)
 	fmt.Printf("[STEP3] upload-file output:\n%s\n", string(uOut))
 	if err != nil {
 		fmt.Println("[ERROR] upload-file failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "upload-file failed"})
+		c.JSON(pdpFailed(c, "upload-file", classifyPDPError("upload-file", uOut, err)), gin.H{"error": "upload-file failed"})
 		return
 	}
 	// parse rootCID
 	uLines := strings.Split(strings.TrimSpace(string(uOut)), "\n")
-	rootCID := strings.SplitN(uLines[len(uLines)-1], ":", 2)[0]
+	uploadedCID := strings.TrimSpace(uLines[len(uLines)-1])
+	rootCID := strings.SplitN(uploadedCID, ":", 2)[0]
 	fmt.Printf("[FLOW] Parsed rootCID: %s\n", rootCID)
+	// Facts are keyed like the record tables, by the full root:subroot CID
+	fileFacts := facts.facts(header.Filename)
+	recordFileFacts(uploadedCID, fileFacts)
+	emitEvent(tenantOf(c), eventUploadCompleted, gin.H{"filename": header.Filename, "rootCID": rootCID})
 
 	// Step 4: add root
-	arOut, err := newPDPCommand(
-		"add-roots",
-		"--service-url", serviceUrl,
-		"--service-name", serviceName,
-		"--proof-set-id", proofSetID,
-		"--root", rootCID,
-	).CombinedOutput()
+	arOut, err := runAddRoots(c.Request.Context(), serviceUrl, serviceName, proofSetID, []string{rootCID}, nil)
 	fmt.Printf("[STEP4] add-roots output:\n%s\n", string(arOut))
 	if err != nil {
 		fmt.Println("[ERROR] add-roots failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "add-roots failed"})
+		emitEvent(tenantOf(c), eventRootFailed, gin.H{"proofSetID": proofSetID, "rootCID": rootCID, "error": string(arOut)})
+		c.JSON(pdpFailed(c, "add-roots", err), gin.H{"error": "add-roots failed"})
 		return
 	}
+	emitEvent(tenantOf(c), eventRootAdded, gin.H{"proofSetID": proofSetID, "rootCID": rootCID})
 
 	// Final response
-	c.JSON(http.StatusOK, gin.H{
-		"txHash":     txHash,
-		"proofSetID": proofSetID,
-		"rootCID":    rootCID,
-		"addRoots":   strings.TrimSpace(string(arOut)),
+	c.JSON(http.StatusOK, filcdn.OrchestrateResult{
+		TxHash:     txHash,
+		ProofSetID: proofSetID,
+		RootCID:    rootCID,
+		AddRoots:   strings.TrimSpace(string(arOut)),
+		Facts:      fileFacts,
 	})
 }
 
@@ -1476,18 +2364,46 @@ func pingHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	out, err := newPDPCommand(
+	out, err := runPDP(c.Request.Context(),
 		"ping",
 		"--service-url", req.ServiceURL,
 		"--service-name", req.ServiceName,
-	).CombinedOutput()
+	)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": string(out)})
+		c.JSON(pdpFailed(c, "ping", classifyPDPError("ping", out, err)), gin.H{"error": string(out)})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": string(out)})
 }
 
+// listProofSetsHandler lists the proof sets this service has added roots to
+// GET /api/proof-sets
+func listProofSetsHandler(c *gin.Context) {
+	rows, err := db.Query(context.Background(),
+		`SELECT proof_set_id, COALESCE(service_url, ''), COALESCE(service_name, ''),
+		        COUNT(*), MAX(uploaded_at)
+		   FROM file_cids
+		  WHERE proof_set_id IS NOT NULL AND deleted_at IS NULL
+		  GROUP BY proof_set_id, service_url, service_name
+		  ORDER BY MAX(uploaded_at) DESC`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	result := []filcdn.ProofSet{}
+	for rows.Next() {
+		var e filcdn.ProofSet
+		if err := rows.Scan(&e.ProofSetID, &e.ServiceURL, &e.ServiceName, &e.Roots, &e.LastUpload); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result = append(result, e)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
 // createProofSetHandler invokes create-proof-set
 func createProofSetHandler(c *gin.Context) {
 	var req struct {
@@ -1499,14 +2415,14 @@ func createProofSetHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	out, err := newPDPCommand(
+	out, err := runPDP(c.Request.Context(),
 		"create-proof-set",
 		"--service-url", req.ServiceURL,
 		"--service-name", req.ServiceName,
 		"--recordkeeper", req.RecordKeeper,
-	).CombinedOutput()
+	)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": string(out)})
+		c.JSON(pdpFailed(c, "create-proof-set", classifyPDPError("create-proof-set", out, err)), gin.H{"error": string(out)})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"output": string(out)})
@@ -1514,17 +2430,17 @@ func createProofSetHandler(c *gin.Context) {
 
 // getProofSetStatusHandler polls create status
 func getProofSetStatusHandler(c *gin.Context) {
-	txHash := c.Param("txHash")
+	txHash := c.Param("id")
 	serviceUrl := c.Query("serviceUrl")
 	serviceName := c.Query("serviceName")
-	out, err := newPDPCommand(
+	out, err := runPDP(c.Request.Context(),
 		"get-proof-set-create-status",
 		"--service-url", serviceUrl,
 		"--service-name", serviceName,
 		"--tx-hash", txHash,
-	).CombinedOutput()
+	)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": string(out)})
+		c.JSON(pdpFailed(c, "get-proof-set-create-status", classifyPDPError("get-proof-set-create-status", out, err)), gin.H{"error": string(out)})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": string(out)})
@@ -1553,20 +2469,27 @@ func uploadFileHandler(c *gin.Context) {
 	defer os.Remove(tmpPath)
 	defer tmpFile.Close()
 	fmt.Printf("[UPLOAD] Writing upload file to %s\n", tmpPath)
-	io.Copy(tmpFile, file)
+	facts := newFactsRecorder()
+	io.Copy(tmpFile, io.TeeReader(file, facts))
+	if err := scanUpload(c.Request.Context(), scanRequest{dataType: "file", filename: header.Filename, content: file, size: header.Size}); err != nil {
+		c.JSON(uploadFailed(c, err), gin.H{"error": err.Error()})
+		return
+	}
 
-	out, err := newPDPCommand(
+	out, err := runPDP(c.Request.Context(),
 		"upload-file",
 		"--service-url", serviceUrl,
 		"--service-name", serviceName,
 		tmpPath,
-	).CombinedOutput()
+	)
 	fmt.Printf("[UPLOAD] upload-file output:\n%s\n", string(out))
 	if err != nil {
 		fmt.Println("[ERROR] upload-file failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "upload-file failed"})
+		c.JSON(pdpFailed(c, "upload-file", classifyPDPError("upload-file", out, err)), gin.H{"error": "upload-file failed"})
 		return
 	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	recordFileFacts(strings.TrimSpace(lines[len(lines)-1]), facts.facts(header.Filename))
 	c.JSON(http.StatusOK, gin.H{"output": string(out)})
 }
 
@@ -1582,17 +2505,11 @@ func addRootsHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	out, err := newPDPCommand(
-		"add-roots",
-		"--service-url", req.ServiceURL,
-		"--service-name", req.ServiceName,
-		"--proof-set-id", proofSetId,
-		"--root", req.RootCID,
-	).CombinedOutput()
+	out, err := runAddRoots(c.Request.Context(), req.ServiceURL, req.ServiceName, proofSetId, []string{req.RootCID}, nil)
 	fmt.Printf("[ADDROOTS] add-roots output:\n%s\n", string(out))
 	if err != nil {
 		fmt.Println("[ERROR] add-roots failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "add-roots failed"})
+		c.JSON(pdpFailed(c, "add-roots", err), gin.H{"error": "add-roots failed"})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": string(out)})
@@ -0,0 +1,1004 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// TestOpenAPICoversRoutes fails when a route registered in setupRouter has
+// no operation in the OpenAPI document
+func TestOpenAPICoversRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := setupRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json: status %d", w.Code)
+	}
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("decode spec: %v", err)
+	}
+
+	for _, route := range r.Routes() {
+		path := openAPIPath(route.Path)
+		if _, ok := spec.Paths[path][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s is registered but missing from the OpenAPI document", route.Method, path)
+		}
+	}
+}
+
+// TestOpenAPIHasNoStaleOperations fails when the document describes a route
+// that is no longer registered
+func TestOpenAPIHasNoStaleOperations(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registered := map[string]bool{}
+	for _, route := range setupRouter().Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for _, o := range apiOperations(schemaRegistry{}) {
+		if !registered[o.method+" "+o.path] {
+			t.Errorf("%s %s is documented but not registered", o.method, o.path)
+		}
+	}
+}
+
+// stubClamd serves the clamd INSTREAM command on a unix socket, answering
+// with reply for whatever stream it receives
+func stubClamd(t *testing.T, reply func(stream []byte) string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clamd.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var stream []byte
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					stream = append(stream, chunk...)
+				}
+				io.WriteString(conn, reply(stream)+"\x00")
+			}()
+		}
+	}()
+	return path
+}
+
+func TestClamdScanner(t *testing.T) {
+	eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	path := stubClamd(t, func(stream []byte) string {
+		switch {
+		case bytes.Contains(stream, eicar):
+			return "stream: Eicar-Test-Signature FOUND"
+		case len(stream) > 3*clamdChunkSize:
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		return "stream: OK"
+	})
+	s, err := newScanner("clamd", "unix:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spread over several chunks so the content crosses chunk boundaries
+	infected := append(bytes.Repeat([]byte("a"), clamdChunkSize-10), eicar...)
+	tests := []struct {
+		name      string
+		content   []byte
+		infected  bool
+		signature string
+		wantErr   bool
+	}{
+		{name: "clean", content: []byte("hello")},
+		{name: "empty", content: nil},
+		{name: "infected", content: infected, infected: true, signature: "Eicar-Test-Signature"},
+		{name: "error", content: make([]byte, 4*clamdChunkSize), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := s.scan(context.Background(), bytes.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if v.infected != tt.infected || v.signature != tt.signature {
+				t.Errorf("verdict = %+v, want infected %v with %q", v, tt.infected, tt.signature)
+			}
+		})
+	}
+
+	// Nothing listening
+	down := &clamdScanner{network: "unix", address: filepath.Join(t.TempDir(), "none.sock")}
+	if _, err := down.scan(context.Background(), strings.NewReader("hello")); err == nil {
+		t.Error("scan with clamd down succeeded")
+	}
+}
+
+func TestParseClamdAddress(t *testing.T) {
+	for in, want := range map[string][2]string{
+		"unix:/run/clamd.sock": {"unix", "/run/clamd.sock"},
+		"/var/run/clamd.ctl":   {"unix", "/var/run/clamd.ctl"},
+		"tcp:clamav:3310":      {"tcp", "clamav:3310"},
+		"localhost:3310":       {"tcp", "localhost:3310"},
+	} {
+		if network, address := parseClamdAddress(in); network != want[0] || address != want[1] {
+			t.Errorf("parseClamdAddress(%q) = %s %s, want %s %s", in, network, address, want[0], want[1])
+		}
+	}
+}
+
+// getProofSetOutput is what pdptool get-proof-set prints
+const getProofSetOutput = `Proof Set ID: 42
+Next Challenge Epoch: 4820361
+Roots:
+  - Root ID: 0
+    Root CID: baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq
+    Subroot CID: baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq
+    Subroot Offset: 0
+
+  - Root ID: 3
+    Root CID: baga6ea4seaqhxw7rrafaxnbqqbqqcwyhgmxdmbfdemm4ro3fxtzrvxqbk7ezdvi
+    Subroot CID: baga6ea4seaqhxw7rrafaxnbqqbqqcwyhgmxdmbfdemm4ro3fxtzrvxqbk7ezdvi
+    Subroot Offset: 0
+
+`
+
+func TestParseProofSetOutput(t *testing.T) {
+	info := parseProofSetOutput(getProofSetOutput)
+	if info.ID != "42" || info.NextChallengeEpoch != "4820361" {
+		t.Errorf("parsed ID %q, next challenge epoch %q", info.ID, info.NextChallengeEpoch)
+	}
+	if len(info.Roots) != 2 {
+		t.Fatalf("parsed %d roots, want 2: %+v", len(info.Roots), info.Roots)
+	}
+
+	root, ok, err := info.findRoot("baga6ea4seaqhxw7rrafaxnbqqbqqcwyhgmxdmbfdemm4ro3fxtzrvxqbk7ezdvi:baga6ea4seaqhxw7rrafaxnbqqbqqcwyhgmxdmbfdemm4ro3fxtzrvxqbk7ezdvi")
+	if err != nil || !ok || root.RootID != "3" {
+		t.Errorf("findRoot with subroot suffix = %+v, %v, %v; want root 3", root, ok, err)
+	}
+	if _, ok, err := info.findRoot("baga6ea4seaqnotinthisproofset"); err != nil || ok {
+		t.Errorf("findRoot of an absent root = %v, %v; want absent", ok, err)
+	}
+
+	// Output the parser does not understand must not read as "root absent"
+	for name, out := range map[string]string{
+		"empty":      "",
+		"no roots":   "Proof Set ID: 42\nNext Challenge Epoch: 4820361\nRoots:\n",
+		"other form": `{"id": 42, "roots": [{"rootId": 0, "rootCid": "baga6ea4seaq"}]}`,
+		"no cid":     "Proof Set ID: 42\nRoots:\n  - Root ID: 0\n",
+	} {
+		if _, ok, err := parseProofSetOutput(out).findRoot("baga6ea4seaqnotinthisproofset"); err == nil {
+			t.Errorf("%s: findRoot = %v with no error", name, ok)
+		}
+	}
+}
+
+func TestClassifyPDPError(t *testing.T) {
+	tests := []struct {
+		output string
+		want   pdpErrorKind
+	}{
+		{"Error: failed to add roots: dial tcp 10.0.0.5:4030: connection refused", pdpTransient},
+		{"Error: Post \"https://sp.example:4030/pdp/proof-sets/403/roots\": read tcp 10.0.0.7:40312->10.0.0.5:4030: i/o timeout", pdpTransient},
+		{"Error: upload failed: status code 503: service unavailable", pdpTransient},
+		{"Error: unexpected EOF after 5040291 bytes", pdpTransient},
+		{"Error: server returned HTTP 429", pdpTransient},
+		{"Error: failed to create proof set, status code 401: invalid JWT", pdpAuth},
+		{"Error: request failed with status 403", pdpAuth},
+		{"Error: upload failed, status 507: insufficient storage", pdpProviderFull},
+		{"Error: piece not found in proof set 4012", pdpNotSynced},
+		{"Error: failed to add roots, status code 400: subroot size mismatch", pdpInvalidInput},
+		{"Error: unknown flag: --proof-set", pdpInvalidInput},
+		// Numbers that are not statuses
+		{"Error: tx 0x4035021403e5f429 reverted for proof set 502", pdpUnknown},
+		{"Error: wrote 4010 of 5070 bytes", pdpUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyPDPError("add-roots", []byte(tt.output), nil).Kind; got != tt.want {
+			t.Errorf("classifyPDPError(%q) = %s, want %s", tt.output, got, tt.want)
+		}
+	}
+
+	// Failures recorded earlier keep their kind
+	busy := &pdpError{Op: "upload-file", Kind: pdpBusy}
+	if got := classifyPDPError("upload-file", nil, busy); got != busy {
+		t.Errorf("classifyPDPError(pdpError) = %v, want it unchanged", got)
+	}
+}
+
+// queueTestScheduler returns an empty scheduler running one upload-file at a
+// time, with the package limits restored after the test
+func queueTestScheduler(t *testing.T) *pdpScheduler {
+	concurrency, limits, perProvider, queueMax := pdpConcurrency, pdpCommandLimits, pdpProviderConcurrency, pdpQueueMax
+	t.Cleanup(func() {
+		pdpConcurrency, pdpCommandLimits, pdpProviderConcurrency, pdpQueueMax = concurrency, limits, perProvider, queueMax
+	})
+	pdpConcurrency, pdpCommandLimits, pdpProviderConcurrency, pdpQueueMax = 4, map[string]int{"upload-file": 1}, 4, 10
+	return &pdpScheduler{running: map[string]int{}, queues: map[string][]*pdpSlotRequest{}, startedAt: time.Now()}
+}
+
+type heldSlot struct {
+	id      string
+	release func()
+	err     error
+}
+
+// queueSlot requests an upload-file slot for tenant in the background and
+// waits until the request is queued; the outcome is sent on results
+func queueSlot(t *testing.T, ctx context.Context, s *pdpScheduler, tenant, id string, results chan<- heldSlot) {
+	t.Helper()
+	s.mu.Lock()
+	want := s.queued + 1
+	s.mu.Unlock()
+	go func() {
+		release, err := s.acquire(withTenant(ctx, tenant), "upload-file", "")
+		results <- heldSlot{id: id, release: release, err: err}
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		queued := s.queued
+		s.mu.Unlock()
+		if queued == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not queued", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func nextSlot(t *testing.T, results <-chan heldSlot) heldSlot {
+	t.Helper()
+	select {
+	case h := <-results:
+		return h
+	case <-time.After(2 * time.Second):
+		t.Fatal("no slot granted")
+		return heldSlot{}
+	}
+}
+
+// TestPDPSchedulerFairness checks that freed slots go to the tenants in turn
+// rather than in arrival order
+func TestPDPSchedulerFairness(t *testing.T) {
+	s := queueTestScheduler(t)
+	ctx := context.Background()
+
+	release, err := s.acquire(withTenant(ctx, "a"), "upload-file", "")
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	results := make(chan heldSlot, 4)
+	for _, id := range []string{"a1", "a2", "a3"} {
+		queueSlot(t, ctx, s, "a", id, results)
+	}
+	queueSlot(t, ctx, s, "b", "b1", results)
+
+	var order []string
+	for range 4 {
+		release()
+		h := nextSlot(t, results)
+		if h.err != nil {
+			t.Fatalf("%s: %v", h.id, h.err)
+		}
+		order = append(order, h.id)
+		release = h.release
+	}
+	release()
+
+	if got := strings.Join(order, ","); got != "a1,b1,a2,a3" {
+		t.Errorf("grant order %s, want a1,b1,a2,a3", got)
+	}
+	if st := s.stats(); st.Queued != 0 || st.Running["upload-file"] != 0 {
+		t.Errorf("after all releases: %d queued, %d running", st.Queued, st.Running["upload-file"])
+	}
+}
+
+// TestPDPSchedulerCancelWhileQueued checks that a request given up while
+// queued leaves the queue and does not take the next free slot
+func TestPDPSchedulerCancelWhileQueued(t *testing.T) {
+	s := queueTestScheduler(t)
+	ctx := context.Background()
+
+	release, err := s.acquire(withTenant(ctx, "a"), "upload-file", "")
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	canceled := make(chan heldSlot, 1)
+	results := make(chan heldSlot, 1)
+	cctx, cancel := context.WithCancel(ctx)
+	queueSlot(t, cctx, s, "a", "a1", canceled)
+	queueSlot(t, ctx, s, "b", "b1", results)
+
+	cancel()
+	h := nextSlot(t, canceled)
+	var pe *pdpError
+	if !errors.As(h.err, &pe) || pe.Kind != pdpCanceled {
+		t.Fatalf("canceled acquire: %v, want a canceled pdpError", h.err)
+	}
+	s.mu.Lock()
+	queued, tenants := s.queued, strings.Join(s.tenants, ",")
+	s.mu.Unlock()
+	if queued != 1 || tenants != "b" {
+		t.Errorf("after cancel: %d queued, tenants %q; want 1 queued for b", queued, tenants)
+	}
+
+	release()
+	if h := nextSlot(t, results); h.err != nil || h.id != "b1" {
+		t.Fatalf("after release: %s granted with %v, want b1", h.id, h.err)
+	} else {
+		h.release()
+	}
+	if st := s.stats(); st.Queued != 0 || st.Running["upload-file"] != 0 {
+		t.Errorf("after all releases: %d queued, %d running", st.Queued, st.Running["upload-file"])
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarball(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		body := []byte("\\documentclass{article}\n")
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckFormat(t *testing.T) {
+	saved := allowedFormats
+	t.Cleanup(func() { allowedFormats = saved })
+	allowedFormats = map[string][]contentFormat{}
+	for dataType, names := range defaultFormats {
+		allowedFormats[dataType] = parseFormats(names)
+	}
+
+	fasta := []byte(">chr1 Homo sapiens chromosome 1\nNNNNACGTACGTTAGC\nACGTTGCA\n")
+	csv := []byte("mz,intensity,charge\n101.07,2310.5,1\n102.05,1822.0,1\n145.11,930.25,2\n")
+	mzml := []byte(`<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<indexedmzML xmlns="http://psi.hupo.org/ms/mzml"><mzML version="1.1.0">`)
+	tests := []struct {
+		name     string
+		dataType string
+		head     []byte
+		want     bool
+	}{
+		{"FASTA", "genome", fasta, true},
+		{"gzipped FASTA", "genome", gzipped(t, fasta), true},
+		{"FASTQ", "genome", []byte("@read1\nACGT\n+\nIIII\n"), true},
+		{"plain text genome", "genome", []byte("just some notes about a genome\n"), false},
+		{"gzipped text genome", "genome", gzipped(t, []byte("just some notes\n")), false},
+		{"CSV", "spectrum", csv, true},
+		{"mzML", "spectrum", mzml, true},
+		{"gzipped mzML", "spectrum", gzipped(t, mzml), false},
+		{"FASTA spectrum", "spectrum", fasta, false},
+		{"LaTeX tar", "paper", tarball(t, "paper/main.tex", "paper/refs.bib"), true},
+		{"LaTeX tar.gz", "paper", gzipped(t, tarball(t, "paper/main.tex")), true},
+		{"tar without .tex", "paper", tarball(t, "data/readme.txt"), false},
+		{"FASTA paper", "paper", fasta, false},
+	}
+	for _, tt := range tests {
+		if got, detected := checkFormat(tt.dataType, tt.head); got != tt.want {
+			t.Errorf("%s: checkFormat(%s) = %v (detected %s), want %v", tt.name, tt.dataType, got, detected, tt.want)
+		}
+	}
+
+	// Types without a list accept anything
+	if ok, _ := checkFormat("file", []byte{0x00, 0x01, 0x02}); !ok {
+		t.Error("checkFormat(file) rejected a file, want any format accepted")
+	}
+}
+
+// memoryIdempotencyStore keeps idempotency keys in memory
+type memoryIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]*storedResponse
+}
+
+func (m *memoryIdempotencyStore) claim(tenant, key, fingerprint string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keys[tenant+"/"+key]; ok {
+		return false, nil
+	}
+	m.keys[tenant+"/"+key] = &storedResponse{fingerprint: fingerprint, status: "processing"}
+	return true, nil
+}
+
+func (m *memoryIdempotencyStore) load(tenant, key string) (*storedResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.keys[tenant+"/"+key]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return s, nil
+}
+
+func (m *memoryIdempotencyStore) complete(tenant, key string, status int, headers http.Header, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.keys[tenant+"/"+key]
+	s.status, s.code, s.headers, s.body = "completed", &status, headers, body
+	return nil
+}
+
+func (m *memoryIdempotencyStore) release(tenant, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, tenant+"/"+key)
+}
+
+// fakePDPTool points pdpToolPath at a script that logs each command and
+// succeeds; it returns the path of the log
+func fakePDPTool(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "calls.log")
+	script := filepath.Join(dir, "pdptool")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> "+log+"\necho ok\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	saved := pdpToolPath
+	t.Cleanup(func() { pdpToolPath = saved })
+	pdpToolPath = script
+	return log
+}
+
+func pdpCalls(t *testing.T, log string) []string {
+	t.Helper()
+	out, err := os.ReadFile(log)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(out))
+}
+
+// TestIdempotencyAfterProviderCall checks that a request failing after
+// add-roots ran is replayed rather than run again, while one failing before
+// any provider call can be retried with the same key
+func TestIdempotencyAfterProviderCall(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	saved := idempotencyKeys
+	t.Cleanup(func() { idempotencyKeys = saved })
+	idempotencyKeys = &memoryIdempotencyStore{keys: map[string]*storedResponse{}}
+	log := fakePDPTool(t)
+
+	failSave := true
+	r := gin.New()
+	r.POST("/upload", idempotencyMiddleware, func(c *gin.Context) {
+		if _, err := runAddRoots(c.Request.Context(), "http://sp.test", "svc", "7", []string{"baga6ea4seaqroot"}, nil); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if failSave {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save paper metadata"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+	r.POST("/precheck", idempotencyMiddleware, func(c *gin.Context) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "scanner unavailable"})
+	})
+
+	send := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"title":"x"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("/upload", "k1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	failSave = false
+	w := send("/upload", "k1")
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: status %d, replayed %q; want the stored 500", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if calls := pdpCalls(t, log); len(calls) != 1 || calls[0] != "add-roots" {
+		t.Errorf("pdptool calls %v, want a single add-roots", calls)
+	}
+
+	// Nothing reached a provider: the key is released for a retry
+	send("/precheck", "k2")
+	if w := send("/precheck", "k2"); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("retry after a failure before any provider call was replayed")
+	}
+}
+
+var testDBOnce sync.Once
+
+// testDB connects to the database named by TEST_POSTGRES_DSN and creates the
+// tables, skipping the test when it is unset. Tests share the database, so
+// each uses CIDs of its own.
+func testDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN not set")
+	}
+	testDBOnce.Do(func() {
+		os.Setenv("POSTGRES_DSN", dsn)
+		initDB()
+	})
+}
+
+// testCID returns a CID unique to this run of the test
+func testCID(t *testing.T) string {
+	return fmt.Sprintf("baga6ea4seaq%s%d", strings.ToLower(strings.ReplaceAll(t.Name(), "/", "")), time.Now().UnixNano())
+}
+
+// asTenant returns a router whose callers act as the tenant named by the
+// X-Test-Tenant header
+func asTenant() *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		setTenant(c, c.GetHeader("X-Test-Tenant"))
+		c.Next()
+	})
+	return r
+}
+
+func sendJSON(r http.Handler, method, path, tenant, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test-Tenant", tenant)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// TestRecordEditLifecycle updates, replaces and deletes a paper, checks its
+// history and that only its uploader may edit it, then uploads it again
+func TestRecordEditLifecycle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	testDB(t)
+	ctx := context.Background()
+	cid := testCID(t)
+	t.Cleanup(func() {
+		for _, q := range []string{
+			"DELETE FROM paper WHERE cid = $1", "DELETE FROM file_cids WHERE cid = $1",
+			"DELETE FROM replicas WHERE cid = $1", "DELETE FROM record_edits WHERE cid = $1",
+		} {
+			db.Exec(ctx, q, cid)
+		}
+	})
+
+	entry := &recordMetadata{Filename: "paper.pdf", Title: "Quantm dots"}
+	if err := saveUploadedRecord(0, "paper", entry, cid, "7", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, "UPDATE file_cids SET tenant = 'alice' WHERE cid = $1", cid); err != nil {
+		t.Fatal(err)
+	}
+
+	r := asTenant()
+	r.PATCH("/api/data/:type/:cid", patchDataHandler)
+	r.PUT("/api/data/:type/:cid/:field", replaceDataFieldHandler)
+	r.DELETE("/api/data/:type/:cid", deleteDataHandler)
+	r.GET("/api/data/:type/:cid/history", getDataHistoryHandler)
+	path := "/api/data/paper/" + cid
+
+	if w := sendJSON(r, http.MethodPatch, path, "", `{"title":"x"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous patch: status %d, want 401", w.Code)
+	}
+	if w := sendJSON(r, http.MethodPatch, path, "mallory", `{"title":"x"}`); w.Code != http.StatusForbidden {
+		t.Errorf("patch by another tenant: status %d, want 403", w.Code)
+	}
+	if w := sendJSON(r, http.MethodDelete, path, "mallory", ""); w.Code != http.StatusForbidden {
+		t.Errorf("delete by another tenant: status %d, want 403", w.Code)
+	}
+	if w := sendJSON(r, http.MethodPatch, path, "alice", `{"title":""}`); w.Code != http.StatusBadRequest {
+		t.Errorf("clearing a required field: status %d, want 400", w.Code)
+	}
+
+	var updated struct {
+		Data struct {
+			Title     string     `json:"title"`
+			Year      *int       `json:"year"`
+			Keywords  []string   `json:"keywords"`
+			UpdatedAt *time.Time `json:"updated_at"`
+		} `json:"data"`
+	}
+	w := sendJSON(r, http.MethodPatch, path, "alice", `{"title":"Quantum dots","year":2023}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch: status %d: %s", w.Code, w.Body)
+	}
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.Data.Title != "Quantum dots" || updated.Data.Year == nil || *updated.Data.Year != 2023 || updated.Data.UpdatedAt == nil {
+		t.Errorf("patched record %+v", updated.Data)
+	}
+
+	w = sendJSON(r, http.MethodPut, path+"/keywords", "alice", `["optics", " ", " nano "]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("put keywords: status %d: %s", w.Code, w.Body)
+	}
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if strings.Join(updated.Data.Keywords, ",") != "optics,nano" {
+		t.Errorf("keywords %q, want [optics nano]", updated.Data.Keywords)
+	}
+
+	if w := sendJSON(r, http.MethodDelete, path, "alice", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPatch, path, "alice", `{"title":"x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("patch after delete: status %d, want 404", w.Code)
+	}
+	if w := sendJSON(r, http.MethodDelete, path, "alice", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", w.Code)
+	}
+
+	var history struct {
+		Data []struct {
+			Action   string          `json:"action"`
+			Previous json.RawMessage `json:"previous"`
+			Changes  json.RawMessage `json:"changes"`
+		} `json:"data"`
+	}
+	w = sendJSON(r, http.MethodGet, path+"/history", "alice", "")
+	json.Unmarshal(w.Body.Bytes(), &history)
+	var actions []string
+	for _, h := range history.Data {
+		actions = append(actions, h.Action)
+	}
+	if strings.Join(actions, ",") != "delete,replace,update" {
+		t.Fatalf("history actions %v, want [delete replace update]", actions)
+	}
+	if !strings.Contains(string(history.Data[2].Previous), "Quantm dots") || !strings.Contains(string(history.Data[2].Changes), "Quantum dots") {
+		t.Errorf("update entry previous %s, changes %s", history.Data[2].Previous, history.Data[2].Changes)
+	}
+	if string(history.Data[0].Changes) != "null" {
+		t.Errorf("delete entry changes %s, want null", history.Data[0].Changes)
+	}
+
+	// Uploading the same file again revives the deleted row
+	entry.Title = "Quantum dots, revised"
+	if err := saveUploadedRecord(0, "paper", entry, cid, "7", "", ""); err != nil {
+		t.Fatalf("re-upload after delete: %v", err)
+	}
+	p, err := getPaperByCID(cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Quantum dots, revised" || len(p.Keywords) != 0 || p.UpdatedAt != nil {
+		t.Errorf("revived record %+v", p)
+	}
+	if err := saveUploadedRecord(0, "paper", entry, cid, "7", "", ""); err == nil {
+		t.Error("saving a record over a live one succeeded")
+	}
+}
+
+// TestV2KeepsLargeNumbers checks that the v2 envelopes carry integers above
+// 2^53 unchanged
+func TestV2KeepsLargeNumbers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(v2Middleware)
+	r.GET("/bare", func(c *gin.Context) {
+		c.JSON(http.StatusOK, []gin.H{{"id": int64(9007199254740993)}})
+	})
+	r.GET("/failed", func(c *gin.Context) {
+		c.JSON(http.StatusConflict, gin.H{"error": "taken", "id": int64(9007199254740993)})
+	})
+
+	for path, want := range map[string]string{
+		"/bare":   `{"data":[{"id":9007199254740993}]}`,
+		"/failed": `"id":9007199254740993`,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: body %s, want %s", path, w.Body, want)
+		}
+	}
+}
+
+// TestWebhookAddresses checks that deliveries to internal addresses are
+// refused unless private addresses are allowed, and that only the status
+// line of the response is kept
+func TestWebhookAddresses(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34": true, "2606:2800:220:1::1": true,
+		"127.0.0.1": false, "10.1.2.3": false, "172.16.0.1": false, "192.168.1.1": false,
+		"169.254.169.254": false, "100.64.0.1": false, "0.0.0.0": false,
+		"::1": false, "fe80::1": false, "fd00::1": false, "::ffff:127.0.0.1": false,
+	} {
+		if got := webhookAddressAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("webhookAddressAllowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "internal secrets")
+	}))
+	defer srv.Close()
+	d := pendingDelivery{id: 1, url: srv.URL, secret: "s", eventType: eventRootAdded}
+
+	if _, _, err := postWebhook(context.Background(), newWebhookClient(), d, []byte("{}")); !errors.Is(err, errWebhookAddress) {
+		t.Errorf("delivery to %s: %v, want errWebhookAddress", srv.URL, err)
+	}
+
+	saved := webhookAllowPrivate
+	t.Cleanup(func() { webhookAllowPrivate = saved })
+	webhookAllowPrivate = true
+	code, statusLine, err := postWebhook(context.Background(), newWebhookClient(), d, []byte("{}"))
+	if code != http.StatusTeapot || statusLine != "418 I'm a teapot" || err == nil {
+		t.Errorf("allowed delivery: %d %q %v", code, statusLine, err)
+	}
+}
+
+// TestBatchStatus checks that a batch without added files reports a client
+// error unless the provider or the database failed
+func TestBatchStatus(t *testing.T) {
+	malware := &malwareError{signature: "Eicar-Test-Signature", auditID: 1}
+	rejected := &pdpError{Op: "upload-file", Kind: pdpInvalidInput}
+	unavailable := &pdpError{Op: "add-roots", Kind: pdpTransient}
+	failed := func(status string, err error) *batchFileResult {
+		res := &batchFileResult{}
+		res.fail(status, err)
+		return res
+	}
+	tests := []struct {
+		name    string
+		results []*batchFileResult
+		want    int
+	}{
+		{"all quarantined", []*batchFileResult{failed("quarantined", malware), failed("quarantined", malware)}, http.StatusUnprocessableEntity},
+		{"mixed client errors", []*batchFileResult{failed("quarantined", malware), failed("upload_failed", rejected)}, http.StatusUnprocessableEntity},
+		{"already stored", []*batchFileResult{failed("db_failed", fmt.Errorf("saving: %w", errRecordExists))}, http.StatusConflict},
+		{"provider down", []*batchFileResult{failed("add_roots_failed", unavailable), failed("add_roots_failed", unavailable)}, http.StatusServiceUnavailable},
+		{"provider down for one", []*batchFileResult{failed("quarantined", malware), failed("add_roots_failed", unavailable)}, http.StatusServiceUnavailable},
+		{"database failed", []*batchFileResult{failed("quarantined", malware), failed("db_failed", errors.New("connection reset"))}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := batchStatus(tt.results); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestBatchRejectsDuplicateContent checks that two files with the same
+// content, which would get the same root CID, are rejected before upload
+func TestBatchRejectsDuplicateContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := fakePDPTool(t)
+	r := gin.New()
+	r.POST("/api/upload/:type/batch", uploadBatchHandler)
+
+	fasta := ">chr1 Homo sapiens chromosome 1\nNNNNACGTACGTTAGC\n"
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("serviceUrl", "http://sp.test")
+	mw.WriteField("serviceName", "svc")
+	mw.WriteField("proofSetID", "7")
+	mw.WriteField("manifest", `[{"filename":"a.fa","organism":"Homo sapiens"},{"filename":"b.fa","organism":"Homo sapiens"}]`)
+	for _, name := range []string{"a.fa", "b.fa"} {
+		part, _ := mw.CreateFormFile("files", name)
+		io.WriteString(part, fasta)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/upload/genome/batch", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "same content") {
+		t.Errorf("status %d: %s; want 400 for duplicate content", w.Code, w.Body)
+	}
+	if calls := pdpCalls(t, log); len(calls) != 0 {
+		t.Errorf("pdptool ran %v", calls)
+	}
+}
+
+// TestProgressTrackers checks that upload IDs are scoped by tenant and that a
+// tracker created by a subscriber lives as long as it is followed
+func TestProgressTrackers(t *testing.T) {
+	progressMu.Lock()
+	saved := progressJobs
+	progressJobs = map[progressKey]*uploadProgress{}
+	progressMu.Unlock()
+	t.Cleanup(func() {
+		progressMu.Lock()
+		progressJobs = saved
+		progressMu.Unlock()
+	})
+
+	alice, ok := startProgress(progressKey{tenant: "alice", id: "up1"})
+	if !ok {
+		t.Fatal("alice could not start up1")
+	}
+	if _, ok := startProgress(progressKey{tenant: "bob", id: "up1"}); !ok {
+		t.Error("bob could not start an upload with the ID alice is using")
+	}
+	alice.emit(progressEvent{Stage: stageUploadStarted})
+	if history, _ := getProgress(progressKey{tenant: "bob", id: "up1"}).subscribe(); len(history) != 0 {
+		t.Errorf("bob sees alice's events %v", history)
+	}
+
+	waiting := getProgress(progressKey{tenant: "alice", id: "up2"})
+	_, ch := waiting.subscribe()
+	sweep := func(after time.Duration) bool {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		sweepProgress(time.Now().Add(after))
+		_, ok := progressJobs[progressKey{tenant: "alice", id: "up2"}]
+		return ok
+	}
+	if !sweep(2 * progressRetention) {
+		t.Fatal("tracker swept while a subscriber was waiting")
+	}
+	waiting.unsubscribe(ch)
+	if !sweep(progressRetention / 2) {
+		t.Error("tracker swept right after its subscriber left")
+	}
+	if sweep(2 * progressRetention) {
+		t.Error("idle tracker kept after progressRetention")
+	}
+}
+
+// TestIntentStateMachine walks intents through the reconciler: a root_added
+// intent is completed, a stale uploaded one is flagged, and metadata without
+// a root is flagged under the tenant and filename it was uploaded with
+func TestIntentStateMachine(t *testing.T) {
+	testDB(t)
+	ctx := context.Background()
+	completedCID, unknownCID, orphanCID := testCID(t)+"a", testCID(t)+"b", testCID(t)+"c"
+	cids := []string{completedCID, unknownCID, orphanCID}
+	t.Cleanup(func() {
+		for _, q := range []string{
+			"DELETE FROM upload_intents WHERE root_cid = ANY($1)", "DELETE FROM paper WHERE cid = ANY($1)",
+			"DELETE FROM file_cids WHERE cid = ANY($1)", "DELETE FROM replicas WHERE cid = ANY($1)",
+		} {
+			db.Exec(ctx, q, cids)
+		}
+	})
+
+	intent := func(id int64) *uploadIntent {
+		t.Helper()
+		in, err := scanIntent(db.QueryRow(ctx, `SELECT `+intentColumns+` FROM upload_intents WHERE id = $1`, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in
+	}
+	// Makes the intents old enough for the reconciler
+	backdate := func(ids ...int64) {
+		t.Helper()
+		if _, err := db.Exec(ctx,
+			"UPDATE upload_intents SET updated_at = NOW() - $2::float8 * INTERVAL '1 second' WHERE id = ANY($1)",
+			ids, 2*reconcileStaleAfter.Seconds()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create := func(filename string) int64 {
+		t.Helper()
+		id, err := createIntent("alice", "paper", "upload", "", &recordMetadata{Filename: filename, Title: "Quantum dots"}, "7", "", "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	completed := create("dots.pdf")
+	if in := intent(completed); in.State != "pending" {
+		t.Fatalf("new intent is %s, want pending", in.State)
+	}
+	markIntent(completed, "uploaded", completedCID, nil)
+	if in := intent(completed); in.State != "uploaded" || in.RootCID == nil || *in.RootCID != completedCID {
+		t.Fatalf("after upload: %s %v", in.State, in.RootCID)
+	}
+	markIntent(completed, "root_added", "", nil)
+
+	unknown := create("lost.pdf")
+	markIntent(unknown, "uploaded", unknownCID, nil)
+
+	// Metadata whose file_cids row was deleted
+	if err := saveUploadedRecord(0, "paper", &recordMetadata{Filename: "orphan.pdf", Title: "Orphan"}, orphanCID, "7", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, "UPDATE file_cids SET tenant = 'bob', deleted_at = NOW() WHERE cid = $1", orphanCID); err != nil {
+		t.Fatal(err)
+	}
+
+	backdate(completed, unknown)
+	reconcile(ctx)
+
+	if in := intent(completed); in.State != "completed" {
+		t.Errorf("root_added intent is %s after reconciling, want completed (%v)", in.State, in.LastError)
+	}
+	var owner *string
+	if err := db.QueryRow(ctx, "SELECT tenant FROM file_cids WHERE cid = $1", completedCID).Scan(&owner); err != nil || owner == nil || *owner != "alice" {
+		t.Errorf("completed record owner %v (%v), want alice", owner, err)
+	}
+	if in := intent(unknown); in.State != "needs_attention" {
+		t.Errorf("stale uploaded intent is %s, want needs_attention", in.State)
+	}
+
+	var tenant, filename string
+	if err := db.QueryRow(ctx,
+		"SELECT tenant, filename FROM upload_intents WHERE root_cid = $1 AND source = 'reconciler'",
+		orphanCID).Scan(&tenant, &filename); err != nil {
+		t.Fatalf("metadata without a root was not flagged: %v", err)
+	}
+	if tenant != "bob" || filename != "orphan.pdf" {
+		t.Errorf("flagged intent tenant %q, filename %q; want bob, orphan.pdf", tenant, filename)
+	}
+}
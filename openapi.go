@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The OpenAPI 3 document is built here rather than kept as a static file so
+// response schemas come straight from the SDK types. Every route registered
+// in setupRouter must have an operation below; TestOpenAPICoversRoutes fails
+// otherwise.
+
+type object = map[string]interface{}
+
+// apiOperation describes one method on one path
+type apiOperation struct {
+	method    string
+	path      string // gin syntax, e.g. /api/data/:type/:cid
+	tag       string
+	summary   string
+	params    []object
+	body      object
+	responses object
+}
+
+func op(method, path, tag, summary string) *apiOperation {
+	o := &apiOperation{method: method, path: path, tag: tag, summary: summary, responses: object{}}
+	// Path parameters are always required and always strings
+	for _, seg := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(seg, ":"); ok {
+			o.params = append(o.params, object{"name": name, "in": "path", "required": true, "schema": object{"type": "string"}})
+		}
+	}
+	return o
+}
+
+func (o *apiOperation) describe(name, description string) *apiOperation {
+	for _, p := range o.params {
+		if p["name"] == name {
+			p["description"] = description
+		}
+	}
+	return o
+}
+
+func (o *apiOperation) query(name, typ, description string) *apiOperation {
+	o.params = append(o.params, object{"name": name, "in": "query", "description": description, "schema": object{"type": typ}})
+	return o
+}
+
+func (o *apiOperation) header(name string, required bool, description string) *apiOperation {
+	o.params = append(o.params, object{"name": name, "in": "header", "required": required, "description": description,
+		"schema": object{"type": "string"}})
+	return o
+}
+
+// idempotent adds the Idempotency-Key header accepted by mutating routes
+func (o *apiOperation) idempotent() *apiOperation {
+	o.header("Idempotency-Key", false,
+		"Retries with the same key and request replay the first response (marked Idempotent-Replayed)")
+	return o.errors("409", "422")
+}
+
+// uploadID adds the optional X-Upload-ID header used by the progress stream
+func (o *apiOperation) uploadID() *apiOperation {
+	o.header("X-Upload-ID", false, "Client-chosen ID to follow this upload at GET /api/uploads/{id}/events; "+
+		"reusable once the upload has ended")
+	return o.errors("409")
+}
+
+func (o *apiOperation) json(schema object) *apiOperation {
+	o.body = object{"required": true, "content": object{"application/json": object{"schema": schema}}}
+	return o
+}
+
+// form sets a multipart/form-data body. Fields are name, type and
+// description triples; a name ending in "*" is required.
+func (o *apiOperation) form(fields ...[3]string) *apiOperation {
+	props := object{}
+	var required []string
+	for _, f := range fields {
+		name := strings.TrimSuffix(f[0], "*")
+		if name != f[0] {
+			required = append(required, name)
+		}
+		var schema object
+		switch f[1] {
+		case "binary":
+			schema = object{"type": "string", "format": "binary"}
+		case "binary[]":
+			schema = object{"type": "array", "items": object{"type": "string", "format": "binary"}}
+		default:
+			schema = object{"type": f[1]}
+		}
+		schema["description"] = f[2]
+		props[name] = schema
+	}
+	schema := object{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	o.body = object{"required": true, "content": object{"multipart/form-data": object{"schema": schema}}}
+	return o
+}
+
+func (o *apiOperation) respond(status, description string, schema object) *apiOperation {
+	r := object{"description": description}
+	if schema != nil {
+		r["content"] = object{"application/json": object{"schema": schema}}
+	}
+	o.responses[status] = r
+	return o
+}
+
+func (o *apiOperation) respondWith(status, description, contentType string, schema object) *apiOperation {
+	o.responses[status] = object{"description": description, "content": object{contentType: object{"schema": schema}}}
+	return o
+}
+
+// errors adds the error responses the handler can return
+func (o *apiOperation) errors(statuses ...string) *apiOperation {
+	for _, s := range statuses {
+		o.responses[s] = object{"$ref": "#/components/responses/Error"}
+	}
+	return o
+}
+
+// openAPIPath converts a gin path to OpenAPI syntax
+func openAPIPath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if name, ok := strings.CutPrefix(seg, ":"); ok {
+			segs[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// schemaRegistry collects component schemas derived from Go types
+type schemaRegistry map[string]object
+
+func (reg schemaRegistry) ref(v interface{}) object {
+	return reg.schemaOf(reflect.TypeOf(v))
+}
+
+func (reg schemaRegistry) schemaOf(t reflect.Type) object {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return object{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return object{"description": "Arbitrary JSON"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := reg.schemaOf(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return object{"allOf": []object{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.Slice:
+		return object{"type": "array", "items": reg.schemaOf(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": reg.schemaOf(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := reg[name]; !ok {
+			reg[name] = object{} // placeholder for recursive types
+			props := object{}
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				tag := strings.Split(f.Tag.Get("json"), ",")[0]
+				if !f.IsExported() || tag == "-" {
+					continue
+				}
+				if tag == "" {
+					tag = f.Name
+				}
+				props[tag] = reg.schemaOf(f.Type)
+			}
+			reg[name] = object{"type": "object", "properties": props}
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	}
+	return object{}
+}
+
+// data wraps a schema in the {"data": ...} envelope most routes respond with
+func data(schema object) object {
+	return object{"type": "object", "properties": object{"data": schema}}
+}
+
+func arrayOf(schema object) object {
+	return object{"type": "array", "items": schema}
+}
+
+func props(names ...string) object {
+	p := object{}
+	for _, n := range names {
+		p[n] = object{"type": "string"}
+	}
+	return object{"type": "object", "properties": p}
+}
+
+// apiOperations lists every route with its parameters and responses,
+// followed by the /api/v2 copies of the /api routes
+func apiOperations(reg schemaRegistry) []*apiOperation {
+	ops := v1Operations(reg)
+	for _, o := range ops {
+		// Mirrors registerAPIRoutes: every mutating route but tus PATCH
+		switch {
+		case o.method == "PATCH" && o.path == "/api/tus/:id":
+		case o.method == "POST", o.method == "PUT", o.method == "PATCH", o.method == "DELETE":
+			o.idempotent()
+		}
+	}
+	for _, o := range ops {
+		if strings.HasPrefix(o.path, "/api/") {
+			ops = append(ops, v2Operation(o))
+		}
+	}
+	return ops
+}
+
+// v2Operation describes the /api/v2 copy of an /api route: JSON successes
+// gain the {"data": ...} envelope and errors use ErrorV2
+func v2Operation(o *apiOperation) *apiOperation {
+	v := *o
+	v.path = "/api/v2" + strings.TrimPrefix(o.path, "/api")
+	v.tag = o.tag + " (v2)"
+	v.responses = object{"default": object{"$ref": "#/components/responses/ErrorV2"}}
+	for status, r := range o.responses {
+		r := r.(object)
+		if _, isRef := r["$ref"]; isRef {
+			v.responses[status] = object{"$ref": "#/components/responses/ErrorV2"}
+			continue
+		}
+		content, ok := r["content"].(object)
+		if !ok || content["application/json"] == nil {
+			v.responses[status] = r
+			continue
+		}
+		schema := content["application/json"].(object)["schema"].(object)
+		if p, ok := schema["properties"].(object); !ok || p["data"] == nil {
+			schema = data(schema)
+		}
+		v.responses[status] = object{"description": r["description"],
+			"content": object{"application/json": object{"schema": schema}}}
+	}
+	return &v
+}
+
+// v1Operations lists the /api routes and the API description routes
+func v1Operations(reg schemaRegistry) []*apiOperation {
+	record := object{"oneOf": []object{reg.ref(filcdn.Paper{}), reg.ref(filcdn.Genome{}), reg.ref(filcdn.Spectrum{}), reg.ref(filcdn.FileCID{})}}
+	typed := object{"oneOf": []object{reg.ref(filcdn.Paper{}), reg.ref(filcdn.Genome{}), reg.ref(filcdn.Spectrum{})}}
+	uploadResult := reg.ref(filcdn.UploadResult{})
+	output := props("output")
+	message := props("message")
+
+	target := [][3]string{
+		{"serviceUrl", "string", "Storage provider URL; when it is unavailable the upload fails over to a registered provider"},
+		{"serviceName", "string", "Storage provider service name"},
+		{"proofSetID", "string", "Proof set to add the root to (default: one from the tenant's pool for serviceUrl)"},
+		{"encryption", "string", `"server" to encrypt with the tenant key before storing`},
+	}
+	withTarget := func(fields ...[3]string) [][3]string {
+		return append(append([][3]string{}, target...), fields...)
+	}
+	skipFormatCheck := [3]string{"skipFormatCheck", "string", `"true" to accept a file in any format (admins only)`}
+
+	return []*apiOperation{
+		// Orchestrator
+		op("POST", "/api/pdp", "Proof sets", "Create a proof set, upload a file and add it as a root in one call").
+			form([3]string{"serviceUrl*", "string", "Storage provider URL"}, [3]string{"serviceName*", "string", "Storage provider service name"},
+				[3]string{"recordkeeper*", "string", "Record keeper contract address"}, [3]string{"file*", "binary", "File to store"}).
+			respond("200", "Stored", reg.ref(filcdn.OrchestrateResult{})).errors("400", "422", "429", "500", "502", "503", "504", "507"),
+
+		// Typed uploads
+		op("POST", "/api/upload/paper", "Uploads", "Upload a paper").uploadID().
+			form(withTarget([3]string{"file*", "binary", "Paper file"}, [3]string{"title*", "string", "Title"},
+				[3]string{"journal", "string", "Journal"}, [3]string{"year", "integer", "Publication year"},
+				[3]string{"keywords", "string", "Comma-separated keywords"}, skipFormatCheck)...).
+			respond("200", "Stored", uploadResult).errors("400", "403", "415", "422", "429", "500", "502", "503", "504", "507"),
+		op("POST", "/api/upload/genome", "Uploads", "Upload a genome").uploadID().
+			form(withTarget([3]string{"file*", "binary", "Genome file"}, [3]string{"organism*", "string", "Organism"},
+				[3]string{"assemblyVersion", "string", "Assembly version"}, [3]string{"notes", "string", "Notes"}, skipFormatCheck)...).
+			respond("200", "Stored", uploadResult).errors("400", "403", "415", "422", "429", "500", "502", "503", "504", "507"),
+		op("POST", "/api/upload/spectrum", "Uploads", "Upload a spectrum").uploadID().
+			form(withTarget([3]string{"file*", "binary", "Spectrum file"}, [3]string{"compound*", "string", "Compound"},
+				[3]string{"technique", "string", "Technique (NMR, IR, MS, ...)"}, [3]string{"metadata", "string", "JSON metadata"}, skipFormatCheck)...).
+			respond("200", "Stored", uploadResult).errors("400", "403", "415", "422", "429", "500", "502", "503", "504", "507"),
+		op("POST", "/api/upload/:type/batch", "Uploads", "Upload several files with a single add-roots call").
+			describe("type", "paper, genome or spectrum").uploadID().
+			form(withTarget([3]string{"files*", "binary[]", "Files to store"},
+				[3]string{"manifest*", "string", "JSON array of per-file metadata matched by filename"}, skipFormatCheck)...).
+			respond("200", "All files stored", reg.ref(filcdn.BatchResult{})).
+			respond("207", "Some files failed; see results", reg.ref(filcdn.BatchResult{})).
+			errors("400", "403", "415", "422", "429", "500", "502", "503", "504", "507"),
+		op("GET", "/api/uploads/:id/events", "Uploads", "Follow an upload's progress as Server-Sent Events").
+			describe("id", "The X-Upload-ID sent with the upload").
+			respondWith("200", "One event per stage; the stream ends after completed or failed", "text/event-stream",
+				reg.ref(filcdn.ProgressEvent{})).errors("400"),
+
+		// Resumable uploads
+		op("OPTIONS", "/api/tus/", "Resumable uploads", "tus capabilities").
+			respond("204", "Tus-Version, Tus-Extension and Tus-Max-Size headers", nil),
+		op("POST", "/api/tus/", "Resumable uploads", "Create a tus upload").
+			header("Tus-Resumable", true, "1.0.0").header("Upload-Length", true, "Total size in bytes").
+			header("Upload-Metadata", true, "Comma-separated key base64(value) pairs: type, filename, proofSetID, serviceUrl, serviceName, encryption and record fields").
+			respond("201", "Created; Location holds the upload URL", nil).errors("400", "401", "403", "412", "413", "500"),
+		op("HEAD", "/api/tus/:id", "Resumable uploads", "Get the received offset").
+			header("Tus-Resumable", true, "1.0.0").
+			respond("200", "Upload-Offset and Upload-Length headers", nil).errors("404"),
+		op("PATCH", "/api/tus/:id", "Resumable uploads", "Append bytes at Upload-Offset").
+			header("Tus-Resumable", true, "1.0.0").header("Upload-Offset", true, "Offset the chunk starts at").
+			respond("204", "Appended; Upload-Offset holds the new offset", nil).errors("400", "404", "409", "415", "423", "500"),
+		op("GET", "/api/tus/:id", "Resumable uploads", "Get upload and processing status").
+			respond("200", "Upload", data(reg.ref(filcdn.ResumableUpload{}))).errors("404"),
+		op("DELETE", "/api/tus/:id", "Resumable uploads", "Terminate an upload").
+			header("Tus-Resumable", true, "1.0.0").
+			respond("204", "Terminated", nil).errors("404", "409"),
+
+		// Data
+		op("GET", "/api/data/:type", "Data", "Query records").describe("type", "paper, genome, spectrum or file_cids").
+			query("limit", "integer", "Page size (default 20)").query("offset", "integer", "Records to skip").
+			query("sort", "string", "Sort column").query("order", "string", "ASC or DESC").
+			query("search", "string", "Free-text search").
+			query("year", "integer", "paper: year").query("journal", "string", "paper: journal").query("keyword", "string", "paper: keyword").
+			query("organism", "string", "genome: organism").query("assembly", "string", "genome: assembly version").
+			query("compound", "string", "spectrum: compound").query("technique", "string", "spectrum: technique").
+			query("verification", "string", "file_cids: verified, missing, not_proving, unretrievable, error or unverified").
+			respond("200", "One page of records", object{"type": "object", "properties": object{
+				"data":       arrayOf(record),
+				"pagination": reg.ref(filcdn.Pagination{}),
+				"sort":       reg.ref(filcdn.Sort{}),
+			}}).errors("400", "500"),
+		op("GET", "/api/data/:type/:cid", "Data", "Get a record").describe("type", "paper, genome, spectrum or file_cids").
+			respond("200", "Record", data(record)).errors("400", "404", "500"),
+		op("GET", "/api/data/:type/:cid/history", "Data", "List a record's edit history").
+			respond("200", "Edits, newest first", data(arrayOf(reg.ref(filcdn.HistoryEntry{})))).errors("500"),
+		op("GET", "/api/data/:type/:cid/replicas", "Replication", "Desired and actual copies of a record").
+			describe("type", "paper, genome, spectrum or file_cids").
+			respond("200", "Replication state", data(reg.ref(filcdn.RecordReplicas{}))).errors("400", "404", "500"),
+		op("PUT", "/api/data/:type/:cid/replication", "Replication", "Override the number of copies of one record").
+			describe("type", "paper, genome, spectrum or file_cids").
+			json(object{"type": "object", "required": []string{"copies"}, "properties": object{"copies": object{"type": "integer", "minimum": 1, "maximum": 10}}}).
+			respond("200", "Replication state", data(reg.ref(filcdn.RecordReplicas{}))).errors("400", "401", "404", "500"),
+		op("GET", "/api/content/:cid", "Data", "Download a stored file, decrypted for its owner and encrypted for key grant holders").
+			respondWith("200", "File content", "application/octet-stream", object{"type": "string", "format": "binary"}).
+			errors("403", "404", "409", "500", "502"),
+		op("PATCH", "/api/data/:type/:cid", "Data", "Update metadata fields").describe("type", "paper, genome or spectrum").
+			json(object{"type": "object", "description": "Fields to set, using the upload form names"}).
+			respond("200", "Updated record", data(typed)).errors("400", "401", "403", "404", "500"),
+		op("PUT", "/api/data/:type/:cid/:field", "Data", "Replace a collection field").
+			describe("field", "keywords (paper) or metadata (spectrum)").
+			json(object{"description": "New value"}).
+			respond("200", "Updated record", data(typed)).errors("400", "401", "403", "404", "500"),
+		op("DELETE", "/api/data/:type/:cid", "Data", "Delete a record's metadata").
+			respond("200", "Deleted", props("deleted", "type")).errors("400", "401", "403", "404", "500"),
+
+		// Sharing
+		op("PUT", "/api/users/:user/public-key", "Sharing", "Register a user's X25519 public key").
+			json(props("publicKey")).respond("200", "Registered", reg.ref(filcdn.PublicKey{})).errors("400", "401", "500"),
+		op("GET", "/api/users/:user/public-key", "Sharing", "Get a user's public key").
+			query("tenant", "string", "Tenant of the user (default: caller's)").
+			respond("200", "Public key", reg.ref(filcdn.PublicKey{})).errors("404", "500"),
+		op("POST", "/api/records/:cid/encryption", "Sharing", "Register a client-side encrypted record").
+			json(object{"type": "object", "required": []string{"algorithm"}, "properties": object{
+				"algorithm":  object{"type": "string"},
+				"recipients": arrayOf(reg.ref(filcdn.Recipient{})),
+			}}).
+			respond("201", "Registered", props("cid", "mode", "algorithm", "owner")).errors("400", "401", "403", "404", "409", "500"),
+		op("POST", "/api/records/:cid/recipients", "Sharing", "Share a record's data key with a recipient").
+			json(reg.ref(filcdn.Recipient{})).
+			respond("201", "Shared", props("cid", "recipientTenant", "recipientUser")).errors("400", "401", "403", "404", "500"),
+		op("GET", "/api/records/:cid/recipients", "Sharing", "List a record's recipients").
+			respond("200", "Grants", data(arrayOf(reg.ref(filcdn.KeyGrant{})))).errors("401", "403", "404", "500"),
+		op("DELETE", "/api/records/:cid/recipients/:user", "Sharing", "Revoke a recipient").
+			query("tenant", "string", "Tenant of the recipient (default: caller's)").
+			respond("200", "Revoked", object{"type": "object"}).errors("401", "403", "404", "500"),
+		op("GET", "/api/records/:cid/keys/:user", "Sharing", "Get the caller's wrapped data key").
+			respond("200", "Wrapped key", reg.ref(filcdn.WrappedKey{})).errors("401", "404", "500"),
+
+		// Webhooks
+		op("POST", "/api/webhooks", "Webhooks", "Subscribe to events").
+			json(object{"type": "object", "required": []string{"url"}, "properties": object{
+				"url":    object{"type": "string"},
+				"events": arrayOf(object{"type": "string", "enum": slices.Sorted(maps.Keys(webhookEventTypes))}),
+				"secret": object{"type": "string"},
+			}}).
+			respond("201", "Subscribed; secret is only returned here", reg.ref(filcdn.Webhook{})).errors("400", "401", "500"),
+		op("GET", "/api/webhooks", "Webhooks", "List subscriptions").
+			respond("200", "Subscriptions", data(arrayOf(reg.ref(filcdn.Webhook{})))).errors("401", "500"),
+		op("DELETE", "/api/webhooks/:id", "Webhooks", "Deactivate a subscription").
+			respond("200", "Deactivated", object{"type": "object"}).errors("400", "401", "404", "500"),
+		op("GET", "/api/webhooks/:id/deliveries", "Webhooks", "List deliveries").
+			query("status", "string", "pending, delivered, failed or cancelled").
+			query("limit", "integer", "Page size (default 50)").query("offset", "integer", "Records to skip").
+			respond("200", "Deliveries, newest first", data(arrayOf(reg.ref(filcdn.WebhookDelivery{})))).errors("400", "401", "404", "500"),
+		op("GET", "/api/webhooks/:id/deliveries/:deliveryId", "Webhooks", "Get a delivery with its attempts").
+			respond("200", "Delivery", data(reg.ref(filcdn.WebhookDeliveryDetail{}))).errors("400", "401", "404", "500"),
+		op("POST", "/api/webhooks/:id/deliveries/:deliveryId/replay", "Webhooks", "Redeliver an event").
+			respond("202", "Queued", object{"type": "object"}).errors("400", "401", "404", "500"),
+
+		// Deletions
+		op("POST", "/api/deletions", "Deletions", "Schedule removal of a root and its records").
+			json(reg.ref(filcdn.DeletionRequest{})).
+			respond("202", "Scheduled", data(reg.ref(filcdn.Deletion{}))).errors("400", "401", "403", "404", "409", "500"),
+		op("GET", "/api/deletions", "Deletions", "List deletions").
+			query("status", "string", "Filter by status").
+			query("limit", "integer", "Page size (default 50)").query("offset", "integer", "Records to skip").
+			respond("200", "Deletions, newest first", data(arrayOf(reg.ref(filcdn.Deletion{})))).errors("500"),
+		op("GET", "/api/deletions/:id", "Deletions", "Get a deletion").
+			respond("200", "Deletion", data(reg.ref(filcdn.Deletion{}))).errors("400", "404", "500"),
+		op("POST", "/api/deletions/:id/undo", "Deletions", "Undo a deletion inside its undo window").
+			respond("200", "Cancelled", data(reg.ref(filcdn.Deletion{}))).errors("400", "401", "403", "404", "409", "500"),
+
+		// Upload intents
+		op("GET", "/api/admin/intents", "Admin", "List upload intents").
+			query("state", "string", "State to list (default needs_attention; all for every state)").
+			query("limit", "integer", "Page size (default 50)").query("offset", "integer", "Records to skip").
+			respond("200", "Intents, most recently updated first", data(arrayOf(reg.ref(filcdn.UploadIntent{})))).errors("401", "403", "500"),
+		op("GET", "/api/admin/intents/:id", "Admin", "Get an upload intent").
+			respond("200", "Intent", data(reg.ref(filcdn.UploadIntent{}))).errors("400", "401", "403", "404", "500"),
+		op("POST", "/api/admin/intents/:id/retry", "Admin", "Save the metadata of an intent whose root is in the proof set").
+			respond("200", "Completed", data(reg.ref(filcdn.UploadIntent{}))).errors("400", "401", "403", "404", "409", "500"),
+		op("POST", "/api/admin/intents/:id/resolve", "Admin", "Close an intent that was handled by hand").
+			json(props("note")).
+			respond("200", "Resolved", data(reg.ref(filcdn.UploadIntent{}))).errors("400", "401", "403", "404", "409", "500"),
+		op("GET", "/api/admin/pdp-queue", "Admin", "pdptool concurrency limits, running commands and queue").
+			respond("200", "Queue metrics", data(reg.ref(filcdn.PDPQueueStats{}))).errors("401", "403"),
+		op("GET", "/api/admin/scans", "Admin", "List malware scan audit records, newest first").
+			query("verdict", "string", "clean, infected, error or all (default)").
+			query("limit", "integer", "Page size (default 50)").query("offset", "integer", "Records to skip").
+			respond("200", "Scan records", data(arrayOf(reg.ref(filcdn.ScanRecord{})))).errors("401", "403", "500"),
+
+		// Providers and replication policies
+		op("GET", "/api/admin/providers", "Replication", "List registered providers").
+			respond("200", "Providers", data(arrayOf(reg.ref(filcdn.Provider{})))).errors("401", "403", "500"),
+		op("POST", "/api/admin/providers", "Replication", "Register a provider, or update the one with the same service URL").
+			json(reg.ref(filcdn.ProviderRequest{})).
+			respond("201", "Registered", data(reg.ref(filcdn.Provider{}))).errors("400", "401", "403", "409", "500"),
+		op("DELETE", "/api/admin/providers/:id", "Replication", "Stop placing replicas on a provider").
+			respond("200", "Deactivated", data(reg.ref(filcdn.Provider{}))).errors("400", "401", "403", "404", "500"),
+		op("GET", "/api/admin/replication-policies", "Replication", "List per-type replication policies").
+			respond("200", "Policies", data(arrayOf(reg.ref(filcdn.ReplicationPolicy{})))).errors("401", "403", "500"),
+		op("PUT", "/api/admin/replication-policies/:type", "Replication", "Set the number of copies for a data type").
+			describe("type", "paper, genome, spectrum or file").
+			json(object{"type": "object", "required": []string{"copies"}, "properties": object{"copies": object{"type": "integer", "minimum": 1, "maximum": 10}}}).
+			respond("200", "Policy", data(reg.ref(filcdn.ReplicationPolicy{}))).errors("400", "401", "403", "500"),
+
+		// Proof sets and legacy endpoints
+		op("POST", "/api/ping", "Proof sets", "Check connectivity to a storage provider").
+			json(props("serviceUrl", "serviceName")).respond("200", "pdptool output", message).errors("400", "429", "500", "504"),
+		op("POST", "/api/proof-sets", "Proof sets", "Create a proof set").
+			json(props("serviceUrl", "serviceName", "recordkeeper")).respond("200", "pdptool output", output).errors("400", "429", "500", "504"),
+		op("GET", "/api/proof-sets", "Proof sets", "List proof sets the service has added roots to").
+			respond("200", "Proof sets", data(arrayOf(reg.ref(filcdn.ProofSet{})))).errors("500"),
+		op("GET", "/api/proof-sets/pool", "Proof sets", "List the caller's pool proof sets, newest first").
+			query("serviceUrl", "string", "Only proof sets on this provider").
+			respond("200", "Pool proof sets", data(arrayOf(reg.ref(filcdn.PoolProofSet{})))).errors("401", "500"),
+		op("GET", "/api/proof-sets/:id/status", "Proof sets", "Poll proof set creation").
+			describe("id", "Transaction hash printed by proof set creation").
+			query("serviceUrl", "string", "Storage provider URL").query("serviceName", "string", "Storage provider service name").
+			respond("200", "pdptool output", props("status")).errors("429", "500", "504"),
+		op("GET", "/api/proof-sets/:id/health", "Proof sets", "Proving health of a proof set").
+			query("serviceUrl", "string", "Storage provider URL (required; proof set IDs are only unique per provider)").
+			query("since", "string", "Only samples from this RFC 3339 time (default: all kept)").
+			query("limit", "integer", "Maximum samples (default 100)").
+			respond("200", "Latest sample and history, newest first", data(reg.ref(filcdn.ProofSetHealth{}))).errors("400", "401", "403", "404", "500"),
+		op("POST", "/api/upload", "Legacy", "Upload a file without adding it to a proof set").
+			form([3]string{"serviceUrl", "string", "Storage provider URL"}, [3]string{"serviceName", "string", "Storage provider service name"},
+				[3]string{"file*", "binary", "File to store"}).
+			respond("200", "pdptool output", output).errors("400", "422", "429", "500", "503", "504"),
+		op("POST", "/api/proof-sets/:proofSetId/roots", "Proof sets", "Add a root to a proof set").
+			json(props("serviceUrl", "serviceName", "root")).respond("200", "pdptool output", message).errors("400", "429", "500", "502", "503", "504", "507"),
+		op("POST", "/api/proofset/upload-and-add-root", "Legacy", "Upload a file and add it to a proof set").uploadID().
+			form(withTarget([3]string{"file*", "binary", "File to store"})...).
+			respond("200", "Stored", reg.ref(filcdn.RootUploadResult{})).errors("400", "403", "422", "429", "500", "502", "503", "504", "507"),
+		op("GET", "/api/cids", "Legacy", "List filename to CID mappings").
+			query("filename", "string", "Only this filename").
+			respond("200", "Mappings", arrayOf(reg.ref(filcdn.CIDEntry{}))).errors("500"),
+
+		// API description
+		op("GET", "/openapi.json", "Docs", "This document").respond("200", "OpenAPI 3 document", object{"type": "object"}),
+		op("GET", "/docs", "Docs", "Interactive API documentation").
+			respondWith("200", "Swagger UI", "text/html", object{"type": "string"}),
+	}
+}
+
+// openAPISpec builds the document once
+var openAPISpec = sync.OnceValue(func() object {
+	reg := schemaRegistry{}
+	paths := object{}
+	for _, o := range apiOperations(reg) {
+		p := openAPIPath(o.path)
+		if paths[p] == nil {
+			paths[p] = object{}
+		}
+		operation := object{"tags": []string{o.tag}, "summary": o.summary, "responses": o.responses}
+		if len(o.params) > 0 {
+			operation["parameters"] = o.params
+		}
+		if o.body != nil {
+			operation["requestBody"] = o.body
+		}
+		paths[p].(object)[strings.ToLower(o.method)] = operation
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "filcdn service",
+			"version": "1.0.0",
+			"description": "Stores research data on Filecoin PDP storage providers and indexes its metadata. " +
+				"Every route under /api is also served under /api/v2, where successful JSON responses are " +
+				"wrapped in {\"data\": ...} and errors carry a code, message, details and request ID. " +
+				"Every response has an X-Request-ID header.",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": reg,
+			"responses": object{
+				"Error": object{
+					"description": "Error",
+					"content":     object{"application/json": object{"schema": props("error")}},
+				},
+				"ErrorV2": object{
+					"description": "Error with a machine-readable code and the request ID",
+					"content":     object{"application/json": object{"schema": reg.ref(filcdn.ErrorResponse{})}},
+				},
+			},
+			"securitySchemes": object{"bearerAuth": object{"type": "http", "scheme": "bearer",
+				"description": "API key from API_KEYS_FILE; omit when the service runs without keys"}},
+		},
+		"security": []object{{"bearerAuth": []string{}}, {}},
+	}
+})
+
+// openAPIHandler serves the OpenAPI document
+// GET /openapi.json
+func openAPIHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, openAPISpec())
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>filcdn API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>`
+
+// docsHandler serves Swagger UI for the OpenAPI document
+// GET /docs
+func docsHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Failed pdptool invocations are classified by what their output says went
+// wrong. The kind decides whether an operation is retried (pdpRetry), what
+// status the client gets and, under /api/v2, the error code ("pdp_" + kind).
+type pdpErrorKind string
+
+const (
+	pdpTransient    pdpErrorKind = "transient"     // network trouble or provider 5xx
+	pdpNotSynced    pdpErrorKind = "not_synced"    // provider has not caught up with an upload yet
+	pdpAuth         pdpErrorKind = "auth"          // provider rejected our credentials
+	pdpInvalidInput pdpErrorKind = "invalid_input" // provider rejected the request
+	pdpProviderFull pdpErrorKind = "provider_full" // provider is out of space or capacity
+	pdpTimeout      pdpErrorKind = "timeout"       // pdptool ran past its time limit and was killed
+	pdpCanceled     pdpErrorKind = "canceled"      // the caller went away and pdptool was killed
+	pdpBusy         pdpErrorKind = "busy"          // too many pdptool commands queued here
+	pdpUnknown      pdpErrorKind = "unknown"
+)
+
+// pdpErrorMarkers map output fragments (lower case) and HTTP statuses to
+// kinds, checked in order so the more specific kinds win
+var pdpErrorMarkers = []struct {
+	kind     pdpErrorKind
+	markers  []string
+	statuses []string
+}{
+	{pdpNotSynced, []string{"not found or does not belong to service", "piece not found", "not yet available"}, nil},
+	{pdpAuth, []string{"unauthorized", "forbidden", "invalid jwt", "token is expired", "service secret"},
+		[]string{"401", "403"}},
+	{pdpProviderFull, []string{"insufficient storage", "no space left", "storage full", "capacity exceeded"},
+		[]string{"507"}},
+	{pdpTransient, []string{
+		"connection refused", "connection reset", "no such host", "i/o timeout", "timeout",
+		"deadline exceeded", "unexpected eof", "broken pipe", "network is unreachable",
+		"bad gateway", "service unavailable", "gateway timeout",
+		"too many requests", "temporarily unavailable", "circuit open",
+	}, []string{"429", "502", "503", "504"}},
+	{pdpInvalidInput, []string{"bad request", "invalid", "malformed", "unknown flag", "required flag"},
+		[]string{"400"}},
+}
+
+// httpStatusPattern finds the HTTP statuses pdptool reports ("status 403",
+// "status code: 503", "HTTP 502", "HTTP/1.1 429"). Bare numbers are not
+// statuses: ports, proof set IDs and byte counts are full of them.
+var httpStatusPattern = regexp.MustCompile(`\b(?:status(?:\s+code)?|http(?:/[0-9.]+)?)\s*[:=]?\s*([1-5][0-9]{2})\b`)
+
+// pdpError is a failed PDP operation
+type pdpError struct {
+	Op     string // pdptool command, e.g. add-roots
+	Kind   pdpErrorKind
+	Output string
+}
+
+func (e *pdpError) Error() string {
+	return fmt.Sprintf("%s failed (%s): %s", e.Op, e.Kind, e.Output)
+}
+
+// Is lets transient failures match errProviderUnavailable
+func (e *pdpError) Is(target error) bool {
+	return target == errProviderUnavailable && e.Kind == pdpTransient
+}
+
+// status is the HTTP status reported to clients
+func (e *pdpError) status() int {
+	switch e.Kind {
+	case pdpTransient, pdpNotSynced:
+		return http.StatusServiceUnavailable
+	case pdpAuth:
+		return http.StatusBadGateway
+	case pdpInvalidInput:
+		return http.StatusBadRequest
+	case pdpProviderFull:
+		return http.StatusInsufficientStorage
+	case pdpTimeout:
+		return http.StatusGatewayTimeout
+	case pdpBusy:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// pdpOutcomeUnknown reports whether a failed PDP operation may still have
+// been applied by the provider, so it must not simply be sent again
+func pdpOutcomeUnknown(err error) bool {
+	var pe *pdpError
+	if !errors.As(err, &pe) {
+		return true
+	}
+	switch pe.Kind {
+	case pdpTimeout, pdpCanceled, pdpTransient, pdpUnknown:
+		return true
+	}
+	return false
+}
+
+// classifyPDPError turns a failed pdptool run into a pdpError
+func classifyPDPError(op string, output []byte, err error) *pdpError {
+	var pe *pdpError
+	if errors.As(err, &pe) {
+		return pe
+	}
+	out := strings.TrimSpace(string(output))
+	text := strings.ToLower(out)
+	if err != nil {
+		text += " " + strings.ToLower(err.Error())
+		if out == "" {
+			out = err.Error()
+		}
+	}
+	var statuses []string
+	for _, m := range httpStatusPattern.FindAllStringSubmatch(text, -1) {
+		statuses = append(statuses, m[1])
+	}
+	for _, m := range pdpErrorMarkers {
+		for _, marker := range m.markers {
+			if strings.Contains(text, marker) {
+				return &pdpError{Op: op, Kind: m.kind, Output: out}
+			}
+		}
+		for _, status := range m.statuses {
+			if slices.Contains(statuses, status) {
+				return &pdpError{Op: op, Kind: m.kind, Output: out}
+			}
+		}
+	}
+	return &pdpError{Op: op, Kind: pdpUnknown, Output: out}
+}
+
+// pdpFailed annotates the error response for a failed PDP operation and
+// returns the status to respond with
+func pdpFailed(c *gin.Context, op string, err error) int {
+	var pe *pdpError
+	if !errors.As(err, &pe) {
+		pdptoolFailed(c, op, nil)
+		return http.StatusInternalServerError
+	}
+	annotateError(c, "pdp_"+string(pe.Kind), fmt.Sprintf("%s failed (%s)", pe.Op, pe.Kind), []byte(pe.Output))
+	switch pe.Kind {
+	case pdpTransient, pdpNotSynced:
+		c.Header("Retry-After", "30")
+	case pdpBusy:
+		c.Header("Retry-After", "5")
+	}
+	return pe.status()
+}
+
+// pdpRetryPolicy decides how failed PDP operations are retried: up to
+// maxAttempts tries while the failure is of a retryable kind, waiting a
+// jittered exponential backoff between tries, and never starting a try
+// after deadline has passed since the first.
+type pdpRetryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	deadline    time.Duration
+	retryOn     map[pdpErrorKind]bool
+}
+
+var pdpRetry pdpRetryPolicy
+
+// parseRetryKinds reads a comma-separated list of error kinds
+func parseRetryKinds(list string) map[pdpErrorKind]bool {
+	known := map[pdpErrorKind]bool{pdpTransient: true, pdpNotSynced: true, pdpAuth: true,
+		pdpInvalidInput: true, pdpProviderFull: true, pdpTimeout: true, pdpUnknown: true}
+	kinds := map[pdpErrorKind]bool{}
+	for _, k := range strings.Split(list, ",") {
+		kind := pdpErrorKind(strings.TrimSpace(k))
+		if known[kind] {
+			kinds[kind] = true
+		} else if kind != "" {
+			fmt.Printf("[INIT] Ignoring unknown PDP error kind %q\n", kind)
+		}
+	}
+	return kinds
+}
+
+// only narrows the policy to the given kinds (those it retries at all), for
+// operations that are not safe to repeat after every failure
+func (p pdpRetryPolicy) only(kinds ...pdpErrorKind) pdpRetryPolicy {
+	retryOn := map[pdpErrorKind]bool{}
+	for _, k := range kinds {
+		retryOn[k] = p.retryOn[k]
+	}
+	p.retryOn = retryOn
+	return p
+}
+
+// backoff returns the wait before try attempt+1: baseDelay doubled per
+// attempt, capped at maxDelay, with the upper half randomised
+func (p pdpRetryPolicy) backoff(attempt int) time.Duration {
+	d := p.baseDelay << (attempt - 1)
+	if d > p.maxDelay || d <= 0 {
+		d = p.maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// run calls try until it succeeds, fails with a kind that is not retried,
+// or the attempts or deadline run out. onAttempt, if set, is told about each
+// try before it starts.
+func (p pdpRetryPolicy) run(ctx context.Context, op string, onAttempt func(attempt, maxAttempts int), try func() ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if onAttempt != nil {
+			onAttempt(attempt, p.maxAttempts)
+		}
+		out, err := try()
+		if err == nil {
+			return out, nil
+		}
+		pe := classifyPDPError(op, out, err)
+		if !p.retryOn[pe.Kind] || attempt >= p.maxAttempts {
+			return out, pe
+		}
+		wait := p.backoff(attempt)
+		if time.Since(start)+wait > p.deadline {
+			fmt.Printf("[RETRY] %s: giving up after %d attempts, retry deadline %s reached\n", op, attempt, p.deadline)
+			return out, pe
+		}
+		fmt.Printf("[RETRY] %s attempt %d/%d failed (%s), retrying in %s\n", op, attempt, p.maxAttempts, pe.Kind, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return out, &pdpError{Op: op, Kind: pdpCanceled, Output: "request canceled while waiting to retry"}
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every pdptool process runs in a slot from pdpSlots. A command may start
+// when fewer than its command's limit (pdpCommandLimits, default
+// pdpConcurrency) and fewer than pdpProviderConcurrency commands for the
+// same provider are running. Commands that cannot start wait in per-tenant
+// queues; freed slots go to the tenants in turn, so one tenant's backlog
+// does not hold up the others. At most pdpQueueMax commands wait in all;
+// beyond that runPDP fails with a pdpError of kind busy (429).
+var (
+	pdpConcurrency         int
+	pdpCommandLimits       = map[string]int{}
+	pdpProviderConcurrency int
+	pdpQueueMax            int
+)
+
+var pdpSlots = &pdpScheduler{
+	running:   map[string]int{},
+	queues:    map[string][]*pdpSlotRequest{},
+	startedAt: time.Now(),
+}
+
+type pdpSlotRequest struct {
+	tenant   string
+	command  string
+	provider string
+	queuedAt time.Time
+	granted  chan struct{}
+}
+
+func (r *pdpSlotRequest) commandKey() string  { return "command:" + r.command }
+func (r *pdpSlotRequest) providerKey() string { return "provider:" + r.provider }
+
+type pdpScheduler struct {
+	mu        sync.Mutex
+	running   map[string]int // by commandKey and providerKey
+	queues    map[string][]*pdpSlotRequest
+	tenants   []string // tenants with queued requests, in turn order
+	next      int      // index in tenants of the next tenant to serve
+	queued    int
+	startedAt time.Time
+
+	admitted  int64
+	rejected  int64
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+func commandLimit(command string) int {
+	if n, ok := pdpCommandLimits[command]; ok {
+		return n
+	}
+	return pdpConcurrency
+}
+
+func (s *pdpScheduler) canRun(r *pdpSlotRequest) bool {
+	return s.running[r.commandKey()] < commandLimit(r.command) &&
+		(r.provider == "" || s.running[r.providerKey()] < pdpProviderConcurrency)
+}
+
+// start takes the slots of r; s.mu is held
+func (s *pdpScheduler) start(r *pdpSlotRequest) {
+	s.running[r.commandKey()]++
+	if r.provider != "" {
+		s.running[r.providerKey()]++
+	}
+	wait := time.Since(r.queuedAt)
+	s.admitted++
+	s.totalWait += wait
+	if wait > s.maxWait {
+		s.maxWait = wait
+	}
+}
+
+// acquire waits for a slot for command against provider (may be empty) and
+// returns the function that frees it. It fails at once when the queue is
+// full and gives up when ctx is done.
+func (s *pdpScheduler) acquire(ctx context.Context, command, provider string) (func(), error) {
+	r := &pdpSlotRequest{
+		tenant:   tenantFromContext(ctx),
+		command:  command,
+		provider: provider,
+		queuedAt: time.Now(),
+		granted:  make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.queued == 0 && s.canRun(r) {
+		s.start(r)
+		s.mu.Unlock()
+		return func() { s.release(r) }, nil
+	}
+	if s.queued >= pdpQueueMax {
+		s.rejected++
+		s.mu.Unlock()
+		return nil, &pdpError{Op: command, Kind: pdpBusy, Output: fmt.Sprintf("%d pdptool commands already queued", pdpQueueMax)}
+	}
+	if len(s.queues[r.tenant]) == 0 {
+		s.tenants = append(s.tenants, r.tenant)
+	}
+	s.queues[r.tenant] = append(s.queues[r.tenant], r)
+	s.queued++
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-r.granted:
+		return func() { s.release(r) }, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-r.granted:
+			// Granted while giving up; hand the slot on
+			s.releaseLocked(r)
+		default:
+			s.dequeue(r)
+		}
+		return nil, &pdpError{Op: command, Kind: pdpCanceled, Output: "request canceled while queued"}
+	}
+}
+
+func (s *pdpScheduler) release(r *pdpSlotRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked(r)
+}
+
+func (s *pdpScheduler) releaseLocked(r *pdpSlotRequest) {
+	s.running[r.commandKey()]--
+	if r.provider != "" {
+		s.running[r.providerKey()]--
+	}
+	s.dispatch()
+}
+
+// dispatch starts queued requests while slots allow, taking the tenants in
+// turn; s.mu is held
+func (s *pdpScheduler) dispatch() {
+	for s.queued > 0 {
+		started := false
+		for i := 0; i < len(s.tenants); i++ {
+			idx := (s.next + i) % len(s.tenants)
+			tenant := s.tenants[idx]
+			for _, r := range s.queues[tenant] {
+				if !s.canRun(r) {
+					continue
+				}
+				s.dequeue(r)
+				s.start(r)
+				close(r.granted)
+				// dequeue may have dropped the tenant from the turn order
+				if idx < len(s.tenants) && s.tenants[idx] == tenant {
+					s.next = idx + 1
+				} else {
+					s.next = idx
+				}
+				started = true
+				break
+			}
+			if started {
+				break
+			}
+		}
+		if !started {
+			return
+		}
+	}
+}
+
+// dequeue removes a waiting request; s.mu is held
+func (s *pdpScheduler) dequeue(r *pdpSlotRequest) {
+	q := s.queues[r.tenant]
+	for i, qr := range q {
+		if qr != r {
+			continue
+		}
+		s.queues[r.tenant] = append(q[:i:i], q[i+1:]...)
+		s.queued--
+		if len(s.queues[r.tenant]) == 0 {
+			delete(s.queues, r.tenant)
+			for j, t := range s.tenants {
+				if t == r.tenant {
+					s.tenants = append(s.tenants[:j], s.tenants[j+1:]...)
+					if j < s.next {
+						s.next--
+					}
+					break
+				}
+			}
+		}
+		if len(s.tenants) > 0 {
+			s.next %= len(s.tenants)
+		} else {
+			s.next = 0
+		}
+		return
+	}
+}
+
+// stats returns the queue metrics
+func (s *pdpScheduler) stats() filcdn.PDPQueueStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := filcdn.PDPQueueStats{
+		Queued:            s.queued,
+		QueueCapacity:     pdpQueueMax,
+		QueuedByTenant:    map[string]int{},
+		QueuedByCommand:   map[string]int{},
+		Running:           map[string]int{},
+		RunningByProvider: map[string]int{},
+		Limits:            map[string]int{"default": pdpConcurrency, "perProvider": pdpProviderConcurrency},
+		Admitted:          s.admitted,
+		Rejected:          s.rejected,
+		MaxWaitMs:         s.maxWait.Milliseconds(),
+		Since:             s.startedAt,
+	}
+	if s.admitted > 0 {
+		st.AvgWaitMs = (s.totalWait / time.Duration(s.admitted)).Milliseconds()
+	}
+	for command, n := range pdpCommandLimits {
+		st.Limits[command] = n
+	}
+	for tenant, q := range s.queues {
+		st.QueuedByTenant[tenant] = len(q)
+		for _, r := range q {
+			st.QueuedByCommand[r.command]++
+		}
+	}
+	for key, n := range s.running {
+		if n == 0 {
+			continue
+		}
+		if command, ok := strings.CutPrefix(key, "command:"); ok {
+			st.Running[command] = n
+		} else if provider, ok := strings.CutPrefix(key, "provider:"); ok {
+			st.RunningByProvider[provider] = n
+		}
+	}
+	return st
+}
+
+// argValue returns the value following flag in a pdptool command line
+func argValue(args []string, flag string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// pdpQueueHandler reports the pdptool queue metrics
+// GET /api/admin/pdp-queue
+func pdpQueueHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": pdpSlots.stats()})
+}
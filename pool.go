@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Uploads that name no proofSetID go to a proof set from the tenant's pool
+// for the provider. A proof set takes roots until it holds poolMaxRoots roots
+// or poolMaxBytes bytes; once every active proof set of a pool is past
+// poolRolloverAt of that, the next one is created in the background so it
+// is ready when the current one fills up. Proof set creation needs
+// poolRecordKeeper; without it pools only use proof sets that already exist.
+//
+// Room is reserved when an upload starts (acquireProofSet) and either
+// assigned to the stored roots or released when the upload fails.
+var (
+	poolMaxRoots      int
+	poolMaxBytes      int64
+	poolRolloverAt    float64
+	poolCreateWait    time.Duration
+	poolCreateTimeout time.Duration
+	poolPollInterval  time.Duration
+	poolRecordKeeper  string
+)
+
+var (
+	errNoProofSet           = errors.New("no proof set is available yet; a new one is being created")
+	errPoolCreationDisabled = errors.New("no proof set has room and automatic proof set creation is disabled (PDP_RECORDKEEPER is not set)")
+)
+
+const poolColumns = `id, tenant, service_url, service_name, proof_set_id, tx_hash, status, roots, bytes,
+	last_error, created_at, updated_at`
+
+func scanPoolEntry(row pgx.Row) (*filcdn.PoolProofSet, error) {
+	var p filcdn.PoolProofSet
+	err := row.Scan(&p.ID, &p.Tenant, &p.ServiceURL, &p.ServiceName, &p.ProofSetID, &p.TxHash, &p.Status,
+		&p.Roots, &p.Bytes, &p.LastError, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// proofSetLease is room reserved in a pool proof set. Its methods are no-ops
+// on a nil lease, which stands for a proof set named by the client.
+type proofSetLease struct {
+	poolID     int64
+	tenant     string
+	proofSetID string
+	roots      int   // reserved and not yet assigned
+	bytes      int64 // reserved and not yet assigned
+}
+
+// acquireProofSet reserves room for roots roots of size bytes in total in
+// one of the tenant's proof sets on the provider, creating a proof set and
+// waiting up to poolCreateWait for it when none has room
+func acquireProofSet(ctx context.Context, tenant, serviceUrl, serviceName string, roots int, size int64) (*proofSetLease, error) {
+	deadline := time.Now().Add(poolCreateWait)
+	for {
+		lease, err := reserveProofSet(ctx, tenant, serviceUrl, serviceName, roots, size)
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil {
+			go rolloverIfNeeded(tenant, serviceUrl, serviceName)
+			return lease, nil
+		}
+
+		if err := startProofSetCreation(ctx, tenant, serviceUrl, serviceName); err != nil {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errNoProofSet
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+		pollProofSetCreation(ctx, "tenant = $1 AND service_url = $2 AND service_name = $3",
+			tenant, serviceUrl, serviceName)
+	}
+}
+
+// reserveProofSet returns nil when no active proof set has room
+func reserveProofSet(ctx context.Context, tenant, serviceUrl, serviceName string, roots int, size int64) (*proofSetLease, error) {
+	lease := &proofSetLease{tenant: tenant, roots: roots, bytes: size}
+	var total int
+	var totalBytes int64
+	err := db.QueryRow(ctx,
+		`UPDATE proof_set_pool SET roots = roots + $4, bytes = bytes + $5::bigint, updated_at = NOW()
+		  WHERE id = (SELECT id FROM proof_set_pool
+		               WHERE tenant = $1 AND service_url = $2 AND service_name = $3 AND status = 'active'
+		                 AND roots + $4 <= $6 AND ($7::bigint = 0 OR bytes = 0 OR bytes + $5::bigint <= $7)
+		               ORDER BY id LIMIT 1
+		               FOR UPDATE SKIP LOCKED)
+		 RETURNING id, proof_set_id, roots, bytes`,
+		tenant, serviceUrl, serviceName, roots, size, poolMaxRoots, poolMaxBytes).
+		Scan(&lease.poolID, &lease.proofSetID, &total, &totalBytes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if total >= poolMaxRoots || (poolMaxBytes > 0 && totalBytes >= poolMaxBytes) {
+		if _, err := db.Exec(ctx,
+			"UPDATE proof_set_pool SET status = 'full', updated_at = NOW() WHERE id = $1 AND status = 'active'",
+			lease.poolID); err != nil {
+			fmt.Printf("[POOL ERROR] Marking proofSet %s full: %v\n", lease.proofSetID, err)
+		} else {
+			fmt.Printf("[POOL] proofSet %s is full (%d roots, %d bytes)\n", lease.proofSetID, total, totalBytes)
+		}
+	}
+	return lease, nil
+}
+
+// assign records rootCID of size bytes as stored in the leased proof set
+func (l *proofSetLease) assign(rootCID string, size int64) {
+	if l == nil {
+		return
+	}
+	l.roots--
+	l.bytes -= size
+	if _, err := db.Exec(context.Background(),
+		`INSERT INTO proof_set_assignments (cid, pool_id, tenant, proof_set_id, bytes)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		rootCID, l.poolID, l.tenant, l.proofSetID, size); err != nil {
+		fmt.Printf("[POOL ERROR] Recording assignment of %s: %v\n", rootCID, err)
+	}
+}
+
+// done gives back the room that was reserved but not assigned
+func (l *proofSetLease) done() {
+	if l == nil || (l.roots <= 0 && l.bytes <= 0) {
+		return
+	}
+	if _, err := db.Exec(context.Background(),
+		`UPDATE proof_set_pool
+		    SET roots = GREATEST(roots - $2, 0), bytes = GREATEST(bytes - $3::bigint, 0), updated_at = NOW(),
+		        status = CASE WHEN status = 'full' AND roots - $2 < $4 AND ($5::bigint = 0 OR bytes - $3 < $5)
+		                      THEN 'active' ELSE status END
+		  WHERE id = $1`,
+		l.poolID, max(l.roots, 0), max(l.bytes, 0), poolMaxRoots, poolMaxBytes); err != nil {
+		fmt.Printf("[POOL ERROR] Releasing room in proofSet %s: %v\n", l.proofSetID, err)
+	}
+	l.roots, l.bytes = 0, 0
+}
+
+// leaseProofSetFor resolves the proof set of an upload request: the client's
+// proofSetID when given, otherwise room in the tenant's pool. It writes the
+// error response and returns false on failure. Callers defer lease.done().
+func leaseProofSetFor(c *gin.Context, serviceUrl, serviceName, proofSetID string, roots int, size int64) (string, *proofSetLease, bool) {
+	if proofSetID != "" {
+		return proofSetID, nil, true
+	}
+	if serviceUrl == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "proofSetID or serviceUrl is required"})
+		return "", nil, false
+	}
+	lease, err := acquireProofSet(c.Request.Context(), tenantOf(c), serviceUrl, serviceName, roots, size)
+	if errors.Is(err, errNoProofSet) || errors.Is(err, errPoolCreationDisabled) {
+		if errors.Is(err, errNoProofSet) {
+			c.Header("Retry-After", "30")
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return "", nil, false
+	}
+	if err != nil {
+		fmt.Printf("[POOL ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to select a proof set: " + err.Error()})
+		return "", nil, false
+	}
+	fmt.Printf("[POOL] Selected proofSet %s for %d roots\n", lease.proofSetID, roots)
+	return lease.proofSetID, lease, true
+}
+
+// rolloverIfNeeded starts creating the pool's next proof set once every
+// active one is past poolRolloverAt
+func rolloverIfNeeded(tenant, serviceUrl, serviceName string) {
+	ctx := context.Background()
+	var fresh int
+	if err := db.QueryRow(ctx,
+		`SELECT COUNT(*) FROM proof_set_pool
+		  WHERE tenant = $1 AND service_url = $2 AND service_name = $3
+		    AND (status = 'creating'
+		         OR (status = 'active' AND roots < $4::float8 * $5::int
+		             AND ($6::bigint = 0 OR bytes < $4::float8 * $6)))`,
+		tenant, serviceUrl, serviceName, poolRolloverAt, poolMaxRoots, poolMaxBytes).Scan(&fresh); err != nil {
+		fmt.Printf("[POOL ERROR] Checking rollover: %v\n", err)
+		return
+	}
+	if fresh > 0 {
+		return
+	}
+	fmt.Printf("[POOL] Pool of %q on %s is nearly full, creating the next proof set\n", tenant, serviceUrl)
+	if err := startProofSetCreation(ctx, tenant, serviceUrl, serviceName); err != nil {
+		fmt.Printf("[POOL ERROR] %v\n", err)
+	}
+}
+
+// startProofSetCreation submits create-proof-set for the pool unless a
+// creation is already under way
+func startProofSetCreation(ctx context.Context, tenant, serviceUrl, serviceName string) error {
+	if poolRecordKeeper == "" {
+		return errPoolCreationDisabled
+	}
+
+	var id int64
+	err := db.QueryRow(ctx,
+		`INSERT INTO proof_set_pool (tenant, service_url, service_name, status)
+		 VALUES ($1, $2, $3, 'creating')
+		 ON CONFLICT (tenant, service_url, service_name) WHERE status = 'creating' DO NOTHING
+		 RETURNING id`,
+		tenant, serviceUrl, serviceName).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil // already being created
+	}
+	if err != nil {
+		return err
+	}
+
+	out, err := runPDP(ctx,
+		"create-proof-set",
+		"--service-url", serviceUrl,
+		"--service-name", serviceName,
+		"--recordkeeper", poolRecordKeeper,
+	)
+	txHash := parseCreateTxHash(string(out))
+	if err == nil && txHash == "" {
+		err = errors.New("txHash not found in create-proof-set output")
+	}
+	if err != nil {
+		msg := fmt.Sprintf("create-proof-set failed: %v: %s", err, strings.TrimSpace(string(out)))
+		db.Exec(ctx, "UPDATE proof_set_pool SET status = 'failed', last_error = $2, updated_at = NOW() WHERE id = $1", id, msg)
+		return errors.New(msg)
+	}
+	fmt.Printf("[POOL] Creating proof set for %q on %s: tx %s\n", tenant, serviceUrl, txHash)
+	_, err = db.Exec(ctx, "UPDATE proof_set_pool SET tx_hash = $2, updated_at = NOW() WHERE id = $1", id, txHash)
+	return err
+}
+
+// parseCreateTxHash finds the transaction hash in create-proof-set output
+func parseCreateTxHash(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Location:") {
+			if idx := strings.Index(line, "/pdp/proof-sets/created/"); idx >= 0 {
+				return strings.TrimSpace(line[idx+len("/pdp/proof-sets/created/"):])
+			}
+		}
+	}
+	return ""
+}
+
+// parseCreatedProofSetID returns the proof set ID once
+// get-proof-set-create-status reports the proof set created
+func parseCreatedProofSetID(out string) (string, bool) {
+	lower := strings.ToLower(out)
+	if !strings.Contains(lower, "proofset created: true") {
+		return "", false
+	}
+	idx := strings.Index(lower, "proofset id: ")
+	if idx < 0 {
+		return "", true
+	}
+	rest := out[idx+len("proofset id: "):]
+	if end := strings.Index(rest, "\n"); end >= 0 {
+		rest = rest[:end]
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// runProofSetPool finishes proof set creations until the process exits
+func runProofSetPool() {
+	fmt.Printf("[POOL] Worker started (max %d roots / %d bytes per proof set, rollover at %.0f%%)\n",
+		poolMaxRoots, poolMaxBytes, poolRolloverAt*100)
+	ticker := time.NewTicker(poolPollInterval)
+	defer ticker.Stop()
+
+	for {
+		pollProofSetCreation(context.Background(), "TRUE")
+		<-ticker.C
+	}
+}
+
+// pollProofSetCreation checks the creations matching where and activates
+// the proof sets that were created
+func pollProofSetCreation(ctx context.Context, where string, args ...any) {
+	rows, err := db.Query(ctx,
+		`SELECT `+poolColumns+` FROM proof_set_pool WHERE status = 'creating' AND tx_hash IS NOT NULL AND `+where,
+		args...)
+	if err != nil {
+		fmt.Printf("[POOL ERROR] Loading creations: %v\n", err)
+		return
+	}
+	var creating []*filcdn.PoolProofSet
+	for rows.Next() {
+		p, err := scanPoolEntry(rows)
+		if err != nil {
+			fmt.Printf("[POOL ERROR] %v\n", err)
+			continue
+		}
+		creating = append(creating, p)
+	}
+	rows.Close()
+
+	for _, p := range creating {
+		out, _ := runPDP(ctx,
+			"get-proof-set-create-status",
+			"--service-url", p.ServiceURL,
+			"--service-name", p.ServiceName,
+			"--tx-hash", *p.TxHash,
+		)
+		proofSetID, created := parseCreatedProofSetID(string(out))
+		switch {
+		case created && proofSetID != "":
+			tag, err := db.Exec(ctx,
+				`UPDATE proof_set_pool SET status = 'active', proof_set_id = $2, updated_at = NOW()
+				  WHERE id = $1 AND status = 'creating'`,
+				p.ID, proofSetID)
+			if err != nil {
+				fmt.Printf("[POOL ERROR] Activating proofSet %s: %v\n", proofSetID, err)
+			} else if tag.RowsAffected() > 0 {
+				fmt.Printf("[POOL] proofSet %s created for %q on %s\n", proofSetID, p.Tenant, p.ServiceURL)
+				emitEvent(p.Tenant, eventProofSetCreated, gin.H{"txHash": *p.TxHash, "proofSetID": proofSetID})
+			}
+		case time.Since(p.CreatedAt) > poolCreateTimeout:
+			db.Exec(ctx,
+				`UPDATE proof_set_pool SET status = 'failed', last_error = $2, updated_at = NOW()
+				  WHERE id = $1 AND status = 'creating'`,
+				p.ID, "proof set not created within "+poolCreateTimeout.String()+": "+strings.TrimSpace(string(out)))
+		}
+	}
+
+	// A creation that never got its tx hash recorded is abandoned
+	db.Exec(ctx,
+		`UPDATE proof_set_pool SET status = 'failed', last_error = 'create-proof-set did not complete', updated_at = NOW()
+		  WHERE status = 'creating' AND tx_hash IS NULL AND created_at < NOW() - INTERVAL '10 minutes'`)
+}
+
+// listProofSetPoolHandler lists the caller's pool proof sets
+// GET /api/proof-sets/pool?serviceUrl=...
+func listProofSetPoolHandler(c *gin.Context) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return
+	}
+	rows, err := db.Query(context.Background(),
+		`SELECT `+poolColumns+` FROM proof_set_pool
+		  WHERE tenant = $1 AND ($2 = '' OR service_url = $2)
+		  ORDER BY id DESC`,
+		tenant, c.Query("serviceUrl"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	result := []*filcdn.PoolProofSet{}
+	for rows.Next() {
+		p, err := scanPoolEntry(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result = append(result, p)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
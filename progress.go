@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upload progress over Server-Sent Events. A client picks an upload ID, sends
+// it as X-Upload-ID with the upload request and follows
+// GET /api/uploads/:id/events, before or while the upload runs. Each stage
+// is one SSE event named after the stage:
+//
+//	received          request body bytes read so far (total from Content-Length)
+//	temp_write        bytes written to the temp file
+//	upload_started    upload-file invoked
+//	upload_finished   upload-file returned a root CID
+//	add_roots_attempt add-roots attempt N of M
+//	add_roots_done    add-roots succeeded
+//	db_saved          metadata stored
+//	completed/failed  terminal; the stream ends after it
+//
+// IDs are per tenant: a stream only sees uploads of the caller's tenant.
+// Progress is kept in memory only, for progressRetention after it ends, and
+// a tracker nothing was uploaded to yet lives while someone follows it and
+// for progressRetention after. An ID may be reused once its upload has
+// ended: the next upload starts a fresh history. Reusing the ID of an upload
+// still running is refused with 409.
+
+const (
+	stageReceived        = "received"
+	stageTempWrite       = "temp_write"
+	stageUploadStarted   = "upload_started"
+	stageUploadFinished  = "upload_finished"
+	stageAddRootsAttempt = "add_roots_attempt"
+	stageAddRootsDone    = "add_roots_done"
+	stageDBSaved         = "db_saved"
+	stageCompleted       = "completed"
+	stageFailed          = "failed"
+
+	progressRetention      = 10 * time.Minute
+	progressReportInterval = 250 * time.Millisecond
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type progressEvent struct {
+	Stage       string    `json:"stage"`
+	Bytes       int64     `json:"bytes,omitempty"`
+	Total       int64     `json:"total,omitempty"`
+	Attempt     int       `json:"attempt,omitempty"`
+	MaxAttempts int       `json:"maxAttempts,omitempty"`
+	RootCID     string    `json:"rootCID,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+func (e progressEvent) terminal() bool {
+	return e.Stage == stageCompleted || e.Stage == stageFailed
+}
+
+// uploadProgress is the progress of one upload. A nil *uploadProgress is
+// valid and ignores everything, so helpers can report unconditionally.
+type uploadProgress struct {
+	id        string
+	mu        sync.Mutex
+	events    []progressEvent
+	subs      map[chan progressEvent]struct{}
+	idleSince time.Time // created, or last subscriber left
+	started   bool      // an upload request has claimed the tracker
+	doneAt    time.Time
+}
+
+var (
+	progressMu   sync.Mutex
+	progressJobs = map[progressKey]*uploadProgress{}
+)
+
+// progressKey scopes upload IDs to the tenant that chose them
+type progressKey struct {
+	tenant string
+	id     string
+}
+
+// getProgress returns the tracker for id, creating it if needed. Expired
+// trackers are swept on the way.
+func getProgress(key progressKey) *uploadProgress {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	sweepProgress(time.Now())
+	return progressFor(key)
+}
+
+// startProgress claims the tracker for id for an upload request. A tracker
+// whose upload has ended is replaced, so its history does not swallow the new
+// upload's events; ok is false while another upload with id is running.
+func startProgress(key progressKey) (p *uploadProgress, ok bool) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	sweepProgress(time.Now())
+	p = progressFor(key)
+	p.mu.Lock()
+	running, done := p.started && p.doneAt.IsZero(), !p.doneAt.IsZero()
+	p.mu.Unlock()
+	if running {
+		return nil, false
+	}
+	if done {
+		delete(progressJobs, key)
+		p = progressFor(key)
+	}
+	p.mu.Lock()
+	p.started = true
+	p.mu.Unlock()
+	return p, true
+}
+
+// progressFor returns the tracker for id, creating it if needed. The caller
+// holds progressMu.
+func progressFor(key progressKey) *uploadProgress {
+	p, ok := progressJobs[key]
+	if !ok {
+		p = &uploadProgress{id: key.id, subs: map[chan progressEvent]struct{}{}, idleSince: time.Now()}
+		progressJobs[key] = p
+	}
+	return p
+}
+
+// sweepProgress drops expired trackers: ended ones, and unclaimed ones
+// nobody has followed for progressRetention. The caller holds progressMu.
+func sweepProgress(now time.Time) {
+	for key, p := range progressJobs {
+		p.mu.Lock()
+		expired := (!p.doneAt.IsZero() && now.Sub(p.doneAt) > progressRetention) ||
+			(!p.started && len(p.subs) == 0 && now.Sub(p.idleSince) > progressRetention)
+		p.mu.Unlock()
+		if expired {
+			delete(progressJobs, key)
+		}
+	}
+}
+
+func (p *uploadProgress) emit(e progressEvent) {
+	if p == nil {
+		return
+	}
+	e.Time = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.doneAt.IsZero() {
+		return
+	}
+
+	// Byte counters replace their previous value instead of growing the history
+	if n := len(p.events); n > 0 && e.Bytes > 0 && p.events[n-1].Stage == e.Stage {
+		p.events[n-1] = e
+	} else {
+		p.events = append(p.events, e)
+	}
+
+	for ch := range p.subs {
+		select {
+		case ch <- e:
+		default: // slow subscriber; byte updates are superseded and terminal state is resent on close
+		}
+	}
+	if e.terminal() {
+		p.doneAt = e.Time
+		for ch := range p.subs {
+			close(ch)
+		}
+		p.subs = map[chan progressEvent]struct{}{}
+	}
+}
+
+func (p *uploadProgress) stage(stage string) {
+	p.emit(progressEvent{Stage: stage})
+}
+
+// subscribe returns the history so far and, unless the upload has ended, a
+// channel of further events
+func (p *uploadProgress) subscribe() ([]progressEvent, chan progressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	history := append([]progressEvent(nil), p.events...)
+	if !p.doneAt.IsZero() {
+		return history, nil
+	}
+	ch := make(chan progressEvent, 64)
+	p.subs[ch] = struct{}{}
+	return history, ch
+}
+
+func (p *uploadProgress) unsubscribe(ch chan progressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.subs[ch]; ok {
+		delete(p.subs, ch)
+		close(ch)
+		if len(p.subs) == 0 {
+			p.idleSince = time.Now()
+		}
+	}
+}
+
+func (p *uploadProgress) last() (progressEvent, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.events) == 0 {
+		return progressEvent{}, false
+	}
+	return p.events[len(p.events)-1], true
+}
+
+// progressCounter reports bytes passing through a reader or writer at most
+// every progressReportInterval, plus once at the end
+type progressCounter struct {
+	progress *uploadProgress
+	stage    string
+	total    int64
+	n        int64
+	reported time.Time
+}
+
+func (pc *progressCounter) add(n int, final bool) {
+	pc.n += int64(n)
+	if final || time.Since(pc.reported) >= progressReportInterval {
+		pc.reported = time.Now()
+		pc.progress.emit(progressEvent{Stage: pc.stage, Bytes: pc.n, Total: pc.total})
+	}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	counter *progressCounter
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.counter.add(n, err == io.EOF)
+	return n, err
+}
+
+type progressWriter struct {
+	io.Writer
+	counter *progressCounter
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.counter.add(n, false)
+	return n, err
+}
+
+// trackWrites wraps w so bytes written to it are reported under stage
+func (p *uploadProgress) trackWrites(w io.Writer, stage string, total int64) (io.Writer, func()) {
+	if p == nil {
+		return w, func() {}
+	}
+	counter := &progressCounter{progress: p, stage: stage, total: total}
+	return &progressWriter{Writer: w, counter: counter}, func() { counter.add(0, true) }
+}
+
+// progressMiddleware attaches a tracker to requests carrying X-Upload-ID,
+// counts the request body as it is read and ends the stream with the
+// handler's outcome
+func progressMiddleware(c *gin.Context) {
+	id := c.GetHeader("X-Upload-ID")
+	if id == "" {
+		c.Next()
+		return
+	}
+	if !uploadIDPattern.MatchString(id) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "X-Upload-ID must be 1-64 letters, digits, '-' or '_'"})
+		return
+	}
+
+	p, ok := startProgress(progressKey{tenant: tenantOf(c), id: id})
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "an upload with this X-Upload-ID is already running"})
+		return
+	}
+	c.Set("uploadProgress", p)
+	c.Request.Body = &progressReader{
+		ReadCloser: c.Request.Body,
+		counter:    &progressCounter{progress: p, stage: stageReceived, total: c.Request.ContentLength},
+	}
+
+	c.Next()
+
+	status := c.Writer.Status()
+	if status >= http.StatusBadRequest {
+		p.emit(progressEvent{Stage: stageFailed, Status: status, Message: http.StatusText(status)})
+	} else {
+		p.emit(progressEvent{Stage: stageCompleted, Status: status})
+	}
+}
+
+// progressOf returns the request's tracker, or nil
+func progressOf(c *gin.Context) *uploadProgress {
+	if p, ok := c.Get("uploadProgress"); ok {
+		return p.(*uploadProgress)
+	}
+	return nil
+}
+
+// uploadEventsHandler streams the progress of an upload as Server-Sent Events
+// GET /api/uploads/:id/events
+func uploadEventsHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !uploadIDPattern.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+	p := getProgress(progressKey{tenant: tenantOf(c), id: id})
+	history, ch := p.subscribe()
+	if ch != nil {
+		defer p.unsubscribe(ch)
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	for _, e := range history {
+		c.SSEvent(e.Stage, e)
+	}
+	c.Writer.Flush()
+	if ch == nil {
+		return
+	}
+
+	fmt.Printf("[PROGRESS] Streaming %s\n", id)
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				// Closed on completion; resend the terminal event in case it was dropped
+				if last, ok := p.last(); ok && last.terminal() {
+					c.SSEvent(last.Stage, last)
+				}
+				return false
+			}
+			c.SSEvent(e.Stage, e)
+			return !e.terminal()
+		case <-heartbeat.C:
+			c.SSEvent("ping", gin.H{"time": time.Now()})
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
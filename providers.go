@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Registered storage providers. Each has the proof set the service adds
+// replica roots to. Clients still name the provider of the primary copy in
+// every upload; the registry is where extra copies go.
+
+const providerColumns = "id, name, service_url, service_name, proof_set_id, active, created_at"
+
+func scanProvider(row pgx.Row) (*filcdn.Provider, error) {
+	var p filcdn.Provider
+	err := row.Scan(&p.ID, &p.Name, &p.ServiceURL, &p.ServiceName, &p.ProofSetID, &p.Active, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// activeProviders returns the active providers in registration order
+func activeProviders(ctx context.Context) ([]*filcdn.Provider, error) {
+	rows, err := db.Query(ctx, `SELECT `+providerColumns+` FROM providers WHERE active ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*filcdn.Provider
+	for rows.Next() {
+		p, err := scanProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// listProvidersHandler lists registered providers
+// GET /api/admin/providers
+func listProvidersHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	rows, err := db.Query(context.Background(), `SELECT `+providerColumns+` FROM providers ORDER BY id`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	result := []*filcdn.Provider{}
+	for rows.Next() {
+		p, err := scanProvider(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		p.Circuit = circuitState(p.ServiceURL)
+		result = append(result, p)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+// registerProviderHandler registers a provider, or updates and reactivates
+// the one with the same service URL
+// POST /api/admin/providers
+//
+//	{"name": "sp1", "serviceUrl": "https://sp1.example", "serviceName": "pdp", "proofSetID": "42"}
+func registerProviderHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	var req filcdn.ProviderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.ServiceURL = strings.TrimRight(strings.TrimSpace(req.ServiceURL), "/")
+	if req.Name == "" || req.ServiceURL == "" || req.ProofSetID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name, serviceUrl and proofSetID are required"})
+		return
+	}
+
+	p, err := scanProvider(db.QueryRow(context.Background(),
+		`INSERT INTO providers (name, service_url, service_name, proof_set_id)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (service_url) DO UPDATE
+		    SET name = EXCLUDED.name, service_name = EXCLUDED.service_name,
+		        proof_set_id = EXCLUDED.proof_set_id, active = TRUE
+		 RETURNING `+providerColumns,
+		req.Name, req.ServiceURL, req.ServiceName, req.ProofSetID))
+	if err != nil {
+		if strings.Contains(err.Error(), "providers_name_key") {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A provider named %q is already registered", req.Name)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	fmt.Printf("[PROVIDERS] Registered %s (%s, proofSet %s)\n", p.Name, p.ServiceURL, p.ProofSetID)
+	c.JSON(http.StatusCreated, gin.H{"data": p})
+}
+
+// deactivateProviderHandler stops placing replicas on a provider. Its
+// replicas no longer count towards replication policies.
+// DELETE /api/admin/providers/:id
+func deactivateProviderHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider ID"})
+		return
+	}
+	p, err := scanProvider(db.QueryRow(context.Background(),
+		`UPDATE providers SET active = FALSE WHERE id = $1 RETURNING `+providerColumns, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	fmt.Printf("[PROVIDERS] Deactivated %s\n", p.Name)
+	c.JSON(http.StatusOK, gin.H{"data": p})
+}
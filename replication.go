@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Replication policies ask for more than one copy of a record, each on a
+// distinct provider. The copy on the provider named in the upload is the
+// primary; extra copies go to registered providers (providers.go) and their
+// proof sets. The desired number of copies is the record's own policy
+// (record_replication), else its data type's (replication_policies), else 1.
+//
+// The upload handlers start the extra copies once the record is saved, so a
+// copy never outlives an upload that failed; they are read back from the
+// primary like the repair worker's. Every copy is tracked in replicas:
+//
+//	uploaded  piece is on the provider, root not yet added
+//	stored    root is in the provider's proof set
+//	failed    last attempt failed; the repair worker tries again
+//	removing  the record is being deleted and remove-roots was submitted
+//	removed   the root has left the proof set (deletion.go)
+//
+// The repair worker adds roots left uploaded and uploads missing copies of
+// under-replicated records, reading the content back from a stored copy.
+// Roots are only ever added for records with a live file_cids row and no
+// deletion in progress; copies left uploaded for any other CID are marked
+// failed.
+var (
+	replicationInterval    time.Duration
+	replicationRepairBatch int
+)
+
+const (
+	maxReplicaAttempts   = 5
+	replicaStaleUploaded = 10 * time.Minute
+)
+
+const replicaColumns = `service_url, service_name, proof_set_id, root_cid, is_primary, status, attempts,
+	last_error, updated_at`
+
+func scanReplica(row pgx.Row) (*filcdn.Replica, error) {
+	var r filcdn.Replica
+	err := row.Scan(&r.ServiceURL, &r.ServiceName, &r.ProofSetID, &r.RootCID, &r.Primary, &r.Status,
+		&r.Attempts, &r.LastError, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// replicationCopies returns the number of copies the policy of dataType asks
+// for
+func replicationCopies(ctx context.Context, dataType string) int {
+	copies := 1
+	err := db.QueryRow(ctx, "SELECT copies FROM replication_policies WHERE data_type = $1", dataType).Scan(&copies)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		fmt.Printf("[REPLICATION ERROR] Loading policy for %s: %v\n", dataType, err)
+	}
+	return copies
+}
+
+// replicaTargets picks up to n active providers that hold no copy of cid yet
+// and have not given up on it
+func replicaTargets(ctx context.Context, cid, primaryURL string, n int) ([]*filcdn.Provider, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	rows, err := db.Query(ctx,
+		`SELECT `+providerColumns+` FROM providers p
+		  WHERE active AND service_url <> $2
+		    AND NOT EXISTS (SELECT 1 FROM replicas r
+		                     WHERE r.cid = $1 AND r.service_url = p.service_url
+		                       AND (r.status IN ('uploaded', 'stored') OR r.attempts >= $3))
+		  ORDER BY id
+		  LIMIT $4`,
+		cid, primaryURL, maxReplicaAttempts, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*filcdn.Provider
+	for rows.Next() {
+		p, err := scanProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// replicateRecord makes the extra copies the replication policy of dataType
+// asks for of a record that has just been saved. Failures are recorded for
+// the repair worker and never fail the upload.
+func replicateRecord(cid, dataType, primaryURL string) {
+	ctx := context.Background()
+	copies := replicationCopies(ctx, dataType)
+	if copies <= 1 {
+		return
+	}
+	if err := repairRecord(ctx, cid, primaryURL, copies-1); err != nil {
+		fmt.Printf("[REPLICATION ERROR] Replicating %s: %v\n", cid, err)
+	}
+}
+
+// addReplicaRoots adds the roots of every uploaded copy of cid to its
+// provider's proof set, as long as cid is a live record
+func addReplicaRoots(cid string) {
+	ctx := context.Background()
+	rows, err := db.Query(ctx,
+		`SELECT r.root_cid, p.id, p.name, p.service_url, p.service_name, p.proof_set_id, p.active, p.created_at
+		   FROM replicas r JOIN providers p ON p.service_url = r.service_url
+		  WHERE r.cid = $1 AND r.status = 'uploaded' AND NOT r.is_primary
+		    AND EXISTS (SELECT 1 FROM file_cids f WHERE f.cid = r.cid AND f.deleted_at IS NULL)
+		    AND NOT EXISTS (SELECT 1 FROM deletions d WHERE d.cid = r.cid AND d.status = 'removing')`,
+		cid)
+	if err != nil {
+		fmt.Printf("[REPLICATION ERROR] Loading replicas of %s: %v\n", cid, err)
+		return
+	}
+	type pending struct {
+		rootCID  string
+		provider filcdn.Provider
+	}
+	var due []pending
+	for rows.Next() {
+		var d pending
+		p := &d.provider
+		if err := rows.Scan(&d.rootCID, &p.ID, &p.Name, &p.ServiceURL, &p.ServiceName, &p.ProofSetID,
+			&p.Active, &p.CreatedAt); err != nil {
+			fmt.Printf("[REPLICATION ERROR] %v\n", err)
+			continue
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	for _, d := range due {
+		if err := addRootToProofSet(ctx, d.provider.ServiceURL, d.provider.ServiceName, d.provider.ProofSetID, d.rootCID, nil); err != nil {
+			fmt.Printf("[REPLICATION ERROR] Adding %s to %s: %v\n", cid, d.provider.Name, err)
+			recordReplica(ctx, cid, d.rootCID, &d.provider, "failed", err)
+			continue
+		}
+		fmt.Printf("[REPLICATION] %s stored on %s (proofSet %s)\n", cid, d.provider.Name, d.provider.ProofSetID)
+		recordReplica(ctx, cid, d.rootCID, &d.provider, "stored", nil)
+	}
+}
+
+// recordReplica upserts the state of one copy; failures count an attempt
+func recordReplica(ctx context.Context, cid, rootCID string, p *filcdn.Provider, status string, cause error) {
+	var lastError *string
+	attempt := 0
+	if cause != nil {
+		msg := cause.Error()
+		lastError = &msg
+		attempt = 1
+	}
+	if _, err := db.Exec(ctx,
+		`INSERT INTO replicas (cid, root_cid, service_url, service_name, proof_set_id, status, attempts, last_error)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 ON CONFLICT (cid, service_url) DO UPDATE
+		    SET root_cid = EXCLUDED.root_cid, service_name = EXCLUDED.service_name,
+		        proof_set_id = EXCLUDED.proof_set_id, status = EXCLUDED.status,
+		        attempts = CASE WHEN EXCLUDED.status = 'stored' THEN 0 ELSE replicas.attempts + $7 END,
+		        last_error = EXCLUDED.last_error, updated_at = NOW()`,
+		cid, rootCID, p.ServiceURL, p.ServiceName, p.ProofSetID, status, attempt, lastError); err != nil {
+		fmt.Printf("[REPLICATION ERROR] Recording replica of %s on %s: %v\n", cid, p.Name, err)
+	}
+}
+
+// runReplicationRepair completes and repairs replicas until the process exits
+func runReplicationRepair() {
+	fmt.Printf("[REPLICATION] Repair worker started (every %s, batch %d)\n", replicationInterval, replicationRepairBatch)
+	ticker := time.NewTicker(replicationInterval)
+	defer ticker.Stop()
+
+	for {
+		repairReplicas(context.Background())
+		<-ticker.C
+	}
+}
+
+func repairReplicas(ctx context.Context) {
+	// Copies of CIDs that are not (or no longer) a live record must never
+	// get a root: nothing would ever remove it
+	if tag, err := db.Exec(ctx,
+		`UPDATE replicas r SET status = 'failed', last_error = 'no live record for this copy', updated_at = NOW()
+		  WHERE status = 'uploaded' AND NOT is_primary AND updated_at < NOW() - $1::float8 * INTERVAL '1 second'
+		    AND NOT EXISTS (SELECT 1 FROM file_cids f WHERE f.cid = r.cid AND f.deleted_at IS NULL)`,
+		replicaStaleUploaded.Seconds()); err != nil {
+		fmt.Printf("[REPLICATION ERROR] Failing orphaned replicas: %v\n", err)
+	} else if tag.RowsAffected() > 0 {
+		fmt.Printf("[REPLICATION] Marked %d orphaned replicas failed\n", tag.RowsAffected())
+	}
+
+	// Copies whose upload request ended before their roots were added
+	rows, err := db.Query(ctx,
+		`SELECT DISTINCT r.cid FROM replicas r
+		  WHERE r.status = 'uploaded' AND r.updated_at < NOW() - $1::float8 * INTERVAL '1 second'
+		    AND EXISTS (SELECT 1 FROM file_cids f WHERE f.cid = r.cid AND f.deleted_at IS NULL)`,
+		replicaStaleUploaded.Seconds())
+	if err != nil {
+		fmt.Printf("[REPLICATION ERROR] Loading uploaded replicas: %v\n", err)
+		return
+	}
+	var uploaded []string
+	for rows.Next() {
+		var cid string
+		if err := rows.Scan(&cid); err == nil {
+			uploaded = append(uploaded, cid)
+		}
+	}
+	rows.Close()
+	for _, cid := range uploaded {
+		addReplicaRoots(cid)
+	}
+
+	// Records with fewer stored copies than their policy asks for. Copies on
+	// deactivated providers do not count.
+	rows, err = db.Query(ctx,
+		`WITH typed AS (
+		     SELECT cid, 'paper' AS data_type FROM paper WHERE deleted_at IS NULL
+		     UNION ALL SELECT cid, 'genome' FROM genome WHERE deleted_at IS NULL
+		     UNION ALL SELECT cid, 'spectrum' FROM spectrum WHERE deleted_at IS NULL
+		 ), records AS (
+		     SELECT DISTINCT ON (f.cid) f.cid, COALESCE(f.service_url, '') AS primary_url,
+		            COALESCE(rr.copies, rp.copies, 1) AS copies
+		       FROM file_cids f
+		       LEFT JOIN typed t ON t.cid = f.cid
+		       LEFT JOIN replication_policies rp ON rp.data_type = COALESCE(t.data_type, 'file')
+		       LEFT JOIN record_replication rr ON rr.cid = f.cid
+		      WHERE f.deleted_at IS NULL
+		        AND NOT EXISTS (SELECT 1 FROM deletions d WHERE d.cid = f.cid AND d.status = 'removing')
+		      ORDER BY f.cid, f.id
+		 )
+		 SELECT cid, primary_url, copies - stored FROM (
+		     SELECT rec.cid, rec.primary_url, rec.copies,
+		            (SELECT COUNT(*) FROM replicas r
+		              WHERE r.cid = rec.cid AND r.status = 'stored'
+		                AND (r.is_primary OR EXISTS (SELECT 1 FROM providers p
+		                                              WHERE p.service_url = r.service_url AND p.active))) AS stored
+		       FROM records rec
+		      WHERE rec.copies > 1
+		 ) s
+		  WHERE stored > 0 AND stored < copies
+		  ORDER BY cid
+		  LIMIT $1`,
+		replicationRepairBatch)
+	if err != nil {
+		fmt.Printf("[REPLICATION ERROR] Loading under-replicated records: %v\n", err)
+		return
+	}
+	type underReplicated struct {
+		cid        string
+		primaryURL string
+		missing    int
+	}
+	var due []underReplicated
+	for rows.Next() {
+		var u underReplicated
+		if err := rows.Scan(&u.cid, &u.primaryURL, &u.missing); err != nil {
+			fmt.Printf("[REPLICATION ERROR] %v\n", err)
+			continue
+		}
+		due = append(due, u)
+	}
+	rows.Close()
+
+	for _, u := range due {
+		if err := repairRecord(ctx, u.cid, u.primaryURL, u.missing); err != nil {
+			fmt.Printf("[REPLICATION ERROR] Repairing %s: %v\n", u.cid, err)
+		}
+	}
+}
+
+// repairRecord reads cid back from a stored copy and uploads it to missing
+// more providers
+func repairRecord(ctx context.Context, cid, primaryURL string, missing int) error {
+	targets, err := replicaTargets(ctx, cid, primaryURL, missing)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return nil // no provider left to place a copy on
+	}
+
+	var sourceURL, sourceRoot string
+	if err := db.QueryRow(ctx,
+		`SELECT service_url, root_cid FROM replicas
+		  WHERE cid = $1 AND status = 'stored'
+		  ORDER BY is_primary DESC, id LIMIT 1`,
+		cid).Scan(&sourceURL, &sourceRoot); err != nil {
+		return fmt.Errorf("no stored copy to read from: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp("", "pdp-replica-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	resp, err := fetchPiece(ctx, sourceURL, sourceRoot)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	_, err = io.Copy(tmpFile, resp.Body)
+	resp.Body.Close()
+	tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("reading copy from %s: %w", sourceURL, err)
+	}
+
+	for _, p := range targets {
+		rootCID, err := runUploadFile(ctx, p.ServiceURL, p.ServiceName, tmpFile.Name())
+		if err != nil {
+			fmt.Printf("[REPLICATION ERROR] Uploading %s to %s: %v\n", cid, p.Name, err)
+			recordReplica(ctx, cid, cid, p, "failed", err)
+			continue
+		}
+		recordReplica(ctx, cid, rootCID, p, "uploaded", nil)
+	}
+	addReplicaRoots(cid)
+	return nil
+}
+
+// replicationPoliciesHandler lists the per-type policies
+// GET /api/admin/replication-policies
+func replicationPoliciesHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	rows, err := db.Query(context.Background(),
+		"SELECT data_type, copies FROM replication_policies ORDER BY data_type")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	result := []filcdn.ReplicationPolicy{}
+	for rows.Next() {
+		var p filcdn.ReplicationPolicy
+		if err := rows.Scan(&p.DataType, &p.Copies); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result = append(result, p)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
+
+// setReplicationPolicyHandler sets the number of copies for a data type
+// PUT /api/admin/replication-policies/genome {"copies": 2}
+func setReplicationPolicyHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	dataType := c.Param("type")
+	if _, ok := editableFields[dataType]; !ok && dataType != "file" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data type. Valid types: paper, genome, spectrum, file"})
+		return
+	}
+	copies, ok := bindCopies(c)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec(context.Background(),
+		`INSERT INTO replication_policies (data_type, copies) VALUES ($1, $2)
+		 ON CONFLICT (data_type) DO UPDATE SET copies = EXCLUDED.copies, updated_at = NOW()`,
+		dataType, copies); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	fmt.Printf("[REPLICATION] Policy for %s: %d copies\n", dataType, copies)
+	c.JSON(http.StatusOK, gin.H{"data": filcdn.ReplicationPolicy{DataType: dataType, Copies: copies}})
+}
+
+// bindCopies reads {"copies": n} and writes a 400 unless 1 <= n <= 10
+func bindCopies(c *gin.Context) (int, bool) {
+	var req struct {
+		Copies int `json:"copies"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if req.Copies < 1 || req.Copies > 10 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "copies must be between 1 and 10"})
+		return 0, false
+	}
+	return req.Copies, true
+}
+
+// getReplicasHandler returns the desired and actual copies of a record
+// GET /api/data/:type/:cid/replicas
+func getReplicasHandler(c *gin.Context) {
+	if status, ok := loadRecordReplicas(c); ok {
+		c.JSON(http.StatusOK, gin.H{"data": status})
+	}
+}
+
+// setRecordReplicationHandler overrides the type policy for one record.
+// Missing copies are uploaded by the repair worker.
+// PUT /api/data/:type/:cid/replication {"copies": 3}
+func setRecordReplicationHandler(c *gin.Context) {
+	if _, ok := requireTenant(c); !ok {
+		return
+	}
+	copies, ok := bindCopies(c)
+	if !ok {
+		return
+	}
+	if _, ok := loadRecordReplicas(c); !ok {
+		return
+	}
+	if _, err := db.Exec(context.Background(),
+		`INSERT INTO record_replication (cid, copies) VALUES ($1, $2)
+		 ON CONFLICT (cid) DO UPDATE SET copies = EXCLUDED.copies, updated_at = NOW()`,
+		c.Param("cid"), copies); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if status, ok := loadRecordReplicas(c); ok {
+		c.JSON(http.StatusOK, gin.H{"data": status})
+	}
+}
+
+// loadRecordReplicas reads the replication state of the record named by the
+// :type and :cid parameters, writing a 400 or 404 when there is none
+func loadRecordReplicas(c *gin.Context) (*filcdn.RecordReplicas, bool) {
+	dataType, cid := c.Param("type"), c.Param("cid")
+	if _, ok := editableFields[dataType]; !ok && dataType != "file_cids" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data type. Valid types: paper, genome, spectrum, file_cids"})
+		return nil, false
+	}
+	ctx := context.Background()
+
+	var exists bool
+	if err := db.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM file_cids WHERE cid = $1 AND deleted_at IS NULL)", cid).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+		return nil, false
+	}
+
+	policyType := dataType
+	if dataType == "file_cids" {
+		policyType = "file"
+	}
+	status := &filcdn.RecordReplicas{CID: cid, Replicas: []filcdn.Replica{}}
+	var override *int
+	err := db.QueryRow(ctx, "SELECT copies FROM record_replication WHERE cid = $1", cid).Scan(&override)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if override != nil {
+		status.Copies, status.Source = *override, "record"
+	} else {
+		status.Copies, status.Source = replicationCopies(ctx, policyType), "type"
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT `+replicaColumns+` FROM replicas WHERE cid = $1 ORDER BY is_primary DESC, id`, cid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanReplica(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		if r.Status == "stored" {
+			status.Stored++
+		}
+		status.Replicas = append(status.Replicas, *r)
+	}
+	return status, true
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Uploads are scanned for malware once their temp file is written and
+// before upload-file, so nothing infected reaches proven storage. The scan
+// reads the bytes the client sent, which with server-side encryption are
+// not the bytes in the temp file. A positive is copied to quarantineDir and
+// the upload rejected with 422. When the scanner itself fails the upload is
+// rejected with 503 (scanFailOpen false) or stored unscanned (true). Every
+// scan leaves a row in scan_audit.
+var (
+	uploadScanner malwareScanner // nil disables scanning
+	scanTimeout   time.Duration
+	scanFailOpen  bool
+	quarantineDir string
+)
+
+// malwareScanner checks content for malware
+type malwareScanner interface {
+	name() string
+	// scan reads r to the end, or until it has a verdict
+	scan(ctx context.Context, r io.Reader) (scanVerdict, error)
+}
+
+type scanVerdict struct {
+	infected  bool
+	signature string // what was found, when infected
+}
+
+// errScannerUnavailable matches scans that could not finish under the
+// fail-closed policy
+var errScannerUnavailable = errors.New("malware scanner unavailable")
+
+// malwareError is an upload found to be infected
+type malwareError struct {
+	signature string
+	auditID   int64
+}
+
+func (e *malwareError) Error() string {
+	return fmt.Sprintf("malware detected (%s); the file was quarantined as scan %d", e.signature, e.auditID)
+}
+
+// newScanner returns the scanner named by MALWARE_SCANNER
+func newScanner(kind, clamdAddress string) (malwareScanner, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "clamd":
+		network, address := parseClamdAddress(clamdAddress)
+		return &clamdScanner{network: network, address: address}, nil
+	}
+	return nil, fmt.Errorf("unknown malware scanner %q (want clamd or none)", kind)
+}
+
+// parseClamdAddress reads unix:/path, tcp:host:port, a bare socket path or
+// a bare host:port
+func parseClamdAddress(s string) (string, string) {
+	switch {
+	case strings.HasPrefix(s, "unix:"):
+		return "unix", strings.TrimPrefix(s, "unix:")
+	case strings.HasPrefix(s, "tcp:"):
+		return "tcp", strings.TrimPrefix(s, "tcp:")
+	case strings.HasPrefix(s, "/"):
+		return "unix", s
+	}
+	return "tcp", s
+}
+
+// clamdChunkSize is the size of the INSTREAM chunks sent to clamd
+const clamdChunkSize = 64 << 10
+
+// clamdScanner streams content to clamd with the INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func (s *clamdScanner) name() string { return "clamd" }
+
+func (s *clamdScanner) scan(ctx context.Context, r io.Reader) (scanVerdict, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return scanVerdict{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// clamd may answer early (e.g. when the stream is over its size limit)
+	// and close the connection; its reply explains the failed write
+	writeErr := s.stream(conn, r)
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		if writeErr != nil {
+			return scanVerdict{}, writeErr
+		}
+		return scanVerdict{}, fmt.Errorf("reading clamd reply: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// stream sends r as INSTREAM chunks: a 4-byte big-endian length before each,
+// and a zero length at the end
+func (s *clamdScanner) stream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply reads "stream: OK", "stream: <signature> FOUND" or
+// "<message> ERROR"
+func parseClamdReply(reply string) (scanVerdict, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return scanVerdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return scanVerdict{infected: true, signature: strings.TrimSuffix(result, " FOUND")}, nil
+	case strings.HasSuffix(result, " ERROR"):
+		return scanVerdict{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(result, " ERROR"))
+	}
+	return scanVerdict{}, fmt.Errorf("unexpected clamd reply %q", reply)
+}
+
+// scanRequest is an upload to scan: the bytes the client sent and what
+// they are
+type scanRequest struct {
+	dataType string
+	filename string
+	content  io.ReaderAt
+	size     int64
+}
+
+// scanUpload scans an upload with uploadScanner. It returns nil for clean
+// content, when scanning is disabled and when the scanner failed under the
+// fail-open policy; a *malwareError for infected content, which is copied to
+// quarantine; and an error matching errScannerUnavailable when the scanner
+// failed under the fail-closed policy.
+func scanUpload(ctx context.Context, req scanRequest) error {
+	if uploadScanner == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+
+	sum := sha256.New()
+	verdict, err := uploadScanner.scan(ctx, io.TeeReader(io.NewSectionReader(req.content, 0, req.size), sum))
+	a := scanAudit{
+		Tenant:   tenantFromContext(ctx),
+		DataType: req.dataType,
+		Filename: req.filename,
+		Size:     req.size,
+		SHA256:   hex.EncodeToString(sum.Sum(nil)),
+		Scanner:  uploadScanner.name(),
+	}
+
+	switch {
+	case err != nil:
+		a.Verdict, a.Error = "error", err.Error()
+		if scanFailOpen {
+			a.Action = "allowed"
+		} else {
+			a.Action = "rejected"
+		}
+		// The hash only covers what was read before the failure
+		a.SHA256 = ""
+	case verdict.infected:
+		a.Verdict, a.Signature, a.Action = "infected", verdict.signature, "quarantined"
+	default:
+		a.Verdict, a.Action = "clean", "stored"
+	}
+	id := saveScanAudit(a)
+
+	switch {
+	case err != nil:
+		fmt.Printf("[SCAN ERROR] %s %s: %v (%s)\n", req.dataType, req.filename, err, a.Action)
+		if scanFailOpen {
+			return nil
+		}
+		return fmt.Errorf("%w: %v", errScannerUnavailable, err)
+	case verdict.infected:
+		fmt.Printf("[SCAN] %s %s infected with %s, quarantined as scan %d\n", req.dataType, req.filename, verdict.signature, id)
+		quarantine(id, req)
+		return &malwareError{signature: verdict.signature, auditID: id}
+	}
+	return nil
+}
+
+// scanAudit is a row of scan_audit
+type scanAudit struct {
+	Tenant    string
+	DataType  string
+	Filename  string
+	Size      int64
+	SHA256    string
+	Scanner   string
+	Verdict   string // clean, infected or error
+	Signature string
+	Error     string
+	Action    string // stored, quarantined, rejected (scanner failed, fail-closed) or allowed (scanner failed, fail-open)
+}
+
+func saveScanAudit(a scanAudit) int64 {
+	var id int64
+	if err := db.QueryRow(context.Background(),
+		`INSERT INTO scan_audit (tenant, data_type, filename, size_bytes, sha256, scanner, verdict, signature, error, action)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, NULLIF($8, ''), NULLIF($9, ''), $10)
+		 RETURNING id`,
+		a.Tenant, a.DataType, a.Filename, a.Size, a.SHA256, a.Scanner, a.Verdict, a.Signature, a.Error, a.Action).Scan(&id); err != nil {
+		fmt.Printf("[SCAN ERROR] Saving audit record for %s: %v\n", a.Filename, err)
+	}
+	return id
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// quarantine keeps a copy of infected content for review and records where
+func quarantine(auditID int64, req scanRequest) {
+	path := filepath.Join(quarantineDir, fmt.Sprintf("%d-%s", auditID, unsafeFilename.ReplaceAllString(req.filename, "_")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err == nil {
+		_, err = io.Copy(f, io.NewSectionReader(req.content, 0, req.size))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Printf("[SCAN ERROR] Quarantining scan %d: %v\n", auditID, err)
+		return
+	}
+	if _, err := db.Exec(context.Background(),
+		"UPDATE scan_audit SET quarantine_path = $2 WHERE id = $1", auditID, path); err != nil {
+		fmt.Printf("[SCAN ERROR] Recording quarantine of scan %d: %v\n", auditID, err)
+	}
+}
+
+// uploadFailed annotates the error response for a failed upload, whether
+// the scan or upload-file failed, and returns the status to respond with
+func uploadFailed(c *gin.Context, err error) int {
+	var me *malwareError
+	switch {
+	case errors.As(err, &me):
+		annotateError(c, codeMalwareDetected, err.Error(), nil)
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errScannerUnavailable):
+		c.Header("Retry-After", "60")
+		annotateError(c, codeUnavailable, err.Error(), nil)
+		return http.StatusServiceUnavailable
+	}
+	return pdpFailed(c, "upload-file", err)
+}
+
+// listScansHandler lists scan audit records, newest first
+// GET /api/admin/scans?verdict=infected
+func listScansHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+	verdict := c.DefaultQuery("verdict", "all")
+	limit := parseIntParam(c, "limit", 50)
+	offset := parseIntParam(c, "offset", 0)
+
+	rows, err := db.Query(context.Background(),
+		`SELECT id, tenant, data_type, filename, size_bytes, COALESCE(sha256, ''), scanner, verdict,
+		        COALESCE(signature, ''), COALESCE(error, ''), action, COALESCE(quarantine_path, ''), scanned_at
+		   FROM scan_audit
+		  WHERE ($1 = 'all' OR verdict = $1)
+		  ORDER BY id DESC
+		  LIMIT $2 OFFSET $3`,
+		verdict, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	result := []filcdn.ScanRecord{}
+	for rows.Next() {
+		var s filcdn.ScanRecord
+		if err := rows.Scan(&s.ID, &s.Tenant, &s.DataType, &s.Filename, &s.Size, &s.SHA256, &s.Scanner, &s.Verdict,
+			&s.Signature, &s.Error, &s.Action, &s.QuarantinePath, &s.ScannedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result = append(result, s)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
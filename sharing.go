@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Sharing encrypted records between collaborators. Users register an X25519
+// public key under their tenant; a record's data key is then wrapped for each
+// recipient and stored in record_key_grants. For client-side encrypted (.enc)
+// records the owner wraps the key locally and uploads the result; for
+// server-side encrypted records the service can wrap it itself.
+//
+// Revoking a grant stops the service from handing out that wrapped key and
+// excludes the recipient from keys wrapped later. It cannot take back a key
+// the recipient has already fetched; re-encrypt the data for that.
+//
+// Server-side wrapping uses an ephemeral X25519 key, HKDF-SHA256 over the
+// shared secret (salt: ephemeral || recipient public key) and AES-256-GCM:
+//
+//	wrapped = ephemeral public key (32) || nonce (12) || sealed data key
+
+const shareWrapAlgorithm = "X25519-HKDF-SHA256-AES-256-GCM"
+
+type keyGrant struct {
+	RecipientTenant string     `json:"recipientTenant"`
+	RecipientUser   string     `json:"recipientUser"`
+	Algorithm       string     `json:"algorithm"`
+	KeyFingerprint  string     `json:"keyFingerprint"`
+	WrappedKey      string     `json:"wrappedKey,omitempty"`
+	GrantedAt       time.Time  `json:"grantedAt"`
+	RevokedAt       *time.Time `json:"revokedAt"`
+}
+
+// keyFingerprint identifies a public key in grants and listings
+func keyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// registerPublicKeyHandler registers or replaces a user's X25519 public key
+// PUT /api/users/:user/public-key {"publicKey": "<base64 32 bytes>"}
+func registerPublicKeyHandler(c *gin.Context) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		PublicKey string `json:"publicKey" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(req.PublicKey)
+	if err == nil {
+		_, err = ecdh.X25519().NewPublicKey(raw)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "publicKey must be a base64-encoded 32-byte X25519 key"})
+		return
+	}
+
+	user := c.Param("user")
+	if _, err := db.Exec(context.Background(),
+		`INSERT INTO user_public_keys (tenant, user_id, public_key)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (tenant, user_id) DO UPDATE SET public_key = EXCLUDED.public_key, updated_at = NOW()`,
+		tenant, user, raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[SHARE] Registered public key %s for %s/%s\n", keyFingerprint(raw), tenant, user)
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant, "user": user, "keyFingerprint": keyFingerprint(raw)})
+}
+
+// getPublicKeyHandler returns a user's public key so others can wrap keys for them
+// GET /api/users/:user/public-key?tenant=lab-b
+func getPublicKeyHandler(c *gin.Context) {
+	tenant := c.DefaultQuery("tenant", tenantOf(c))
+	user := c.Param("user")
+
+	raw, err := loadPublicKey(context.Background(), tenant, user)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No public key registered for this user"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tenant":         tenant,
+		"user":           user,
+		"publicKey":      base64.StdEncoding.EncodeToString(raw),
+		"keyFingerprint": keyFingerprint(raw),
+	})
+}
+
+func loadPublicKey(ctx context.Context, tenant, user string) ([]byte, error) {
+	var raw []byte
+	err := db.QueryRow(ctx,
+		"SELECT public_key FROM user_public_keys WHERE tenant = $1 AND user_id = $2",
+		tenant, user).Scan(&raw)
+	return raw, err
+}
+
+// registerEncryptionHandler records that a client-side encrypted record exists
+// and stores the owner's initial wrapped keys. Only the tenant that uploaded
+// the record may register it; records whose uploader is unknown need an admin.
+// POST /api/records/:cid/encryption {"algorithm": "AES-256-GCM", "recipients": [{"user": "alice", "wrappedKey": "..."}]}
+func registerEncryptionHandler(c *gin.Context) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Algorithm  string `json:"algorithm" binding:"required"`
+		Recipients []struct {
+			Tenant        string `json:"tenant"`
+			User          string `json:"user" binding:"required"`
+			WrapAlgorithm string `json:"wrapAlgorithm"`
+			WrappedKey    string `json:"wrappedKey" binding:"required"`
+		} `json:"recipients"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cid := c.Param("cid")
+	ctx := context.Background()
+
+	var uploader *string
+	err := db.QueryRow(ctx,
+		"SELECT tenant FROM file_cids WHERE cid = $1 AND deleted_at IS NULL ORDER BY id DESC LIMIT 1",
+		cid).Scan(&uploader)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch {
+	case uploader == nil:
+		if !requireAdmin(c) {
+			return
+		}
+	case *uploader != tenant:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the tenant that uploaded this record can register its encryption"})
+		return
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO record_encryption (cid, mode, algorithm, tenant) VALUES ($1, 'client', $2, $3)
+		 ON CONFLICT (cid) DO NOTHING`,
+		cid, req.Algorithm, tenant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Encryption metadata is already registered for this record"})
+		return
+	}
+
+	for _, r := range req.Recipients {
+		if r.Tenant == "" {
+			r.Tenant = tenant
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(r.WrappedKey)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("wrappedKey for %s is not valid base64", r.User)})
+			return
+		}
+		if r.WrapAlgorithm == "" {
+			r.WrapAlgorithm = shareWrapAlgorithm
+		}
+		if status, err := saveGrant(ctx, tx, cid, tenant, r.Tenant, r.User, r.WrapAlgorithm, wrapped); err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[SHARE] Registered client-side encryption for %s (%d recipients)\n", cid, len(req.Recipients))
+	c.JSON(http.StatusCreated, gin.H{"cid": cid, "mode": "client", "algorithm": req.Algorithm, "owner": tenant})
+}
+
+// shareRecordHandler grants a recipient access to a record's data key. For
+// client-side encrypted records wrappedKey is required; for server-side ones
+// the service wraps the key for the recipient's registered public key.
+// POST /api/records/:cid/recipients {"tenant": "lab-b", "user": "alice", "wrappedKey": "..."}
+func shareRecordHandler(c *gin.Context) {
+	var req struct {
+		Tenant        string `json:"tenant"`
+		User          string `json:"user" binding:"required"`
+		WrapAlgorithm string `json:"wrapAlgorithm"`
+		WrappedKey    string `json:"wrappedKey"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cid := c.Param("cid")
+	ctx := context.Background()
+
+	owner, mode, ok := requireRecordOwner(c, cid)
+	if !ok {
+		return
+	}
+	if req.Tenant == "" {
+		req.Tenant = owner
+	}
+
+	var wrapped []byte
+	switch {
+	case req.WrappedKey != "":
+		var err error
+		if wrapped, err = base64.StdEncoding.DecodeString(req.WrappedKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wrappedKey is not valid base64"})
+			return
+		}
+		if req.WrapAlgorithm == "" {
+			req.WrapAlgorithm = shareWrapAlgorithm
+		}
+	case mode == "server":
+		env, err := loadEnvelope(ctx, cid)
+		if err == nil {
+			err = env.unwrap()
+		}
+		if err != nil {
+			fmt.Printf("[SHARE ERROR] %s: %v\n", cid, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot unwrap data key"})
+			return
+		}
+		publicKey, err := loadPublicKey(ctx, req.Tenant, req.User)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Recipient has no registered public key"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if wrapped, err = wrapKeyForRecipient(env.dataKey, publicKey); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		req.WrapAlgorithm = shareWrapAlgorithm
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrappedKey is required for client-side encrypted records"})
+		return
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if status, err := saveGrant(ctx, tx, cid, owner, req.Tenant, req.User, req.WrapAlgorithm, wrapped); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[SHARE] %s shared with %s/%s\n", cid, req.Tenant, req.User)
+	c.JSON(http.StatusCreated, gin.H{"cid": cid, "recipientTenant": req.Tenant, "recipientUser": req.User})
+}
+
+// listRecipientsHandler lists everyone a record has been shared with
+// GET /api/records/:cid/recipients
+func listRecipientsHandler(c *gin.Context) {
+	cid := c.Param("cid")
+	if _, _, ok := requireRecordOwner(c, cid); !ok {
+		return
+	}
+
+	rows, err := db.Query(context.Background(),
+		`SELECT recipient_tenant, recipient_user, algorithm, key_fingerprint, created_at, revoked_at
+		   FROM record_key_grants
+		  WHERE cid = $1
+		  ORDER BY created_at`,
+		cid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var grants []keyGrant
+	for rows.Next() {
+		var g keyGrant
+		if err := rows.Scan(&g.RecipientTenant, &g.RecipientUser, &g.Algorithm, &g.KeyFingerprint,
+			&g.GrantedAt, &g.RevokedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		grants = append(grants, g)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": grants})
+}
+
+// revokeRecipientHandler revokes a recipient's grant
+// DELETE /api/records/:cid/recipients/:user?tenant=lab-b
+func revokeRecipientHandler(c *gin.Context) {
+	cid := c.Param("cid")
+	owner, _, ok := requireRecordOwner(c, cid)
+	if !ok {
+		return
+	}
+	recipientTenant := c.DefaultQuery("tenant", owner)
+	user := c.Param("user")
+
+	tag, err := db.Exec(context.Background(),
+		`UPDATE record_key_grants SET revoked_at = NOW()
+		  WHERE cid = $1 AND recipient_tenant = $2 AND recipient_user = $3 AND revoked_at IS NULL`,
+		cid, recipientTenant, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active grant for this recipient"})
+		return
+	}
+
+	fmt.Printf("[SHARE] Revoked %s/%s on %s\n", recipientTenant, user, cid)
+	c.JSON(http.StatusOK, gin.H{"cid": cid, "recipientTenant": recipientTenant, "recipientUser": user, "revoked": true})
+}
+
+// getWrappedKeyHandler hands a recipient their wrapped copy of the data key.
+// For server-side encrypted records it comes with the envelope parameters
+// needed to decrypt the ciphertext from GET /api/content/:cid.
+// GET /api/records/:cid/keys/:user
+func getWrappedKeyHandler(c *gin.Context) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return
+	}
+	cid := c.Param("cid")
+	user := c.Param("user")
+
+	var g keyGrant
+	var wrapped, noncePrefix []byte
+	var encAlgorithm string
+	var chunkSize *int
+	var plaintextSize *int64
+	err := db.QueryRow(context.Background(),
+		`SELECT g.recipient_tenant, g.recipient_user, g.algorithm, g.key_fingerprint, g.wrapped_key,
+		        g.created_at, e.algorithm, e.nonce_prefix, e.chunk_size, e.plaintext_size
+		   FROM record_key_grants g
+		   JOIN record_encryption e ON e.cid = g.cid
+		  WHERE g.cid = $1 AND g.recipient_tenant = $2 AND g.recipient_user = $3 AND g.revoked_at IS NULL`,
+		cid, tenant, user).Scan(&g.RecipientTenant, &g.RecipientUser, &g.Algorithm, &g.KeyFingerprint,
+		&wrapped, &g.GrantedAt, &encAlgorithm, &noncePrefix, &chunkSize, &plaintextSize)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No access to this record"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	g.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+	res := gin.H{"data": g, "encryptionAlgorithm": encAlgorithm}
+	if noncePrefix != nil {
+		res["noncePrefix"] = base64.StdEncoding.EncodeToString(noncePrefix)
+	}
+	if chunkSize != nil {
+		res["chunkSize"] = *chunkSize
+	}
+	if plaintextSize != nil {
+		res["plaintextSize"] = *plaintextSize
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// requireRecordOwner checks that the caller's tenant owns the record's
+// encryption metadata and returns the owner and encryption mode
+func requireRecordOwner(c *gin.Context, cid string) (string, string, bool) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return "", "", false
+	}
+	var owner, mode string
+	err := db.QueryRow(context.Background(),
+		"SELECT tenant, mode FROM record_encryption WHERE cid = $1", cid).Scan(&owner, &mode)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Record has no encryption metadata"})
+			return "", "", false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", "", false
+	}
+	if owner != tenant {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the record owner can manage its recipients"})
+		return "", "", false
+	}
+	return owner, mode, true
+}
+
+// saveGrant stores (or replaces) a recipient's wrapped key, pinned to the
+// fingerprint of the public key currently registered for them
+func saveGrant(ctx context.Context, tx pgx.Tx, cid, grantedBy, recipientTenant, recipientUser, algorithm string, wrapped []byte) (int, error) {
+	publicKey, err := loadPublicKey(ctx, recipientTenant, recipientUser)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return http.StatusNotFound, fmt.Errorf("%s/%s has no registered public key", recipientTenant, recipientUser)
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO record_key_grants
+		   (cid, recipient_tenant, recipient_user, algorithm, key_fingerprint, wrapped_key, granted_by)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (cid, recipient_tenant, recipient_user) DO UPDATE
+		   SET algorithm = EXCLUDED.algorithm, key_fingerprint = EXCLUDED.key_fingerprint,
+		       wrapped_key = EXCLUDED.wrapped_key, granted_by = EXCLUDED.granted_by,
+		       created_at = NOW(), revoked_at = NULL`,
+		cid, recipientTenant, recipientUser, algorithm, keyFingerprint(publicKey), wrapped, grantedBy)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to save grant: %w", err)
+	}
+	return 0, nil
+}
+
+// wrapKeyForRecipient encrypts dataKey to an X25519 public key
+func wrapKeyForRecipient(dataKey, recipientPublicKey []byte) ([]byte, error) {
+	curve := ecdh.X25519()
+	recipient, err := curve.NewPublicKey(recipientPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublicKey...)
+	kek, err := hkdf.Key(sha256.New, shared, salt, "filcdn-share-v1", 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(ephemeralPublic, nonce...)
+	return aead.Seal(out, nonce, dataKey, nil), nil
+}
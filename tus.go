@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (core, creation and
+// termination extensions). Upload state lives in tus_uploads and the bytes in
+// a staging file named after the upload ID, so the current offset is simply
+// the staging file's size and survives restarts. Once the last byte arrives
+// the file goes through the same upload-file / add-roots / insert pipeline as
+// the multipart upload handlers.
+//
+// Upload-Metadata keys: type (paper, genome or spectrum; default genome),
+// filename, serviceUrl, serviceName, proofSetID, encryption and the metadata
+// fields of the chosen type as used by the single-file forms (keywords
+// comma-separated, metadata as a JSON document). Without proofSetID the file
+// goes to a proof set from the tenant's pool, chosen once the last byte
+// arrives. The staging file holds the plaintext; with encryption=server it is
+// encrypted on its way to the provider.
+
+const tusVersion = "1.0.0"
+
+var (
+	tusStagingDir  string
+	tusMaxSize     int64
+	tusRetryDelay  time.Duration
+	tusMaxAttempts int
+
+	// tusLocks serializes PATCH requests per upload
+	tusLocks sync.Map
+)
+
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Tenant   string            `json:"-"`
+	DataType string            `json:"type"`
+	Filename string            `json:"filename"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata"`
+	Status   string            `json:"status"` // uploading, processing, completed, failed
+	RootCID  *string           `json:"rootCID"`
+	Error    *string           `json:"error"`
+}
+
+func (u *tusUpload) stagingPath() string {
+	return filepath.Join(tusStagingDir, u.ID)
+}
+
+func loadTusUpload(ctx context.Context, id string) (*tusUpload, error) {
+	u := &tusUpload{ID: id}
+	var metadata []byte
+	err := db.QueryRow(ctx,
+		`SELECT COALESCE(tenant, ''), data_type, filename, length, metadata, status, root_cid, error
+		   FROM tus_uploads WHERE id = $1`,
+		id).Scan(&u.Tenant, &u.DataType, &u.Filename, &u.Length, &metadata, &u.Status, &u.RootCID, &u.Error)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(metadata, &u.Metadata); err != nil {
+		return nil, err
+	}
+	if stat, err := os.Stat(u.stagingPath()); err == nil {
+		u.Offset = stat.Size()
+	}
+	return u, nil
+}
+
+// tusMiddleware sets the headers required on every tus response and rejects
+// clients speaking another protocol version
+func tusMiddleware(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+	if c.Request.Method != http.MethodOptions && c.Request.Method != http.MethodGet &&
+		c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	c.Next()
+}
+
+// tusOptionsHandler advertises the server's tus capabilities
+// OPTIONS /api/tus/
+func tusOptionsHandler(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,termination")
+	c.Header("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// tusCreateHandler creates a new upload
+// POST /api/tus/  Upload-Length: 123456  Upload-Metadata: filename Z2Vub21lLmZh,organism aHVtYW4=,...
+func tusCreateHandler(c *gin.Context) {
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length header is required"})
+		return
+	}
+	if length > tusMaxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("upload exceeds Tus-Max-Size of %d bytes", tusMaxSize)})
+		return
+	}
+
+	metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if metadata["type"] == "" {
+		metadata["type"] = "genome"
+	}
+	dataType := metadata["type"]
+	if _, ok := editableFields[dataType]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data type. Valid types: paper, genome, spectrum"})
+		return
+	}
+	if metadata["filename"] == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filename metadata is required"})
+		return
+	}
+	if metadata["proofSetID"] == "" && metadata["serviceUrl"] == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "proofSetID or serviceUrl metadata is required"})
+		return
+	}
+	entry, err := tusRecordMetadata(metadata)
+	if err == nil {
+		err = entry.validate(dataType)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := uploadEncryptionTenant(c, metadata["encryption"]); !ok {
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	u := &tusUpload{ID: hex.EncodeToString(idBytes), Tenant: tenantOf(c), DataType: dataType,
+		Filename: metadata["filename"], Length: length}
+
+	f, err := os.OpenFile(u.stagingPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	f.Close()
+
+	metadataJSON, _ := json.Marshal(metadata)
+	if _, err := db.Exec(context.Background(),
+		`INSERT INTO tus_uploads (id, tenant, data_type, filename, length, metadata) VALUES ($1, $2, $3, $4, $5, $6)`,
+		u.ID, u.Tenant, u.DataType, u.Filename, u.Length, string(metadataJSON)); err != nil {
+		os.Remove(u.stagingPath())
+		fmt.Printf("[TUS ERROR] %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[TUS] Created %s for %s %s (%d bytes)\n", u.ID, dataType, u.Filename, length)
+	// Relative to the group the upload was created on (/api/tus or /api/v2/tus)
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+u.ID)
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+
+	// An empty upload is complete as soon as it is created
+	if length == 0 {
+		startTusProcessing(u)
+	}
+}
+
+// tusHeadHandler reports how many bytes the server has
+// HEAD /api/tus/:id
+func tusHeadHandler(c *gin.Context) {
+	u, err := loadTusUpload(context.Background(), c.Param("id"))
+	if err != nil {
+		tusLoadError(c, err)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	c.Header("Upload-Metadata", encodeTusMetadata(u.Metadata))
+	c.Status(http.StatusOK)
+}
+
+// tusPatchHandler appends a chunk at the given offset
+// PATCH /api/tus/:id  Upload-Offset: 1048576  Content-Type: application/offset+octet-stream
+func tusPatchHandler(c *gin.Context) {
+	id := c.Param("id")
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset header is required"})
+		return
+	}
+
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		c.JSON(http.StatusLocked, gin.H{"error": "another request is writing to this upload"})
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	u, err := loadTusUpload(context.Background(), id)
+	if err != nil {
+		tusLoadError(c, err)
+		return
+	}
+	if u.Status != "uploading" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("upload is already %s", u.Status)})
+		return
+	}
+	if offset != u.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("offset mismatch: server has %d bytes", u.Offset)})
+		return
+	}
+
+	f, err := os.OpenFile(u.stagingPath(), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Keep whatever arrived before a dropped connection; the client resumes from there
+	written, copyErr := io.Copy(f, io.LimitReader(c.Request.Body, u.Length-u.Offset))
+	syncErr := f.Sync()
+	f.Close()
+	u.Offset += written
+	fmt.Printf("[TUS] %s: +%d bytes, %d/%d\n", id, written, u.Offset, u.Length)
+
+	if copyErr != nil || syncErr != nil {
+		c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "upload interrupted, resume from Upload-Offset"})
+		return
+	}
+
+	// Check the format as soon as the start of the file has arrived
+	if received := u.Offset - written; received < sniffLen && (u.Offset >= sniffLen || u.Offset == u.Length) {
+		if !checkTusFormat(c, u) {
+			return
+		}
+	}
+
+	if u.Offset == u.Length {
+		startTusProcessing(u)
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// tusStatusHandler returns the upload and, once processed, the stored root.
+// Not part of tus; clients poll it after the last PATCH.
+// GET /api/tus/:id
+func tusStatusHandler(c *gin.Context) {
+	u, err := loadTusUpload(context.Background(), c.Param("id"))
+	if err != nil {
+		tusLoadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": u})
+}
+
+// tusDeleteHandler terminates an upload and discards its staged bytes
+// DELETE /api/tus/:id
+func tusDeleteHandler(c *gin.Context) {
+	id := c.Param("id")
+	tag, err := db.Exec(context.Background(),
+		"DELETE FROM tus_uploads WHERE id = $1 AND status IN ('uploading', 'failed')", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := loadTusUpload(context.Background(), id); err != nil {
+			tusLoadError(c, err)
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "upload is being processed or already stored"})
+		return
+	}
+
+	os.Remove(filepath.Join(tusStagingDir, id))
+	tusLocks.Delete(id)
+	fmt.Printf("[TUS] Terminated %s\n", id)
+	c.Status(http.StatusNoContent)
+}
+
+// checkTusFormat sniffs the start of a staged upload. A file in a format
+// not allowed for its data type fails the upload and gets a 415.
+func checkTusFormat(c *gin.Context, u *tusUpload) bool {
+	f, err := os.Open(u.stagingPath())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+
+	ok, detected := checkFormat(u.DataType, head[:n])
+	if ok {
+		return true
+	}
+	fmt.Printf("[TUS] %s rejected: %s is not an accepted %s format\n", u.ID, detected, u.DataType)
+	db.Exec(context.Background(),
+		"UPDATE tus_uploads SET status = 'failed', error = $2, updated_at = NOW() WHERE id = $1",
+		u.ID, fmt.Sprintf("%s is not an accepted %s format", detected, u.DataType))
+	os.Remove(u.stagingPath())
+	formatRejected(c, u.DataType, u.Filename, detected)
+	return false
+}
+
+func tusLoadError(c *gin.Context, err error) {
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// startTusProcessing marks a fully received upload as processing and hands it
+// to the storage pipeline in the background
+func startTusProcessing(u *tusUpload) {
+	tag, err := db.Exec(context.Background(),
+		"UPDATE tus_uploads SET status = 'processing', updated_at = NOW() WHERE id = $1 AND status = 'uploading'",
+		u.ID)
+	if err != nil || tag.RowsAffected() == 0 {
+		fmt.Printf("[TUS ERROR] %s cannot start processing: %v\n", u.ID, err)
+		return
+	}
+	go processTusUpload(u)
+}
+
+// resumeTusProcessing restarts uploads that were being processed when the
+// service stopped
+func resumeTusProcessing() {
+	rows, err := db.Query(context.Background(), "SELECT id FROM tus_uploads WHERE status = 'processing'")
+	if err != nil {
+		fmt.Printf("[TUS ERROR] Cannot load interrupted uploads: %v\n", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		u, err := loadTusUpload(context.Background(), id)
+		if err != nil {
+			fmt.Printf("[TUS ERROR] %s: %v\n", id, err)
+			continue
+		}
+		fmt.Printf("[TUS] Resuming processing of %s\n", id)
+		go processTusUpload(u)
+	}
+}
+
+// processTusUpload runs the assembled file through upload-file, add-roots and
+// the metadata insert, then records the outcome. Failures that pass on their
+// own keep the staged file and are tried again after tusRetryDelay, up to
+// tusMaxAttempts times; the upload stays processing meanwhile, so a restart
+// resumes it too.
+func processTusUpload(u *tusUpload) {
+	rootCID, err := storeTusUpload(u)
+
+	ctx := context.Background()
+	if err != nil {
+		fmt.Printf("[TUS ERROR] %s: %v\n", u.ID, err)
+		if tusRetryable(err) {
+			var attempts int
+			if dbErr := db.QueryRow(ctx,
+				`UPDATE tus_uploads SET attempts = attempts + 1, error = $2, updated_at = NOW()
+				  WHERE id = $1 RETURNING attempts`,
+				u.ID, err.Error()).Scan(&attempts); dbErr != nil {
+				fmt.Printf("[TUS ERROR] %s: %v\n", u.ID, dbErr)
+			} else if attempts < tusMaxAttempts {
+				fmt.Printf("[TUS] %s: retrying in %s (attempt %d/%d)\n", u.ID, tusRetryDelay, attempts, tusMaxAttempts)
+				time.AfterFunc(tusRetryDelay, func() { processTusUpload(u) })
+				return
+			}
+		}
+		db.Exec(ctx,
+			"UPDATE tus_uploads SET status = 'failed', error = $2, updated_at = NOW() WHERE id = $1",
+			u.ID, err.Error())
+		return
+	}
+
+	if _, err := db.Exec(ctx,
+		`UPDATE tus_uploads SET status = 'completed', root_cid = $2, error = NULL,
+		        updated_at = NOW(), completed_at = NOW()
+		  WHERE id = $1`,
+		u.ID, rootCID); err != nil {
+		fmt.Printf("[TUS ERROR] %s: %v\n", u.ID, err)
+		return
+	}
+	os.Remove(u.stagingPath())
+	tusLocks.Delete(u.ID)
+	fmt.Printf("[TUS] %s stored as %s\n", u.ID, rootCID)
+}
+
+// tusRetryable reports whether a failed attempt to store an upload may
+// succeed later: the pdptool queue was full, the provider was unreachable or
+// the scanner was down. When add-roots is what failed, the next attempt
+// stops at the intent left uploaded rather than add the root twice.
+func tusRetryable(err error) bool {
+	var pe *pdpError
+	if errors.As(err, &pe) && pe.Kind == pdpBusy {
+		return true
+	}
+	return errors.Is(err, errProviderUnavailable) || errors.Is(err, errScannerUnavailable)
+}
+
+func storeTusUpload(u *tusUpload) (string, error) {
+	ctx := withTenant(context.Background(), u.Tenant)
+	entry, err := tusRecordMetadata(u.Metadata)
+	if err != nil {
+		return "", err
+	}
+	serviceUrl, serviceName, proofSetID := u.Metadata["serviceUrl"], u.Metadata["serviceName"], u.Metadata["proofSetID"]
+
+	// A restart may have interrupted an earlier attempt; never upload and add
+	// the same file twice
+	prev, err := findIntent("tus", u.ID)
+	if err != nil {
+		return "", err
+	}
+	if prev != nil {
+		switch prev.State {
+		case "completed":
+			return *prev.RootCID, nil
+		case "root_added":
+			fmt.Printf("[TUS] %s: root %s already added, saving metadata\n", u.ID, *prev.RootCID)
+			if err := completeIntent(ctx, prev); err != nil {
+				return "", err
+			}
+			return *prev.RootCID, nil
+		case "uploaded":
+			markIntent(prev.ID, "needs_attention", "", errors.New("interrupted after upload-file; add-roots outcome unknown"))
+			return "", errors.New("interrupted while adding the root to the proof set; needs admin attention")
+		case "needs_attention":
+			return "", errors.New("previous attempt needs admin attention")
+		case "pending":
+			markIntent(prev.ID, "failed", "", errors.New("interrupted before the upload finished"))
+		}
+	}
+
+	var lease *proofSetLease
+	if proofSetID == "" {
+		lease, err = acquireProofSet(ctx, u.Tenant, serviceUrl, serviceName, 1, u.Length)
+		if err != nil {
+			return "", err
+		}
+		defer lease.done()
+		proofSetID = lease.proofSetID
+	}
+
+	encryptFor := ""
+	if u.Metadata["encryption"] == "server" {
+		encryptFor = u.Tenant
+	}
+	intentID, err := createIntent(u.Tenant, u.DataType, "tus", u.ID, entry, proofSetID, serviceUrl, serviceName, encryptFor != "")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(u.stagingPath())
+	if err != nil {
+		markIntent(intentID, "failed", "", err)
+		return "", fmt.Errorf("staged file missing: %w", err)
+	}
+	defer f.Close()
+
+	header := &multipart.FileHeader{Filename: u.Filename, Size: u.Length}
+	target := &uploadTarget{serviceURL: serviceUrl, serviceName: serviceName, proofSetID: proofSetID, lease: lease, failover: true}
+	facts := newFactsRecorder()
+	src, env, err := encryptUpload(encryptFor, io.TeeReader(f, facts))
+	if err != nil {
+		markIntent(intentID, "failed", "", err)
+		return "", err
+	}
+	rootCID, err := uploadFileToStorage(ctx, src, f, header, target, u.DataType, nil)
+	if err != nil {
+		markIntent(intentID, "failed", "", err)
+		return "", err
+	}
+	// Saved before add-roots: the data key exists only in memory, and a
+	// restart after the root lands resumes from the intent without it
+	if env != nil {
+		if err := saveEnvelope(context.Background(), rootCID, env); err != nil {
+			markIntent(intentID, "failed", "", err)
+			return "", err
+		}
+	}
+	retargetIntent(intentID, target)
+	serviceUrl, serviceName, proofSetID = target.serviceURL, target.serviceName, target.proofSetID
+	markIntent(intentID, "uploaded", rootCID, nil)
+	recordFileFacts(rootCID, facts.facts(u.Filename))
+	emitEvent(u.Tenant, eventUploadCompleted, gin.H{"type": u.DataType, "filename": u.Filename, "rootCID": rootCID})
+	if err := addRootToProofSet(ctx, serviceUrl, serviceName, proofSetID, rootCID, nil); err != nil {
+		markAddRootsFailed(intentID, err)
+		emitEvent(u.Tenant, eventRootFailed, gin.H{"type": u.DataType, "proofSetID": proofSetID, "rootCID": rootCID, "error": err.Error()})
+		return "", err
+	}
+	target.lease.assign(rootCID, u.Length)
+	markIntent(intentID, "root_added", "", nil)
+	emitEvent(u.Tenant, eventRootAdded, gin.H{"type": u.DataType, "proofSetID": proofSetID, "rootCID": rootCID})
+	if err := saveUploadedRecord(intentID, u.DataType, entry, rootCID, proofSetID, serviceUrl, serviceName); err != nil {
+		return "", err
+	}
+	go replicateRecord(rootCID, u.DataType, serviceUrl)
+	return rootCID, nil
+}
+
+// tusRecordMetadata maps Upload-Metadata pairs onto the record metadata
+func tusRecordMetadata(metadata map[string]string) (*recordMetadata, error) {
+	entry := &recordMetadata{
+		Filename:        metadata["filename"],
+		Title:           metadata["title"],
+		Journal:         metadata["journal"],
+		Organism:        metadata["organism"],
+		AssemblyVersion: metadata["assemblyVersion"],
+		Notes:           metadata["notes"],
+		Compound:        metadata["compound"],
+		Technique:       metadata["technique"],
+	}
+	if yearStr := metadata["year"]; yearStr != "" {
+		year, err := strconv.Atoi(yearStr)
+		if err != nil {
+			return nil, errors.New("year must be an integer")
+		}
+		entry.Year = &year
+	}
+	if keywords := metadata["keywords"]; keywords != "" {
+		entry.Keywords = strings.Split(keywords, ",")
+	}
+	if m := metadata["metadata"]; m != "" {
+		entry.Metadata = json.RawMessage(m)
+	}
+	return entry, nil
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value for %q is not valid base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func encodeTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The verifier re-checks stored roots after the fact. It walks file_cids in
+// batches, least recently verified first, and for each row records
+// last_verified_at, verification_status and verification_error:
+//
+//	verified       root is in its proof set, the proof set is being proven
+//	               and (when sampling is enabled) the piece can be retrieved
+//	missing        root is no longer in the proof set
+//	not_proving    proof set has no next challenge scheduled
+//	unretrievable  the sample range could not be fetched from the provider
+//	error          the provider could not be asked; checked again next round
+var (
+	verifyInterval    time.Duration
+	verifyBatchSize   int
+	verifyMaxAge      time.Duration
+	verifySampleBytes int64
+)
+
+const (
+	verificationVerified      = "verified"
+	verificationMissing       = "missing"
+	verificationNotProving    = "not_proving"
+	verificationUnretrievable = "unretrievable"
+	verificationError         = "error"
+)
+
+var verificationStatuses = map[string]bool{
+	verificationVerified:      true,
+	verificationMissing:       true,
+	verificationNotProving:    true,
+	verificationUnretrievable: true,
+	verificationError:         true,
+}
+
+// verifyTarget is one file_cids row due for verification
+type verifyTarget struct {
+	id          int
+	cid         string
+	proofSetID  string
+	serviceURL  string
+	serviceName string
+}
+
+// runVerifier verifies a batch of roots every verifyInterval
+func runVerifier() {
+	fmt.Printf("[VERIFY] Worker started (every %s, batch %d, re-verify after %s, sample %d bytes)\n",
+		verifyInterval, verifyBatchSize, verifyMaxAge, verifySampleBytes)
+	ticker := time.NewTicker(verifyInterval)
+	defer ticker.Stop()
+
+	for {
+		verifyBatch(context.Background())
+		<-ticker.C
+	}
+}
+
+func verifyBatch(ctx context.Context) {
+	rows, err := db.Query(ctx,
+		`SELECT id, cid, COALESCE(proof_set_id, ''), COALESCE(service_url, ''), COALESCE(service_name, '')
+		   FROM file_cids
+		  WHERE deleted_at IS NULL
+		    AND (last_verified_at IS NULL OR last_verified_at < NOW() - $1::float8 * INTERVAL '1 second')
+		  ORDER BY last_verified_at NULLS FIRST, id
+		  LIMIT $2`,
+		verifyMaxAge.Seconds(), verifyBatchSize)
+	if err != nil {
+		fmt.Printf("[VERIFY ERROR] Loading roots: %v\n", err)
+		return
+	}
+	var due []verifyTarget
+	for rows.Next() {
+		var t verifyTarget
+		if err := rows.Scan(&t.id, &t.cid, &t.proofSetID, &t.serviceURL, &t.serviceName); err != nil {
+			fmt.Printf("[VERIFY ERROR] %v\n", err)
+			continue
+		}
+		due = append(due, t)
+	}
+	rows.Close()
+	if len(due) == 0 {
+		return
+	}
+
+	// Every root of a proof set is checked against one get-proof-set call
+	proofSets := map[[3]string]*proofSetInfo{}
+	proofSetErrors := map[[3]string]error{}
+	counts := map[string]int{}
+	for _, t := range due {
+		status, reason := verifyRoot(ctx, t, proofSets, proofSetErrors)
+		counts[status]++
+		var lastError *string
+		if reason != "" {
+			lastError = &reason
+		}
+		if _, err := db.Exec(ctx,
+			`UPDATE file_cids
+			    SET last_verified_at = NOW(), verification_status = $2, verification_error = $3
+			  WHERE id = $1`,
+			t.id, status, lastError); err != nil {
+			fmt.Printf("[VERIFY ERROR] Recording %s: %v\n", t.cid, err)
+		}
+		if status != verificationVerified {
+			fmt.Printf("[VERIFY] %s in proofSet %s: %s (%s)\n", t.cid, t.proofSetID, status, reason)
+		}
+	}
+	fmt.Printf("[VERIFY] Checked %d roots: %v\n", len(due), counts)
+}
+
+// verifyRoot returns the verification status of one root and, unless it is
+// verified, the reason
+func verifyRoot(ctx context.Context, t verifyTarget, proofSets map[[3]string]*proofSetInfo, proofSetErrors map[[3]string]error) (string, string) {
+	if t.proofSetID == "" || t.serviceURL == "" {
+		return verificationError, "no proof set or provider recorded for this root"
+	}
+
+	key := [3]string{t.serviceURL, t.serviceName, t.proofSetID}
+	info, ok := proofSets[key]
+	if !ok && proofSetErrors[key] == nil {
+		var err error
+		info, err = getProofSet(ctx, t.serviceURL, t.serviceName, t.proofSetID)
+		if err != nil {
+			proofSetErrors[key] = err
+		} else {
+			proofSets[key] = info
+		}
+	}
+	if err := proofSetErrors[key]; err != nil {
+		return verificationError, err.Error()
+	}
+
+	if _, ok, err := info.findRoot(t.cid); err != nil {
+		return verificationError, err.Error()
+	} else if !ok {
+		return verificationMissing, fmt.Sprintf("root not found in proof set %s", t.proofSetID)
+	}
+	if epoch := strings.TrimSpace(info.NextChallengeEpoch); epoch == "" || epoch == "0" {
+		return verificationNotProving, fmt.Sprintf("proof set %s has no next challenge epoch", t.proofSetID)
+	}
+
+	if verifySampleBytes > 0 {
+		if err := fetchPieceSample(ctx, t.serviceURL, t.cid, verifySampleBytes); err != nil {
+			return verificationUnretrievable, err.Error()
+		}
+	}
+	return verificationVerified, ""
+}
+
+// fetchPieceSample reads the first n bytes of a piece from the provider's
+// retrieval endpoint
+func fetchPieceSample(ctx context.Context, serviceUrl, rootCID string, n int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	url := strings.TrimRight(serviceUrl, "/") + "/piece/" + pieceCIDForRoot(rootCID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("retrieval failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("retrieval failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	// Providers that ignore Range send the whole piece; only read the sample
+	read, err := io.Copy(io.Discard, io.LimitReader(resp.Body, n))
+	if err != nil {
+		return fmt.Errorf("retrieval failed after %d bytes: %w", read, err)
+	}
+	if read == 0 {
+		return fmt.Errorf("retrieval returned no data")
+	}
+	return nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"filcdn-service/filcdn"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Webhook notifications. emitEvent stores an event and one pending delivery
+// per matching subscription of the tenant; the delivery worker POSTs them
+// with exponential backoff and logs every attempt. Each request carries
+//
+//	X-Filcdn-Event:     event type
+//	X-Filcdn-Delivery:  delivery ID
+//	X-Filcdn-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256(secret, "<t>.<body>")>
+//
+// Receivers should recompute the HMAC and reject stale timestamps.
+
+const (
+	eventProofSetCreated = "proofset.created"
+	eventUploadCompleted = "upload.completed"
+	eventRootAdded       = "root.added"
+	eventRootFailed      = "root.failed"
+
+	eventProofSetDeadlineMissed = "proofset.deadline_missed"
+)
+
+var webhookEventTypes = map[string]bool{
+	eventProofSetCreated: true,
+	eventUploadCompleted: true,
+	eventRootAdded:       true,
+	eventRootFailed:      true,
+
+	eventProofSetDeadlineMissed: true,
+}
+
+var (
+	webhookPollInterval time.Duration
+	webhookMaxAttempts  int
+	webhookTimeout      time.Duration
+
+	// webhookAllowPrivate lets deliveries reach loopback, private and
+	// link-local addresses, e.g. a receiver on the same host in development
+	webhookAllowPrivate bool
+
+	// webhookWake nudges the delivery worker when new deliveries are queued
+	webhookWake = make(chan struct{}, 1)
+)
+
+// emitEvent queues an event for every subscription of tenant that wants it.
+// Failures are logged and never fail the calling request.
+func emitEvent(tenant, eventType string, data gin.H) {
+	if tenant == "" {
+		return
+	}
+	ctx := context.Background()
+	payload, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("[WEBHOOK ERROR] Cannot encode %s: %v\n", eventType, err)
+		return
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		fmt.Printf("[WEBHOOK ERROR] %v\n", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var eventID int64
+	if err := tx.QueryRow(ctx,
+		"INSERT INTO webhook_events (tenant, type, data) VALUES ($1, $2, $3) RETURNING id",
+		tenant, eventType, string(payload)).Scan(&eventID); err != nil {
+		fmt.Printf("[WEBHOOK ERROR] Cannot store %s: %v\n", eventType, err)
+		return
+	}
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO webhook_deliveries (subscription_id, event_id)
+		 SELECT id, $3 FROM webhook_subscriptions
+		  WHERE tenant = $1 AND active AND (cardinality(events) = 0 OR $2 = ANY(events))`,
+		tenant, eventType, eventID)
+	if err != nil {
+		fmt.Printf("[WEBHOOK ERROR] Cannot queue %s: %v\n", eventType, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		fmt.Printf("[WEBHOOK ERROR] %v\n", err)
+		return
+	}
+
+	if tag.RowsAffected() > 0 {
+		fmt.Printf("[WEBHOOK] %s #%d queued for %d subscriptions\n", eventType, eventID, tag.RowsAffected())
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// createWebhookHandler subscribes a URL to events of the caller's tenant.
+// An empty events list subscribes to everything. The secret is only returned here.
+// POST /api/webhooks {"url": "https://lab.example/hook", "events": ["root.added"]}
+func createWebhookHandler(c *gin.Context) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		URL    string   `json:"url" binding:"required"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http(s) URL"})
+		return
+	}
+	for _, e := range req.Events {
+		if !webhookEventTypes[e] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown event type %q", e)})
+			return
+		}
+	}
+	if req.Events == nil {
+		req.Events = []string{}
+	}
+	if req.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		req.Secret = hex.EncodeToString(b)
+	}
+
+	w := filcdn.Webhook{URL: req.URL, Events: req.Events, Secret: req.Secret, Active: true}
+	if err := db.QueryRow(context.Background(),
+		`INSERT INTO webhook_subscriptions (tenant, url, secret, events)
+		 VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		tenant, req.URL, req.Secret, req.Events).Scan(&w.ID, &w.CreatedAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[WEBHOOK] Subscription #%d for %s → %s\n", w.ID, tenant, req.URL)
+	c.JSON(http.StatusCreated, w)
+}
+
+// listWebhooksHandler lists the caller's subscriptions
+// GET /api/webhooks
+func listWebhooksHandler(c *gin.Context) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return
+	}
+	rows, err := db.Query(context.Background(),
+		`SELECT id, url, events, active, created_at FROM webhook_subscriptions
+		  WHERE tenant = $1 ORDER BY id`,
+		tenant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var subs []filcdn.Webhook
+	for rows.Next() {
+		var w filcdn.Webhook
+		if err := rows.Scan(&w.ID, &w.URL, &w.Events, &w.Active, &w.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		subs = append(subs, w)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": subs})
+}
+
+// deleteWebhookHandler deactivates a subscription; its delivery logs are kept
+// DELETE /api/webhooks/:id
+func deleteWebhookHandler(c *gin.Context) {
+	sub, ok := requireSubscription(c)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "UPDATE webhook_subscriptions SET active = FALSE WHERE id = $1", sub); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE webhook_deliveries SET status = 'cancelled'
+		  WHERE subscription_id = $1 AND status = 'pending'`, sub); err != nil {
+		fmt.Printf("[WEBHOOK ERROR] Cancelling deliveries of #%d: %v\n", sub, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": sub, "active": false})
+}
+
+// listDeliveriesHandler returns the delivery log of a subscription, newest first
+// GET /api/webhooks/:id/deliveries?status=failed
+func listDeliveriesHandler(c *gin.Context) {
+	sub, ok := requireSubscription(c)
+	if !ok {
+		return
+	}
+	limit := parseIntParam(c, "limit", 50)
+	offset := parseIntParam(c, "offset", 0)
+
+	rows, err := db.Query(context.Background(),
+		`SELECT d.id, d.event_id, e.type, d.status, d.attempts, d.last_status_code, d.last_error,
+		        d.next_attempt_at, d.created_at, d.delivered_at
+		   FROM webhook_deliveries d
+		   JOIN webhook_events e ON e.id = d.event_id
+		  WHERE d.subscription_id = $1 AND ($2 = '' OR d.status = $2)
+		  ORDER BY d.id DESC
+		  LIMIT $3 OFFSET $4`,
+		sub, c.Query("status"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var deliveries []filcdn.WebhookDelivery
+	for rows.Next() {
+		var d filcdn.WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError,
+			&d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": deliveries})
+}
+
+// getDeliveryHandler returns one delivery with its payload and every attempt
+// GET /api/webhooks/:id/deliveries/:deliveryId
+func getDeliveryHandler(c *gin.Context) {
+	sub, ok := requireSubscription(c)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(c.Param("deliveryId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery id"})
+		return
+	}
+	ctx := context.Background()
+
+	detail := filcdn.WebhookDeliveryDetail{ID: deliveryID}
+	err = db.QueryRow(ctx,
+		`SELECT d.status, d.event_id, e.type, e.data
+		   FROM webhook_deliveries d JOIN webhook_events e ON e.id = d.event_id
+		  WHERE d.id = $1 AND d.subscription_id = $2`,
+		deliveryID, sub).Scan(&detail.Status, &detail.EventID, &detail.EventType, &detail.EventData)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT attempt, status_code, error, response_body, duration_ms, attempted_at
+		   FROM webhook_delivery_attempts WHERE delivery_id = $1 ORDER BY attempt`,
+		deliveryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a filcdn.WebhookDeliveryAttempt
+		if err := rows.Scan(&a.Attempt, &a.StatusCode, &a.Error, &a.ResponseBody, &a.DurationMs, &a.AttemptedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		detail.Attempts = append(detail.Attempts, a)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": detail})
+}
+
+// replayDeliveryHandler queues a fresh delivery of the same event
+// POST /api/webhooks/:id/deliveries/:deliveryId/replay
+func replayDeliveryHandler(c *gin.Context) {
+	sub, ok := requireSubscription(c)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(c.Param("deliveryId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery id"})
+		return
+	}
+
+	var newID int64
+	err = db.QueryRow(context.Background(),
+		`INSERT INTO webhook_deliveries (subscription_id, event_id, replay_of)
+		 SELECT subscription_id, event_id, id FROM webhook_deliveries
+		  WHERE id = $1 AND subscription_id = $2
+		 RETURNING id`,
+		deliveryID, sub).Scan(&newID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+	fmt.Printf("[WEBHOOK] Delivery #%d replayed as #%d\n", deliveryID, newID)
+	c.JSON(http.StatusAccepted, gin.H{"id": newID, "replay_of": deliveryID, "status": "pending"})
+}
+
+// requireSubscription resolves :id to a subscription of the caller's tenant
+func requireSubscription(c *gin.Context) (int, bool) {
+	tenant, ok := requireTenant(c)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return 0, false
+	}
+	var exists bool
+	if err := db.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $1 AND tenant = $2)",
+		id, tenant).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+// runWebhookWorker delivers due webhooks until the process exits
+func runWebhookWorker() {
+	fmt.Printf("[WEBHOOK] Worker started (max %d attempts, poll every %s)\n", webhookMaxAttempts, webhookPollInterval)
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	client := newWebhookClient()
+	for {
+		deliverDueWebhooks(context.Background(), client)
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+type pendingDelivery struct {
+	id        int64
+	attempts  int
+	url       string
+	secret    string
+	eventID   int64
+	eventType string
+	tenant    string
+	data      []byte
+	createdAt time.Time
+}
+
+func deliverDueWebhooks(ctx context.Context, client *http.Client) {
+	rows, err := db.Query(ctx,
+		`SELECT d.id, d.attempts, s.url, s.secret, e.id, e.type, e.tenant, e.data, e.created_at
+		   FROM webhook_deliveries d
+		   JOIN webhook_subscriptions s ON s.id = d.subscription_id
+		   JOIN webhook_events e ON e.id = d.event_id
+		  WHERE d.status = 'pending' AND d.next_attempt_at <= NOW()
+		  ORDER BY d.next_attempt_at
+		  LIMIT 100`)
+	if err != nil {
+		fmt.Printf("[WEBHOOK ERROR] Loading deliveries: %v\n", err)
+		return
+	}
+	var due []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.id, &d.attempts, &d.url, &d.secret, &d.eventID, &d.eventType,
+			&d.tenant, &d.data, &d.createdAt); err != nil {
+			fmt.Printf("[WEBHOOK ERROR] %v\n", err)
+			continue
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	for _, d := range due {
+		deliverWebhook(ctx, client, d)
+	}
+}
+
+// errWebhookAddress is returned for deliveries to an address webhooks may
+// not reach
+var errWebhookAddress = errors.New("webhook address not allowed")
+
+// newWebhookClient returns the client deliveries are made with. The address
+// is checked after the host is resolved, on every connection including
+// redirects, so a subscription cannot reach the service's own network by
+// name or by DNS rebinding.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil || !webhookAddressAllowed(ip) {
+				return fmt.Errorf("%w: %s", errWebhookAddress, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext}, // no proxy: it would be dialed instead
+	}
+}
+
+// webhookAddressAllowed reports whether deliveries may connect to ip: any
+// public unicast address, and others only with webhookAllowPrivate
+func webhookAddressAllowed(ip netip.Addr) bool {
+	if webhookAllowPrivate {
+		return true
+	}
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), internal
+// like the private ranges
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// deliverWebhook makes one attempt and schedules the next one on failure
+func deliverWebhook(ctx context.Context, client *http.Client, d pendingDelivery) {
+	body, _ := json.Marshal(gin.H{
+		"id":         d.eventID,
+		"type":       d.eventType,
+		"tenant":     d.tenant,
+		"created_at": d.createdAt,
+		"data":       json.RawMessage(d.data),
+	})
+
+	attempt := d.attempts + 1
+	start := time.Now()
+	statusCode, statusLine, err := postWebhook(ctx, client, d, body)
+	duration := time.Since(start)
+
+	var errText *string
+	if err != nil {
+		s := err.Error()
+		errText = &s
+	}
+	var code *int
+	if statusCode != 0 {
+		code = &statusCode
+	}
+	if _, logErr := db.Exec(ctx,
+		`INSERT INTO webhook_delivery_attempts (delivery_id, attempt, status_code, error, response_body, duration_ms)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		d.id, attempt, code, errText, statusLine, duration.Milliseconds()); logErr != nil {
+		fmt.Printf("[WEBHOOK ERROR] Cannot log attempt: %v\n", logErr)
+	}
+
+	if err == nil {
+		db.Exec(ctx,
+			`UPDATE webhook_deliveries
+			    SET status = 'delivered', attempts = $2, last_status_code = $3, last_error = NULL, delivered_at = NOW()
+			  WHERE id = $1`,
+			d.id, attempt, code)
+		fmt.Printf("[WEBHOOK] Delivery #%d (%s) delivered to %s\n", d.id, d.eventType, d.url)
+		return
+	}
+
+	status := "pending"
+	if attempt >= webhookMaxAttempts {
+		status = "failed"
+	}
+	db.Exec(ctx,
+		`UPDATE webhook_deliveries
+		    SET status = $2, attempts = $3, last_status_code = $4, last_error = $5, next_attempt_at = $6
+		  WHERE id = $1`,
+		d.id, status, attempt, code, errText, time.Now().Add(webhookBackoff(attempt)))
+	fmt.Printf("[WEBHOOK] Delivery #%d attempt %d failed (%s): %v\n", d.id, attempt, status, err)
+}
+
+// postWebhook sends one delivery and returns the response status code and
+// status line. The response body is discarded: receivers are not trusted to
+// keep secrets out of it.
+func postWebhook(ctx context.Context, client *http.Client, d pendingDelivery, body []byte) (int, string, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(d.secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "filcdn-service-webhooks")
+	req.Header.Set("X-Filcdn-Event", d.eventType)
+	req.Header.Set("X-Filcdn-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set("X-Filcdn-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1024)) // lets the connection be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, resp.Status, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, resp.Status, nil
+}
+
+// webhookBackoff is 30s doubling per attempt, capped at 6h, with ±20% jitter
+func webhookBackoff(attempt int) time.Duration {
+	backoff := 30 * time.Second * time.Duration(math.Pow(2, float64(attempt-1)))
+	if backoff > 6*time.Hour || backoff <= 0 {
+		backoff = 6 * time.Hour
+	}
+	jitter := 0.8 + 0.4*mathrand.Float64()
+	return time.Duration(float64(backoff) * jitter)
+}